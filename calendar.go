@@ -0,0 +1,156 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	log "github.com/sirupsen/logrus"
+)
+
+// calendarExtension is the extension of calendar feed file names, which some calendar
+// applications require before they subscribe to a URL.
+const calendarExtension = ".ics"
+
+// requestBaseURL returns the scheme and host the request was made to, taking into account
+// the proxy in front of the server.
+func requestBaseURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host
+}
+
+// CreateCalendarFeed generates a new secret token for the requesting user's calendar feed,
+// replacing any previous one, and returns the feed's URL. Anyone with the URL can read the
+// user's workouts, so regenerating it is how access is revoked.
+func (env *Env) CreateCalendarFeed(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	user, ok := env.authenticate(w, r)
+	if !ok {
+		return
+	}
+	token, err := newSecret()
+	if err != nil {
+		InternalServerError(w, err)
+		return
+	}
+	feed := CalendarFeed{Token: token}
+	if err = env.db.SetCalendarToken(r.Context(), user.ID, feed.Token); err != nil {
+		InternalServerError(w, err)
+		return
+	}
+	feed.URL = requestBaseURL(r) + apiVersion + "/calendar/" + feed.Token + calendarExtension
+	log.WithField("name", user.Name).Info("Created calendar feed")
+	WriteJSON(w, http.StatusCreated, feed)
+}
+
+// DeleteCalendarFeed disables the requesting user's calendar feed.
+func (env *Env) DeleteCalendarFeed(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	user, ok := env.authenticate(w, r)
+	if !ok {
+		return
+	}
+	if err := env.db.SetCalendarToken(r.Context(), user.ID, ""); err != nil {
+		InternalServerError(w, err)
+		return
+	}
+	log.WithField("name", user.Name).Info("Deleted calendar feed")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// GetCalendar serves the iCalendar feed of the user whose secret token names the file in
+// the URL parameter, such as <token>.ics. The token takes the place of an access token,
+// since calendar applications cannot send one.
+func (env *Env) GetCalendar(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	file := ps.ByName("file")
+	if !strings.HasSuffix(file, calendarExtension) {
+		NotFound(w, r)
+		return
+	}
+	user, err := env.db.GetCalendarUser(r.Context(), strings.TrimSuffix(file, calendarExtension))
+	switch {
+	case err == ErrUserNotFound:
+		NotFound(w, r)
+		return
+	case err != nil:
+		InternalServerError(w, err)
+		return
+	}
+
+	workouts, err := env.db.GetWorkouts(r.Context(), user.ID)
+	if err != nil {
+		InternalServerError(w, err)
+		return
+	}
+	planned, err := env.db.GetPlannedWorkouts(r.Context(), user.ID)
+	if err != nil {
+		InternalServerError(w, err)
+		return
+	}
+
+	log.WithFields(log.Fields{
+		"name":     user.Name,
+		"workouts": len(workouts),
+		"planned":  len(planned),
+	}).Info("Served calendar feed")
+	w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+	w.Header().Set("Content-Disposition", `inline; filename="workouts.ics"`)
+	w.Header().Set("Cache-Control", "private, max-age=300")
+	w.WriteHeader(http.StatusOK)
+	w.Write(WriteICS(user.Name, workouts, planned, time.Now()))
+}
+
+// ImportCalendar imports the events of an iCalendar object in the request body as planned
+// workouts of the requesting user. Events already imported, identified by their UID, are
+// updated. The optional tz query parameter sets the time zone of times without one.
+// Events that cannot be read are reported without stopping the others from being
+// imported.
+func (env *Env) ImportCalendar(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	user, ok := env.authenticate(w, r)
+	if !ok {
+		return
+	}
+	location, problems := parseTimeZone(r.URL.Query())
+	if !validRequest(w, problems) {
+		return
+	}
+	body, ok := readBody(w, r, maxBodyBytes, "an iCalendar object", "text/calendar")
+	if !ok {
+		return
+	}
+
+	planned, importErrors, err := ParsePlannedWorkouts(body, location)
+	if err != nil {
+		WriteError(w, http.StatusBadRequest, err, "Invalid iCalendar object: "+err.Error())
+		return
+	}
+	if err = env.db.ImportPlannedWorkouts(r.Context(), user.ID, planned); err != nil {
+		InternalServerError(w, err)
+		return
+	}
+	if importErrors == nil {
+		importErrors = make([]ImportError, 0)
+	}
+	log.WithFields(log.Fields{
+		"name":     user.Name,
+		"imported": len(planned),
+		"errors":   len(importErrors),
+	}).Info("Imported calendar")
+	WriteJSON(w, http.StatusOK, PlannedImport{Imported: len(planned), Errors: importErrors})
+}
+
+// GetPlannedWorkouts returns the planned workouts of the requesting user.
+func (env *Env) GetPlannedWorkouts(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	user, ok := env.authenticate(w, r)
+	if !ok {
+		return
+	}
+	planned, err := env.db.GetPlannedWorkouts(r.Context(), user.ID)
+	if err != nil {
+		InternalServerError(w, err)
+		return
+	}
+	WriteJSON(w, http.StatusOK, planned)
+}
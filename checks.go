@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Modes of a workout check. A check in warn mode holds back the write until the client
+// confirms it with the force query parameter, while one in reject mode always refuses it.
+const (
+	CheckOff    = "off"
+	CheckWarn   = "warn"
+	CheckReject = "reject"
+)
+
+// Names of the checks run on workout writes.
+const (
+	CheckOverlap  = "overlap"
+	CheckDuration = "duration"
+	CheckFuture   = "future"
+)
+
+// Error codes specific to workout checks.
+const (
+	ErrCodeConfirmationRequired = "confirmation_required"
+	ErrCodeWorkoutRejected      = "workout_rejected"
+)
+
+// WorkoutChecks configures the checks run when a workout is added or updated.
+type WorkoutChecks struct {
+	// Overlap checks for other workouts of the same user at the same time.
+	Overlap string
+	// Duration checks for workouts longer than MaxDuration, such as a stopwatch that was
+	// left running.
+	Duration    string
+	MaxDuration time.Duration
+	// Future checks for workouts ending more than FutureTolerance from now.
+	Future          string
+	FutureTolerance time.Duration
+}
+
+// DefaultWorkoutChecks are used for any check that is not configured. The checks are off
+// unless they are enabled, so that clients that do not confirm workouts keep working.
+var DefaultWorkoutChecks = WorkoutChecks{
+	Overlap:         CheckOff,
+	Duration:        CheckOff,
+	MaxDuration:     12 * time.Hour,
+	Future:          CheckOff,
+	FutureTolerance: 5 * time.Minute,
+}
+
+// checkWorkout runs the enabled checks on a workout about to be written, returning the
+// warnings raised by checks in warn mode and those raised by checks in reject mode.
+func (env *Env) checkWorkout(ctx context.Context, workout Workout, now time.Time) ([]WorkoutWarning, []WorkoutWarning, error) {
+	var warnings, rejections []WorkoutWarning
+	raise := func(mode string, warning WorkoutWarning) {
+		switch mode {
+		case CheckWarn:
+			warnings = append(warnings, warning)
+		case CheckReject:
+			rejections = append(rejections, warning)
+		}
+	}
+
+	checks := env.checks
+	if workout.End != nil && (checks.Overlap == CheckWarn || checks.Overlap == CheckReject) {
+		overlapping, err := env.db.GetOverlappingWorkouts(ctx, workout.User, workout.Start, *workout.End, workout.ID)
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(overlapping) > 0 {
+			ids := make([]int, len(overlapping))
+			for i, other := range overlapping {
+				ids[i] = other.ID
+			}
+			raise(checks.Overlap, WorkoutWarning{
+				Check:    CheckOverlap,
+				Message:  fmt.Sprintf("The workout overlaps %d of your other workouts", len(overlapping)),
+				Workouts: ids,
+			})
+		}
+	}
+
+	if duration := workout.Duration(); duration > checks.MaxDuration && checks.MaxDuration > 0 {
+		raise(checks.Duration, WorkoutWarning{
+			Check: CheckDuration,
+			Message: fmt.Sprintf(
+				"The workout lasts %s, which is longer than %s",
+				formatDuration(duration),
+				formatDuration(checks.MaxDuration),
+			),
+		})
+	}
+
+	if workout.End != nil && workout.End.After(now.Add(checks.FutureTolerance)) {
+		raise(checks.Future, WorkoutWarning{
+			Check:   CheckFuture,
+			Message: "The workout ends in the future",
+		})
+	}
+	return warnings, rejections, nil
+}
+
+// confirmWorkout checks that the user of a workout exists and, if the workout replaces
+// another, owns it, then runs the workout checks, writing an error response if the workout
+// should not be written. Warnings are waived when the request's force query parameter is
+// true. Returns whether the handler should go ahead with the write.
+func (env *Env) confirmWorkout(w http.ResponseWriter, r *http.Request, workout Workout) bool {
+	return env.checkWorkoutOwner(w, r, workout) && env.passesChecks(w, r, workout)
+}
+
+// passesChecks runs the workout checks on a workout about to be written, writing an error
+// response if it should not be written, as confirmWorkout does.
+func (env *Env) passesChecks(w http.ResponseWriter, r *http.Request, workout Workout) bool {
+	force, _ := strconv.ParseBool(r.URL.Query().Get("force"))
+	warnings, rejections, err := env.checkWorkout(r.Context(), workout, time.Now())
+	if err == nil && !env.requestedBy(r, workout.User) {
+		// The routes that write workouts take the user from the body rather than an
+		// access token, so the other workouts a warning is about are only listed for
+		// requests that carry the user's token.
+		hideWarningWorkouts(warnings)
+		hideWarningWorkouts(rejections)
+	}
+	switch {
+	case err != nil:
+		InternalServerError(w, err)
+		return false
+	case len(rejections) > 0:
+		WriteErrorResponse(
+			w,
+			http.StatusUnprocessableEntity,
+			fmt.Errorf("workout rejected: %v", rejections),
+			ErrorResponse{
+				Message:  rejections[0].Message,
+				Code:     ErrCodeWorkoutRejected,
+				Warnings: append(rejections, warnings...),
+			},
+		)
+		return false
+	case len(warnings) > 0 && !force:
+		WriteErrorResponse(
+			w,
+			http.StatusConflict,
+			fmt.Errorf("workout requires confirmation: %v", warnings),
+			ErrorResponse{
+				Message:  warnings[0].Message + ". Send the request again with force=true to save it anyway",
+				Code:     ErrCodeConfirmationRequired,
+				Warnings: warnings,
+			},
+		)
+		return false
+	default:
+		return true
+	}
+}
+
+// checkWorkoutOwner writes an error response unless the user of a workout exists and, if
+// the workout replaces another, owns the workout it replaces.
+func (env *Env) checkWorkoutOwner(w http.ResponseWriter, r *http.Request, workout Workout) bool {
+	var err error
+	if workout.ID == 0 {
+		_, err = env.db.GetUsername(r.Context(), workout.User)
+	} else {
+		_, err = env.db.GetWorkout(r.Context(), workout.User, workout.ID)
+	}
+	switch {
+	case err == ErrUserNotFound:
+		WriteErrorCode(
+			w,
+			http.StatusNotFound,
+			err,
+			ErrCodeUserNotFound,
+			"The specified user could not be found",
+		)
+		return false
+	case err == ErrWorkoutNotFound:
+		WriteErrorCode(
+			w,
+			http.StatusUnauthorized,
+			err,
+			ErrCodeNotAuthorized,
+			"The requested workout does not belong to you",
+		)
+		return false
+	case err != nil:
+		InternalServerError(w, err)
+		return false
+	}
+	return true
+}
+
+// requestedBy reports whether a request carries the access token of the given user.
+func (env *Env) requestedBy(r *http.Request, userID int) bool {
+	header := r.Header.Get("Authorization")
+	token := strings.TrimSpace(strings.TrimPrefix(header, "Bearer "))
+	if !strings.HasPrefix(header, "Bearer ") || token == "" {
+		return false
+	}
+	user, err := env.db.LoginWithToken(r.Context(), token)
+	return err == nil && user.ID == userID
+}
+
+// hideWarningWorkouts removes the IDs of the workouts that warnings are about.
+func hideWarningWorkouts(warnings []WorkoutWarning) {
+	for i := range warnings {
+		warnings[i].Workouts = nil
+	}
+}
+
+// formatDuration formats a duration in hours and minutes, such as "14h05m".
+func formatDuration(d time.Duration) string {
+	minutes := int(d.Minutes())
+	return fmt.Sprintf("%dh%02dm", minutes/60, minutes%60)
+}
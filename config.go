@@ -2,8 +2,11 @@ package main
 
 import (
 	"errors"
+	"fmt"
 	"os"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/sirupsen/logrus"
 )
@@ -13,6 +16,12 @@ type Config struct {
 	dbConnectionString string
 	port               string
 	logLevel           logrus.Level
+	workoutChecks      WorkoutChecks
+	importDir          string
+	importHost         string
+	autoMigrate        bool
+	queryTimeout       time.Duration
+	trashRetention     time.Duration
 }
 
 // ReadConfig populates a Config struct from environment variables.
@@ -45,9 +54,109 @@ func ReadConfig() (Config, error) {
 	case "PANIC":
 		logLevel = logrus.PanicLevel
 	}
+
+	checks, err := readWorkoutChecks()
+	if err != nil {
+		return empty, err
+	}
+
+	// Uploads are kept until they are imported, so that interrupted imports can resume.
+	// They must outlive restarts, so unlike the temporary directory, the default is beside
+	// the server.
+	importDir := os.Getenv("IMPORT_DIR")
+	if importDir == "" {
+		importDir = defaultImportDir
+	}
+	// An interrupted import is only resumed by a server with the same host, since the
+	// upload is only on the host it was sent to. Servers that share IMPORT_DIR can share a
+	// host to resume each other's imports.
+	importHost := os.Getenv("IMPORT_HOST")
+	if importHost == "" {
+		if importHost, err = os.Hostname(); err != nil {
+			return empty, fmt.Errorf("unable to find the host name for 'IMPORT_HOST': %v", err)
+		}
+	}
+
+	// Migrations are applied on startup unless they are run separately with the migrate
+	// command, as when deploying several servers to a database.
+	autoMigrate := true
+	if value := os.Getenv("AUTO_MIGRATE"); value != "" {
+		if autoMigrate, err = strconv.ParseBool(value); err != nil {
+			return empty, fmt.Errorf("invalid value '%s' for 'AUTO_MIGRATE': expected true or false", value)
+		}
+	}
+
+	// Each call to the datastore is cancelled once it has taken queryTimeout, unless the
+	// timeout is zero.
+	queryTimeout := defaultQueryTimeout
+	if value := os.Getenv("QUERY_TIMEOUT"); value != "" {
+		if queryTimeout, err = time.ParseDuration(value); err != nil || queryTimeout < 0 {
+			return empty, fmt.Errorf("invalid duration '%s' for 'QUERY_TIMEOUT'", value)
+		}
+	}
+
+	// Deleted workouts can be restored from the trash until they have been in it for
+	// trashRetention.
+	trashRetention := defaultTrashRetention
+	if value := os.Getenv("TRASH_RETENTION"); value != "" {
+		if trashRetention, err = time.ParseDuration(value); err != nil || trashRetention <= 0 {
+			return empty, fmt.Errorf("invalid duration '%s' for 'TRASH_RETENTION'", value)
+		}
+	}
+
 	return Config{
 		connectionString,
 		port,
 		logLevel,
+		checks,
+		importDir,
+		importHost,
+		autoMigrate,
+		queryTimeout,
+		trashRetention,
 	}, nil
 }
+
+// readWorkoutChecks reads the mode of each workout check from the CHECK_OVERLAP,
+// CHECK_DURATION and CHECK_FUTURE environment variables, and their thresholds from
+// MAX_WORKOUT_DURATION and FUTURE_TOLERANCE. Anything unset uses DefaultWorkoutChecks.
+func readWorkoutChecks() (WorkoutChecks, error) {
+	checks := DefaultWorkoutChecks
+	modes := []struct {
+		variable string
+		mode     *string
+	}{
+		{"CHECK_OVERLAP", &checks.Overlap},
+		{"CHECK_DURATION", &checks.Duration},
+		{"CHECK_FUTURE", &checks.Future},
+	}
+	for _, m := range modes {
+		switch mode := strings.ToLower(os.Getenv(m.variable)); mode {
+		case "":
+		case CheckOff, CheckWarn, CheckReject:
+			*m.mode = mode
+		default:
+			return checks, fmt.Errorf("invalid value '%s' for '%s': expected off, warn or reject", mode, m.variable)
+		}
+	}
+
+	durations := []struct {
+		variable string
+		duration *time.Duration
+	}{
+		{"MAX_WORKOUT_DURATION", &checks.MaxDuration},
+		{"FUTURE_TOLERANCE", &checks.FutureTolerance},
+	}
+	for _, d := range durations {
+		value := os.Getenv(d.variable)
+		if value == "" {
+			continue
+		}
+		duration, err := time.ParseDuration(value)
+		if err != nil || duration < 0 {
+			return checks, fmt.Errorf("invalid duration '%s' for '%s'", value, d.variable)
+		}
+		*d.duration = duration
+	}
+	return checks, nil
+}
@@ -0,0 +1,450 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/julienschmidt/httprouter"
+	log "github.com/sirupsen/logrus"
+)
+
+// csvFields are the workout fields that can be read from the columns of a CSV file. Each
+// is read from the column named by the <field>_column query parameter, which defaults to
+// the column with the same name as the field.
+var csvFields = []string{"start", "end", "duration", "intensity", "type"}
+
+// csvHeader is the header row of exported CSV files, which can be imported again as is.
+var csvHeader = []string{"id", "start", "end", "duration", "intensity", "type"}
+
+// csvDateTimeLayouts are tried in order to parse times when no format is given.
+var csvDateTimeLayouts = []string{
+	time.RFC3339,
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05",
+	"2006-01-02T15:04",
+	"2006-01-02 15:04",
+	"2006-01-02",
+}
+
+// csvUnixFormat is the format of times given as seconds since the Unix epoch.
+const csvUnixFormat = "unix"
+
+// csvLayoutTokens converts the tokens of a date format such as DD/MM/YYYY HH:mm into a
+// time layout. Single letters accept numbers with or without a leading zero.
+var csvLayoutTokens = strings.NewReplacer(
+	"YYYY", "2006",
+	"YY", "06",
+	"MM", "1",
+	"M", "1",
+	"DD", "2",
+	"D", "2",
+	"HH", "15",
+	"H", "15",
+	"hh", "3",
+	"h", "3",
+	"mm", "04",
+	"ss", "05",
+	"A", "PM",
+)
+
+// CSVOptions configures how the rows of a CSV file are read as workouts.
+type CSVOptions struct {
+	// Header is whether the first row names the columns. Without one, columns can only be
+	// given by their position.
+	Header    bool
+	Delimiter rune
+	// Columns maps workout fields to the name or position, starting from 1, of the column
+	// they are read from.
+	Columns map[string]string
+	// Layout is the time layout of the start and end columns, or csvUnixFormat. Times
+	// are tried against csvDateTimeLayouts if it is empty.
+	Layout string
+	// Location is the time zone of times that do not include an offset.
+	Location *time.Location
+}
+
+// parseCSVOptions reads the options of a CSV import from the query parameters header,
+// delimiter, format, tz and <field>_column.
+func parseCSVOptions(params url.Values) (CSVOptions, []FieldError) {
+	options := CSVOptions{Header: true, Delimiter: ',', Columns: make(map[string]string)}
+	location, problems := parseTimeZone(params)
+	options.Location = location
+
+	if value := params.Get("header"); value != "" {
+		header, err := strconv.ParseBool(value)
+		if err != nil {
+			problems = append(problems, FieldError{"header", "must be true or false"})
+		}
+		options.Header = header
+	}
+
+	switch delimiter := params.Get("delimiter"); {
+	case delimiter == "":
+	case delimiter == "tab":
+		options.Delimiter = '\t'
+	case utf8.RuneCountInString(delimiter) == 1 && !strings.ContainsAny(delimiter, "\"\r\n") &&
+		delimiter != string(utf8.RuneError):
+		options.Delimiter, _ = utf8.DecodeRuneInString(delimiter)
+	default:
+		problems = append(problems, FieldError{"delimiter", "must be a single character or tab"})
+	}
+
+	if format := params.Get("format"); format == csvUnixFormat {
+		options.Layout = format
+	} else if format != "" {
+		options.Layout = csvLayoutTokens.Replace(format)
+		reference := time.Date(2018, 3, 14, 15, 9, 0, 0, time.UTC)
+		parsed, err := time.Parse(options.Layout, reference.Format(options.Layout))
+		if err != nil || parsed.YearDay() != reference.YearDay() || parsed.Year() != reference.Year() {
+			problems = append(problems, FieldError{
+				"format",
+				"must be unix or a date format such as DD/MM/YYYY HH:mm, using YYYY, YY, MM, M, DD, D, HH, H, hh, h, mm, ss and A",
+			})
+		}
+	}
+
+	for _, field := range csvFields {
+		column := strings.TrimSpace(params.Get(field + "_column"))
+		if column == "" {
+			continue
+		}
+		if position, err := strconv.Atoi(column); !options.Header && (err != nil || position < 1) {
+			problems = append(problems, FieldError{field + "_column", "must be a column position, starting from 1, when there is no header"})
+			continue
+		}
+		options.Columns[field] = column
+	}
+	return options, problems
+}
+
+// readCSV splits a CSV file into its header, if it has one, and the rows that follow.
+// Rows where every cell is blank are dropped, but still counted in the row numbers.
+func readCSV(data []byte, options CSVOptions) ([]string, [][]string, []int, error) {
+	// Spreadsheet applications often start the files they export with a byte order mark.
+	data = bytes.TrimPrefix(data, []byte("\xef\xbb\xbf"))
+	reader := csv.NewReader(bytes.NewReader(data))
+	reader.Comma = options.Delimiter
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	var header []string
+	first := 1
+	if options.Header && len(records) > 0 {
+		header = records[0]
+		records = records[1:]
+		first = 2
+	}
+	var rows [][]string
+	var numbers []int
+	for i, record := range records {
+		if strings.TrimSpace(strings.Join(record, "")) == "" {
+			continue
+		}
+		rows = append(rows, record)
+		numbers = append(numbers, first+i)
+	}
+	return header, rows, numbers, nil
+}
+
+// columnIndices returns the index of the column each workout field is read from. Fields
+// without a column of their own are left out, unless their column was given explicitly.
+func (options CSVOptions) columnIndices(header []string) (map[string]int, []FieldError) {
+	names := make(map[string]int)
+	for i, name := range header {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if _, seen := names[name]; !seen {
+			names[name] = i
+		}
+	}
+
+	columns := make(map[string]int)
+	var problems []FieldError
+	for _, field := range csvFields {
+		column, explicit := options.Columns[field]
+		if !explicit {
+			column = field
+		}
+		if i, ok := names[strings.ToLower(column)]; ok {
+			columns[field] = i
+		} else if position, err := strconv.Atoi(column); err == nil && position >= 1 {
+			columns[field] = position - 1
+		} else if explicit {
+			problems = append(problems, FieldError{field + "_column", fmt.Sprintf("'%s' does not name a column of the file", column)})
+		}
+	}
+	if _, ok := columns["start"]; !ok && len(problems) == 0 {
+		problems = append(problems, FieldError{"start_column", "is required when the file has no start column"})
+	}
+	return columns, problems
+}
+
+// workout reads a workout from a row of a CSV file. The end of the workout is read from
+// the end column if it is filled in, and otherwise from the duration column.
+func (options CSVOptions) workout(row []string, columns map[string]int, number int) (Workout, []ImportError) {
+	var workout Workout
+	var problems []ImportError
+	cell := func(field string) string {
+		if i, ok := columns[field]; ok && i < len(row) {
+			return strings.TrimSpace(row[i])
+		}
+		return ""
+	}
+	fail := func(field, message string) {
+		problems = append(problems, ImportError{Record: number, Field: field, Message: message})
+	}
+
+	var err error
+	switch start := cell("start"); {
+	case start == "":
+		fail("start", "is required")
+	default:
+		if workout.Start, err = options.parseTime(start); err != nil {
+			fail("start", fmt.Sprintf("'%s' is not a valid time", start))
+		}
+	}
+
+	switch end, duration := cell("end"), cell("duration"); {
+	case end != "":
+		parsed, err := options.parseTime(end)
+		if err != nil {
+			fail("end", fmt.Sprintf("'%s' is not a valid time", end))
+			break
+		}
+		workout.End = &parsed
+	case duration != "":
+		d, err := parseCSVDuration(duration)
+		if err != nil {
+			fail("duration", fmt.Sprintf("'%s' is not a valid duration", duration))
+			break
+		}
+		end := workout.Start.Add(d)
+		workout.End = &end
+	default:
+		fail("end", "is required unless a duration is given")
+	}
+
+	if intensity := cell("intensity"); intensity != "" {
+		n, err := strconv.Atoi(intensity)
+		if err != nil {
+			fail("intensity", fmt.Sprintf("'%s' is not a whole number", intensity))
+		} else {
+			workout.Intensity = &n
+		}
+	}
+	workout.Type = normalizeWorkoutType(cell("type"))
+	return workout, problems
+}
+
+// parseTime parses a time in the layout of the options.
+func (options CSVOptions) parseTime(value string) (time.Time, error) {
+	switch options.Layout {
+	case csvUnixFormat:
+		seconds, err := strconv.ParseFloat(value, 64)
+		if err != nil || math.IsNaN(seconds) || math.IsInf(seconds, 0) {
+			return time.Time{}, fmt.Errorf("%q is not a Unix time", value)
+		}
+		whole, fraction := math.Modf(seconds)
+		return time.Unix(int64(whole), int64(fraction*1e9)).In(options.Location), nil
+	case "":
+		var err error
+		for _, layout := range csvDateTimeLayouts {
+			var t time.Time
+			if t, err = time.ParseInLocation(layout, value, options.Location); err == nil {
+				return t, nil
+			}
+		}
+		return time.Time{}, err
+	default:
+		return time.ParseInLocation(options.Layout, value, options.Location)
+	}
+}
+
+// parseCSVDuration parses a duration given in minutes, as H:MM or H:MM:SS, or in the
+// form 1h30m.
+func parseCSVDuration(value string) (time.Duration, error) {
+	if minutes, err := strconv.ParseFloat(value, 64); err == nil {
+		if minutes < 0 || minutes > math.MaxInt64/float64(time.Minute) {
+			return 0, fmt.Errorf("%q is out of range", value)
+		}
+		return time.Duration(minutes * float64(time.Minute)), nil
+	}
+	if parts := strings.Split(value, ":"); len(parts) == 2 || len(parts) == 3 {
+		var d time.Duration
+		units := []time.Duration{time.Hour, time.Minute, time.Second}
+		for i, part := range parts {
+			n, err := strconv.Atoi(part)
+			if err != nil || n < 0 || i > 0 && (len(part) != 2 || n > 59) {
+				return 0, fmt.Errorf("%q is not a duration", value)
+			}
+			d += time.Duration(n) * units[i]
+		}
+		return d, nil
+	}
+	return time.ParseDuration(value)
+}
+
+// ImportCSV imports the rows of a CSV file in the request body as workouts of the
+// requesting user. The columns that workout fields are read from, the format and time
+// zone of times and the delimiter are set by query parameters. When dry_run is true,
+// the workouts are only read and returned, so that clients can preview the import. Rows
+// that cannot be imported are reported without stopping the others from being imported.
+// As with batches, workout checks are not run on imports.
+func (env *Env) ImportCSV(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	user, ok := env.authenticate(w, r)
+	if !ok {
+		return
+	}
+	params := r.URL.Query()
+	options, problems := parseCSVOptions(params)
+	dryRun, err := strconv.ParseBool(params.Get("dry_run"))
+	if err != nil && params.Get("dry_run") != "" {
+		problems = append(problems, FieldError{"dry_run", "must be true or false"})
+	}
+	if !validRequest(w, problems) {
+		return
+	}
+	body, ok := readBody(w, r, maxBatchBodyBytes, "a CSV file", "text/csv", "application/csv", "text/plain")
+	if !ok {
+		return
+	}
+
+	header, rows, numbers, err := readCSV(body, options)
+	if err != nil {
+		WriteError(w, http.StatusBadRequest, err, "Invalid CSV file: "+err.Error())
+		return
+	}
+	columns, problems := options.columnIndices(header)
+	if !validRequest(w, problems) {
+		return
+	}
+	if len(rows) > maxBatchOperations {
+		WriteError(
+			w,
+			http.StatusRequestEntityTooLarge,
+			fmt.Errorf("CSV file of %d rows is too large", len(rows)),
+			fmt.Sprintf("A CSV file may contain at most %d rows", maxBatchOperations),
+		)
+		return
+	}
+
+	result := WorkoutImport{DryRun: dryRun, Workouts: make([]Workout, 0), Errors: make([]ImportError, 0)}
+	var ops []BatchOperation
+	var opRows []int
+	for i, row := range rows {
+		workout, rowErrors := options.workout(row, columns, numbers[i])
+		if len(rowErrors) == 0 {
+			workout.User = user.ID
+			for _, problem := range workout.validateNew() {
+				rowErrors = append(rowErrors, ImportError{Record: numbers[i], Field: problem.Field, Message: problem.Message})
+			}
+		}
+		if len(rowErrors) > 0 {
+			result.Errors = append(result.Errors, rowErrors...)
+			continue
+		}
+		ops = append(ops, BatchOperation{Op: BatchCreate, Workout: workout})
+		opRows = append(opRows, numbers[i])
+	}
+
+	if dryRun || len(ops) == 0 {
+		for _, op := range ops {
+			op.Workout.User = 0
+			result.Workouts = append(result.Workouts, op.Workout)
+		}
+	} else {
+		now := time.Now()
+		applied, err := env.db.BatchWorkouts(r.Context(), ops, batchWebhooks(ops, now))
+		if err != nil {
+			InternalServerError(w, err)
+			return
+		}
+		env.publishBatch(ops, applied, now)
+		for i, op := range applied {
+			batchResultStatus(&op)
+			if op.Err != nil {
+				result.Errors = append(result.Errors, ImportError{Record: opRows[i], Message: op.Error})
+				continue
+			}
+			workout := ops[i].Workout
+			workout.ID = op.ID
+			workout.User = 0
+			result.Workouts = append(result.Workouts, workout)
+		}
+		result.Imported = len(result.Workouts)
+	}
+
+	log.WithFields(log.Fields{
+		"name":     user.Name,
+		"rows":     len(rows),
+		"imported": result.Imported,
+		"errors":   len(result.Errors),
+		"dry_run":  dryRun,
+	}).Info("Imported CSV file")
+	WriteJSON(w, http.StatusOK, result)
+}
+
+// ExportCSV returns the finished workouts of the requesting user as a CSV file, with times
+// in the time zone given by the optional tz query parameter and durations in minutes.
+func (env *Env) ExportCSV(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	user, ok := env.authenticate(w, r)
+	if !ok {
+		return
+	}
+	location, problems := parseTimeZone(r.URL.Query())
+	if !validRequest(w, problems) {
+		return
+	}
+	workouts, err := env.db.GetWorkouts(r.Context(), user.ID)
+	if err != nil {
+		InternalServerError(w, err)
+		return
+	}
+
+	var buffer bytes.Buffer
+	writer := csv.NewWriter(&buffer)
+	writer.Write(csvHeader)
+	for _, workout := range workouts {
+		var end, intensity string
+		if workout.End != nil {
+			end = workout.End.In(location).Format(time.RFC3339)
+		}
+		if workout.Intensity != nil {
+			intensity = strconv.Itoa(*workout.Intensity)
+		}
+		minutes := math.Round(workout.Duration().Minutes()*100) / 100
+		writer.Write([]string{
+			strconv.Itoa(workout.ID),
+			workout.Start.In(location).Format(time.RFC3339),
+			end,
+			strconv.FormatFloat(minutes, 'f', -1, 64),
+			intensity,
+			workout.Type,
+		})
+	}
+	writer.Flush()
+	if err = writer.Error(); err != nil {
+		InternalServerError(w, err)
+		return
+	}
+
+	log.WithFields(log.Fields{
+		"name":     user.Name,
+		"workouts": len(workouts),
+	}).Info("Exported CSV file")
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="workouts.csv"`)
+	w.WriteHeader(http.StatusOK)
+	w.Write(buffer.Bytes())
+}
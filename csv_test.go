@@ -0,0 +1,169 @@
+package main
+
+import (
+	"net/url"
+	"testing"
+	"time"
+)
+
+// problemFields returns the fields of the given problems in order.
+func problemFields(problems []FieldError) []string {
+	fields := make([]string, len(problems))
+	for i, problem := range problems {
+		fields[i] = problem.Field
+	}
+	return fields
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestParseCSVOptions(t *testing.T) {
+	for _, test := range []struct {
+		name      string
+		query     string
+		header    bool
+		delimiter rune
+		columns   map[string]string
+		problems  []string
+	}{
+		{name: "defaults", header: true, delimiter: ','},
+		{
+			name:      "columns",
+			query:     "delimiter=%3B&start_column=Date&duration_column=3&type_column=+Activity+",
+			header:    true,
+			delimiter: ';',
+			columns:   map[string]string{"start": "Date", "duration": "3", "type": "Activity"},
+		},
+		{
+			name:      "no header",
+			query:     "header=false&delimiter=tab&start_column=1&end_column=Finish&intensity_column=0",
+			delimiter: '\t',
+			columns:   map[string]string{"start": "1"},
+			problems:  []string{"end_column", "intensity_column"},
+		},
+		{
+			name:      "invalid",
+			query:     "header=maybe&delimiter=%3B%3B&tz=Mars/Olympus_Mons",
+			delimiter: ',',
+			problems:  []string{"tz", "header", "delimiter"},
+		},
+		{name: "quote delimiter", query: "delimiter=\"", header: true, delimiter: ',', problems: []string{"delimiter"}},
+		{name: "multibyte delimiter", query: "delimiter=§", header: true, delimiter: '§'},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			params, err := url.ParseQuery(test.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			options, problems := parseCSVOptions(params)
+			if options.Header != test.header || options.Delimiter != test.delimiter {
+				t.Errorf("header is %t and delimiter %q, expected %t and %q", options.Header, options.Delimiter, test.header, test.delimiter)
+			}
+			if len(options.Columns) != len(test.columns) {
+				t.Errorf("columns are %v, expected %v", options.Columns, test.columns)
+			}
+			for field, column := range test.columns {
+				if options.Columns[field] != column {
+					t.Errorf("%s column is %q, expected %q", field, options.Columns[field], column)
+				}
+			}
+			if fields := problemFields(problems); !equalStrings(fields, test.problems) {
+				t.Errorf("problems are with %v, expected %v", fields, test.problems)
+			}
+		})
+	}
+}
+
+func TestCSVTimeFormats(t *testing.T) {
+	toronto := testLocation(t)
+	for _, test := range []struct {
+		format string
+		layout string
+		value  string
+		time   time.Time
+	}{
+		// MM is the month, mm the minute and a single M a month without a leading zero.
+		{"DD/MM/YYYY HH:mm", "2/1/2006 15:04", "05/03/2019 07:30", time.Date(2019, time.March, 5, 7, 30, 0, 0, toronto)},
+		{"D/M/YYYY H:mm", "2/1/2006 15:04", "5/3/2019 7:30", time.Date(2019, time.March, 5, 7, 30, 0, 0, toronto)},
+		{"MM/DD/YY hh:mm A", "1/2/06 3:04 PM", "03/05/19 07:30 PM", time.Date(2019, time.March, 5, 19, 30, 0, 0, toronto)},
+		{"M/D/YY h:mm:ss A", "1/2/06 3:04:05 PM", "3/5/19 7:30:15 AM", time.Date(2019, time.March, 5, 7, 30, 15, 0, toronto)},
+		{"YYYY-MM-DDTHH:mm:ss", "2006-1-2T15:04:05", "2019-03-05T07:30:00", time.Date(2019, time.March, 5, 7, 30, 0, 0, toronto)},
+		{"YYYY-MM-DD", "2006-1-2", "2019-12-31", time.Date(2019, time.December, 31, 0, 0, 0, 0, toronto)},
+		// Clocks went forward from 2:00 to 3:00 in Toronto on 10 March 2019.
+		{"DD.MM.YYYY HH:mm", "2.1.2006 15:04", "10.03.2019 03:30", time.Date(2019, time.March, 10, 3, 30, 0, 0, toronto)},
+		{"unix", csvUnixFormat, "1551791400.5", time.Date(2019, time.March, 5, 8, 10, 0, 5e8, toronto)},
+		{"", "", "2019-03-05 07:30", time.Date(2019, time.March, 5, 7, 30, 0, 0, toronto)},
+		{"", "", "2019-03-05T07:30:00-08:00", time.Date(2019, time.March, 5, 10, 30, 0, 0, toronto)},
+	} {
+		t.Run(test.format, func(t *testing.T) {
+			options, problems := parseCSVOptions(url.Values{"format": {test.format}, "tz": {"America/Toronto"}})
+			if len(problems) > 0 {
+				t.Fatalf("format is invalid: %+v", problems)
+			}
+			if options.Layout != test.layout {
+				t.Errorf("layout is %q, expected %q", options.Layout, test.layout)
+			}
+			parsed, err := options.parseTime(test.value)
+			if err != nil || !parsed.Equal(test.time) {
+				t.Errorf("%q is %v (%v), expected %v", test.value, parsed, err, test.time)
+			}
+		})
+	}
+}
+
+func TestInvalidCSVTimeFormats(t *testing.T) {
+	for _, format := range []string{"DD/MM", "HH:mm", "MMM YYYY", "YYYY-mm-DD"} {
+		t.Run(format, func(t *testing.T) {
+			_, problems := parseCSVOptions(url.Values{"format": {format}})
+			if fields := problemFields(problems); !equalStrings(fields, []string{"format"}) {
+				t.Errorf("problems are with %v, expected the format", fields)
+			}
+		})
+	}
+}
+
+func TestParseCSVDuration(t *testing.T) {
+	for _, test := range []struct {
+		value    string
+		duration time.Duration
+		valid    bool
+	}{
+		{"45", 45 * time.Minute, true},
+		{"1.5", 90 * time.Second, true},
+		{"0", 0, true},
+		{"1:30", time.Hour + 30*time.Minute, true},
+		{"0:05", 5 * time.Minute, true},
+		{"1:30:15", time.Hour + 30*time.Minute + 15*time.Second, true},
+		{"12:00:00", 12 * time.Hour, true},
+		{"0:00:59", 59 * time.Second, true},
+		{"1h30m", time.Hour + 30*time.Minute, true},
+		{"-5", 0, false},
+		{"1e300", 0, false},
+		{"1:5", 0, false},
+		{"1:60", 0, false},
+		{"1:30:60", 0, false},
+		{"1:30:5", 0, false},
+		{"-1:30", 0, false},
+		{"1:-1", 0, false},
+		{"1:30:", 0, false},
+		{"1:2:3:4", 0, false},
+		{"an hour", 0, false},
+	} {
+		t.Run(test.value, func(t *testing.T) {
+			duration, err := parseCSVDuration(test.value)
+			if (err == nil) != test.valid || duration != test.duration {
+				t.Errorf("%q is %v (%v), expected %v", test.value, duration, err, test.duration)
+			}
+		})
+	}
+}
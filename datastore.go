@@ -1,29 +1,104 @@
 package main
 
 import (
+	"context"
 	"database/sql"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
 )
 
 // Datastore defines the methods used to retrieve data from our database.
 type Datastore interface {
-	SignUp(request UserRequest) (int, error)
-	LoginWithCredentials(name, passHash string) (User, error)
-	LoginWithToken(token string) (User, error)
-	GetUsername(userID int) (string, error)
-	AddWorkout(workout Workout) (int, error)
-	UpdateWorkout(workout Workout) error
-	DeleteWorkout(workoutID int) error
-	GetWorkouts(userID int) ([]Workout, error)
-	GetUsers() ([]string, error)
-}
-
-// DB implements Datastore and serves as the bridge between the Datastore
+	SignUp(ctx context.Context, request UserRequest) (int, error)
+	LoginWithCredentials(ctx context.Context, name, passHash string) (User, error)
+	LoginWithToken(ctx context.Context, token string) (User, error)
+	GetUsername(ctx context.Context, userID int) (string, error)
+	AddWorkout(ctx context.Context, workout Workout) (int, error)
+	UpdateWorkout(ctx context.Context, workout Workout) error
+	DeleteWorkout(ctx context.Context, workoutID int) (int, error)
+	GetDeletedWorkouts(ctx context.Context, userID int) ([]Workout, error)
+	RestoreWorkout(ctx context.Context, userID, workoutID int) (Workout, error)
+	PurgeDeletedWorkouts(ctx context.Context, before time.Time) (int, error)
+	GetWorkouts(ctx context.Context, userID int) ([]Workout, error)
+	GetWorkout(ctx context.Context, userID, workoutID int) (Workout, error)
+	GetUsers(ctx context.Context) ([]string, error)
+	BatchWorkouts(ctx context.Context, ops []BatchOperation, webhooks BatchWebhooks) ([]BatchResult, error)
+	GetInsights(ctx context.Context, userID int, query InsightsQuery) (Insights, error)
+	GetWorkoutsBetween(ctx context.Context, userID int, from, to time.Time) ([]Workout, error)
+	GetOverlappingWorkouts(ctx context.Context, userID int, start, end time.Time, excludeID int) ([]Workout, error)
+	GetGoals(ctx context.Context, userID int) ([]Goal, error)
+	AddGoal(ctx context.Context, goal Goal) (int, error)
+	UpdateGoal(ctx context.Context, goal Goal) error
+	DeleteGoal(ctx context.Context, userID, goalID int) error
+	StartWorkout(ctx context.Context, userID int, start time.Time) (WorkoutSession, error)
+	GetActiveWorkout(ctx context.Context, userID int) (WorkoutSession, error)
+	UpdateWorkoutSession(ctx context.Context, userID, workoutID int, action string, at time.Time) (WorkoutSession, error)
+	GetWebhooks(ctx context.Context, userID int) ([]Webhook, error)
+	AddWebhook(ctx context.Context, webhook Webhook) (int, error)
+	DeleteWebhook(ctx context.Context, userID, webhookID int) error
+	QueueWebhookDeliveries(ctx context.Context, events []WebhookEvent) error
+	ClaimWebhookDeliveries(ctx context.Context, limit int, lease time.Duration) ([]WebhookDelivery, error)
+	RecordWebhookAttempt(ctx context.Context, delivery WebhookDelivery) error
+	GetWebhookDeliveries(ctx context.Context, userID, webhookID, limit int) ([]WebhookDelivery, error)
+	SetCalendarToken(ctx context.Context, userID int, token string) error
+	GetCalendarUser(ctx context.Context, token string) (User, error)
+	GetPlannedWorkouts(ctx context.Context, userID int) ([]PlannedWorkout, error)
+	ImportPlannedWorkouts(ctx context.Context, userID int, planned []PlannedWorkout) error
+	ImportWorkouts(ctx context.Context, workouts []Workout) ([]int, error)
+	AddImportJob(ctx context.Context, job ImportJob) (int, error)
+	UpdateImportJob(ctx context.Context, job ImportJob) error
+	GetImportJob(ctx context.Context, userID, jobID int) (ImportJob, error)
+	ClaimStaleImportJobs(ctx context.Context, host string, lease time.Duration) ([]ImportJob, error)
+}
+
+// BatchWebhooks returns the webhook events for the results of a batch of operations, which
+// BatchWorkouts queues along with the changes. It may be nil.
+type BatchWebhooks func(results []BatchResult) ([]WebhookEvent, error)
+
+// Database is a Datastore whose schema is kept up to date by migrations.
+type Database interface {
+	Datastore
+	Migrate() (int, error)
+	MigrateDown(steps int) (int, error)
+	MigrationStatus() ([]MigrationStatus, error)
+}
+
+// OpenDatabase connects to the database at url, choosing the implementation by its scheme:
+// sqlite:// followed by the path of a SQLite database, or otherwise Postgres.
+func OpenDatabase(url string) (Database, error) {
+	scheme := ""
+	if i := strings.Index(url, "://"); i >= 0 {
+		scheme = strings.ToLower(url[:i])
+	}
+	switch scheme {
+	case "sqlite", "sqlite3":
+		return InitializeSQLite(url[len(scheme)+len("://"):])
+	case "", "postgres", "postgresql":
+		return InitializeDB("postgres", url)
+	default:
+		return nil, fmt.Errorf("unsupported database '%s': expected postgres or sqlite", scheme)
+	}
+}
+
+// DB implements Datastore on Postgres and serves as the bridge between the Datastore
 // definition and the actual database.
 type DB struct {
 	*sql.DB
 }
 
+// queryer is satisfied by both *sql.DB and *sql.Tx, which lets the same queries be run
+// on their own or as part of a transaction.
+type queryer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
 // InitializeDB initializes the database connection.
 func InitializeDB(driverName, dataSourceName string) (*DB, error) {
 	db, err := sql.Open(driverName, dataSourceName)
@@ -38,54 +113,76 @@ func InitializeDB(driverName, dataSourceName string) (*DB, error) {
 }
 
 // SignUp adds a new user to the database and returns their user ID.
-func (db *DB) SignUp(r UserRequest) (int, error) {
-	// Verify that the name is not already taken.
-	if db.rowExists("SELECT id FROM users WHERE name = $1", r.Name) {
-		return 0, ErrUserAlreadyExists
-	}
+func (db *DB) SignUp(ctx context.Context, r UserRequest) (int, error) {
+	// Names are unique, so of two users signing up with the same name at once, the insert
+	// of the second fails.
 	var userID int
-	err := db.QueryRow(
+	err := db.QueryRowContext(
+		ctx,
 		`INSERT INTO users(name, password, token)
 		VALUES ($1, $2, $3) RETURNING id`,
 		r.Name, r.Token, r.Token).Scan(&userID)
+	if violatedConstraint(err) == "unique_user_name" {
+		return 0, ErrUserAlreadyExists
+	}
 	return userID, err
 }
 
-// LoginWithCredentials logs a user in using a name and password hash.
-func (db *DB) LoginWithCredentials(name, passHash string) (User, error) {
+// LoginWithCredentials logs a user in using a name and password hash. Users who were
+// renamed when names were made unique log in with the name they signed up with, which
+// their password is keyed by, and are told their new name when they do.
+func (db *DB) LoginWithCredentials(ctx context.Context, name, passHash string) (User, error) {
 	user := User{}
 	var ourPassHash string
-	row := db.QueryRow("SELECT id, name, password FROM users WHERE name = $1", name)
+	row := db.QueryRowContext(ctx, "SELECT id, name, password FROM users WHERE name = $1", name)
 	err := row.Scan(&user.ID, &user.Name, &ourPassHash)
 	switch {
 	case err == sql.ErrNoRows:
-		return user, ErrUserNotFound
+		return db.loginRenamedUser(ctx, name, passHash, ErrUserNotFound)
 	case err != nil:
 		return user, err
 	case ourPassHash != passHash:
-		return user, ErrInvalidCredentials
+		return db.loginRenamedUser(ctx, name, passHash, ErrInvalidCredentials)
 	default:
 		return user, nil
 	}
 }
 
+// loginRenamedUser logs in a renamed user using the name they had and their password
+// hash, returning notRenamed if there is no such user.
+func (db *DB) loginRenamedUser(ctx context.Context, oldName, passHash string, notRenamed error) (User, error) {
+	user := User{}
+	err := db.QueryRowContext(
+		ctx,
+		`SELECT users.id, users.name
+		FROM user_renames
+		JOIN users ON users.id = user_renames.user_id
+		WHERE user_renames.old_name = $1 AND users.password = $2
+		ORDER BY users.id
+		LIMIT 1`,
+		oldName, passHash,
+	).Scan(&user.ID, &user.Name)
+	if err == sql.ErrNoRows {
+		return user, notRenamed
+	}
+	return user, err
+}
+
 // LoginWithToken logs a user in using an access token.
-func (db *DB) LoginWithToken(token string) (User, error) {
+func (db *DB) LoginWithToken(ctx context.Context, token string) (User, error) {
 	user := User{}
-	row := db.QueryRow("SELECT id, name FROM users WHERE token = $1", token)
+	row := db.QueryRowContext(ctx, "SELECT id, name FROM users WHERE token = $1", token)
 	err := row.Scan(&user.ID, &user.Name)
-	switch {
-	case err == sql.ErrNoRows:
+	if err == sql.ErrNoRows {
 		return user, ErrUserNotFound
-	default:
-		return user, nil
 	}
+	return user, err
 }
 
 // GetUsername retrieves the name of the user with the given ID.
-func (db *DB) GetUsername(userID int) (string, error) {
+func (db *DB) GetUsername(ctx context.Context, userID int) (string, error) {
 	var name string
-	row := db.QueryRow("SELECT name FROM users WHERE id = $1", userID)
+	row := db.QueryRowContext(ctx, "SELECT name FROM users WHERE id = $1", userID)
 	err := row.Scan(&name)
 	switch {
 	case err == sql.ErrNoRows:
@@ -96,73 +193,279 @@ func (db *DB) GetUsername(userID int) (string, error) {
 }
 
 // AddWorkout adds a workout to the database.
-func (db *DB) AddWorkout(workout Workout) (int, error) {
-	if !db.rowExists("SELECT id FROM users WHERE id = $1", workout.User) {
-		return 0, ErrUserNotFound
+func (db *DB) AddWorkout(ctx context.Context, workout Workout) (int, error) {
+	return addWorkout(ctx, db, workout)
+}
+
+// UpdateWorkout replaces the workout with the given workout.
+func (db *DB) UpdateWorkout(ctx context.Context, workout Workout) error {
+	return updateWorkout(ctx, db, workout)
+}
+
+// DeleteWorkout moves the workout with the specified ID to the trash and returns the ID of
+// the user it belongs to.
+func (db *DB) DeleteWorkout(ctx context.Context, workoutID int) (int, error) {
+	var userID int
+	err := db.QueryRowContext(
+		ctx,
+		`UPDATE workouts SET deleted_at = now()
+		WHERE id = $1 AND deleted_at IS NULL
+		RETURNING user_id`,
+		workoutID,
+	).Scan(&userID)
+	if err == sql.ErrNoRows {
+		return userID, ErrWorkoutNotFound
 	}
+	return userID, err
+}
 
+// GetDeletedWorkouts retrieves the workouts the given user has in the trash, the most
+// recently deleted first.
+func (db *DB) GetDeletedWorkouts(ctx context.Context, userID int) ([]Workout, error) {
+	workouts := make([]Workout, 0)
+	err := db.readRows(
+		ctx,
+		func(rs *sql.Rows) error {
+			var workout Workout
+			readErr := rs.Scan(&workout.ID, &workout.Start, &workout.End, &workout.Intensity, &workout.Type, &workout.Deleted)
+			workouts = append(workouts, workout)
+			return readErr
+		},
+		`SELECT id, start_time, end_time, intensity, type, deleted_at
+		FROM workouts
+		WHERE user_id = $1 AND deleted_at IS NOT NULL
+		ORDER BY deleted_at DESC, id`,
+		userID,
+	)
+	return workouts, err
+}
+
+// RestoreWorkout takes a workout of the given user out of the trash and returns it.
+func (db *DB) RestoreWorkout(ctx context.Context, userID, workoutID int) (Workout, error) {
+	workout := Workout{User: userID}
+	err := db.QueryRowContext(
+		ctx,
+		`UPDATE workouts SET deleted_at = NULL
+		WHERE id = $1 AND user_id = $2 AND deleted_at IS NOT NULL
+		RETURNING id, start_time, end_time, intensity, type`,
+		workoutID, userID,
+	).Scan(&workout.ID, &workout.Start, &workout.End, &workout.Intensity, &workout.Type)
+	// A workout deleted while it was in progress cannot come back while another is.
+	switch {
+	case err == sql.ErrNoRows:
+		return workout, ErrWorkoutNotFound
+	case violatedConstraint(err) == "one_active_workout":
+		return workout, ErrWorkoutInProgress
+	}
+	return workout, err
+}
+
+// PurgeDeletedWorkouts permanently deletes the workouts that were moved to the trash
+// before the given time, returning how many it deleted.
+func (db *DB) PurgeDeletedWorkouts(ctx context.Context, before time.Time) (int, error) {
+	result, err := db.ExecContext(ctx, "DELETE FROM workouts WHERE deleted_at < $1", before)
+	if err != nil {
+		return 0, err
+	}
+	purged, err := result.RowsAffected()
+	return int(purged), err
+}
+
+// BatchWorkouts applies a list of workout operations within a single transaction. Each
+// operation runs under its own savepoint, so a failing operation is reported in its
+// result without discarding the others. The deliveries of the webhook events for the
+// results are queued in the same transaction. The returned error is only non-nil if the
+// transaction itself could not be completed.
+func (db *DB) BatchWorkouts(ctx context.Context, ops []BatchOperation, webhooks BatchWebhooks) ([]BatchResult, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	// Rolling back after a successful commit is a no-op.
+	defer tx.Rollback()
+
+	results := make([]BatchResult, len(ops))
+	for i, op := range ops {
+		if _, err = tx.ExecContext(ctx, "SAVEPOINT batch_operation"); err != nil {
+			return nil, err
+		}
+
+		result := BatchResult{Index: i, Op: op.Op, ID: op.Workout.ID}
+		switch op.Op {
+		case BatchCreate:
+			result.ID, result.Err = addWorkout(ctx, tx, op.Workout)
+		case BatchUpdate:
+			result.Err = updateWorkout(ctx, tx, op.Workout)
+		case BatchDelete:
+			result.Err = deleteOwnWorkout(ctx, tx, op.Workout)
+		default:
+			result.Err = ErrInvalidBatchOperation
+		}
+
+		if result.Err != nil {
+			_, err = tx.ExecContext(ctx, "ROLLBACK TO SAVEPOINT batch_operation")
+		} else {
+			_, err = tx.ExecContext(ctx, "RELEASE SAVEPOINT batch_operation")
+		}
+		if err != nil {
+			return nil, err
+		}
+		results[i] = result
+	}
+
+	if webhooks != nil {
+		events, err := webhooks(results)
+		if err != nil {
+			return nil, err
+		}
+		if err = queueWebhookDeliveries(ctx, tx, events); err != nil {
+			return nil, err
+		}
+	}
+	return results, tx.Commit()
+}
+
+// addWorkout inserts a workout, relying on the foreign key of the workouts table to
+// reject users that do not exist, even if they are deleted while it runs.
+func addWorkout(ctx context.Context, q queryer, workout Workout) (int, error) {
 	var workoutID int
-	err := db.QueryRow(
-		`INSERT INTO workouts(user_id, start_time, end_time)
-		VALUES ($1, $2, $3) RETURNING id`,
-		workout.User, workout.Start, workout.End,
+	err := q.QueryRowContext(
+		ctx,
+		`INSERT INTO workouts(user_id, start_time, end_time, intensity, type)
+		VALUES ($1, $2, $3, $4, $5) RETURNING id`,
+		workout.User, workout.Start, workout.End, workout.Intensity, workout.Type,
 	).Scan(&workoutID)
+	if violatedConstraint(err) == "fk_user_id" {
+		return 0, ErrUserNotFound
+	}
 	return workoutID, err
 }
 
-// UpdateWorkout replaces the workout with the given workout.
-func (db *DB) UpdateWorkout(workout Workout) error {
-	// Verify that the workout belongs to the user
+// updateWorkout replaces a workout if it belongs to workout.User, checking the owner in
+// the same statement that makes the change. The stored intensity and type are kept if the
+// workout left them out.
+func updateWorkout(ctx context.Context, q queryer, workout Workout) error {
+	result, err := q.ExecContext(
+		ctx,
+		`UPDATE workouts
+		SET start_time = $1, end_time = $2, intensity = CASE WHEN $7 THEN intensity ELSE $3 END,
+			type = CASE WHEN $8 THEN type ELSE $4 END
+		WHERE id = $5 AND user_id = $6 AND deleted_at IS NULL`,
+		workout.Start, workout.End, workout.Intensity, workout.Type, workout.ID, workout.User,
+		workout.keepIntensity, workout.keepType,
+	)
+	return requireAffected(result, err, ErrUserNotAuthorized)
+}
+
+// deleteOwnWorkout moves a workout to the trash after verifying that it belongs to
+// workout.User.
+func deleteOwnWorkout(ctx context.Context, q queryer, workout Workout) error {
 	var ourUser int
-	_ = db.QueryRow(
-		"SELECT user_id FROM workouts WHERE id = $1",
+	err := q.QueryRowContext(
+		ctx,
+		"SELECT user_id FROM workouts WHERE id = $1 AND deleted_at IS NULL",
 		workout.ID,
 	).Scan(&ourUser)
-	if ourUser != workout.User {
+	switch {
+	case err == sql.ErrNoRows:
+		return ErrWorkoutNotFound
+	case err != nil:
+		return err
+	case ourUser != workout.User:
 		return ErrUserNotAuthorized
 	}
 
-	_, err := db.Exec(
-		`UPDATE workouts
-		SET start_time = $1, end_time = $2
-		WHERE id = $3`,
-		workout.Start, workout.End, workout.ID,
-	)
+	_, err = q.ExecContext(ctx, "UPDATE workouts SET deleted_at = now() WHERE id = $1", workout.ID)
 	return err
 }
 
-// DeleteWorkout deletes the workout with the specified ID.
-func (db *DB) DeleteWorkout(workoutID int) error {
-	_, err := db.Exec(
-		`DELETE FROM workouts WHERE id = $1`,
-		workoutID,
+// GetWorkouts retrieves the list of finished workouts for the given user.
+func (db *DB) GetWorkouts(ctx context.Context, userID int) ([]Workout, error) {
+	workouts := make([]Workout, 0)
+	err := db.readRows(
+		ctx,
+		func(rs *sql.Rows) error {
+			var workout Workout
+			readErr := rs.Scan(&workout.ID, &workout.Start, &workout.End, &workout.Intensity, &workout.Type)
+			workouts = append(workouts, workout)
+			return readErr
+		},
+		`SELECT id, start_time, end_time, intensity, type
+		FROM workouts
+		WHERE user_id = $1 AND end_time IS NOT NULL AND deleted_at IS NULL
+		ORDER BY end_time`,
+		userID,
 	)
-	return err
+	return workouts, err
+}
+
+// GetWorkout retrieves a workout, provided that it belongs to the user and is not in the
+// trash.
+func (db *DB) GetWorkout(ctx context.Context, userID, workoutID int) (Workout, error) {
+	workout := Workout{ID: workoutID, User: userID}
+	err := db.QueryRowContext(
+		ctx,
+		`SELECT start_time, end_time, intensity, type
+		FROM workouts
+		WHERE id = $1 AND user_id = $2 AND deleted_at IS NULL`,
+		workoutID, userID,
+	).Scan(&workout.Start, &workout.End, &workout.Intensity, &workout.Type)
+	if err == sql.ErrNoRows {
+		return workout, ErrWorkoutNotFound
+	}
+	return workout, err
 }
 
-// GetWorkouts retrieves the list of workouts for the given user.
-func (db *DB) GetWorkouts(userID int) ([]Workout, error) {
+// GetWorkoutsBetween retrieves the finished workouts of the given user that started within
+// [from, to), ordered by start time.
+func (db *DB) GetWorkoutsBetween(ctx context.Context, userID int, from, to time.Time) ([]Workout, error) {
 	workouts := make([]Workout, 0)
 	err := db.readRows(
+		ctx,
 		func(rs *sql.Rows) error {
 			var workout Workout
-			readErr := rs.Scan(&workout.ID, &workout.Start, &workout.End)
+			readErr := rs.Scan(&workout.ID, &workout.Start, &workout.End, &workout.Intensity, &workout.Type)
 			workouts = append(workouts, workout)
 			return readErr
 		},
-		`SELECT id, start_time, end_time
+		`SELECT id, start_time, end_time, intensity, type
 		FROM workouts
-		WHERE user_id = $1
-		ORDER BY end_time`,
-		userID,
+		WHERE user_id = $1 AND start_time >= $2 AND start_time < $3 AND end_time IS NOT NULL
+			AND deleted_at IS NULL
+		ORDER BY start_time`,
+		userID, from, to,
+	)
+	return workouts, err
+}
+
+// GetOverlappingWorkouts retrieves the workouts of the given user that overlap the period
+// [start, end), other than the workout with ID excludeID. Workouts in progress are
+// considered to last until now.
+func (db *DB) GetOverlappingWorkouts(ctx context.Context, userID int, start, end time.Time, excludeID int) ([]Workout, error) {
+	workouts := make([]Workout, 0)
+	err := db.readRows(
+		ctx,
+		func(rs *sql.Rows) error {
+			var workout Workout
+			readErr := rs.Scan(&workout.ID, &workout.Start, &workout.End, &workout.Intensity, &workout.Type)
+			workouts = append(workouts, workout)
+			return readErr
+		},
+		`SELECT id, start_time, end_time, intensity, type
+		FROM workouts
+		WHERE user_id = $1 AND start_time < $3 AND COALESCE(end_time, now()) > $2 AND id <> $4
+			AND deleted_at IS NULL
+		ORDER BY start_time`,
+		userID, start, end, excludeID,
 	)
 	return workouts, err
 }
 
 // GetUsers returns a list of users' names from the database.
-func (db *DB) GetUsers() ([]string, error) {
+func (db *DB) GetUsers(ctx context.Context) ([]string, error) {
 	var userNames []string
 	err := db.readRows(
+		ctx,
 		func(rs *sql.Rows) error {
 			var name string
 			readErr := rs.Scan(&name)
@@ -174,8 +477,642 @@ func (db *DB) GetUsers() ([]string, error) {
 	return userNames, err
 }
 
-func (db *DB) readRows(read func(rs *sql.Rows) error, query string, args ...interface{}) error {
-	rows, err := db.Query(query, args...)
+// GetInsights computes the time of day breakdown and workout frequency of a user over
+// the requested range. Workouts are placed in the part of the day they ended in, matching
+// the iOS app, and in the week or month they started in.
+func (db *DB) GetInsights(ctx context.Context, userID int, query InsightsQuery) (Insights, error) {
+	insights := Insights{
+		From:      query.From,
+		To:        query.To,
+		Bucket:    query.Bucket,
+		TimeZone:  query.Location.String(),
+		Frequency: make([]FrequencyBucket, 0),
+	}
+
+	err := db.QueryRowContext(
+		ctx,
+		`SELECT
+			COUNT(*) FILTER (WHERE hour < 6),
+			COUNT(*) FILTER (WHERE hour >= 6 AND hour < 12),
+			COUNT(*) FILTER (WHERE hour >= 12 AND hour < 18),
+			COUNT(*) FILTER (WHERE hour >= 18)
+		FROM (
+			SELECT EXTRACT(HOUR FROM end_time AT TIME ZONE $4) AS hour
+			FROM workouts
+			WHERE user_id = $1 AND start_time >= $2::timestamptz AND start_time < $3::timestamptz
+				AND end_time IS NOT NULL AND deleted_at IS NULL
+		) AS hours`,
+		userID, query.From, query.To, insights.TimeZone,
+	).Scan(
+		&insights.TimeOfDay.Night,
+		&insights.TimeOfDay.Morning,
+		&insights.TimeOfDay.Afternoon,
+		&insights.TimeOfDay.Evening,
+	)
+	if err != nil {
+		return insights, err
+	}
+
+	// Every bucket in the range is returned, including those without any workouts.
+	err = db.readRows(
+		ctx,
+		func(rs *sql.Rows) error {
+			var bucket FrequencyBucket
+			readErr := rs.Scan(&bucket.Start, &bucket.Count, &bucket.TotalMinutes)
+			bucket.Start = bucket.Start.In(query.Location)
+			insights.Frequency = append(insights.Frequency, bucket)
+			return readErr
+		},
+		`SELECT
+			buckets.start AT TIME ZONE $5,
+			COUNT(w.id),
+			COALESCE(SUM(EXTRACT(EPOCH FROM w.end_time - w.start_time)) / 60, 0)::float8
+		FROM generate_series(
+			date_trunc($4, $2::timestamptz AT TIME ZONE $5),
+			$3::timestamptz AT TIME ZONE $5 - interval '1 microsecond',
+			('1 ' || $4)::interval
+		) AS buckets(start)
+		LEFT JOIN workouts w
+			ON w.user_id = $1
+			AND w.start_time >= $2::timestamptz AND w.start_time < $3::timestamptz
+			AND w.end_time IS NOT NULL AND w.deleted_at IS NULL
+			AND date_trunc($4, w.start_time AT TIME ZONE $5) = buckets.start
+		GROUP BY buckets.start
+		ORDER BY buckets.start`,
+		userID, query.From, query.To, query.Bucket, insights.TimeZone,
+	)
+	return insights, err
+}
+
+// GetGoals retrieves the goals of the given user in the order they were created.
+func (db *DB) GetGoals(ctx context.Context, userID int) ([]Goal, error) {
+	goals := make([]Goal, 0)
+	err := db.readRows(
+		ctx,
+		func(rs *sql.Rows) error {
+			goal := Goal{User: userID}
+			readErr := rs.Scan(&goal.ID, &goal.Metric, &goal.Period, &goal.Target, &goal.Created)
+			goals = append(goals, goal)
+			return readErr
+		},
+		`SELECT id, metric, period, target, created_at
+		FROM goals
+		WHERE user_id = $1
+		ORDER BY created_at, id`,
+		userID,
+	)
+	return goals, err
+}
+
+// AddGoal adds a goal to the database and returns its ID.
+func (db *DB) AddGoal(ctx context.Context, goal Goal) (int, error) {
+	var goalID int
+	err := db.QueryRowContext(
+		ctx,
+		`INSERT INTO goals(user_id, metric, period, target)
+		VALUES ($1, $2, $3, $4) RETURNING id`,
+		goal.User, goal.Metric, goal.Period, goal.Target,
+	).Scan(&goalID)
+	return goalID, err
+}
+
+// UpdateGoal replaces the goal with the given goal, provided that it belongs to goal.User.
+func (db *DB) UpdateGoal(ctx context.Context, goal Goal) error {
+	result, err := db.ExecContext(
+		ctx,
+		`UPDATE goals
+		SET metric = $1, period = $2, target = $3
+		WHERE id = $4 AND user_id = $5`,
+		goal.Metric, goal.Period, goal.Target, goal.ID, goal.User,
+	)
+	return requireAffected(result, err, ErrGoalNotFound)
+}
+
+// DeleteGoal deletes the goal with the specified ID, provided that it belongs to the user.
+func (db *DB) DeleteGoal(ctx context.Context, userID, goalID int) error {
+	result, err := db.ExecContext(
+		ctx,
+		`DELETE FROM goals WHERE id = $1 AND user_id = $2`,
+		goalID, userID,
+	)
+	return requireAffected(result, err, ErrGoalNotFound)
+}
+
+// StartWorkout starts a workout for the given user that stays in progress until it is
+// finished. A user can only have one workout in progress at a time.
+func (db *DB) StartWorkout(ctx context.Context, userID int, start time.Time) (WorkoutSession, error) {
+	session := WorkoutSession{Workout: Workout{Start: start}, Pauses: make([]Pause, 0)}
+	err := db.QueryRowContext(
+		ctx,
+		`INSERT INTO workouts(user_id, start_time)
+		SELECT $1::integer, $2::timestamptz
+		WHERE NOT EXISTS (
+			SELECT 1 FROM workouts WHERE user_id = $1 AND end_time IS NULL AND deleted_at IS NULL
+		)
+		RETURNING id`,
+		userID, start,
+	).Scan(&session.Workout.ID)
+	// A workout started by another request at the same time passes the check, but then
+	// violates one_active_workout.
+	switch {
+	case err == sql.ErrNoRows, violatedConstraint(err) == "one_active_workout":
+		return session, ErrWorkoutInProgress
+	case violatedConstraint(err) == "fk_user_id":
+		return session, ErrUserNotFound
+	}
+	return session, err
+}
+
+// GetActiveWorkout retrieves the workout the given user has in progress.
+func (db *DB) GetActiveWorkout(ctx context.Context, userID int) (WorkoutSession, error) {
+	var session WorkoutSession
+	workout := &session.Workout
+	err := db.QueryRowContext(
+		ctx,
+		`SELECT id, start_time, end_time, intensity, type
+		FROM workouts
+		WHERE user_id = $1 AND end_time IS NULL AND deleted_at IS NULL`,
+		userID,
+	).Scan(&workout.ID, &workout.Start, &workout.End, &workout.Intensity, &workout.Type)
+	switch {
+	case err == sql.ErrNoRows:
+		return session, ErrWorkoutNotFound
+	case err != nil:
+		return session, err
+	}
+	session.Pauses, err = getPauses(ctx, db, workout.ID)
+	session.Paused = sessionPaused(session)
+	return session, err
+}
+
+// UpdateWorkoutSession pauses, resumes or finishes the given workout in progress at the
+// instant at.
+func (db *DB) UpdateWorkoutSession(ctx context.Context, userID, workoutID int, action string, at time.Time) (WorkoutSession, error) {
+	var session WorkoutSession
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return session, err
+	}
+	// Rolling back after a successful commit is a no-op.
+	defer tx.Rollback()
+
+	workout := &session.Workout
+	var ourUser int
+	err = tx.QueryRowContext(
+		ctx,
+		`SELECT id, user_id, start_time, end_time, intensity, type
+		FROM workouts
+		WHERE id = $1 AND deleted_at IS NULL
+		FOR UPDATE`,
+		workoutID,
+	).Scan(&workout.ID, &ourUser, &workout.Start, &workout.End, &workout.Intensity, &workout.Type)
+	switch {
+	case err == sql.ErrNoRows:
+		return session, ErrWorkoutNotFound
+	case err != nil:
+		return session, err
+	case ourUser != userID:
+		return session, ErrUserNotAuthorized
+	}
+	if session.Pauses, err = getPauses(ctx, tx, workoutID); err != nil {
+		return session, err
+	}
+	session.Paused = sessionPaused(session)
+	if err = applySessionAction(&session, action, at); err != nil {
+		return session, err
+	}
+
+	if action == SessionPause {
+		_, err = tx.ExecContext(
+			ctx,
+			"INSERT INTO workout_pauses(workout_id, paused_at) VALUES ($1, $2)",
+			workoutID, at,
+		)
+	} else {
+		_, err = tx.ExecContext(
+			ctx,
+			"UPDATE workout_pauses SET resumed_at = $2 WHERE workout_id = $1 AND resumed_at IS NULL",
+			workoutID, at,
+		)
+	}
+	if err == nil && action == SessionFinish {
+		_, err = tx.ExecContext(ctx, "UPDATE workouts SET end_time = $2 WHERE id = $1", workoutID, at)
+	}
+	if err != nil {
+		return session, err
+	}
+	return session, tx.Commit()
+}
+
+// getPauses retrieves the pauses of a workout in the order they happened.
+func getPauses(ctx context.Context, q queryer, workoutID int) ([]Pause, error) {
+	rows, err := q.QueryContext(
+		ctx,
+		`SELECT paused_at, resumed_at
+		FROM workout_pauses
+		WHERE workout_id = $1
+		ORDER BY paused_at`,
+		workoutID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	pauses := make([]Pause, 0)
+	for rows.Next() {
+		var pause Pause
+		if err = rows.Scan(&pause.Start, &pause.End); err != nil {
+			return nil, err
+		}
+		pauses = append(pauses, pause)
+	}
+	return pauses, rows.Err()
+}
+
+// GetWebhooks retrieves the webhooks of the given user in the order they were added,
+// without their secrets.
+func (db *DB) GetWebhooks(ctx context.Context, userID int) ([]Webhook, error) {
+	webhooks := make([]Webhook, 0)
+	err := db.readRows(
+		ctx,
+		func(rs *sql.Rows) error {
+			var webhook Webhook
+			var events string
+			readErr := rs.Scan(&webhook.ID, &webhook.URL, &events, &webhook.Created)
+			webhook.Events = strings.Split(events, ",")
+			webhooks = append(webhooks, webhook)
+			return readErr
+		},
+		`SELECT id, url, events, created_at
+		FROM webhooks
+		WHERE user_id = $1
+		ORDER BY id`,
+		userID,
+	)
+	return webhooks, err
+}
+
+// AddWebhook adds a webhook to the database and returns its ID.
+func (db *DB) AddWebhook(ctx context.Context, webhook Webhook) (int, error) {
+	var webhookID int
+	err := db.QueryRowContext(
+		ctx,
+		`INSERT INTO webhooks(user_id, url, events, secret, created_at)
+		VALUES ($1, $2, $3, $4, $5) RETURNING id`,
+		webhook.User, webhook.URL, strings.Join(webhook.Events, ","), webhook.Secret, webhook.Created,
+	).Scan(&webhookID)
+	return webhookID, err
+}
+
+// DeleteWebhook deletes the webhook with the specified ID, provided that it belongs to the
+// user, along with its deliveries.
+func (db *DB) DeleteWebhook(ctx context.Context, userID, webhookID int) error {
+	result, err := db.ExecContext(
+		ctx,
+		`DELETE FROM webhooks WHERE id = $1 AND user_id = $2`,
+		webhookID, userID,
+	)
+	return requireAffected(result, err, ErrWebhookNotFound)
+}
+
+// QueueWebhookDeliveries queues the delivery of each event to the webhooks of its user
+// that subscribe to it.
+func (db *DB) QueueWebhookDeliveries(ctx context.Context, events []WebhookEvent) error {
+	return queueWebhookDeliveries(ctx, db, events)
+}
+
+// queueWebhookDeliveries queues the deliveries of events in a single statement, in the
+// order of the events.
+func queueWebhookDeliveries(ctx context.Context, q queryer, events []WebhookEvent) error {
+	if len(events) == 0 {
+		return nil
+	}
+	users := make([]int64, len(events))
+	types := make([]string, len(events))
+	payloads := make([]string, len(events))
+	for i, event := range events {
+		users[i], types[i], payloads[i] = int64(event.User), event.Type, string(event.Payload)
+	}
+	_, err := q.ExecContext(
+		ctx,
+		`INSERT INTO webhook_deliveries(webhook_id, event, payload)
+		SELECT webhooks.id, e.type, e.payload::jsonb
+		FROM unnest($1::integer[], $2::text[], $3::text[]) WITH ORDINALITY AS e(user_id, type, payload, n)
+		JOIN webhooks ON webhooks.user_id = e.user_id AND e.type = ANY(string_to_array(webhooks.events, ','))
+		ORDER BY e.n, webhooks.id`,
+		pq.Array(users), pq.Array(types), pq.Array(payloads),
+	)
+	return err
+}
+
+// ClaimWebhookDeliveries retrieves up to limit pending deliveries that are due, along with
+// the URL and secret of their webhooks. Claimed deliveries are not due again until the
+// lease has passed, so that other servers leave them alone while they are attempted.
+func (db *DB) ClaimWebhookDeliveries(ctx context.Context, limit int, lease time.Duration) ([]WebhookDelivery, error) {
+	deliveries := make([]WebhookDelivery, 0)
+	err := db.readRows(
+		ctx,
+		func(rs *sql.Rows) error {
+			delivery := WebhookDelivery{Status: DeliveryPending}
+			var payload string
+			readErr := rs.Scan(
+				&delivery.ID, &delivery.Webhook, &delivery.Event, &payload,
+				&delivery.Attempts, &delivery.Created, &delivery.URL, &delivery.Secret,
+			)
+			delivery.Payload = []byte(payload)
+			deliveries = append(deliveries, delivery)
+			return readErr
+		},
+		`UPDATE webhook_deliveries d
+		SET next_attempt_at = now() + $2::float8 * interval '1 second'
+		FROM webhooks h
+		WHERE d.webhook_id = h.id AND d.id IN (
+			SELECT id
+			FROM webhook_deliveries
+			WHERE status = 'pending' AND next_attempt_at <= now()
+			ORDER BY next_attempt_at, id
+			LIMIT $1
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING d.id, d.webhook_id, d.event, d.payload, d.attempts, d.created_at, h.url, h.secret`,
+		limit, lease.Seconds(),
+	)
+	return deliveries, err
+}
+
+// RecordWebhookAttempt saves the outcome of an attempt to deliver an event.
+func (db *DB) RecordWebhookAttempt(ctx context.Context, delivery WebhookDelivery) error {
+	_, err := db.ExecContext(
+		ctx,
+		`UPDATE webhook_deliveries
+		SET status = $2, attempts = $3, next_attempt_at = $4, response_code = NULLIF($5, 0),
+			error = NULLIF($6, ''), delivered_at = $7
+		WHERE id = $1`,
+		delivery.ID, delivery.Status, delivery.Attempts, delivery.NextAttempt,
+		delivery.ResponseCode, delivery.Error, delivery.Delivered,
+	)
+	return err
+}
+
+// GetWebhookDeliveries retrieves the latest deliveries of a webhook, provided that it
+// belongs to the user, starting with the most recent.
+func (db *DB) GetWebhookDeliveries(ctx context.Context, userID, webhookID, limit int) ([]WebhookDelivery, error) {
+	if !rowExists(ctx, db, "SELECT id FROM webhooks WHERE id = $1 AND user_id = $2", webhookID, userID) {
+		return nil, ErrWebhookNotFound
+	}
+	deliveries := make([]WebhookDelivery, 0)
+	err := db.readRows(
+		ctx,
+		func(rs *sql.Rows) error {
+			delivery := WebhookDelivery{Webhook: webhookID}
+			var payload string
+			readErr := rs.Scan(
+				&delivery.ID, &delivery.Event, &payload, &delivery.Status, &delivery.Attempts,
+				&delivery.NextAttempt, &delivery.ResponseCode, &delivery.Error,
+				&delivery.Created, &delivery.Delivered,
+			)
+			delivery.Payload = []byte(payload)
+			deliveries = append(deliveries, delivery)
+			return readErr
+		},
+		`SELECT id, event, payload, status, attempts, next_attempt_at, COALESCE(response_code, 0),
+			COALESCE(error, ''), created_at, delivered_at
+		FROM webhook_deliveries
+		WHERE webhook_id = $1
+		ORDER BY id DESC
+		LIMIT $2`,
+		webhookID, limit,
+	)
+	return deliveries, err
+}
+
+// SetCalendarToken sets the secret token of the user's calendar feed. An empty token
+// disables the feed.
+func (db *DB) SetCalendarToken(ctx context.Context, userID int, token string) error {
+	result, err := db.ExecContext(
+		ctx,
+		"UPDATE users SET calendar_token = NULLIF($2, '') WHERE id = $1",
+		userID, token,
+	)
+	return requireAffected(result, err, ErrUserNotFound)
+}
+
+// GetCalendarUser retrieves the user whose calendar feed has the given token.
+func (db *DB) GetCalendarUser(ctx context.Context, token string) (User, error) {
+	user := User{}
+	if token == "" {
+		return user, ErrUserNotFound
+	}
+	err := db.QueryRowContext(
+		ctx,
+		"SELECT id, name FROM users WHERE calendar_token = $1",
+		token,
+	).Scan(&user.ID, &user.Name)
+	if err == sql.ErrNoRows {
+		return user, ErrUserNotFound
+	}
+	return user, err
+}
+
+// GetPlannedWorkouts retrieves the planned workouts of the given user, ordered by start
+// time.
+func (db *DB) GetPlannedWorkouts(ctx context.Context, userID int) ([]PlannedWorkout, error) {
+	planned := make([]PlannedWorkout, 0)
+	err := db.readRows(
+		ctx,
+		func(rs *sql.Rows) error {
+			var workout PlannedWorkout
+			readErr := rs.Scan(&workout.ID, &workout.UID, &workout.Summary, &workout.Start, &workout.End)
+			planned = append(planned, workout)
+			return readErr
+		},
+		`SELECT id, uid, summary, start_time, end_time
+		FROM planned_workouts
+		WHERE user_id = $1
+		ORDER BY start_time`,
+		userID,
+	)
+	return planned, err
+}
+
+// ImportPlannedWorkouts adds planned workouts for the given user in a single transaction,
+// replacing any previously imported with the same UID.
+func (db *DB) ImportPlannedWorkouts(ctx context.Context, userID int, planned []PlannedWorkout) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	// Rolling back after a successful commit is a no-op.
+	defer tx.Rollback()
+
+	for _, workout := range planned {
+		_, err = tx.ExecContext(
+			ctx,
+			`INSERT INTO planned_workouts(user_id, uid, summary, start_time, end_time)
+			VALUES ($1, $2, $3, $4, $5)
+			ON CONFLICT (user_id, uid) DO UPDATE
+			SET summary = EXCLUDED.summary, start_time = EXCLUDED.start_time, end_time = EXCLUDED.end_time`,
+			userID, workout.UID, workout.Summary, workout.Start, workout.End,
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// ImportWorkouts adds workouts in a single transaction, skipping any with the same start
+// and end as another workout of the same user, including those in the trash, which can be
+// restored instead. It returns the IDs of the workouts in order, with 0 for those that
+// were skipped.
+func (db *DB) ImportWorkouts(ctx context.Context, workouts []Workout) ([]int, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	// Rolling back after a successful commit is a no-op.
+	defer tx.Rollback()
+
+	ids := make([]int, len(workouts))
+	for i, workout := range workouts {
+		err = tx.QueryRowContext(
+			ctx,
+			`INSERT INTO workouts(user_id, start_time, end_time, intensity, type)
+			SELECT $1::integer, $2::timestamptz, $3::timestamptz, $4::smallint, $5::text
+			WHERE NOT EXISTS (
+				SELECT id FROM workouts WHERE user_id = $1 AND start_time = $2 AND end_time = $3
+			)
+			RETURNING id`,
+			workout.User, workout.Start, workout.End, workout.Intensity, workout.Type,
+		).Scan(&ids[i])
+		if err != nil && err != sql.ErrNoRows {
+			return nil, err
+		}
+	}
+	return ids, tx.Commit()
+}
+
+// AddImportJob adds an import job to the database and returns its ID.
+func (db *DB) AddImportJob(ctx context.Context, job ImportJob) (int, error) {
+	var jobID int
+	err := db.QueryRowContext(
+		ctx,
+		`INSERT INTO import_jobs(user_id, source, status, file, host, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7) RETURNING id`,
+		job.User, job.Source, job.Status, job.File, job.Host, job.Created, job.Updated,
+	).Scan(&jobID)
+	return jobID, err
+}
+
+// UpdateImportJob saves the progress of an import job.
+func (db *DB) UpdateImportJob(ctx context.Context, job ImportJob) error {
+	importErrors, err := json.Marshal(job.Errors)
+	if err != nil {
+		return err
+	}
+	result, err := db.ExecContext(
+		ctx,
+		`UPDATE import_jobs
+		SET status = $2, bytes_read = $3, total_bytes = $4, total = $5, processed = $6,
+			imported = $7, duplicates = $8, failed = $9, errors = $10::jsonb, error = NULLIF($11, ''),
+			updated_at = $12, finished_at = $13
+		WHERE id = $1`,
+		job.ID, job.Status, job.BytesRead, job.TotalBytes, job.Total, job.Processed, job.Imported,
+		job.Duplicates, job.Failed, string(importErrors), job.Error, job.Updated, job.Finished,
+	)
+	return requireAffected(result, err, ErrImportJobNotFound)
+}
+
+// GetImportJob retrieves an import job, provided that it belongs to the user.
+func (db *DB) GetImportJob(ctx context.Context, userID, jobID int) (ImportJob, error) {
+	job := ImportJob{ID: jobID}
+	var importErrors string
+	err := db.QueryRowContext(
+		ctx,
+		`SELECT source, status, bytes_read, total_bytes, total, processed, imported, duplicates,
+			failed, errors, COALESCE(error, ''), created_at, updated_at, finished_at
+		FROM import_jobs
+		WHERE id = $1 AND user_id = $2`,
+		jobID, userID,
+	).Scan(
+		&job.Source, &job.Status, &job.BytesRead, &job.TotalBytes, &job.Total, &job.Processed,
+		&job.Imported, &job.Duplicates, &job.Failed, &importErrors, &job.Error, &job.Created,
+		&job.Updated, &job.Finished,
+	)
+	switch {
+	case err == sql.ErrNoRows:
+		return job, ErrImportJobNotFound
+	case err != nil:
+		return job, err
+	}
+	err = json.Unmarshal([]byte(importErrors), &job.Errors)
+	return job, err
+}
+
+// ClaimStaleImportJobs retrieves the unfinished import jobs of the host that have not
+// saved their progress within the lease, marking them as running so that other servers
+// leave them alone while they are resumed. Only the host a job was started on has its
+// file, so the jobs of other hosts are left to them. Jobs without a host, which were
+// started before hosts were recorded, are claimed by any host.
+func (db *DB) ClaimStaleImportJobs(ctx context.Context, host string, lease time.Duration) ([]ImportJob, error) {
+	jobs := make([]ImportJob, 0)
+	err := db.readRows(
+		ctx,
+		func(rs *sql.Rows) error {
+			job := ImportJob{Status: JobRunning}
+			var importErrors string
+			readErr := rs.Scan(
+				&job.ID, &job.User, &job.Source, &job.BytesRead, &job.TotalBytes, &job.Total,
+				&job.Processed, &job.Imported, &job.Duplicates, &job.Failed, &importErrors,
+				&job.Created, &job.Updated, &job.File, &job.Host,
+			)
+			if readErr == nil {
+				readErr = json.Unmarshal([]byte(importErrors), &job.Errors)
+			}
+			jobs = append(jobs, job)
+			return readErr
+		},
+		`UPDATE import_jobs
+		SET status = 'running', updated_at = now()
+		WHERE id IN (
+			SELECT id
+			FROM import_jobs
+			WHERE status IN ('pending', 'running') AND host IN ($2, '')
+				AND updated_at < now() - $1::float8 * interval '1 second'
+			ORDER BY id
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING id, user_id, source, bytes_read, total_bytes, total, processed, imported,
+			duplicates, failed, errors, created_at, updated_at, file, host`,
+		lease.Seconds(), host,
+	)
+	return jobs, err
+}
+
+// requireAffected returns notFound if a statement succeeded without affecting any rows.
+func requireAffected(result sql.Result, err error, notFound error) error {
+	if err != nil {
+		return err
+	}
+	affected, err := result.RowsAffected()
+	switch {
+	case err != nil:
+		return err
+	case affected == 0:
+		return notFound
+	default:
+		return nil
+	}
+}
+
+func (db *DB) readRows(ctx context.Context, read func(rs *sql.Rows) error, query string, args ...interface{}) error {
+	return queryRows(ctx, db, read, query, args...)
+}
+
+// queryRows runs a query and calls read for each row of its result.
+func queryRows(ctx context.Context, q queryer, read func(rs *sql.Rows) error, query string, args ...interface{}) error {
+	rows, err := q.QueryContext(ctx, query, args...)
 	if err != nil {
 		return err
 	}
@@ -194,11 +1131,20 @@ func (db *DB) readRows(read func(rs *sql.Rows) error, query string, args ...inte
 	return nil
 }
 
-func (db *DB) rowExists(query string, args ...interface{}) bool {
-	row := db.QueryRow(query, args...)
+func rowExists(ctx context.Context, q queryer, query string, args ...interface{}) bool {
+	row := q.QueryRowContext(ctx, query, args...)
 	return row.Scan() != sql.ErrNoRows
 }
 
+// violatedConstraint returns the name of the constraint that err reports being violated,
+// or an empty string if err reports anything else.
+func violatedConstraint(err error) string {
+	if pqErr, ok := err.(*pq.Error); ok && pqErr.Code.Class() == "23" {
+		return pqErr.Constraint
+	}
+	return ""
+}
+
 /* Custom error types */
 
 // ErrUserAlreadyExists is returned when a new account with an existing name is requested.
@@ -213,3 +1159,42 @@ var ErrInvalidCredentials = errors.New("datastore: the user's credentials did no
 // ErrUserNotAuthorized is returned when a user requests an action that they do not have
 // access to.
 var ErrUserNotAuthorized = errors.New("datastore: the user does not have access to modify the workout")
+
+// ErrWorkoutNotFound is returned when a workout could not be found.
+var ErrWorkoutNotFound = errors.New("datastore: a workout with the given ID could not be found")
+
+// ErrInvalidBatchOperation is returned for a batch operation that is not one of create,
+// update or delete.
+var ErrInvalidBatchOperation = errors.New("datastore: unknown batch operation")
+
+// ErrWorkoutInProgress is returned when a user starts a workout while they already have
+// one in progress.
+var ErrWorkoutInProgress = errors.New("datastore: the user already has a workout in progress")
+
+// ErrWorkoutFinished is returned when a workout that has already finished is paused,
+// resumed or finished.
+var ErrWorkoutFinished = errors.New("datastore: the workout has already finished")
+
+// ErrWorkoutPaused is returned when a workout that is already paused is paused again.
+var ErrWorkoutPaused = errors.New("datastore: the workout is already paused")
+
+// ErrWorkoutNotPaused is returned when a workout that is not paused is resumed.
+var ErrWorkoutNotPaused = errors.New("datastore: the workout is not paused")
+
+// ErrSessionOutOfOrder is returned when an action on a workout in progress happened
+// before the workout's previous action.
+var ErrSessionOutOfOrder = errors.New("datastore: the action happened before the workout's last action")
+
+// ErrInvalidSessionAction is returned when a workout in progress is given an unknown
+// action.
+var ErrInvalidSessionAction = errors.New("datastore: unknown workout session action")
+
+// ErrWebhookNotFound is returned when a webhook could not be found.
+var ErrWebhookNotFound = errors.New("datastore: a webhook with the given ID could not be found")
+
+// ErrImportJobNotFound is returned when an import job does not exist or belongs to
+// another user.
+var ErrImportJobNotFound = errors.New("datastore: an import job with the given ID could not be found")
+
+// ErrGoalNotFound is returned when a goal could not be found among the user's goals.
+var ErrGoalNotFound = errors.New("datastore: a goal with the given ID could not be found")
@@ -0,0 +1,1076 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// The contract that every Datastore implementation satisfies. Each implementation runs the
+// same tests against an empty database of its own.
+
+// openDatastore opens an empty datastore for a test, returning it with a function that
+// closes it.
+type openDatastore func(t *testing.T) (Datastore, func())
+
+// datastoreContract lists the tests of the contract.
+var datastoreContract = []struct {
+	name string
+	test func(t *testing.T, db Datastore)
+}{
+	{"Users", testDatastoreUsers},
+	{"UserErrors", testDatastoreUserErrors},
+	{"ConcurrentWrites", testDatastoreConcurrentWrites},
+	{"Workouts", testDatastoreWorkouts},
+	{"Trash", testDatastoreTrash},
+	{"BatchWorkouts", testDatastoreBatchWorkouts},
+	{"ImportWorkouts", testDatastoreImportWorkouts},
+	{"Insights", testDatastoreInsights},
+	{"Goals", testDatastoreGoals},
+	{"WorkoutSessions", testDatastoreWorkoutSessions},
+	{"Webhooks", testDatastoreWebhooks},
+	{"Calendar", testDatastoreCalendar},
+	{"ImportJobs", testDatastoreImportJobs},
+}
+
+func testDatastore(t *testing.T, open openDatastore) {
+	for _, contract := range datastoreContract {
+		contract := contract
+		t.Run(contract.name, func(t *testing.T) {
+			db, closeDB := open(t)
+			defer closeDB()
+			contract.test(t, db)
+		})
+	}
+}
+
+func TestMemoryDatastore(t *testing.T) {
+	testDatastore(t, func(t *testing.T) (Datastore, func()) {
+		return NewMemoryDB(), func() {}
+	})
+}
+
+// TestMemoryDBConcurrency exercises MemoryDB from many goroutines at once, which the race
+// detector checks when the tests are run with -race.
+func TestMemoryDBConcurrency(t *testing.T) {
+	ctx := context.Background()
+	db := NewMemoryDB()
+	userID := addTestUser(t, db, "Runner")
+
+	const goroutines = 20
+	// Only the test's goroutine may stop the test, so nothing that can call t.Fatal runs
+	// in the others.
+	starts := make([]time.Time, goroutines)
+	for i := range starts {
+		starts[i] = testTime(t, i, 0)
+	}
+	var wg sync.WaitGroup
+	signUps := make(chan error, goroutines)
+	for i := 0; i < goroutines; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, err := db.SignUp(ctx, UserRequest{Name: "Swimmer", Token: fmt.Sprintf("token-%d", i)})
+			signUps <- err
+			end := starts[i].Add(30 * time.Minute)
+			if _, err = db.AddWorkout(ctx, Workout{User: userID, Start: starts[i], End: &end}); err != nil {
+				t.Errorf("unable to add workout: %v", err)
+			}
+			if _, err = db.GetWorkouts(ctx, userID); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(signUps)
+
+	succeeded := 0
+	for err := range signUps {
+		switch err {
+		case nil:
+			succeeded++
+		case ErrUserAlreadyExists:
+		default:
+			t.Errorf("signing up returned %v", err)
+		}
+	}
+	if succeeded != 1 {
+		t.Errorf("%d concurrent sign ups with the same name succeeded, expected 1", succeeded)
+	}
+	if workouts, _ := db.GetWorkouts(ctx, userID); len(workouts) != goroutines {
+		t.Errorf("GetWorkouts returned %d workouts, expected %d", len(workouts), goroutines)
+	}
+}
+
+func TestSQLiteDatastore(t *testing.T) {
+	testDatastore(t, func(t *testing.T) (Datastore, func()) {
+		db, err := InitializeSQLite(":memory:")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = db.Migrate(); err != nil {
+			t.Fatal(err)
+		}
+		return db, func() { db.Close() }
+	})
+}
+
+// TestSQLiteMigrateDuplicateNames checks that users sharing a name are given names of
+// their own so that names can be made unique, and can still log in with the name they
+// signed up with.
+func TestSQLiteMigrateDuplicateNames(t *testing.T) {
+	db, err := InitializeSQLite(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err = db.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = db.MigrateDown(len(sqliteMigrations.migrations) - 1); err != nil {
+		t.Fatal(err)
+	}
+
+	long := strings.Repeat("a", 50)
+	users := []struct {
+		id             int
+		name, password string
+		expected       string
+	}{
+		{1, "Alice", "first", "Alice"},
+		{2, "Alice", "second", "Alice-2-2"},
+		// The name the second Alice would be given is taken.
+		{3, "Alice-2", "third", "Alice-2"},
+		{4, long, "fourth", long},
+		{5, long, "fifth", strings.Repeat("a", 48) + "-5"},
+	}
+	for _, u := range users {
+		_, err = db.db.Exec("INSERT INTO users(id, name, password, token) VALUES (?, ?, ?, ?)", u.id, u.name, u.password, u.password)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err = db.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	for _, u := range users {
+		if name, err := db.GetUsername(ctx, u.id); err != nil || name != u.expected {
+			t.Errorf("user %d is named %q, %v, expected %q", u.id, name, err, u.expected)
+		}
+		if user, err := db.LoginWithCredentials(ctx, u.name, u.password); err != nil || user.ID != u.id || user.Name != u.expected {
+			t.Errorf("logging in as %q with the password of user %d returned %+v, %v", u.name, u.id, user, err)
+		}
+	}
+	if _, err = db.LoginWithCredentials(ctx, "Alice", "third"); err != ErrInvalidCredentials {
+		t.Errorf("logging in as Alice with another user's password returned %v", err)
+	}
+	var renames int
+	if err = db.db.QueryRow("SELECT count(*) FROM user_renames").Scan(&renames); err != nil || renames != 2 {
+		t.Errorf("%d renames were recorded, %v, expected 2", renames, err)
+	}
+}
+
+// TestPostgresDatastore runs the contract against the Postgres database at
+// TEST_DATABASE_URL, if it is set. Every table in the database is dropped before each
+// test, so it must not be a database whose data matters.
+func TestPostgresDatastore(t *testing.T) {
+	url := os.Getenv("TEST_DATABASE_URL")
+	if url == "" {
+		t.Skip("TEST_DATABASE_URL is not set")
+	}
+	testDatastore(t, func(t *testing.T) (Datastore, func()) {
+		db, err := InitializeDB("postgres", url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = db.MigrateDown(len(postgresMigrations.migrations)); err != nil {
+			t.Fatal(err)
+		}
+		if _, err = db.Migrate(); err != nil {
+			t.Fatal(err)
+		}
+		return db, func() { db.Close() }
+	})
+}
+
+// TestPostgresMigrateSchema checks that the migrations adopt a database created from the
+// schema.sql that came before them, keeping its data, when TEST_DATABASE_URL is set.
+func TestPostgresMigrateSchema(t *testing.T) {
+	url := os.Getenv("TEST_DATABASE_URL")
+	if url == "" {
+		t.Skip("TEST_DATABASE_URL is not set")
+	}
+	schema, err := ioutil.ReadFile("testdata/schema.sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := InitializeDB("postgres", url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if _, err = db.MigrateDown(len(postgresMigrations.migrations)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = db.Exec("DROP TABLE schema_migrations"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = db.Exec(string(schema)); err != nil {
+		t.Fatal(err)
+	}
+	var userID, duplicateID int
+	err = db.QueryRow(
+		"INSERT INTO users(name, password, token) VALUES ('Alice', 'hash', 'hash') RETURNING id",
+	).Scan(&userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.QueryRow(
+		"INSERT INTO users(name, password, token) VALUES ('Alice', 'other', 'other') RETURNING id",
+	).Scan(&duplicateID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := testTime(t, 7, 0)
+	_, err = db.Exec(
+		"INSERT INTO workouts(user_id, start_time, end_time) VALUES ($1, $2, $3)",
+		userID, start, start.Add(time.Hour),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	count, err := db.Migrate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != len(postgresMigrations.migrations) {
+		t.Errorf("Migrate applied %d migrations, expected %d", count, len(postgresMigrations.migrations))
+	}
+	ctx := context.Background()
+	if name, err := db.GetUsername(ctx, duplicateID); err != nil || name != fmt.Sprintf("Alice-%d", duplicateID) {
+		t.Errorf("the user sharing a name was renamed to %q, %v", name, err)
+	}
+	if user, err := db.LoginWithCredentials(ctx, "Alice", "other"); err != nil || user.ID != duplicateID {
+		t.Errorf("the renamed user logging in with their old name returned %+v, %v", user, err)
+	}
+	workouts, err := db.GetWorkouts(ctx, userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(workouts) != 1 || !workouts[0].Start.Equal(start) || workouts[0].Intensity != nil {
+		t.Errorf("GetWorkouts returned %+v, expected the workout from before the migrations", workouts)
+	}
+	// Workouts could not be left without an end before the migrations.
+	if _, err = db.StartWorkout(ctx, userID, testTime(t, 9, 0)); err != nil {
+		t.Errorf("StartWorkout failed after the migrations: %v", err)
+	}
+}
+
+// TestQueryTimeoutDatastore checks that the timeouts leave the calls of a datastore that
+// answers in time unchanged.
+func TestQueryTimeoutDatastore(t *testing.T) {
+	testDatastore(t, func(t *testing.T) (Datastore, func()) {
+		return WithQueryTimeout(NewMemoryDB(), time.Minute), func() {}
+	})
+}
+
+// slowDB takes until its context is done to get workouts, then fails the way a driver
+// would.
+type slowDB struct {
+	Datastore
+}
+
+// deadlineDB records the deadline that batches of workout operations are given.
+type deadlineDB struct {
+	Datastore
+	deadline time.Time
+}
+
+func (db *deadlineDB) BatchWorkouts(ctx context.Context, ops []BatchOperation, webhooks BatchWebhooks) ([]BatchResult, error) {
+	db.deadline, _ = ctx.Deadline()
+	return make([]BatchResult, len(ops)), nil
+}
+
+func (db slowDB) GetWorkouts(ctx context.Context, userID int) ([]Workout, error) {
+	<-ctx.Done()
+	return nil, errors.New("canceling statement due to user request")
+}
+
+func TestQueryTimeout(t *testing.T) {
+	db := WithQueryTimeout(slowDB{NewMemoryDB()}, 10*time.Millisecond)
+	if _, err := db.GetWorkouts(context.Background(), 1); err != context.DeadlineExceeded {
+		t.Errorf("a call taking longer than the timeout returned %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := db.GetWorkouts(ctx, 1); err != context.Canceled {
+		t.Errorf("a call with a cancelled context returned %v", err)
+	}
+
+	// Batches are given more time the more operations they have.
+	deadlines := &deadlineDB{}
+	db = WithQueryTimeout(deadlines, time.Second)
+	ops := make([]BatchOperation, maxBatchOperations)
+	before := time.Now()
+	if _, err := db.BatchWorkouts(context.Background(), ops, nil); err != nil {
+		t.Fatal(err)
+	}
+	expected := time.Duration(1+maxBatchOperations/batchOperationsPerTimeout) * time.Second
+	if timeout := deadlines.deadline.Sub(before); timeout < expected || timeout > expected+time.Second {
+		t.Errorf("a batch of %d operations was given %s, expected %s", maxBatchOperations, timeout, expected)
+	}
+
+	// Without a timeout, only the context of the call limits it.
+	db = WithQueryTimeout(slowDB{NewMemoryDB()}, 0)
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := db.GetWorkouts(ctx, 1); err != context.DeadlineExceeded {
+		t.Errorf("a call past the deadline of its context returned %v", err)
+	}
+}
+
+/* Helpers */
+
+func addTestUser(t *testing.T, db Datastore, name string) int {
+	ctx := context.Background()
+	userID, err := db.SignUp(ctx, UserRequest{Name: name, Token: name + "-token"})
+	if err != nil {
+		t.Fatalf("unable to sign up %s: %v", name, err)
+	}
+	return userID
+}
+
+func addTestWorkout(t *testing.T, db Datastore, userID int, start time.Time, length time.Duration) Workout {
+	ctx := context.Background()
+	end := start.Add(length)
+	workout := Workout{User: userID, Start: start, End: &end, Type: "run"}
+	id, err := db.AddWorkout(ctx, workout)
+	if err != nil {
+		t.Fatalf("unable to add workout: %v", err)
+	}
+	workout.ID = id
+	return workout
+}
+
+// testTime returns an instant on 1 March 2019 in Toronto, where it is five hours behind
+// UTC, so that datastores are seen to keep the instant of times in other time zones.
+func testTime(t *testing.T, hour, minute int) time.Time {
+	location, err := time.LoadLocation("America/Toronto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return time.Date(2019, time.March, 1, hour, minute, 0, 0, location)
+}
+
+func workoutIDs(workouts []Workout) []int {
+	ids := make([]int, len(workouts))
+	for i, workout := range workouts {
+		ids[i] = workout.ID
+	}
+	return ids
+}
+
+func equalIDs(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+/* Contract */
+
+func testDatastoreUsers(t *testing.T, db Datastore) {
+	ctx := context.Background()
+	userID := addTestUser(t, db, "Runner")
+	if _, err := db.SignUp(ctx, UserRequest{Name: "Runner", Token: "other"}); err != ErrUserAlreadyExists {
+		t.Errorf("signing up with a taken name returned %v, expected ErrUserAlreadyExists", err)
+	}
+
+	user, err := db.LoginWithCredentials(ctx, "Runner", "Runner-token")
+	if err != nil || user.ID != userID || user.Name != "Runner" {
+		t.Errorf("logging in returned %+v, %v", user, err)
+	}
+	if _, err = db.LoginWithCredentials(ctx, "Runner", "wrong"); err != ErrInvalidCredentials {
+		t.Errorf("logging in with the wrong password returned %v", err)
+	}
+	if _, err = db.LoginWithCredentials(ctx, "Nobody", "Runner-token"); err != ErrUserNotFound {
+		t.Errorf("logging in as an unknown user returned %v", err)
+	}
+	if user, err = db.LoginWithToken(ctx, "Runner-token"); err != nil || user.ID != userID {
+		t.Errorf("logging in with a token returned %+v, %v", user, err)
+	}
+	if _, err = db.LoginWithToken(ctx, "unknown"); err != ErrUserNotFound {
+		t.Errorf("logging in with an unknown token returned %v", err)
+	}
+
+	if name, err := db.GetUsername(ctx, userID); err != nil || name != "Runner" {
+		t.Errorf("GetUsername returned %q, %v", name, err)
+	}
+	if _, err = db.GetUsername(ctx, userID+100); err != ErrUserNotFound {
+		t.Errorf("GetUsername of an unknown user returned %v", err)
+	}
+	if names, err := db.GetUsers(ctx); err != nil || len(names) != 1 || names[0] != "Runner" {
+		t.Errorf("GetUsers returned %v, %v", names, err)
+	}
+}
+
+// testDatastoreUserErrors checks the errors returned when a user is unknown, signs up
+// with a taken name, gives the wrong credentials or acts on another user's workout.
+func testDatastoreUserErrors(t *testing.T, db Datastore) {
+	ctx := context.Background()
+	userID := addTestUser(t, db, "Runner")
+	otherID := addTestUser(t, db, "Swimmer")
+	unknownID := userID + otherID + 100
+	workout := addTestWorkout(t, db, userID, testTime(t, 7, 0), time.Hour)
+
+	if _, err := db.SignUp(ctx, UserRequest{Name: "Swimmer", Token: "Runner-token"}); err != ErrUserAlreadyExists {
+		t.Errorf("signing up with another user's name returned %v, expected ErrUserAlreadyExists", err)
+	}
+	if _, err := db.SignUp(ctx, UserRequest{Name: "runner", Token: "runner-token"}); err != nil {
+		t.Errorf("names are case sensitive, but signing up as runner returned %v", err)
+	}
+
+	if _, err := db.LoginWithCredentials(ctx, "Runner", "Swimmer-token"); err != ErrInvalidCredentials {
+		t.Errorf("logging in with another user's password returned %v, expected ErrInvalidCredentials", err)
+	}
+	if _, err := db.LoginWithCredentials(ctx, "", ""); err != ErrUserNotFound {
+		t.Errorf("logging in without a name returned %v, expected ErrUserNotFound", err)
+	}
+
+	end := testTime(t, 10, 0)
+	notFound := []struct {
+		name string
+		err  error
+	}{
+		{"GetUsername", func() error { _, err := db.GetUsername(ctx, unknownID); return err }()},
+		{"AddWorkout", func() error {
+			_, err := db.AddWorkout(ctx, Workout{User: unknownID, Start: testTime(t, 9, 0), End: &end})
+			return err
+		}()},
+		{"StartWorkout", func() error { _, err := db.StartWorkout(ctx, unknownID, testTime(t, 9, 0)); return err }()},
+		{"SetCalendarToken", db.SetCalendarToken(ctx, unknownID, "secret")},
+		{"GetCalendarUser", func() error { _, err := db.GetCalendarUser(ctx, "secret"); return err }()},
+	}
+	for _, call := range notFound {
+		if call.err != ErrUserNotFound {
+			t.Errorf("%s for an unknown user returned %v, expected ErrUserNotFound", call.name, call.err)
+		}
+	}
+
+	// Acting on another user's workout, or on a workout that does not exist, changes
+	// nothing.
+	update := workout
+	update.User, update.Type = otherID, "swim"
+	if err := db.UpdateWorkout(ctx, update); err != ErrUserNotAuthorized {
+		t.Errorf("updating another user's workout returned %v, expected ErrUserNotAuthorized", err)
+	}
+	update.ID, update.User = workout.ID+100, userID
+	if err := db.UpdateWorkout(ctx, update); err != ErrUserNotAuthorized {
+		t.Errorf("updating a workout that does not exist returned %v, expected ErrUserNotAuthorized", err)
+	}
+	results, err := db.BatchWorkouts(ctx, []BatchOperation{
+		{BatchUpdate, Workout{ID: workout.ID, User: otherID, Start: workout.Start, End: workout.End}},
+		{BatchDelete, Workout{ID: workout.ID, User: otherID}},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, result := range results {
+		if result.Err != ErrUserNotAuthorized {
+			t.Errorf("batch operation %d on another user's workout returned %v, expected ErrUserNotAuthorized", i, result.Err)
+		}
+	}
+	if _, err = db.UpdateWorkoutSession(ctx, otherID, workout.ID, SessionPause, testTime(t, 9, 0)); err != ErrUserNotAuthorized {
+		t.Errorf("pausing another user's workout returned %v, expected ErrUserNotAuthorized", err)
+	}
+	workouts, _ := db.GetWorkouts(ctx, userID)
+	if len(workouts) != 1 || workouts[0].Type != "run" {
+		t.Errorf("after acting on it as another user the workout is %+v", workouts)
+	}
+}
+
+// testDatastoreConcurrentWrites races writes that check something before they change it:
+// users signing up with the same name, and the same user starting workouts.
+func testDatastoreConcurrentWrites(t *testing.T, db Datastore) {
+	ctx := context.Background()
+	userID := addTestUser(t, db, "Runner")
+
+	const goroutines = 20
+	// testTime can call t.Fatal, which only the test's goroutine may do.
+	starts := make([]time.Time, goroutines)
+	for i := range starts {
+		starts[i] = testTime(t, 7, i)
+	}
+	var wg sync.WaitGroup
+	start := make(chan struct{})
+	signUps := make(chan error, goroutines)
+	sessions := make(chan error, goroutines)
+	for i := 0; i < goroutines; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			<-start
+			_, err := db.SignUp(ctx, UserRequest{Name: "Swimmer", Token: fmt.Sprintf("token-%d", i)})
+			signUps <- err
+			_, err = db.StartWorkout(ctx, userID, starts[i])
+			sessions <- err
+		}(i)
+	}
+	close(start)
+	wg.Wait()
+	close(signUps)
+	close(sessions)
+
+	expectOne := func(results chan error, expected error, what string) {
+		succeeded := 0
+		for err := range results {
+			switch err {
+			case nil:
+				succeeded++
+			case expected:
+			default:
+				t.Errorf("%s returned %v, expected nil or %v", what, err, expected)
+			}
+		}
+		if succeeded != 1 {
+			t.Errorf("%d of %d concurrent calls to %s succeeded, expected 1", succeeded, goroutines, what)
+		}
+	}
+	expectOne(signUps, ErrUserAlreadyExists, "SignUp")
+	expectOne(sessions, ErrWorkoutInProgress, "StartWorkout")
+	if names, err := db.GetUsers(ctx); err != nil || len(names) != 2 {
+		t.Errorf("GetUsers returned %v, %v, expected Runner and one Swimmer", names, err)
+	}
+}
+
+func testDatastoreWorkouts(t *testing.T, db Datastore) {
+	ctx := context.Background()
+	userID := addTestUser(t, db, "Runner")
+	otherID := addTestUser(t, db, "Swimmer")
+	late := addTestWorkout(t, db, userID, testTime(t, 18, 0), time.Hour)
+	early := addTestWorkout(t, db, userID, testTime(t, 7, 0), 30*time.Minute)
+	addTestWorkout(t, db, otherID, testTime(t, 7, 0), time.Hour)
+	if _, err := db.AddWorkout(ctx, Workout{User: otherID + 100, Start: testTime(t, 9, 0)}); err != ErrUserNotFound {
+		t.Errorf("adding a workout for an unknown user returned %v", err)
+	}
+
+	workouts, err := db.GetWorkouts(ctx, userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !equalIDs(workoutIDs(workouts), []int{early.ID, late.ID}) {
+		t.Fatalf("GetWorkouts returned %v, expected workouts %d and %d", workouts, early.ID, late.ID)
+	}
+	if got := workouts[0]; !got.Start.Equal(early.Start) || !got.End.Equal(*early.End) || got.Type != "run" {
+		t.Errorf("GetWorkouts returned %+v, expected %+v", got, early)
+	}
+
+	if got, err := db.GetWorkout(ctx, userID, late.ID); err != nil || got.User != userID || !got.Start.Equal(late.Start) {
+		t.Errorf("GetWorkout returned %+v, %v, expected %+v", got, err, late)
+	}
+	if _, err = db.GetWorkout(ctx, otherID, late.ID); err != ErrWorkoutNotFound {
+		t.Errorf("getting another user's workout returned %v", err)
+	}
+
+	between, err := db.GetWorkoutsBetween(ctx, userID, testTime(t, 12, 0), testTime(t, 23, 0))
+	if err != nil || !equalIDs(workoutIDs(between), []int{late.ID}) {
+		t.Errorf("GetWorkoutsBetween returned %v, %v", between, err)
+	}
+	overlapping, err := db.GetOverlappingWorkouts(ctx, userID, testTime(t, 7, 15), testTime(t, 19, 0), late.ID)
+	if err != nil || !equalIDs(workoutIDs(overlapping), []int{early.ID}) {
+		t.Errorf("GetOverlappingWorkouts returned %v, %v", overlapping, err)
+	}
+
+	intensity := 7
+	update := early
+	update.Start = early.Start.Add(-time.Hour)
+	update.Intensity = &intensity
+	update.Type = "ride"
+	if err = db.UpdateWorkout(ctx, update); err != nil {
+		t.Fatal(err)
+	}
+	workouts, _ = db.GetWorkouts(ctx, userID)
+	if got := workouts[0]; !got.Start.Equal(update.Start) || got.Intensity == nil || *got.Intensity != 7 || got.Type != "ride" {
+		t.Errorf("updated workout is %+v, expected %+v", got, update)
+	}
+	kept := update
+	kept.Intensity, kept.keepIntensity = nil, true
+	kept.Type, kept.keepType = "", true
+	if err = db.UpdateWorkout(ctx, kept); err != nil {
+		t.Fatal(err)
+	}
+	workouts, _ = db.GetWorkouts(ctx, userID)
+	if got := workouts[0]; got.Intensity == nil || *got.Intensity != 7 || got.Type != "ride" {
+		t.Errorf("updating a workout without its intensity and type left %+v, expected intensity 7 and type ride", got)
+	}
+	update.User = otherID
+	if err = db.UpdateWorkout(ctx, update); err != ErrUserNotAuthorized {
+		t.Errorf("updating another user's workout returned %v", err)
+	}
+
+	if owner, err := db.DeleteWorkout(ctx, late.ID); err != nil || owner != userID {
+		t.Errorf("DeleteWorkout returned %d, %v", owner, err)
+	}
+	if _, err = db.DeleteWorkout(ctx, late.ID); err != ErrWorkoutNotFound {
+		t.Errorf("deleting a deleted workout returned %v", err)
+	}
+	if _, err = db.GetWorkout(ctx, userID, late.ID); err != ErrWorkoutNotFound {
+		t.Errorf("getting a deleted workout returned %v", err)
+	}
+}
+
+func testDatastoreTrash(t *testing.T, db Datastore) {
+	ctx := context.Background()
+	userID := addTestUser(t, db, "Runner")
+	otherID := addTestUser(t, db, "Swimmer")
+	deleted := addTestWorkout(t, db, userID, testTime(t, 7, 0), time.Hour)
+	kept := addTestWorkout(t, db, userID, testTime(t, 9, 0), time.Hour)
+
+	if owner, err := db.DeleteWorkout(ctx, deleted.ID); err != nil || owner != userID {
+		t.Fatalf("DeleteWorkout returned %d, %v", owner, err)
+	}
+	if _, err := db.DeleteWorkout(ctx, deleted.ID); err != ErrWorkoutNotFound {
+		t.Errorf("deleting a workout in the trash returned %v, expected ErrWorkoutNotFound", err)
+	}
+	if workouts, _ := db.GetWorkouts(ctx, userID); !equalIDs(workoutIDs(workouts), []int{kept.ID}) {
+		t.Errorf("GetWorkouts returned %v, expected only the workout that was kept", workoutIDs(workouts))
+	}
+	if workouts, _ := db.GetWorkoutsBetween(ctx, userID, testTime(t, 0, 0), testTime(t, 23, 0)); len(workouts) != 1 {
+		t.Errorf("GetWorkoutsBetween returned %v, expected only the workout that was kept", workoutIDs(workouts))
+	}
+	if workouts, _ := db.GetOverlappingWorkouts(ctx, userID, testTime(t, 7, 30), testTime(t, 8, 30), 0); len(workouts) != 0 {
+		t.Errorf("a workout in the trash overlapped with %v", workoutIDs(workouts))
+	}
+	update := deleted
+	update.Type = "run"
+	if err := db.UpdateWorkout(ctx, update); err != ErrUserNotAuthorized {
+		t.Errorf("updating a workout in the trash returned %v, expected ErrUserNotAuthorized", err)
+	}
+
+	trash, err := db.GetDeletedWorkouts(ctx, userID)
+	if err != nil || len(trash) != 1 || trash[0].ID != deleted.ID || trash[0].Deleted == nil {
+		t.Fatalf("GetDeletedWorkouts returned %+v, %v", trash, err)
+	}
+	if trash, _ = db.GetDeletedWorkouts(ctx, otherID); len(trash) != 0 {
+		t.Errorf("another user's trash holds %v", workoutIDs(trash))
+	}
+	if _, err = db.RestoreWorkout(ctx, otherID, deleted.ID); err != ErrWorkoutNotFound {
+		t.Errorf("restoring another user's workout returned %v, expected ErrWorkoutNotFound", err)
+	}
+	restored, err := db.RestoreWorkout(ctx, userID, deleted.ID)
+	if err != nil || restored.ID != deleted.ID || !restored.Start.Equal(deleted.Start) || restored.Deleted != nil {
+		t.Errorf("RestoreWorkout returned %+v, %v", restored, err)
+	}
+	if _, err = db.RestoreWorkout(ctx, userID, deleted.ID); err != ErrWorkoutNotFound {
+		t.Errorf("restoring a workout that is not in the trash returned %v, expected ErrWorkoutNotFound", err)
+	}
+	if workouts, _ := db.GetWorkouts(ctx, userID); len(workouts) != 2 {
+		t.Errorf("GetWorkouts returned %v after restoring, expected both workouts", workoutIDs(workouts))
+	}
+
+	// A workout deleted while in progress no longer counts as in progress, and cannot be
+	// restored while another is.
+	session, err := db.StartWorkout(ctx, userID, testTime(t, 12, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = db.DeleteWorkout(ctx, session.Workout.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = db.GetActiveWorkout(ctx, userID); err != ErrWorkoutNotFound {
+		t.Errorf("GetActiveWorkout returned %v for a deleted workout, expected ErrWorkoutNotFound", err)
+	}
+	if _, err = db.StartWorkout(ctx, userID, testTime(t, 13, 0)); err != nil {
+		t.Fatalf("starting a workout after deleting the one in progress returned %v", err)
+	}
+	if _, err = db.RestoreWorkout(ctx, userID, session.Workout.ID); err != ErrWorkoutInProgress {
+		t.Errorf("restoring a second workout in progress returned %v, expected ErrWorkoutInProgress", err)
+	}
+
+	results, err := db.BatchWorkouts(ctx, []BatchOperation{{Op: BatchDelete, Workout: Workout{ID: kept.ID, User: userID}}}, nil)
+	if err != nil || results[0].Err != nil {
+		t.Fatalf("deleting in a batch returned %+v, %v", results, err)
+	}
+	if trash, _ = db.GetDeletedWorkouts(ctx, userID); len(trash) != 2 || trash[0].ID != kept.ID {
+		t.Errorf("GetDeletedWorkouts returned %v, expected the workout deleted last first", workoutIDs(trash))
+	}
+
+	if purged, err := db.PurgeDeletedWorkouts(ctx, time.Now().Add(-time.Hour)); err != nil || purged != 0 {
+		t.Errorf("purging workouts deleted over an hour ago returned %d, %v", purged, err)
+	}
+	if purged, err := db.PurgeDeletedWorkouts(ctx, time.Now().Add(time.Minute)); err != nil || purged != 2 {
+		t.Errorf("purging the trash returned %d, %v, expected 2 workouts", purged, err)
+	}
+	if trash, _ = db.GetDeletedWorkouts(ctx, userID); len(trash) != 0 {
+		t.Errorf("the trash holds %v after it was purged", workoutIDs(trash))
+	}
+	if _, err = db.RestoreWorkout(ctx, userID, kept.ID); err != ErrWorkoutNotFound {
+		t.Errorf("restoring a purged workout returned %v, expected ErrWorkoutNotFound", err)
+	}
+}
+
+func testDatastoreBatchWorkouts(t *testing.T, db Datastore) {
+	ctx := context.Background()
+	userID := addTestUser(t, db, "Runner")
+	otherID := addTestUser(t, db, "Swimmer")
+	existing := addTestWorkout(t, db, userID, testTime(t, 7, 0), time.Hour)
+	others := addTestWorkout(t, db, otherID, testTime(t, 7, 0), time.Hour)
+
+	end := testTime(t, 10, 0)
+	results, err := db.BatchWorkouts(ctx, []BatchOperation{
+		{BatchCreate, Workout{User: userID, Start: testTime(t, 9, 0), End: &end}},
+		{BatchDelete, Workout{ID: others.ID, User: userID}},
+		{BatchDelete, Workout{ID: existing.ID, User: userID}},
+		{"rename", Workout{User: userID}},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []error{nil, ErrUserNotAuthorized, nil, ErrInvalidBatchOperation}
+	for i, result := range results {
+		if result.Err != expected[i] {
+			t.Errorf("operation %d returned %v, expected %v", i, result.Err, expected[i])
+		}
+	}
+	workouts, _ := db.GetWorkouts(ctx, userID)
+	if !equalIDs(workoutIDs(workouts), []int{results[0].ID}) {
+		t.Errorf("after the batch the user has workouts %v, expected only %d", workoutIDs(workouts), results[0].ID)
+	}
+	if workouts, _ = db.GetWorkouts(ctx, otherID); len(workouts) != 1 {
+		t.Errorf("a failed operation deleted another user's workout")
+	}
+}
+
+func testDatastoreImportWorkouts(t *testing.T, db Datastore) {
+	ctx := context.Background()
+	userID := addTestUser(t, db, "Runner")
+	existing := addTestWorkout(t, db, userID, testTime(t, 7, 0), time.Hour)
+	end := testTime(t, 10, 0)
+	ids, err := db.ImportWorkouts(ctx, []Workout{
+		{User: userID, Start: existing.Start.UTC(), End: existing.End, Type: "run"},
+		{User: userID, Start: testTime(t, 9, 0), End: &end, Type: "ride"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 2 || ids[0] != 0 || ids[1] == 0 {
+		t.Errorf("ImportWorkouts returned %v, expected the first to be skipped as a duplicate", ids)
+	}
+	if workouts, _ := db.GetWorkouts(ctx, userID); len(workouts) != 2 {
+		t.Errorf("the user has %d workouts after the import, expected 2", len(workouts))
+	}
+}
+
+func testDatastoreInsights(t *testing.T, db Datastore) {
+	ctx := context.Background()
+	userID := addTestUser(t, db, "Runner")
+	addTestWorkout(t, db, userID, testTime(t, 7, 0), 30*time.Minute)
+	addTestWorkout(t, db, userID, testTime(t, 18, 0), time.Hour)
+	// In Toronto this ends in the evening of 28 February, though in UTC it is 1 March.
+	addTestWorkout(t, db, userID, testTime(t, -3, 0), time.Hour)
+
+	location := testTime(t, 0, 0).Location()
+	insights, err := db.GetInsights(ctx, userID, InsightsQuery{
+		From:     time.Date(2019, time.February, 1, 0, 0, 0, 0, location),
+		To:       time.Date(2019, time.April, 1, 0, 0, 0, 0, location),
+		Bucket:   BucketMonth,
+		Location: location,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if breakdown := (TimeOfDayBreakdown{Morning: 1, Evening: 2}); insights.TimeOfDay != breakdown {
+		t.Errorf("time of day is %+v, expected %+v", insights.TimeOfDay, breakdown)
+	}
+	if len(insights.Frequency) != 2 {
+		t.Fatalf("insights have %d buckets, expected February and March", len(insights.Frequency))
+	}
+	february, march := insights.Frequency[0], insights.Frequency[1]
+	if !february.Start.Equal(time.Date(2019, time.February, 1, 0, 0, 0, 0, location)) || february.Count != 1 || february.TotalMinutes != 60 {
+		t.Errorf("February is %+v", february)
+	}
+	if march.Count != 2 || march.TotalMinutes != 90 {
+		t.Errorf("March is %+v", march)
+	}
+}
+
+func testDatastoreGoals(t *testing.T, db Datastore) {
+	ctx := context.Background()
+	userID := addTestUser(t, db, "Runner")
+	otherID := addTestUser(t, db, "Swimmer")
+	goal := Goal{User: userID, Metric: GoalWorkouts, Period: BucketWeek, Target: 3}
+	goalID, err := db.AddGoal(ctx, goal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	goal.ID = goalID
+	goal.Target = 4
+	if err = db.UpdateGoal(ctx, goal); err != nil {
+		t.Fatal(err)
+	}
+	goals, err := db.GetGoals(ctx, userID)
+	if err != nil || len(goals) != 1 || goals[0].Target != 4 || goals[0].Created.IsZero() {
+		t.Errorf("GetGoals returned %+v, %v", goals, err)
+	}
+
+	goal.User = otherID
+	if err = db.UpdateGoal(ctx, goal); err != ErrGoalNotFound {
+		t.Errorf("updating another user's goal returned %v", err)
+	}
+	if err = db.DeleteGoal(ctx, otherID, goalID); err != ErrGoalNotFound {
+		t.Errorf("deleting another user's goal returned %v", err)
+	}
+	if err = db.DeleteGoal(ctx, userID, goalID); err != nil {
+		t.Fatal(err)
+	}
+	if goals, _ = db.GetGoals(ctx, userID); len(goals) != 0 {
+		t.Errorf("the deleted goal is still listed")
+	}
+}
+
+func testDatastoreWorkoutSessions(t *testing.T, db Datastore) {
+	ctx := context.Background()
+	userID := addTestUser(t, db, "Runner")
+	otherID := addTestUser(t, db, "Swimmer")
+	if _, err := db.GetActiveWorkout(ctx, userID); err != ErrWorkoutNotFound {
+		t.Errorf("GetActiveWorkout without a workout in progress returned %v", err)
+	}
+	session, err := db.StartWorkout(ctx, userID, testTime(t, 7, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = db.StartWorkout(ctx, userID, testTime(t, 7, 5)); err != ErrWorkoutInProgress {
+		t.Errorf("starting a second workout returned %v", err)
+	}
+	workoutID := session.Workout.ID
+
+	if _, err = db.UpdateWorkoutSession(ctx, otherID, workoutID, SessionPause, testTime(t, 7, 10)); err != ErrUserNotAuthorized {
+		t.Errorf("pausing another user's workout returned %v", err)
+	}
+	if _, err = db.UpdateWorkoutSession(ctx, userID, workoutID, SessionPause, testTime(t, 7, 10)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = db.UpdateWorkoutSession(ctx, userID, workoutID, SessionPause, testTime(t, 7, 11)); err != ErrWorkoutPaused {
+		t.Errorf("pausing a paused workout returned %v", err)
+	}
+	if _, err = db.UpdateWorkoutSession(ctx, userID, workoutID, SessionResume, testTime(t, 7, 20)); err != nil {
+		t.Fatal(err)
+	}
+	session, err = db.GetActiveWorkout(ctx, userID)
+	if err != nil || session.Workout.ID != workoutID || session.Paused || len(session.Pauses) != 1 {
+		t.Fatalf("GetActiveWorkout returned %+v, %v", session, err)
+	}
+	if pause := session.Pauses[0]; !pause.Start.Equal(testTime(t, 7, 10)) || pause.End == nil || !pause.End.Equal(testTime(t, 7, 20)) {
+		t.Errorf("the pause is %+v", pause)
+	}
+
+	if _, err = db.UpdateWorkoutSession(ctx, userID, workoutID, SessionFinish, testTime(t, 8, 0)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = db.GetActiveWorkout(ctx, userID); err != ErrWorkoutNotFound {
+		t.Errorf("GetActiveWorkout after finishing returned %v", err)
+	}
+	workouts, _ := db.GetWorkouts(ctx, userID)
+	if len(workouts) != 1 || !workouts[0].End.Equal(testTime(t, 8, 0)) {
+		t.Errorf("the finished workout is %+v", workouts)
+	}
+	if _, err = db.UpdateWorkoutSession(ctx, userID, workoutID+100, SessionFinish, testTime(t, 8, 0)); err != ErrWorkoutNotFound {
+		t.Errorf("finishing an unknown workout returned %v", err)
+	}
+}
+
+func testDatastoreWebhooks(t *testing.T, db Datastore) {
+	ctx := context.Background()
+	userID := addTestUser(t, db, "Runner")
+	otherID := addTestUser(t, db, "Swimmer")
+	webhook := Webhook{
+		User:    userID,
+		URL:     "https://example.com/hook",
+		Events:  []string{EventWorkoutCreated, EventWorkoutDeleted},
+		Secret:  "secret",
+		Created: time.Now(),
+	}
+	webhookID, err := db.AddWebhook(ctx, webhook)
+	if err != nil {
+		t.Fatal(err)
+	}
+	webhooks, err := db.GetWebhooks(ctx, userID)
+	if err != nil || len(webhooks) != 1 || webhooks[0].URL != webhook.URL || len(webhooks[0].Events) != 2 {
+		t.Errorf("GetWebhooks returned %+v, %v", webhooks, err)
+	}
+
+	err = db.QueueWebhookDeliveries(ctx, []WebhookEvent{
+		{User: userID, Type: EventWorkoutCreated, Payload: []byte(`{"event":"workout.created"}`)},
+		{User: userID, Type: EventWorkoutUpdated, Payload: []byte(`{"event":"workout.updated"}`)},
+		{User: otherID, Type: EventWorkoutCreated, Payload: []byte(`{"event":"workout.created"}`)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	deliveries, err := db.ClaimWebhookDeliveries(ctx, 10, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deliveries) != 1 || deliveries[0].Event != EventWorkoutCreated || deliveries[0].Secret != "secret" || deliveries[0].URL != webhook.URL {
+		t.Fatalf("claimed %+v, expected only the subscribed event", deliveries)
+	}
+	if claimed, _ := db.ClaimWebhookDeliveries(ctx, 10, time.Minute); len(claimed) != 0 {
+		t.Errorf("claimed deliveries were claimed again within their lease")
+	}
+
+	delivered := time.Now()
+	delivery := deliveries[0]
+	delivery.Status = DeliveryDelivered
+	delivery.Attempts = 1
+	delivery.ResponseCode = 200
+	delivery.Delivered = &delivered
+	if err = db.RecordWebhookAttempt(ctx, delivery); err != nil {
+		t.Fatal(err)
+	}
+	history, err := db.GetWebhookDeliveries(ctx, userID, webhookID, 10)
+	if err != nil || len(history) != 1 || history[0].Status != DeliveryDelivered || history[0].ResponseCode != 200 || history[0].Delivered == nil {
+		t.Errorf("GetWebhookDeliveries returned %+v, %v", history, err)
+	}
+	if _, err = db.GetWebhookDeliveries(ctx, otherID, webhookID, 10); err != ErrWebhookNotFound {
+		t.Errorf("listing another user's deliveries returned %v", err)
+	}
+
+	end := testTime(t, 8, 0)
+	ops := []BatchOperation{
+		{BatchCreate, Workout{User: userID, Start: testTime(t, 7, 0), End: &end}},
+		{BatchDelete, Workout{ID: -1, User: userID}},
+	}
+	failed := errors.New("failed")
+	_, err = db.BatchWorkouts(ctx, ops, func(results []BatchResult) ([]WebhookEvent, error) {
+		return nil, failed
+	})
+	if err != failed {
+		t.Errorf("a batch whose webhooks failed returned %v", err)
+	}
+	if workouts, _ := db.GetWorkouts(ctx, userID); len(workouts) != 0 {
+		t.Errorf("a batch whose webhooks failed added %v", workoutIDs(workouts))
+	}
+	_, err = db.BatchWorkouts(ctx, ops, func(results []BatchResult) ([]WebhookEvent, error) {
+		var events []WebhookEvent
+		for _, result := range results {
+			if result.Err == nil {
+				events = append(events, WebhookEvent{User: userID, Type: EventWorkoutCreated, Payload: []byte(`{}`)})
+			}
+		}
+		return events, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deliveries, err = db.ClaimWebhookDeliveries(ctx, 10, time.Minute); err != nil || len(deliveries) != 1 {
+		t.Errorf("claimed %+v, %v, expected the delivery for the one operation that was applied", deliveries, err)
+	}
+
+	if err = db.DeleteWebhook(ctx, otherID, webhookID); err != ErrWebhookNotFound {
+		t.Errorf("deleting another user's webhook returned %v", err)
+	}
+	if err = db.DeleteWebhook(ctx, userID, webhookID); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func testDatastoreCalendar(t *testing.T, db Datastore) {
+	ctx := context.Background()
+	userID := addTestUser(t, db, "Runner")
+	if err := db.SetCalendarToken(ctx, userID, "calendar"); err != nil {
+		t.Fatal(err)
+	}
+	if user, err := db.GetCalendarUser(ctx, "calendar"); err != nil || user.ID != userID {
+		t.Errorf("GetCalendarUser returned %+v, %v", user, err)
+	}
+	if err := db.SetCalendarToken(ctx, userID, ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.GetCalendarUser(ctx, "calendar"); err != ErrUserNotFound {
+		t.Errorf("a disabled feed returned %v", err)
+	}
+
+	planned := []PlannedWorkout{
+		{UID: "b", Summary: "Long run", Start: testTime(t, 9, 0), End: testTime(t, 11, 0)},
+		{UID: "a", Summary: "Intervals", Start: testTime(t, 7, 0), End: testTime(t, 8, 0)},
+	}
+	if err := db.ImportPlannedWorkouts(ctx, userID, planned); err != nil {
+		t.Fatal(err)
+	}
+	planned[0].Summary = "Longer run"
+	if err := db.ImportPlannedWorkouts(ctx, userID, planned[:1]); err != nil {
+		t.Fatal(err)
+	}
+	got, err := db.GetPlannedWorkouts(ctx, userID)
+	if err != nil || len(got) != 2 || got[0].UID != "a" || got[1].Summary != "Longer run" {
+		t.Errorf("GetPlannedWorkouts returned %+v, %v", got, err)
+	}
+}
+
+func testDatastoreImportJobs(t *testing.T, db Datastore) {
+	ctx := context.Background()
+	userID := addTestUser(t, db, "Runner")
+	otherID := addTestUser(t, db, "Swimmer")
+	created := time.Now().Add(-time.Hour)
+	job := ImportJob{
+		User:    userID,
+		Source:  ImportSourceStrava,
+		Status:  JobPending,
+		Errors:  make([]ImportError, 0),
+		Created: created,
+		Updated: created,
+		File:    "/tmp/export.zip",
+		Host:    "web-1",
+	}
+	jobID, err := db.AddImportJob(ctx, job)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if claimed, err := db.ClaimStaleImportJobs(ctx, "web-2", time.Minute); err != nil || len(claimed) != 0 {
+		t.Errorf("another host claimed %+v, %v", claimed, err)
+	}
+	claimed, err := db.ClaimStaleImportJobs(ctx, "web-1", time.Minute)
+	if err != nil || len(claimed) != 1 || claimed[0].ID != jobID || claimed[0].File != job.File || claimed[0].Host != job.Host || claimed[0].Status != JobRunning {
+		t.Fatalf("ClaimStaleImportJobs returned %+v, %v", claimed, err)
+	}
+	if again, _ := db.ClaimStaleImportJobs(ctx, "web-1", time.Minute); len(again) != 0 {
+		t.Errorf("a claimed job was claimed again within its lease")
+	}
+
+	job = claimed[0]
+	job.Processed = 10
+	job.Imported = 9
+	job.addError(ImportError{Record: 3, Field: "start", Message: "is invalid"})
+	job.Updated = time.Now()
+	if err = db.UpdateImportJob(ctx, job); err != nil {
+		t.Fatal(err)
+	}
+	got, err := db.GetImportJob(ctx, userID, jobID)
+	if err != nil || got.Processed != 10 || got.Imported != 9 || got.Failed != 1 || len(got.Errors) != 1 || got.Errors[0].Record != 3 {
+		t.Errorf("GetImportJob returned %+v, %v", got, err)
+	}
+	if _, err = db.GetImportJob(ctx, otherID, jobID); err != ErrImportJobNotFound {
+		t.Errorf("getting another user's job returned %v", err)
+	}
+	job.ID = jobID + 100
+	if err = db.UpdateImportJob(ctx, job); err != ErrImportJobNotFound {
+		t.Errorf("updating an unknown job returned %v", err)
+	}
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	log "github.com/sirupsen/logrus"
+)
+
+// Types of the events published when a user's workouts change.
+const (
+	EventWorkoutCreated  = "workout.created"
+	EventWorkoutUpdated  = "workout.updated"
+	EventWorkoutDeleted  = "workout.deleted"
+	EventWorkoutStarted  = "workout.started"
+	EventWorkoutPaused   = "workout.paused"
+	EventWorkoutResumed  = "workout.resumed"
+	EventWorkoutFinished = "workout.finished"
+)
+
+// sessionEvents maps the actions on a workout in progress to the events they publish.
+var sessionEvents = map[string]string{
+	SessionPause:  EventWorkoutPaused,
+	SessionResume: EventWorkoutResumed,
+	SessionFinish: EventWorkoutFinished,
+}
+
+const (
+	// eventHistory is the number of recent events kept for each user, which lets clients
+	// that reconnect with a Last-Event-ID header catch up on the events they missed.
+	eventHistory = 100
+	// eventBuffer is the number of events queued for a subscriber before it is considered
+	// too slow and disconnected.
+	eventBuffer = 32
+	// eventHeartbeat is how often a comment is sent to idle streams to keep proxies from
+	// closing them.
+	eventHeartbeat = 15 * time.Second
+)
+
+// EventHub passes the events published for each user on to the streams that user has
+// open. A nil hub discards all events.
+type EventHub struct {
+	mu          sync.Mutex
+	lastID      int64
+	history     map[int][]Event
+	subscribers map[int]map[chan Event]bool
+}
+
+// NewEventHub returns an empty event hub.
+func NewEventHub() *EventHub {
+	return &EventHub{
+		history:     make(map[int][]Event),
+		subscribers: make(map[int]map[chan Event]bool),
+	}
+}
+
+// Publish assigns the next ID to an event and sends it to every subscriber of the given
+// user. Subscribers whose queue is full are disconnected rather than holding up the
+// publisher.
+func (hub *EventHub) Publish(userID int, event Event) {
+	if hub == nil {
+		return
+	}
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+
+	hub.lastID++
+	event.ID = hub.lastID
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	history := append(hub.history[userID], event)
+	if len(history) > eventHistory {
+		history = history[len(history)-eventHistory:]
+	}
+	hub.history[userID] = history
+
+	for events := range hub.subscribers[userID] {
+		select {
+		case events <- event:
+		default:
+			hub.unsubscribe(userID, events)
+		}
+	}
+}
+
+// Subscribe registers a new subscriber for the given user's events. Along with the
+// channel the events are sent on, it returns the recent events published after lastID,
+// which the subscriber should handle first, and a function that cancels the subscription.
+func (hub *EventHub) Subscribe(userID int, lastID int64) (<-chan Event, []Event, func()) {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+
+	var missed []Event
+	if lastID > 0 {
+		for _, event := range hub.history[userID] {
+			if event.ID > lastID {
+				missed = append(missed, event)
+			}
+		}
+	}
+
+	events := make(chan Event, eventBuffer)
+	if hub.subscribers[userID] == nil {
+		hub.subscribers[userID] = make(map[chan Event]bool)
+	}
+	hub.subscribers[userID][events] = true
+	cancel := func() {
+		hub.mu.Lock()
+		defer hub.mu.Unlock()
+		hub.unsubscribe(userID, events)
+	}
+	return events, missed, cancel
+}
+
+// unsubscribe removes a subscriber and closes its channel. The hub must be locked.
+func (hub *EventHub) unsubscribe(userID int, events chan Event) {
+	if !hub.subscribers[userID][events] {
+		return
+	}
+	delete(hub.subscribers[userID], events)
+	if len(hub.subscribers[userID]) == 0 {
+		delete(hub.subscribers, userID)
+	}
+	close(events)
+}
+
+// userEvent is an event published about the workouts of a user.
+type userEvent struct {
+	User  int
+	Event Event
+}
+
+// publish sends an event about a user's workouts to their open event streams and queues
+// its delivery to their webhooks.
+func (env *Env) publish(userID int, event Event) {
+	event.Time = time.Now()
+	env.events.Publish(userID, event)
+	env.queueWebhooks(userID, event)
+}
+
+// workoutEvent returns an event of the given type about a workout.
+func workoutEvent(eventType string, workout Workout) Event {
+	// Events only go to the workout's owner, like the workouts returned by Login.
+	workout.User = 0
+	return Event{Type: eventType, WorkoutID: workout.ID, Workout: &workout}
+}
+
+// deletedEvent returns the event about a workout being deleted.
+func deletedEvent(workoutID int) Event {
+	return Event{Type: EventWorkoutDeleted, WorkoutID: workoutID}
+}
+
+// sessionEvent returns an event of the given type about a workout in progress.
+func sessionEvent(eventType string, session WorkoutSession) Event {
+	return Event{Type: eventType, WorkoutID: session.Workout.ID, Session: &session}
+}
+
+// StreamEvents streams the events published for the requesting user as Server-Sent
+// Events, so that every device they have open sees their workouts change without polling.
+// Clients reconnecting with a Last-Event-ID header first receive the recent events they
+// missed.
+func (env *Env) StreamEvents(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	user, ok := env.authenticate(w, r)
+	if !ok {
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok || env.events == nil {
+		InternalServerError(w, fmt.Errorf("event streaming is not supported by %T", w))
+		return
+	}
+	lastID, _ := strconv.ParseInt(r.Header.Get("Last-Event-ID"), 10, 64)
+
+	events, missed, cancel := env.events.Subscribe(user.ID, lastID)
+	defer cancel()
+	log.WithField("name", user.Name).Info("Opened event stream")
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	for _, event := range missed {
+		if writeEvent(w, event) != nil {
+			return
+		}
+	}
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(eventHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case event, open := <-events:
+			if !open {
+				// The stream fell behind, so the client has to reconnect and catch up.
+				log.WithField("name", user.Name).Warn("Closed slow event stream")
+				return
+			}
+			if writeEvent(w, event) != nil {
+				return
+			}
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": heartbeat\n\n"); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
+
+// writeEvent writes an event in the Server-Sent Events format.
+func writeEvent(w http.ResponseWriter, event Event) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.ID, event.Type, data)
+	return err
+}
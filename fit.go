@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"time"
+)
+
+// Reading the times of activities recorded in the Flexible and Interoperable Data
+// Transfer (FIT) format used by fitness devices.
+
+const (
+	// fitEpoch is the instant FIT timestamps count seconds from, 1989-12-31T00:00:00Z.
+	fitEpoch = 631065600
+	// fitTimestampField is the number of the timestamp field of every message type.
+	fitTimestampField = 253
+	// fitMinTimestamp is the smallest timestamp that is an instant rather than a number
+	// of seconds since the device was turned on.
+	fitMinTimestamp = 0x10000000
+	// fitInvalidTimestamp marks a timestamp that was not recorded.
+	fitInvalidTimestamp = 0xFFFFFFFF
+)
+
+var errInvalidFIT = errors.New("invalid FIT file")
+
+// fitField is the definition of a field of a FIT message.
+type fitField struct {
+	number byte
+	size   byte
+}
+
+// fitDefinition describes the layout of the data messages of a local message type.
+type fitDefinition struct {
+	order  binary.ByteOrder
+	fields []fitField
+	// extra is the size of the developer fields that follow the fields.
+	extra int
+}
+
+// fitTimes returns the earliest and latest timestamps of the messages in a FIT file, which
+// are the start and end of the activity it records.
+func fitTimes(r io.Reader) (time.Time, time.Time, error) {
+	reader := bufio.NewReader(r)
+	header := make([]byte, 12)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return time.Time{}, time.Time{}, errInvalidFIT
+	}
+	size := int(header[0])
+	if (size != 12 && size != 14) || !bytes.Equal(header[8:12], []byte(".FIT")) {
+		return time.Time{}, time.Time{}, errInvalidFIT
+	}
+	if _, err := reader.Discard(size - 12); err != nil {
+		return time.Time{}, time.Time{}, errInvalidFIT
+	}
+	data := io.LimitReader(reader, int64(binary.LittleEndian.Uint32(header[4:8])))
+
+	var definitions [16]*fitDefinition
+	var first, last, latest uint32
+	record := func(timestamp uint32) {
+		if timestamp < fitMinTimestamp || timestamp == fitInvalidTimestamp {
+			return
+		}
+		latest = timestamp
+		if first == 0 || timestamp < first {
+			first = timestamp
+		}
+		if timestamp > last {
+			last = timestamp
+		}
+	}
+
+	buffer := make([]byte, 255)
+	for {
+		var b [1]byte
+		if _, err := io.ReadFull(data, b[:]); err == io.EOF {
+			break
+		} else if err != nil {
+			return time.Time{}, time.Time{}, errInvalidFIT
+		}
+		recordHeader := b[0]
+
+		var local byte
+		switch {
+		case recordHeader&0x80 != 0:
+			// A compressed timestamp header gives the low five bits of the timestamp.
+			local = (recordHeader >> 5) & 0x03
+			offset := uint32(recordHeader & 0x1F)
+			timestamp := latest&^0x1F + offset
+			if offset < latest&0x1F {
+				timestamp += 0x20
+			}
+			if latest != 0 {
+				record(timestamp)
+			}
+		case recordHeader&0x40 != 0:
+			definition, err := readFITDefinition(data, recordHeader&0x20 != 0)
+			if err != nil {
+				return time.Time{}, time.Time{}, err
+			}
+			definitions[recordHeader&0x0F] = definition
+			continue
+		default:
+			local = recordHeader & 0x0F
+		}
+
+		definition := definitions[local]
+		if definition == nil {
+			return time.Time{}, time.Time{}, errInvalidFIT
+		}
+		for _, field := range definition.fields {
+			value := buffer[:field.size]
+			if _, err := io.ReadFull(data, value); err != nil {
+				return time.Time{}, time.Time{}, errInvalidFIT
+			}
+			if field.number == fitTimestampField && field.size == 4 {
+				record(definition.order.Uint32(value))
+			}
+		}
+		if _, err := io.CopyN(ioutil.Discard, data, int64(definition.extra)); err != nil {
+			return time.Time{}, time.Time{}, errInvalidFIT
+		}
+	}
+
+	if first == 0 {
+		return time.Time{}, time.Time{}, errors.New("the FIT file has no timestamps")
+	}
+	return time.Unix(fitEpoch+int64(first), 0).UTC(), time.Unix(fitEpoch+int64(last), 0).UTC(), nil
+}
+
+// readFITDefinition reads the content of a definition message.
+func readFITDefinition(r io.Reader, developer bool) (*fitDefinition, error) {
+	fixed := make([]byte, 5)
+	if _, err := io.ReadFull(r, fixed); err != nil {
+		return nil, errInvalidFIT
+	}
+	definition := &fitDefinition{order: binary.LittleEndian}
+	if fixed[1] == 1 {
+		definition.order = binary.BigEndian
+	}
+	fields := make([]byte, 3*int(fixed[4]))
+	if _, err := io.ReadFull(r, fields); err != nil {
+		return nil, errInvalidFIT
+	}
+	for i := 0; i < len(fields); i += 3 {
+		definition.fields = append(definition.fields, fitField{number: fields[i], size: fields[i+1]})
+	}
+
+	if developer {
+		var count [1]byte
+		if _, err := io.ReadFull(r, count[:]); err != nil {
+			return nil, errInvalidFIT
+		}
+		developerFields := make([]byte, 3*int(count[0]))
+		if _, err := io.ReadFull(r, developerFields); err != nil {
+			return nil, errInvalidFIT
+		}
+		for i := 0; i < len(developerFields); i += 3 {
+			definition.extra += int(developerFields[i+1])
+		}
+	}
+	return definition, nil
+}
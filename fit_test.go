@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+// fitBuilder writes the records of a FIT file.
+type fitBuilder struct {
+	records bytes.Buffer
+}
+
+// define writes a definition message for a local message type. developer lists the sizes
+// of its developer fields, if it has any.
+func (b *fitBuilder) define(local byte, order binary.ByteOrder, fields []fitField, developer ...byte) {
+	header := 0x40 | local
+	if developer != nil {
+		header |= 0x20
+	}
+	architecture := byte(0)
+	if order == binary.BigEndian {
+		architecture = 1
+	}
+	b.records.Write([]byte{header, 0, architecture, 20, 0, byte(len(fields))})
+	for _, field := range fields {
+		b.records.Write([]byte{field.number, field.size, 0x86})
+	}
+	if developer != nil {
+		b.records.WriteByte(byte(len(developer)))
+		for i, size := range developer {
+			b.records.Write([]byte{byte(i), size, 0})
+		}
+	}
+}
+
+// message writes a data message with the given record header and field values.
+func (b *fitBuilder) message(header byte, values ...[]byte) {
+	b.records.WriteByte(header)
+	for _, value := range values {
+		b.records.Write(value)
+	}
+}
+
+// file returns the FIT file of the records, with a header of the given size and a CRC,
+// which is not checked.
+func (b *fitBuilder) file(headerSize byte) []byte {
+	header := make([]byte, headerSize)
+	header[0] = headerSize
+	header[1] = 0x20
+	binary.LittleEndian.PutUint32(header[4:8], uint32(b.records.Len()))
+	copy(header[8:12], ".FIT")
+	return append(append(header, b.records.Bytes()...), 0, 0)
+}
+
+func fitValue(order binary.ByteOrder, value uint32) []byte {
+	encoded := make([]byte, 4)
+	order.PutUint32(encoded, value)
+	return encoded
+}
+
+func fitTime(timestamp uint32) time.Time {
+	return time.Unix(fitEpoch+int64(timestamp), 0).UTC()
+}
+
+func TestFITTimes(t *testing.T) {
+	// start is 1 March 2019 at 13:00 UTC with its lowest five bits set to 10, so that
+	// compressed timestamps roll over.
+	start := uint32(time.Date(2019, time.March, 1, 13, 0, 0, 0, time.UTC).Unix()-fitEpoch)&^0x1F + 10
+	timestamped := []fitField{{number: fitTimestampField, size: 4}, {number: 3, size: 1}}
+	heartRate := []fitField{{number: 3, size: 1}}
+	le, be := binary.LittleEndian, binary.BigEndian
+
+	for _, test := range []struct {
+		name       string
+		build      func(b *fitBuilder)
+		headerSize byte
+		start, end uint32
+	}{{
+		name: "little-endian",
+		build: func(b *fitBuilder) {
+			b.define(0, le, timestamped)
+			b.message(0, fitValue(le, start+60), []byte{120})
+			b.message(0, fitValue(le, start+1800), []byte{150})
+			// Summary messages come last, but can start earlier than any record.
+			b.message(0, fitValue(le, start), []byte{0})
+		},
+		headerSize: 14,
+		start:      start,
+		end:        start + 1800,
+	}, {
+		name: "big-endian",
+		build: func(b *fitBuilder) {
+			b.define(2, be, timestamped)
+			b.message(2, fitValue(be, start), []byte{120})
+			b.message(2, fitValue(be, start+3600), []byte{120})
+		},
+		headerSize: 12,
+		start:      start,
+		end:        start + 3600,
+	}, {
+		name: "compressed timestamps",
+		build: func(b *fitBuilder) {
+			b.define(0, le, timestamped)
+			b.define(1, le, heartRate)
+			b.message(0x80|1<<5|20, []byte{120})
+			b.message(0, fitValue(le, start), []byte{120})
+			b.message(0x80|1<<5|20, []byte{130})
+			b.message(0x80|1<<5|5, []byte{140})
+		},
+		headerSize: 14,
+		start:      start,
+		end:        start + 27,
+	}, {
+		name: "developer fields",
+		build: func(b *fitBuilder) {
+			b.define(0, le, timestamped, 2, 3)
+			b.message(0, fitValue(le, start), []byte{120}, []byte{0xFD, 0, 0xFD, 0xFD, 0})
+			b.message(0, fitValue(le, start+600), []byte{120}, []byte{1, 2, 3, 4, 5})
+		},
+		headerSize: 14,
+		start:      start,
+		end:        start + 600,
+	}, {
+		name: "unrecorded and relative timestamps",
+		build: func(b *fitBuilder) {
+			b.define(0, le, timestamped)
+			b.message(0, fitValue(le, fitInvalidTimestamp), []byte{0})
+			b.message(0, fitValue(le, 3600), []byte{0})
+			b.message(0, fitValue(le, start), []byte{120})
+			b.message(0, fitValue(le, start+900), []byte{120})
+			b.message(0, fitValue(le, fitMinTimestamp-1), []byte{0})
+		},
+		headerSize: 14,
+		start:      start,
+		end:        start + 900,
+	}} {
+		t.Run(test.name, func(t *testing.T) {
+			var b fitBuilder
+			test.build(&b)
+			first, last, err := fitTimes(bytes.NewReader(b.file(test.headerSize)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !first.Equal(fitTime(test.start)) || !last.Equal(fitTime(test.end)) {
+				t.Errorf("activity is from %v to %v, expected %v to %v", first, last, fitTime(test.start), fitTime(test.end))
+			}
+		})
+	}
+}
+
+func TestInvalidFITFiles(t *testing.T) {
+	le := binary.LittleEndian
+	start := uint32(time.Date(2019, time.March, 1, 13, 0, 0, 0, time.UTC).Unix() - fitEpoch)
+	timestamped := []fitField{{number: fitTimestampField, size: 4}}
+	valid := func() *fitBuilder {
+		var b fitBuilder
+		b.define(0, le, timestamped)
+		b.message(0, fitValue(le, start))
+		return &b
+	}
+
+	truncated := valid().file(14)
+	binary.LittleEndian.PutUint32(truncated[4:8], uint32(len(truncated)))
+	wrongType := valid().file(14)
+	copy(wrongType[8:12], ".GPX")
+	undefined := valid()
+	undefined.message(1, fitValue(le, start))
+	noTimestamps := &fitBuilder{}
+	noTimestamps.define(0, le, []fitField{{number: 3, size: 1}})
+	noTimestamps.message(0, []byte{120})
+
+	for _, test := range []struct {
+		name, message string
+		data          []byte
+	}{
+		{"empty", errInvalidFIT.Error(), nil},
+		{"short header", errInvalidFIT.Error(), valid().file(14)[:10]},
+		{"header size", errInvalidFIT.Error(), valid().file(13)},
+		{"wrong type", errInvalidFIT.Error(), wrongType},
+		{"truncated", errInvalidFIT.Error(), truncated},
+		{"undefined message", errInvalidFIT.Error(), undefined.file(14)},
+		{"no timestamps", "the FIT file has no timestamps", noTimestamps.file(14)},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			_, _, err := fitTimes(bytes.NewReader(test.data))
+			if err == nil || err.Error() != test.message {
+				t.Errorf("error is %v, expected %s", err, test.message)
+			}
+		})
+	}
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	log "github.com/sirupsen/logrus"
+)
+
+// defaultGoalPeriods is the number of periods of history returned for each goal when no
+// count is given.
+const defaultGoalPeriods = 12
+
+// GetGoals returns the goals of the requesting user.
+func (env *Env) GetGoals(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	user, ok := env.authenticate(w, r)
+	if !ok {
+		return
+	}
+	goals, err := env.db.GetGoals(r.Context(), user.ID)
+	if err != nil {
+		InternalServerError(w, err)
+		return
+	}
+	WriteJSON(w, http.StatusOK, goals)
+}
+
+// AddGoal adds a goal for the requesting user.
+func (env *Env) AddGoal(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	user, ok := env.authenticate(w, r)
+	if !ok {
+		return
+	}
+	var goal Goal
+	if !decodeJSON(w, r, maxBodyBytes, &goal) || !validRequest(w, goal.validateNew()) {
+		return
+	}
+
+	goal.User = user.ID
+	goalID, err := env.db.AddGoal(r.Context(), goal)
+	if err != nil {
+		InternalServerError(w, err)
+		return
+	}
+	log.WithFields(log.Fields{
+		"name":   user.Name,
+		"metric": goal.Metric,
+		"period": goal.Period,
+	}).Info("Added goal")
+	WriteJSON(w, http.StatusCreated, map[string]int{"id": goalID})
+}
+
+// UpdateGoal replaces the goal specified in the request body.
+func (env *Env) UpdateGoal(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	user, ok := env.authenticate(w, r)
+	if !ok {
+		return
+	}
+	var goal Goal
+	if !decodeJSON(w, r, maxBodyBytes, &goal) || !validRequest(w, goal.validateUpdate()) {
+		return
+	}
+
+	goal.User = user.ID
+	err := env.db.UpdateGoal(r.Context(), goal)
+	switch {
+	case err == ErrGoalNotFound:
+		WriteErrorCode(
+			w,
+			http.StatusNotFound,
+			err,
+			ErrCodeGoalNotFound,
+			"The specified goal could not be found",
+		)
+		return
+	case err != nil:
+		InternalServerError(w, err)
+		return
+	}
+	log.WithFields(log.Fields{
+		"name": user.Name,
+		"goal": goal.ID,
+	}).Info("Updated goal")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// DeleteGoal deletes the goal specified in the URL parameter.
+func (env *Env) DeleteGoal(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	user, ok := env.authenticate(w, r)
+	if !ok {
+		return
+	}
+	goalID, err := strconv.Atoi(ps.ByName("id"))
+	if err != nil {
+		WriteValidationError(w, err, "Invalid goal", []FieldError{{"id", "must be an integer"}})
+		return
+	}
+
+	err = env.db.DeleteGoal(r.Context(), user.ID, goalID)
+	switch {
+	case err == ErrGoalNotFound:
+		WriteErrorCode(
+			w,
+			http.StatusNotFound,
+			err,
+			ErrCodeGoalNotFound,
+			"The specified goal could not be found",
+		)
+		return
+	case err != nil:
+		InternalServerError(w, err)
+		return
+	}
+	log.WithFields(log.Fields{
+		"name": user.Name,
+		"goal": goalID,
+	}).Info("Deleted goal")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// GetGoalProgress returns the completion history of each of the requesting user's goals
+// over the last few periods, computed from their workouts. The optional query parameters
+// are periods, the number of weeks or months of history including the current one, and
+// tz.
+func (env *Env) GetGoalProgress(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	user, ok := env.authenticate(w, r)
+	if !ok {
+		return
+	}
+	params := r.URL.Query()
+	periods, problems := parseInt(params, "periods", defaultGoalPeriods, 1, 104)
+	location, tzProblems := parseTimeZone(params)
+	if !validRequest(w, append(problems, tzProblems...)) {
+		return
+	}
+
+	goals, err := env.db.GetGoals(r.Context(), user.ID)
+	if err != nil {
+		InternalServerError(w, err)
+		return
+	}
+
+	// Load the workouts covering the history of every goal at once.
+	now := time.Now().In(location)
+	var from, to time.Time
+	for _, goal := range goals {
+		current := bucketStart(now, goal.Period)
+		if start := addBuckets(current, goal.Period, 1-periods); from.IsZero() || start.Before(from) {
+			from = start
+		}
+		if end := addBuckets(current, goal.Period, 1); end.After(to) {
+			to = end
+		}
+	}
+	var workouts []Workout
+	if len(goals) > 0 {
+		if workouts, err = env.db.GetWorkoutsBetween(r.Context(), user.ID, from, to); err != nil {
+			InternalServerError(w, err)
+			return
+		}
+	}
+
+	progress := make([]GoalProgress, len(goals))
+	for i, goal := range goals {
+		progress[i] = ComputeGoalProgress(goal, workouts, now, periods)
+	}
+	WriteJSON(w, http.StatusOK, progress)
+}
+
+// ComputeGoalProgress computes the progress made towards a goal in each of the given
+// number of periods up to and including the one containing now, which also determines
+// the calendar that periods follow. Workouts count towards the period they started in.
+func ComputeGoalProgress(goal Goal, workouts []Workout, now time.Time, periods int) GoalProgress {
+	progress := GoalProgress{Goal: goal, Periods: make([]GoalPeriod, periods)}
+	first := addBuckets(bucketStart(now, goal.Period), goal.Period, 1-periods)
+	for i := range progress.Periods {
+		progress.Periods[i].Start = addBuckets(first, goal.Period, i)
+		progress.Periods[i].End = addBuckets(first, goal.Period, i+1)
+	}
+
+	for _, workout := range workouts {
+		for i := range progress.Periods {
+			period := &progress.Periods[i]
+			if workout.Start.Before(period.Start) || !workout.Start.Before(period.End) {
+				continue
+			}
+			if goal.Metric == GoalMinutes {
+				period.Value += workout.Duration().Minutes()
+			} else {
+				period.Value++
+			}
+			break
+		}
+	}
+
+	for i := range progress.Periods {
+		period := &progress.Periods[i]
+		period.Percent = 100 * period.Value / float64(goal.Target)
+		period.Completed = period.Value >= float64(goal.Target)
+		if period.Completed {
+			progress.Completed++
+		}
+	}
+	return progress
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestComputeGoalProgress(t *testing.T) {
+	toronto := testLocation(t)
+	at := func(year int, month time.Month, day, hour, minute int) time.Time {
+		return time.Date(year, month, day, hour, minute, 0, 0, toronto)
+	}
+	weekly := Goal{ID: 1, Metric: GoalWorkouts, Period: BucketWeek, Target: 2}
+	monthly := Goal{ID: 2, Metric: GoalMinutes, Period: BucketMonth, Target: 60}
+	const layout = "2006-01-02 15:04 MST"
+
+	for _, test := range []struct {
+		name     string
+		goal     Goal
+		workouts []Workout
+		now      time.Time
+		// starts are the expected starts of each period, the last of which ends where the
+		// one in progress begins.
+		starts    []string
+		end       string
+		values    []float64
+		completed int
+	}{{
+		name:   "empty history",
+		goal:   weekly,
+		now:    at(2019, time.March, 6, 12, 0),
+		starts: []string{"2019-02-18 00:00 EST", "2019-02-25 00:00 EST", "2019-03-04 00:00 EST"},
+		end:    "2019-03-11 00:00 EDT",
+		values: []float64{0, 0, 0},
+	}, {
+		// 30 December 2019 is the Monday starting the first ISO week of 2020.
+		name: "weeks across a new year",
+		goal: weekly,
+		workouts: []Workout{
+			testWorkout(at(2019, time.December, 29, 23, 30), time.Hour),
+			testWorkout(at(2019, time.December, 30, 0, 15), time.Hour),
+			testWorkout(at(2020, time.January, 1, 9, 0), time.Hour),
+			testWorkout(at(2020, time.January, 6, 0, 0), time.Hour),
+		},
+		now:       at(2020, time.January, 2, 12, 0),
+		starts:    []string{"2019-12-23 00:00 EST", "2019-12-30 00:00 EST"},
+		end:       "2020-01-06 00:00 EST",
+		values:    []float64{1, 2},
+		completed: 1,
+	}, {
+		// The week of 4 March is an hour shorter because clocks went forward on 10 March.
+		name: "week with daylight saving time",
+		goal: weekly,
+		workouts: []Workout{
+			testWorkout(at(2019, time.March, 4, 0, 0), time.Hour),
+			testWorkout(at(2019, time.March, 10, 23, 30), time.Hour),
+			testWorkout(at(2019, time.March, 11, 0, 0), time.Hour),
+		},
+		now:       at(2019, time.March, 11, 12, 0),
+		starts:    []string{"2019-03-04 00:00 EST", "2019-03-11 00:00 EDT"},
+		end:       "2019-03-18 00:00 EDT",
+		values:    []float64{2, 1},
+		completed: 1,
+	}, {
+		name: "months with daylight saving time",
+		goal: monthly,
+		workouts: []Workout{
+			testWorkout(at(2019, time.February, 28, 23, 30), 40*time.Minute),
+			testWorkout(at(2019, time.March, 10, 3, 0), 30*time.Minute),
+			testWorkout(at(2019, time.March, 31, 23, 59), 30*time.Minute),
+			testWorkout(at(2019, time.April, 1, 0, 0), 90*time.Minute),
+		},
+		now:       at(2019, time.March, 31, 23, 59),
+		starts:    []string{"2019-02-01 00:00 EST", "2019-03-01 00:00 EST"},
+		end:       "2019-04-01 00:00 EDT",
+		values:    []float64{40, 60},
+		completed: 1,
+	}} {
+		t.Run(test.name, func(t *testing.T) {
+			progress := ComputeGoalProgress(test.goal, test.workouts, test.now, len(test.starts))
+			if progress.Goal != test.goal {
+				t.Errorf("progress is towards %+v", progress.Goal)
+			}
+			if len(progress.Periods) != len(test.starts) {
+				t.Fatalf("progress has %d periods, expected %d", len(progress.Periods), len(test.starts))
+			}
+			for i, period := range progress.Periods {
+				end := test.end
+				if i+1 < len(test.starts) {
+					end = test.starts[i+1]
+				}
+				if start := period.Start.Format(layout); start != test.starts[i] || period.End.Format(layout) != end {
+					t.Errorf("period %d is from %s to %s, expected %s to %s", i, start, period.End.Format(layout), test.starts[i], end)
+				}
+
+				value := test.values[i]
+				if period.Value != value || !closeTo(period.Percent, 100*value/float64(test.goal.Target)) || period.Completed != (value >= float64(test.goal.Target)) {
+					t.Errorf("period %d is %+v, expected a value of %v", i, period, value)
+				}
+			}
+			if progress.Completed != test.completed {
+				t.Errorf("%d periods are completed, expected %d", progress.Completed, test.completed)
+			}
+		})
+	}
+}
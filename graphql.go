@@ -0,0 +1,972 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+/*
+A minimal GraphQL engine supporting the query subset used by our clients: named or
+anonymous queries, aliases, arguments, variables, fragments, __typename and the
+__schema and __type introspection fields. Mutations, subscriptions and directives are
+not supported.
+*/
+
+/* Documents */
+
+type gqlDocument struct {
+	operations []*gqlOperation
+	fragments  map[string]*gqlFragment
+}
+
+type gqlOperation struct {
+	name       string
+	variables  []gqlVariableDefinition
+	selections []*gqlSelection
+}
+
+type gqlVariableDefinition struct {
+	name         string
+	nonNull      bool
+	defaultValue interface{}
+}
+
+type gqlFragment struct {
+	typeCondition string
+	selections    []*gqlSelection
+}
+
+// gqlSelection is either a field, a fragment spread (fragment is set) or an inline
+// fragment (selections is set without a name).
+type gqlSelection struct {
+	alias         string
+	name          string
+	arguments     map[string]interface{}
+	selections    []*gqlSelection
+	fragment      string
+	typeCondition string
+}
+
+func (s *gqlSelection) isField() bool {
+	return s.name != ""
+}
+
+func (s *gqlSelection) responseKey() string {
+	if s.alias != "" {
+		return s.alias
+	}
+	return s.name
+}
+
+// gqlVariable is an argument value referring to a variable of the operation.
+type gqlVariable string
+
+/* Lexing */
+
+type gqlTokenKind int
+
+const (
+	gqlEOF gqlTokenKind = iota
+	gqlPunctuator
+	gqlName
+	gqlInt
+	gqlFloat
+	gqlString
+)
+
+type gqlToken struct {
+	kind  gqlTokenKind
+	value string
+	pos   int
+}
+
+func gqlLex(source string) ([]gqlToken, error) {
+	var tokens []gqlToken
+	i := 0
+	for i < len(source) {
+		c := source[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == ',':
+			i++
+		case c == '#':
+			for i < len(source) && source[i] != '\n' {
+				i++
+			}
+		case strings.IndexByte("!$():=@[]{}|&", c) >= 0:
+			tokens = append(tokens, gqlToken{gqlPunctuator, string(c), i})
+			i++
+		case c == '.':
+			if !strings.HasPrefix(source[i:], "...") {
+				return nil, fmt.Errorf("unexpected '.' at position %d", i)
+			}
+			tokens = append(tokens, gqlToken{gqlPunctuator, "...", i})
+			i += 3
+		case c == '_' || isLetter(c):
+			start := i
+			for i < len(source) && (source[i] == '_' || isLetter(source[i]) || isDigit(source[i])) {
+				i++
+			}
+			tokens = append(tokens, gqlToken{gqlName, source[start:i], start})
+		case c == '-' || isDigit(c):
+			start := i
+			kind := gqlInt
+			i++
+			for i < len(source) && (isDigit(source[i]) || strings.IndexByte(".eE+-", source[i]) >= 0) {
+				if strings.IndexByte(".eE", source[i]) >= 0 {
+					kind = gqlFloat
+				}
+				i++
+			}
+			tokens = append(tokens, gqlToken{kind, source[start:i], start})
+		case c == '"':
+			value, end, err := gqlLexString(source, i)
+			if err != nil {
+				return nil, err
+			}
+			tokens = append(tokens, gqlToken{gqlString, value, i})
+			i = end
+		default:
+			r, _ := utf8.DecodeRuneInString(source[i:])
+			return nil, fmt.Errorf("unexpected character %q at position %d", r, i)
+		}
+	}
+	return append(tokens, gqlToken{gqlEOF, "", len(source)}), nil
+}
+
+// gqlLexString reads the string literal starting at source[start], returning its value and
+// the position following it. Strings use the same escapes as JSON.
+func gqlLexString(source string, start int) (string, int, error) {
+	if strings.HasPrefix(source[start:], `"""`) {
+		end := strings.Index(source[start+3:], `"""`)
+		if end < 0 {
+			return "", 0, fmt.Errorf("unterminated string at position %d", start)
+		}
+		return source[start+3 : start+3+end], start + 3 + end + 3, nil
+	}
+
+	for i := start + 1; i < len(source); i++ {
+		switch source[i] {
+		case '\\':
+			i++
+		case '\n':
+			return "", 0, fmt.Errorf("unterminated string at position %d", start)
+		case '"':
+			var value string
+			if err := json.Unmarshal([]byte(source[start:i+1]), &value); err != nil {
+				return "", 0, fmt.Errorf("invalid string at position %d", start)
+			}
+			return value, i + 1, nil
+		}
+	}
+	return "", 0, fmt.Errorf("unterminated string at position %d", start)
+}
+
+func isLetter(c byte) bool {
+	return ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z')
+}
+
+func isDigit(c byte) bool {
+	return '0' <= c && c <= '9'
+}
+
+/* Parsing */
+
+type gqlParser struct {
+	tokens []gqlToken
+	pos    int
+	// maxDepth bounds the nesting of selection sets and values, so that a document
+	// cannot make the parser recurse without limit before it is validated. Selection
+	// sets of introspection fields and fragments on introspection types are bounded by
+	// maxIntrospectionDepth instead.
+	maxDepth              int
+	maxIntrospectionDepth int
+}
+
+// parseGraphQL parses a query document, failing if its selection sets or values are nested
+// deeper than the limits allow.
+func parseGraphQL(source string, limits gqlLimits) (*gqlDocument, error) {
+	tokens, err := gqlLex(source)
+	if err != nil {
+		return nil, err
+	}
+	p := &gqlParser{tokens: tokens, maxDepth: limits.MaxDepth, maxIntrospectionDepth: limits.MaxIntrospectionDepth}
+	doc := &gqlDocument{fragments: make(map[string]*gqlFragment)}
+
+	for p.peek().kind != gqlEOF {
+		switch {
+		case p.peekValue("{"):
+			selections, err := p.parseSelectionSet(1, false)
+			if err != nil {
+				return nil, err
+			}
+			doc.operations = append(doc.operations, &gqlOperation{selections: selections})
+		case p.peekValue("query"):
+			operation, err := p.parseOperation()
+			if err != nil {
+				return nil, err
+			}
+			doc.operations = append(doc.operations, operation)
+		case p.peekValue("fragment"):
+			name, fragment, err := p.parseFragment()
+			if err != nil {
+				return nil, err
+			}
+			if _, ok := doc.fragments[name]; ok {
+				return nil, fmt.Errorf("fragment '%s' is defined more than once", name)
+			}
+			doc.fragments[name] = fragment
+		case p.peekValue("mutation") || p.peekValue("subscription"):
+			return nil, fmt.Errorf("%s operations are not supported", p.peek().value)
+		default:
+			return nil, p.unexpected()
+		}
+	}
+	if len(doc.operations) == 0 {
+		return nil, errors.New("the document does not contain an operation")
+	}
+	return doc, nil
+}
+
+func (p *gqlParser) peek() gqlToken {
+	return p.tokens[p.pos]
+}
+
+func (p *gqlParser) peekValue(value string) bool {
+	token := p.peek()
+	return (token.kind == gqlPunctuator || token.kind == gqlName) && token.value == value
+}
+
+func (p *gqlParser) next() gqlToken {
+	token := p.tokens[p.pos]
+	if token.kind != gqlEOF {
+		p.pos++
+	}
+	return token
+}
+
+func (p *gqlParser) unexpected() error {
+	token := p.peek()
+	if token.kind == gqlEOF {
+		return errors.New("unexpected end of document")
+	}
+	return fmt.Errorf("unexpected '%s' at position %d", token.value, token.pos)
+}
+
+func (p *gqlParser) expect(value string) error {
+	if !p.peekValue(value) {
+		return p.unexpected()
+	}
+	p.next()
+	return nil
+}
+
+func (p *gqlParser) expectName() (string, error) {
+	if p.peek().kind != gqlName {
+		return "", p.unexpected()
+	}
+	return p.next().value, nil
+}
+
+func (p *gqlParser) parseOperation() (*gqlOperation, error) {
+	p.next() // query
+	operation := &gqlOperation{}
+	if p.peek().kind == gqlName {
+		operation.name = p.next().value
+	}
+
+	if p.peekValue("(") {
+		p.next()
+		for !p.peekValue(")") {
+			definition, err := p.parseVariableDefinition()
+			if err != nil {
+				return nil, err
+			}
+			operation.variables = append(operation.variables, definition)
+		}
+		p.next()
+	}
+	if p.peekValue("@") {
+		return nil, errors.New("directives are not supported")
+	}
+
+	selections, err := p.parseSelectionSet(1, false)
+	operation.selections = selections
+	return operation, err
+}
+
+func (p *gqlParser) parseVariableDefinition() (gqlVariableDefinition, error) {
+	definition := gqlVariableDefinition{}
+	if err := p.expect("$"); err != nil {
+		return definition, err
+	}
+	name, err := p.expectName()
+	if err != nil {
+		return definition, err
+	}
+	definition.name = name
+	if err = p.expect(":"); err != nil {
+		return definition, err
+	}
+
+	// Only the nullability of the type is used; values are checked when they are read
+	// by a resolver.
+	depth := 0
+	for {
+		switch {
+		case p.peekValue("["):
+			depth++
+			p.next()
+			continue
+		case p.peek().kind == gqlName:
+			p.next()
+		default:
+			return definition, p.unexpected()
+		}
+		break
+	}
+	for ; depth >= 0; depth-- {
+		definition.nonNull = p.peekValue("!")
+		if definition.nonNull {
+			p.next()
+		}
+		if depth > 0 {
+			if err = p.expect("]"); err != nil {
+				return definition, err
+			}
+		}
+	}
+
+	if p.peekValue("=") {
+		p.next()
+		definition.defaultValue, err = p.parseValue(true, 1)
+	}
+	return definition, err
+}
+
+func (p *gqlParser) parseFragment() (string, *gqlFragment, error) {
+	p.next() // fragment
+	name, err := p.expectName()
+	if err != nil {
+		return "", nil, err
+	}
+	if err = p.expect("on"); err != nil {
+		return "", nil, err
+	}
+	typeCondition, err := p.expectName()
+	if err != nil {
+		return "", nil, err
+	}
+	selections, err := p.parseSelectionSet(1, isIntrospectionType(typeCondition))
+	return name, &gqlFragment{typeCondition, selections}, err
+}
+
+// parseSelectionSet parses a selection set at the given depth, which is counted as the
+// validator counts it: fragments do not add to the depth of their selections.
+// introspection is set within introspection fields.
+func (p *gqlParser) parseSelectionSet(depth int, introspection bool) ([]*gqlSelection, error) {
+	maxDepth := p.maxDepth
+	if introspection {
+		maxDepth = p.maxIntrospectionDepth
+	}
+	if depth > maxDepth {
+		return nil, gqlDepthError(maxDepth)
+	}
+	if err := p.expect("{"); err != nil {
+		return nil, err
+	}
+	var selections []*gqlSelection
+	for !p.peekValue("}") {
+		selection, err := p.parseSelection(depth, introspection)
+		if err != nil {
+			return nil, err
+		}
+		selections = append(selections, selection)
+	}
+	p.next()
+	if len(selections) == 0 {
+		return nil, errors.New("selection sets may not be empty")
+	}
+	return selections, nil
+}
+
+func (p *gqlParser) parseSelection(depth int, introspection bool) (*gqlSelection, error) {
+	if p.peekValue("...") {
+		p.next()
+		if p.peekValue("on") || p.peekValue("{") {
+			selection := &gqlSelection{}
+			if p.peekValue("on") {
+				p.next()
+				typeCondition, err := p.expectName()
+				if err != nil {
+					return nil, err
+				}
+				selection.typeCondition = typeCondition
+			}
+			selections, err := p.parseSelectionSet(depth, introspection || isIntrospectionType(selection.typeCondition))
+			selection.selections = selections
+			return selection, err
+		}
+		name, err := p.expectName()
+		return &gqlSelection{fragment: name}, err
+	}
+
+	name, err := p.expectName()
+	if err != nil {
+		return nil, err
+	}
+	selection := &gqlSelection{name: name}
+	if p.peekValue(":") {
+		p.next()
+		selection.alias = name
+		if selection.name, err = p.expectName(); err != nil {
+			return nil, err
+		}
+	}
+
+	if p.peekValue("(") {
+		p.next()
+		selection.arguments = make(map[string]interface{})
+		for !p.peekValue(")") {
+			argument, err := p.expectName()
+			if err != nil {
+				return nil, err
+			}
+			if err = p.expect(":"); err != nil {
+				return nil, err
+			}
+			if selection.arguments[argument], err = p.parseValue(false, 1); err != nil {
+				return nil, err
+			}
+		}
+		p.next()
+	}
+	if p.peekValue("@") {
+		return nil, errors.New("directives are not supported")
+	}
+
+	if p.peekValue("{") {
+		introspection = introspection || selection.name == "__schema" || selection.name == "__type"
+		selection.selections, err = p.parseSelectionSet(depth+1, introspection)
+	}
+	return selection, err
+}
+
+// parseValue parses a value nested at the given depth within lists and input objects.
+func (p *gqlParser) parseValue(constant bool, depth int) (interface{}, error) {
+	if depth > p.maxDepth {
+		return nil, gqlDepthError(p.maxDepth)
+	}
+	token := p.next()
+	switch {
+	case token.kind == gqlPunctuator && token.value == "$" && !constant:
+		name, err := p.expectName()
+		return gqlVariable(name), err
+	case token.kind == gqlPunctuator && token.value == "[":
+		list := make([]interface{}, 0)
+		for !p.peekValue("]") {
+			value, err := p.parseValue(constant, depth+1)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, value)
+		}
+		p.next()
+		return list, nil
+	case token.kind == gqlPunctuator && token.value == "{":
+		object := make(map[string]interface{})
+		for !p.peekValue("}") {
+			name, err := p.expectName()
+			if err != nil {
+				return nil, err
+			}
+			if err = p.expect(":"); err != nil {
+				return nil, err
+			}
+			if object[name], err = p.parseValue(constant, depth+1); err != nil {
+				return nil, err
+			}
+		}
+		p.next()
+		return object, nil
+	case token.kind == gqlInt:
+		value, err := strconv.ParseInt(token.value, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid integer '%s' at position %d", token.value, token.pos)
+		}
+		return float64(value), nil
+	case token.kind == gqlFloat:
+		value, err := strconv.ParseFloat(token.value, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number '%s' at position %d", token.value, token.pos)
+		}
+		return value, nil
+	case token.kind == gqlString:
+		return token.value, nil
+	case token.kind == gqlName && token.value == "true":
+		return true, nil
+	case token.kind == gqlName && token.value == "false":
+		return false, nil
+	case token.kind == gqlName && token.value == "null":
+		return nil, nil
+	case token.kind == gqlName:
+		// Enum values are treated as strings.
+		return token.value, nil
+	case token.kind == gqlEOF:
+		return nil, errors.New("unexpected end of document")
+	default:
+		return nil, fmt.Errorf("unexpected '%s' at position %d", token.value, token.pos)
+	}
+}
+
+/* Schema */
+
+// gqlResolver resolves the value of a field given the value of its parent object and the
+// field's arguments.
+type gqlResolver func(ctx *gqlContext, source interface{}, args gqlArguments) (interface{}, error)
+
+// gqlField describes a single field of an object type. Type is the name of the object
+// type, scalar or enum that the field resolves to, or that the items of a list field
+// resolve to. Items of lists are never null, and NonNull is set for fields that are not.
+type gqlField struct {
+	Type      string
+	List      bool
+	NonNull   bool
+	Arguments []gqlArgument
+	Resolve   gqlResolver
+}
+
+// gqlArgument describes an argument of a field. Type is the name of a scalar.
+type gqlArgument struct {
+	Name    string
+	Type    string
+	NonNull bool
+}
+
+// argument returns the argument of the field with the given name.
+func (field gqlField) argument(name string) (gqlArgument, bool) {
+	for _, argument := range field.Arguments {
+		if argument.Name == name {
+			return argument, true
+		}
+	}
+	return gqlArgument{}, false
+}
+
+// gqlSchema maps the name of each object type to its fields. The root type is "Query".
+type gqlSchema map[string]map[string]gqlField
+
+// isObject reports whether the named type is an object type of the schema rather than a
+// scalar or enum.
+func (schema gqlSchema) isObject(name string) bool {
+	_, ok := schema[name]
+	return ok
+}
+
+// gqlLimits restricts the size of the queries that will be executed.
+type gqlLimits struct {
+	MaxDepth      int
+	MaxComplexity int
+	// ListFactor is the number of items assumed to be returned by a list field when
+	// computing the complexity of the fields selected from it.
+	ListFactor int
+	// MaxIntrospectionDepth is the depth allowed within introspection fields, since
+	// clients follow type references several levels deep. The lists of introspection
+	// types are not multiplied by ListFactor, and MaxIntrospectionObjects bounds the
+	// number of introspection objects returned instead.
+	MaxIntrospectionDepth   int
+	MaxIntrospectionObjects int
+}
+
+// gqlArguments holds the values of a field's arguments after variables are substituted.
+type gqlArguments map[string]interface{}
+
+// String returns the string argument with the given name, or an empty string if it was
+// not given.
+func (args gqlArguments) String(name string) (string, error) {
+	switch value := args[name].(type) {
+	case nil:
+		return "", nil
+	case string:
+		return value, nil
+	default:
+		return "", fmt.Errorf("argument '%s' must be a string", name)
+	}
+}
+
+// Int returns the integer argument with the given name, or fallback if it was not given.
+func (args gqlArguments) Int(name string, fallback int) (int, error) {
+	switch value := args[name].(type) {
+	case nil:
+		return fallback, nil
+	case float64:
+		if value != float64(int(value)) {
+			return 0, fmt.Errorf("argument '%s' must be an integer", name)
+		}
+		return int(value), nil
+	default:
+		return 0, fmt.Errorf("argument '%s' must be an integer", name)
+	}
+}
+
+// gqlError is a single entry of the errors list of a GraphQL response.
+type gqlError struct {
+	Message string        `json:"message"`
+	Path    []interface{} `json:"path,omitempty"`
+}
+
+// gqlResponse is the body of a GraphQL response.
+type gqlResponse struct {
+	Data   *gqlObject `json:"data,omitempty"`
+	Errors []gqlError `json:"errors,omitempty"`
+}
+
+// gqlObject is a resolved object whose fields are serialized in the order they were
+// selected.
+type gqlObject struct {
+	keys   []string
+	values map[string]interface{}
+}
+
+func (o *gqlObject) set(key string, value interface{}) {
+	if _, ok := o.values[key]; !ok {
+		o.keys = append(o.keys, key)
+	}
+	o.values[key] = value
+}
+
+// MarshalJSON serializes the object with its fields in selection order.
+func (o *gqlObject) MarshalJSON() ([]byte, error) {
+	var b bytes.Buffer
+	b.WriteByte('{')
+	for i, key := range o.keys {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		k, _ := json.Marshal(key)
+		b.Write(k)
+		b.WriteByte(':')
+		v, err := json.Marshal(o.values[key])
+		if err != nil {
+			return nil, err
+		}
+		b.Write(v)
+	}
+	b.WriteByte('}')
+	return b.Bytes(), nil
+}
+
+/* Validation */
+
+// gqlValidator checks a parsed operation against the schema and the limits before it is
+// executed.
+type gqlValidator struct {
+	schema    gqlSchema
+	limits    gqlLimits
+	fragments map[string]*gqlFragment
+	visiting  map[string]bool
+}
+
+// validate returns the complexity of the selections on the given type, or an error if they
+// refer to unknown fields or exceed the depth limit.
+func (v *gqlValidator) validate(typeName string, selections []*gqlSelection, depth int) (int, error) {
+	maxDepth := v.limits.MaxDepth
+	if isIntrospectionType(typeName) {
+		maxDepth = v.limits.MaxIntrospectionDepth
+	}
+	if depth > maxDepth {
+		return 0, gqlDepthError(maxDepth)
+	}
+
+	complexity := 0
+	for _, selection := range selections {
+		if !selection.isField() {
+			nested, typeCondition, err := v.fragmentSelections(selection)
+			if err != nil {
+				return 0, err
+			}
+			if typeCondition != "" && typeCondition != typeName {
+				continue
+			}
+			v.visiting[selection.fragment] = true
+			cost, err := v.validate(typeName, nested, depth)
+			delete(v.visiting, selection.fragment)
+			if err != nil {
+				return 0, err
+			}
+			complexity += cost
+			continue
+		}
+
+		if selection.name == "__typename" {
+			complexity++
+			continue
+		}
+		field, ok := v.schema[typeName][selection.name]
+		if !ok {
+			return 0, fmt.Errorf("cannot query field '%s' on type '%s'", selection.name, typeName)
+		}
+		for argument := range selection.arguments {
+			if _, ok := field.argument(argument); !ok {
+				return 0, fmt.Errorf("unknown argument '%s' on field '%s.%s'", argument, typeName, selection.name)
+			}
+		}
+		for _, argument := range field.Arguments {
+			if _, ok := selection.arguments[argument.Name]; argument.NonNull && !ok {
+				return 0, fmt.Errorf("argument '%s' of field '%s.%s' is required", argument.Name, typeName, selection.name)
+			}
+		}
+
+		object := v.schema.isObject(field.Type)
+		switch {
+		case !object && selection.selections != nil:
+			return 0, fmt.Errorf("field '%s.%s' is a scalar and cannot have a selection", typeName, selection.name)
+		case object && selection.selections == nil:
+			return 0, fmt.Errorf("field '%s.%s' must have a selection of subfields", typeName, selection.name)
+		case !object:
+			complexity++
+			continue
+		}
+
+		cost, err := v.validate(field.Type, selection.selections, depth+1)
+		if err != nil {
+			return 0, err
+		}
+		if field.List && !isIntrospectionType(field.Type) {
+			cost *= v.limits.ListFactor
+		}
+		complexity += 1 + cost
+	}
+
+	if complexity > v.limits.MaxComplexity {
+		return 0, fmt.Errorf("the query exceeds the maximum complexity of %d", v.limits.MaxComplexity)
+	}
+	return complexity, nil
+}
+
+// gqlDepthError is the error for a query nested more than maxDepth deep.
+func gqlDepthError(maxDepth int) error {
+	return fmt.Errorf("the query exceeds the maximum depth of %d", maxDepth)
+}
+
+// fragmentSelections returns the selections and type condition of a fragment spread or
+// inline fragment.
+func (v *gqlValidator) fragmentSelections(selection *gqlSelection) ([]*gqlSelection, string, error) {
+	if selection.fragment == "" {
+		return selection.selections, selection.typeCondition, nil
+	}
+	fragment, ok := v.fragments[selection.fragment]
+	if !ok {
+		return nil, "", fmt.Errorf("unknown fragment '%s'", selection.fragment)
+	}
+	if v.visiting[selection.fragment] {
+		return nil, "", fmt.Errorf("fragment '%s' spreads itself", selection.fragment)
+	}
+	return fragment.selections, fragment.typeCondition, nil
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+/* Execution */
+
+// gqlRequest is the body of a GraphQL request.
+type gqlRequest struct {
+	Query         string                 `json:"query"`
+	OperationName string                 `json:"operationName"`
+	Variables     map[string]interface{} `json:"variables"`
+	Extensions    map[string]interface{} `json:"extensions"`
+}
+
+// gqlExecutor executes a single validated operation.
+type gqlExecutor struct {
+	schema    gqlSchema
+	ctx       *gqlContext
+	fragments map[string]*gqlFragment
+	variables map[string]interface{}
+	errors    []gqlError
+	// introspectionObjects is the number of introspection objects that can still be
+	// returned. Once it runs out, further introspection objects are null.
+	introspectionObjects int
+	truncated            bool
+}
+
+// prepareGraphQL parses and validates a request, returning the operation to execute along
+// with the document's fragments and the request's variables with defaults applied.
+func prepareGraphQL(schema gqlSchema, limits gqlLimits, request gqlRequest) (*gqlOperation, *gqlExecutor, error) {
+	doc, err := parseGraphQL(request.Query, limits)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var operation *gqlOperation
+	switch {
+	case request.OperationName != "":
+		for _, o := range doc.operations {
+			if o.name == request.OperationName {
+				operation = o
+			}
+		}
+		if operation == nil {
+			return nil, nil, fmt.Errorf("unknown operation '%s'", request.OperationName)
+		}
+	case len(doc.operations) == 1:
+		operation = doc.operations[0]
+	default:
+		return nil, nil, errors.New("operationName is required when the document contains several operations")
+	}
+
+	validator := &gqlValidator{schema, limits, doc.fragments, make(map[string]bool)}
+	if _, err = validator.validate("Query", operation.selections, 1); err != nil {
+		return nil, nil, err
+	}
+
+	variables := make(map[string]interface{})
+	for _, definition := range operation.variables {
+		value, ok := request.Variables[definition.name]
+		if !ok {
+			value = definition.defaultValue
+		}
+		if value == nil && definition.nonNull {
+			return nil, nil, fmt.Errorf("variable '$%s' is required", definition.name)
+		}
+		variables[definition.name] = value
+	}
+
+	executor := &gqlExecutor{
+		schema:               schema,
+		fragments:            doc.fragments,
+		variables:            variables,
+		introspectionObjects: limits.MaxIntrospectionObjects,
+	}
+	return operation, executor, nil
+}
+
+// execute resolves the selections on an object of the given type. Errors raised by
+// resolvers are recorded and the failing field is set to null.
+func (e *gqlExecutor) execute(typeName string, source interface{}, selections []*gqlSelection, path []interface{}) *gqlObject {
+	if isIntrospectionType(typeName) {
+		if e.introspectionObjects == 0 {
+			if !e.truncated {
+				message := "the introspection query exceeds the maximum number of objects and was truncated"
+				e.errors = append(e.errors, gqlError{message, path})
+				e.truncated = true
+			}
+			return nil
+		}
+		e.introspectionObjects--
+	}
+	result := &gqlObject{values: make(map[string]interface{})}
+	e.executeInto(result, typeName, source, selections, path)
+	return result
+}
+
+func (e *gqlExecutor) executeInto(result *gqlObject, typeName string, source interface{}, selections []*gqlSelection, path []interface{}) {
+	for _, selection := range selections {
+		if !selection.isField() {
+			nested, typeCondition := selection.selections, selection.typeCondition
+			if selection.fragment != "" {
+				nested, typeCondition = e.fragments[selection.fragment].selections, e.fragments[selection.fragment].typeCondition
+			}
+			if typeCondition == "" || typeCondition == typeName {
+				e.executeInto(result, typeName, source, nested, path)
+			}
+			continue
+		}
+
+		key := selection.responseKey()
+		fieldPath := append(append([]interface{}{}, path...), key)
+		if selection.name == "__typename" {
+			result.set(key, typeName)
+			continue
+		}
+
+		field := e.schema[typeName][selection.name]
+		args, err := e.arguments(selection.arguments)
+		var value interface{}
+		if err == nil {
+			value, err = field.Resolve(e.ctx, source, args)
+		}
+		if err != nil {
+			e.errors = append(e.errors, gqlError{err.Error(), fieldPath})
+			result.set(key, nil)
+			continue
+		}
+
+		result.set(key, e.complete(field, value, selection, fieldPath))
+	}
+}
+
+// complete resolves the subfields of an object or list of objects returned by a field.
+func (e *gqlExecutor) complete(field gqlField, value interface{}, selection *gqlSelection, path []interface{}) interface{} {
+	if !e.schema.isObject(field.Type) || value == nil {
+		return value
+	}
+	if !field.List {
+		return e.execute(field.Type, value, selection.selections, path)
+	}
+
+	items := value.([]interface{})
+	completed := make([]interface{}, len(items))
+	for i, item := range items {
+		itemPath := append(append([]interface{}{}, path...), i)
+		completed[i] = e.execute(field.Type, item, selection.selections, itemPath)
+	}
+	return completed
+}
+
+// arguments substitutes variables in the arguments of a field.
+func (e *gqlExecutor) arguments(arguments map[string]interface{}) (gqlArguments, error) {
+	args := make(gqlArguments, len(arguments))
+	for name, value := range arguments {
+		resolved, err := e.substitute(value)
+		if err != nil {
+			return nil, err
+		}
+		args[name] = resolved
+	}
+	return args, nil
+}
+
+func (e *gqlExecutor) substitute(value interface{}) (interface{}, error) {
+	switch v := value.(type) {
+	case gqlVariable:
+		resolved, ok := e.variables[string(v)]
+		if !ok {
+			return nil, fmt.Errorf("variable '$%s' is not defined", string(v))
+		}
+		return resolved, nil
+	case []interface{}:
+		list := make([]interface{}, len(v))
+		for i, item := range v {
+			resolved, err := e.substitute(item)
+			if err != nil {
+				return nil, err
+			}
+			list[i] = resolved
+		}
+		return list, nil
+	case map[string]interface{}:
+		object := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			resolved, err := e.substitute(item)
+			if err != nil {
+				return nil, err
+			}
+			object[key] = resolved
+		}
+		return object, nil
+	default:
+		return value, nil
+	}
+}
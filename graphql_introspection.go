@@ -0,0 +1,267 @@
+package main
+
+import (
+	"errors"
+	"sort"
+	"strings"
+)
+
+/* Introspection */
+
+// gqlScalars are the scalar types that fields can have.
+var gqlScalars = []string{"Boolean", "Float", "Int", "String"}
+
+// gqlEnums maps the enum types that fields can have to their values.
+var gqlEnums = map[string][]string{
+	"__TypeKind": {"SCALAR", "OBJECT", "INTERFACE", "UNION", "ENUM", "INPUT_OBJECT", "LIST", "NON_NULL"},
+	"__DirectiveLocation": {
+		"QUERY", "MUTATION", "SUBSCRIPTION", "FIELD", "FRAGMENT_DEFINITION", "FRAGMENT_SPREAD",
+		"INLINE_FRAGMENT", "VARIABLE_DEFINITION", "SCHEMA", "SCALAR", "OBJECT", "FIELD_DEFINITION",
+		"ARGUMENT_DEFINITION", "INTERFACE", "UNION", "ENUM", "ENUM_VALUE", "INPUT_OBJECT",
+		"INPUT_FIELD_DEFINITION",
+	},
+}
+
+// isIntrospectionType reports whether the named type describes the schema, as the names
+// of those types and of the fields that return them begin with two underscores.
+func isIntrospectionType(name string) bool {
+	return strings.HasPrefix(name, "__")
+}
+
+// gqlType is the value of an introspection __Type: either a named type, or a LIST or
+// NON_NULL wrapper around ofType.
+type gqlType struct {
+	kind   string
+	name   string
+	ofType *gqlType
+}
+
+// namedType returns the type with the given name, or nil if the schema has none.
+func (schema gqlSchema) namedType(name string) *gqlType {
+	switch {
+	case schema.isObject(name):
+		return &gqlType{kind: "OBJECT", name: name}
+	case gqlEnums[name] != nil:
+		return &gqlType{kind: "ENUM", name: name}
+	case containsString(gqlScalars, name):
+		return &gqlType{kind: "SCALAR", name: name}
+	}
+	return nil
+}
+
+// fieldType returns the type of a field with the wrappers its list and nullability need.
+func (schema gqlSchema) fieldType(field gqlField) *gqlType {
+	t := schema.namedType(field.Type)
+	if field.List {
+		t = &gqlType{kind: "LIST", ofType: &gqlType{kind: "NON_NULL", ofType: t}}
+	}
+	if field.NonNull {
+		t = &gqlType{kind: "NON_NULL", ofType: t}
+	}
+	return t
+}
+
+// gqlNamedField is the value of an introspection __Field.
+type gqlNamedField struct {
+	name  string
+	field gqlField
+}
+
+// constant returns a resolver that always resolves to value.
+func constant(value interface{}) gqlResolver {
+	return func(_ *gqlContext, _ interface{}, _ gqlArguments) (interface{}, error) {
+		return value, nil
+	}
+}
+
+// noDirectives resolves the fields of __Directive. The engine supports no directives, so
+// there are none to resolve them for, but the type is defined so that clients can ask.
+func noDirectives(_ *gqlContext, _ interface{}, _ gqlArguments) (interface{}, error) {
+	return nil, errors.New("directives are not supported")
+}
+
+// withIntrospection returns a schema of the given types along with the types describing
+// it, with the __schema and __type fields added to Query.
+func withIntrospection(types gqlSchema) gqlSchema {
+	schema := make(gqlSchema, len(types))
+	for name, fields := range types {
+		schema[name] = make(map[string]gqlField, len(fields))
+		for fieldName, field := range fields {
+			schema[name][fieldName] = field
+		}
+	}
+
+	// typeOf reads the type that a __Type describes, which is nil for wrappers without
+	// an ofType, so that they resolve to null rather than to a type without a kind.
+	typeOf := func(t *gqlType) interface{} {
+		if t == nil {
+			return nil
+		}
+		return t
+	}
+	includeDeprecated := []gqlArgument{{Name: "includeDeprecated", Type: "Boolean"}}
+
+	schema["Query"]["__schema"] = gqlField{
+		Type:    "__Schema",
+		NonNull: true,
+		Resolve: constant(schema),
+	}
+	schema["Query"]["__type"] = gqlField{
+		Type:      "__Type",
+		Arguments: []gqlArgument{{Name: "name", Type: "String", NonNull: true}},
+		Resolve: func(_ *gqlContext, _ interface{}, args gqlArguments) (interface{}, error) {
+			name, err := args.String("name")
+			if err != nil {
+				return nil, err
+			}
+			return typeOf(schema.namedType(name)), nil
+		},
+	}
+
+	schema["__Schema"] = map[string]gqlField{
+		"description": {Type: "String", Resolve: constant(nil)},
+		"types": {
+			Type:    "__Type",
+			List:    true,
+			NonNull: true,
+			Resolve: func(_ *gqlContext, _ interface{}, _ gqlArguments) (interface{}, error) {
+				names := append([]string{}, gqlScalars...)
+				for name := range schema {
+					names = append(names, name)
+				}
+				for name := range gqlEnums {
+					names = append(names, name)
+				}
+				sort.Strings(names)
+				items := make([]interface{}, len(names))
+				for i, name := range names {
+					items[i] = schema.namedType(name)
+				}
+				return items, nil
+			},
+		},
+		"queryType":        {Type: "__Type", NonNull: true, Resolve: constant(schema.namedType("Query"))},
+		"mutationType":     {Type: "__Type", Resolve: constant(nil)},
+		"subscriptionType": {Type: "__Type", Resolve: constant(nil)},
+		"directives":       {Type: "__Directive", List: true, NonNull: true, Resolve: constant([]interface{}{})},
+	}
+
+	schema["__Type"] = map[string]gqlField{
+		"kind":           {Type: "__TypeKind", NonNull: true, Resolve: scalar(func(s interface{}) interface{} { return s.(*gqlType).kind })},
+		"name":           {Type: "String", Resolve: scalar(func(s interface{}) interface{} { return nullString(s.(*gqlType).name) })},
+		"description":    {Type: "String", Resolve: constant(nil)},
+		"specifiedByURL": {Type: "String", Resolve: constant(nil)},
+		"fields": {
+			Type:      "__Field",
+			List:      true,
+			Arguments: includeDeprecated,
+			Resolve: func(_ *gqlContext, source interface{}, _ gqlArguments) (interface{}, error) {
+				t := source.(*gqlType)
+				if t.kind != "OBJECT" {
+					return nil, nil
+				}
+				var names []string
+				for name := range schema[t.name] {
+					if !isIntrospectionType(name) {
+						names = append(names, name)
+					}
+				}
+				sort.Strings(names)
+				items := make([]interface{}, len(names))
+				for i, name := range names {
+					items[i] = gqlNamedField{name, schema[t.name][name]}
+				}
+				return items, nil
+			},
+		},
+		"interfaces": {
+			Type: "__Type",
+			List: true,
+			Resolve: func(_ *gqlContext, source interface{}, _ gqlArguments) (interface{}, error) {
+				if source.(*gqlType).kind != "OBJECT" {
+					return nil, nil
+				}
+				return []interface{}{}, nil
+			},
+		},
+		"possibleTypes": {Type: "__Type", List: true, Resolve: constant(nil)},
+		"enumValues": {
+			Type:      "__EnumValue",
+			List:      true,
+			Arguments: includeDeprecated,
+			Resolve: func(_ *gqlContext, source interface{}, _ gqlArguments) (interface{}, error) {
+				t := source.(*gqlType)
+				if t.kind != "ENUM" {
+					return nil, nil
+				}
+				items := make([]interface{}, len(gqlEnums[t.name]))
+				for i, value := range gqlEnums[t.name] {
+					items[i] = value
+				}
+				return items, nil
+			},
+		},
+		"inputFields": {Type: "__InputValue", List: true, Arguments: includeDeprecated, Resolve: constant(nil)},
+		"ofType":      {Type: "__Type", Resolve: scalar(func(s interface{}) interface{} { return typeOf(s.(*gqlType).ofType) })},
+	}
+
+	schema["__Field"] = map[string]gqlField{
+		"name":        {Type: "String", NonNull: true, Resolve: scalar(func(s interface{}) interface{} { return s.(gqlNamedField).name })},
+		"description": {Type: "String", Resolve: constant(nil)},
+		"args": {
+			Type:      "__InputValue",
+			List:      true,
+			NonNull:   true,
+			Arguments: includeDeprecated,
+			Resolve: scalar(func(s interface{}) interface{} {
+				arguments := s.(gqlNamedField).field.Arguments
+				items := make([]interface{}, len(arguments))
+				for i, argument := range arguments {
+					items[i] = argument
+				}
+				return items
+			}),
+		},
+		"type": {Type: "__Type", NonNull: true, Resolve: scalar(func(s interface{}) interface{} {
+			return schema.fieldType(s.(gqlNamedField).field)
+		})},
+		"isDeprecated":      {Type: "Boolean", NonNull: true, Resolve: constant(false)},
+		"deprecationReason": {Type: "String", Resolve: constant(nil)},
+	}
+
+	schema["__InputValue"] = map[string]gqlField{
+		"name":        {Type: "String", NonNull: true, Resolve: scalar(func(s interface{}) interface{} { return s.(gqlArgument).Name })},
+		"description": {Type: "String", Resolve: constant(nil)},
+		"type": {Type: "__Type", NonNull: true, Resolve: scalar(func(s interface{}) interface{} {
+			argument := s.(gqlArgument)
+			return schema.fieldType(gqlField{Type: argument.Type, NonNull: argument.NonNull})
+		})},
+		"defaultValue":      {Type: "String", Resolve: constant(nil)},
+		"isDeprecated":      {Type: "Boolean", NonNull: true, Resolve: constant(false)},
+		"deprecationReason": {Type: "String", Resolve: constant(nil)},
+	}
+
+	schema["__EnumValue"] = map[string]gqlField{
+		"name":              {Type: "String", NonNull: true, Resolve: scalar(func(s interface{}) interface{} { return s.(string) })},
+		"description":       {Type: "String", Resolve: constant(nil)},
+		"isDeprecated":      {Type: "Boolean", NonNull: true, Resolve: constant(false)},
+		"deprecationReason": {Type: "String", Resolve: constant(nil)},
+	}
+
+	schema["__Directive"] = map[string]gqlField{
+		"name":         {Type: "String", NonNull: true, Resolve: noDirectives},
+		"description":  {Type: "String", Resolve: noDirectives},
+		"locations":    {Type: "__DirectiveLocation", List: true, NonNull: true, Resolve: noDirectives},
+		"args":         {Type: "__InputValue", List: true, NonNull: true, Arguments: includeDeprecated, Resolve: noDirectives},
+		"isRepeatable": {Type: "Boolean", NonNull: true, Resolve: noDirectives},
+	}
+	return schema
+}
+
+// nullString returns nil for an empty string, which GraphQL returns as null.
+func nullString(s string) interface{} {
+	if s == "" {
+		return nil
+	}
+	return s
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	log "github.com/sirupsen/logrus"
+)
+
+// graphQLLimits bounds the queries accepted by the GraphQL endpoint.
+var graphQLLimits = gqlLimits{
+	MaxDepth:                5,
+	MaxComplexity:           500,
+	ListFactor:              10,
+	MaxIntrospectionDepth:   15,
+	MaxIntrospectionObjects: 5000,
+}
+
+// gqlContext carries the state of a single GraphQL request through the resolvers.
+type gqlContext struct {
+	request  context.Context
+	db       Datastore
+	user     User
+	workouts []Workout
+	loaded   bool
+}
+
+// userWorkouts loads the workouts of the requesting user, reading them from the datastore
+// at most once per request.
+func (ctx *gqlContext) userWorkouts() ([]Workout, error) {
+	if !ctx.loaded {
+		workouts, err := ctx.db.GetWorkouts(ctx.request, ctx.user.ID)
+		if err != nil {
+			log.WithError(err).Error("An error occurred")
+			return nil, errors.New("unable to load workouts")
+		}
+		ctx.workouts, ctx.loaded = workouts, true
+	}
+	return ctx.workouts, nil
+}
+
+// workoutsInRange returns the user's workouts starting within the from and to arguments.
+func (ctx *gqlContext) workoutsInRange(args gqlArguments) ([]Workout, error) {
+	from, to, err := timeRangeArguments(args)
+	if err != nil {
+		return nil, err
+	}
+	workouts, err := ctx.userWorkouts()
+	if err != nil {
+		return nil, err
+	}
+
+	var inRange []Workout
+	for _, workout := range workouts {
+		if (from.IsZero() || !workout.Start.Before(from)) && (to.IsZero() || workout.Start.Before(to)) {
+			inRange = append(inRange, workout)
+		}
+	}
+	return inRange, nil
+}
+
+// timeRangeArguments parses the optional from and to arguments, which may be RFC 3339
+// timestamps or dates. A date given for to includes the whole day.
+func timeRangeArguments(args gqlArguments) (time.Time, time.Time, error) {
+	var bounds [2]time.Time
+	for i, name := range []string{"from", "to"} {
+		value, err := args.String(name)
+		switch {
+		case err != nil:
+			return bounds[0], bounds[1], err
+		case value == "":
+			continue
+		}
+		if bounds[i], err = time.Parse(time.RFC3339, value); err == nil {
+			continue
+		}
+		if bounds[i], err = time.Parse("2006-01-02", value); err != nil {
+			return bounds[0], bounds[1], fmt.Errorf("argument '%s' must be a date or RFC 3339 timestamp", name)
+		}
+		if name == "to" {
+			bounds[i] = bounds[i].AddDate(0, 0, 1)
+		}
+	}
+	return bounds[0], bounds[1], nil
+}
+
+func resolveWorkouts(ctx *gqlContext, _ interface{}, args gqlArguments) (interface{}, error) {
+	workouts, err := ctx.workoutsInRange(args)
+	if err != nil {
+		return nil, err
+	}
+	limit, err := args.Int("limit", len(workouts))
+	switch {
+	case err != nil:
+		return nil, err
+	case limit < 0:
+		return nil, errors.New("argument 'limit' must not be negative")
+	case limit < len(workouts):
+		// Workouts are ordered by end time, so the most recent ones are at the end.
+		workouts = workouts[len(workouts)-limit:]
+	}
+
+	items := make([]interface{}, len(workouts))
+	for i, workout := range workouts {
+		items[i] = workout
+	}
+	return items, nil
+}
+
+func resolveSummary(ctx *gqlContext, _ interface{}, args gqlArguments) (interface{}, error) {
+	workouts, err := ctx.workoutsInRange(args)
+	if err != nil {
+		return nil, err
+	}
+	return summarizeWorkouts(workouts), nil
+}
+
+// summarizeWorkouts computes aggregate statistics over a list of workouts.
+func summarizeWorkouts(workouts []Workout) WorkoutSummary {
+	summary := WorkoutSummary{Count: len(workouts)}
+	for i := range workouts {
+		workout := &workouts[i]
+		minutes := workout.Duration().Minutes()
+		summary.TotalMinutes += minutes
+		if minutes > summary.LongestMinutes {
+			summary.LongestMinutes = minutes
+		}
+		if summary.First == nil || workout.Start.Before(*summary.First) {
+			summary.First = &workout.Start
+		}
+		if summary.Last == nil || workout.Start.After(*summary.Last) {
+			summary.Last = &workout.Start
+		}
+	}
+
+	if summary.Count > 0 {
+		summary.AverageMinutes = summary.TotalMinutes / float64(summary.Count)
+		weeks := summary.Last.Sub(*summary.First).Hours() / (24 * 7)
+		if weeks < 1 {
+			weeks = 1
+		}
+		summary.PerWeek = float64(summary.Count) / weeks
+	}
+	return summary
+}
+
+// scalar returns a resolver that reads a scalar from the source object.
+func scalar(read func(source interface{}) interface{}) gqlResolver {
+	return func(_ *gqlContext, source interface{}, _ gqlArguments) (interface{}, error) {
+		return read(source), nil
+	}
+}
+
+func formatOptionalTime(t *time.Time) interface{} {
+	if t == nil {
+		return nil
+	}
+	return t.Format(time.RFC3339)
+}
+
+// summaryArguments and workoutsArguments are the arguments of the summary and workouts
+// fields.
+var (
+	summaryArguments  = []gqlArgument{{Name: "from", Type: "String"}, {Name: "to", Type: "String"}}
+	workoutsArguments = []gqlArgument{{Name: "from", Type: "String"}, {Name: "to", Type: "String"}, {Name: "limit", Type: "Int"}}
+)
+
+// workoutSchema describes the types exposed through the GraphQL endpoint.
+var workoutSchema = withIntrospection(gqlSchema{
+	"Query": {
+		"me": {
+			Type:    "User",
+			NonNull: true,
+			Resolve: func(ctx *gqlContext, _ interface{}, _ gqlArguments) (interface{}, error) {
+				return ctx.user, nil
+			},
+		},
+		"workouts": {Type: "Workout", List: true, Arguments: workoutsArguments, Resolve: resolveWorkouts},
+		"summary":  {Type: "Summary", Arguments: summaryArguments, Resolve: resolveSummary},
+	},
+	"User": {
+		"id":       {Type: "Int", NonNull: true, Resolve: scalar(func(s interface{}) interface{} { return s.(User).ID })},
+		"name":     {Type: "String", NonNull: true, Resolve: scalar(func(s interface{}) interface{} { return s.(User).Name })},
+		"workouts": {Type: "Workout", List: true, Arguments: workoutsArguments, Resolve: resolveWorkouts},
+		"summary":  {Type: "Summary", Arguments: summaryArguments, Resolve: resolveSummary},
+	},
+	"Workout": {
+		"id":    {Type: "Int", NonNull: true, Resolve: scalar(func(s interface{}) interface{} { return s.(Workout).ID })},
+		"start": {Type: "String", NonNull: true, Resolve: scalar(func(s interface{}) interface{} { return s.(Workout).Start.Format(time.RFC3339) })},
+		"end":   {Type: "String", Resolve: scalar(func(s interface{}) interface{} { return formatOptionalTime(s.(Workout).End) })},
+		"durationMinutes": {Type: "Float", NonNull: true, Resolve: scalar(func(s interface{}) interface{} {
+			return s.(Workout).Duration().Minutes()
+		})},
+		"intensity": {Type: "Int", Resolve: scalar(func(s interface{}) interface{} {
+			if intensity := s.(Workout).Intensity; intensity != nil {
+				return *intensity
+			}
+			return nil
+		})},
+		"type": {Type: "String", Resolve: scalar(func(s interface{}) interface{} {
+			if workoutType := s.(Workout).Type; workoutType != "" {
+				return workoutType
+			}
+			return nil
+		})},
+	},
+	"Summary": {
+		"count":          {Type: "Int", NonNull: true, Resolve: scalar(func(s interface{}) interface{} { return s.(WorkoutSummary).Count })},
+		"totalMinutes":   {Type: "Float", NonNull: true, Resolve: scalar(func(s interface{}) interface{} { return s.(WorkoutSummary).TotalMinutes })},
+		"averageMinutes": {Type: "Float", NonNull: true, Resolve: scalar(func(s interface{}) interface{} { return s.(WorkoutSummary).AverageMinutes })},
+		"longestMinutes": {Type: "Float", NonNull: true, Resolve: scalar(func(s interface{}) interface{} { return s.(WorkoutSummary).LongestMinutes })},
+		"perWeek":        {Type: "Float", NonNull: true, Resolve: scalar(func(s interface{}) interface{} { return s.(WorkoutSummary).PerWeek })},
+		"first":          {Type: "String", Resolve: scalar(func(s interface{}) interface{} { return formatOptionalTime(s.(WorkoutSummary).First) })},
+		"last":           {Type: "String", Resolve: scalar(func(s interface{}) interface{} { return formatOptionalTime(s.(WorkoutSummary).Last) })},
+	},
+})
+
+// GraphQL executes a GraphQL query on behalf of the user identified by the request's
+// access token.
+func (env *Env) GraphQL(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	user, ok := env.authenticate(w, r)
+	if !ok {
+		return
+	}
+	var request gqlRequest
+	if !decodeJSON(w, r, maxBodyBytes, &request) ||
+		!validRequest(w, validate(rule{request.Query != "", "query", "is required"})) {
+		return
+	}
+
+	operation, executor, err := prepareGraphQL(workoutSchema, graphQLLimits, request)
+	if err != nil {
+		log.WithError(err).WithField("name", user.Name).Info("Rejected GraphQL query")
+		WriteJSON(w, http.StatusBadRequest, gqlResponse{Errors: []gqlError{{Message: err.Error()}}})
+		return
+	}
+
+	executor.ctx = &gqlContext{request: r.Context(), db: env.db, user: user}
+	data := executor.execute("Query", nil, operation.selections, nil)
+	log.WithFields(log.Fields{
+		"name":   user.Name,
+		"errors": len(executor.errors),
+	}).Info("Executed GraphQL query")
+	WriteJSON(w, http.StatusOK, gqlResponse{Data: data, Errors: executor.errors})
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// introspectionQuery is the query that GraphQL clients such as GraphiQL send to learn the
+// schema, with the type references followed nine levels deep.
+const introspectionQuery = `
+query IntrospectionQuery {
+  __schema {
+    description
+    queryType { name }
+    mutationType { name }
+    subscriptionType { name }
+    types { ...FullType }
+    directives {
+      name
+      description
+      isRepeatable
+      locations
+      args(includeDeprecated: true) { ...InputValue }
+    }
+  }
+}
+
+fragment FullType on __Type {
+  kind
+  name
+  description
+  specifiedByURL
+  fields(includeDeprecated: true) {
+    name
+    description
+    args(includeDeprecated: true) { ...InputValue }
+    type { ...TypeRef }
+    isDeprecated
+    deprecationReason
+  }
+  inputFields(includeDeprecated: true) { ...InputValue }
+  interfaces { ...TypeRef }
+  enumValues(includeDeprecated: true) {
+    name
+    description
+    isDeprecated
+    deprecationReason
+  }
+  possibleTypes { ...TypeRef }
+}
+
+fragment InputValue on __InputValue {
+  name
+  description
+  type { ...TypeRef }
+  defaultValue
+  isDeprecated
+  deprecationReason
+}
+
+fragment TypeRef on __Type {
+  kind
+  name
+  ofType { kind name ofType { kind name ofType { kind name ofType { kind name ofType {
+    kind name ofType { kind name ofType { kind name ofType { kind name ofType { kind name } } } }
+  } } } } }
+}
+`
+
+// runGraphQL executes a query against the workout schema, returning its data as decoded
+// from JSON.
+func runGraphQL(t *testing.T, limits gqlLimits, query string) (map[string]interface{}, []gqlError, error) {
+	operation, executor, err := prepareGraphQL(workoutSchema, limits, gqlRequest{Query: query})
+	if err != nil {
+		return nil, nil, err
+	}
+	executor.ctx = &gqlContext{request: context.Background(), db: NewMemoryDB(), user: User{ID: 1, Name: "runner"}}
+	encoded, err := json.Marshal(executor.execute("Query", nil, operation.selections, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var data map[string]interface{}
+	if err = json.Unmarshal(encoded, &data); err != nil {
+		t.Fatal(err)
+	}
+	return data, executor.errors, nil
+}
+
+// typeRef formats an introspected type reference as it would be written in a schema.
+func typeRef(value interface{}) string {
+	t := value.(map[string]interface{})
+	switch t["kind"] {
+	case "NON_NULL":
+		return typeRef(t["ofType"]) + "!"
+	case "LIST":
+		return "[" + typeRef(t["ofType"]) + "]"
+	default:
+		return t["name"].(string)
+	}
+}
+
+func TestGraphQLIntrospectionQuery(t *testing.T) {
+	data, errors, err := runGraphQL(t, graphQLLimits, introspectionQuery)
+	if err != nil || len(errors) > 0 {
+		t.Fatalf("introspection failed with %v %+v", err, errors)
+	}
+	schema := data["__schema"].(map[string]interface{})
+	if schema["queryType"].(map[string]interface{})["name"] != "Query" || schema["mutationType"] != nil ||
+		schema["subscriptionType"] != nil || len(schema["directives"].([]interface{})) != 0 {
+		t.Errorf("schema is %+v", schema)
+	}
+
+	// fields maps the name of each type to the signatures of its fields, and names lists
+	// the types in order.
+	fields := make(map[string][]string)
+	var names []string
+	kinds := make(map[string]interface{})
+	var references []string
+	for _, value := range schema["types"].([]interface{}) {
+		introspected := value.(map[string]interface{})
+		name := introspected["name"].(string)
+		names = append(names, name)
+		kinds[name] = introspected["kind"]
+		// Only objects have fields, which are null for the other kinds of types.
+		introspectedFields, _ := introspected["fields"].([]interface{})
+		for _, value := range introspectedFields {
+			field := value.(map[string]interface{})
+			var args []string
+			for _, value := range field["args"].([]interface{}) {
+				arg := value.(map[string]interface{})
+				args = append(args, fmt.Sprintf("%s: %s", arg["name"], typeRef(arg["type"])))
+				references = append(references, strings.Trim(typeRef(arg["type"]), "[]!"))
+			}
+			signature := field["name"].(string)
+			if len(args) > 0 {
+				signature += "(" + strings.Join(args, ", ") + ")"
+			}
+			fields[name] = append(fields[name], signature+": "+typeRef(field["type"]))
+			references = append(references, strings.Trim(typeRef(field["type"]), "[]!"))
+		}
+	}
+
+	expectedNames := []string{
+		"Boolean", "Float", "Int", "Query", "String", "Summary", "User", "Workout",
+		"__Directive", "__DirectiveLocation", "__EnumValue", "__Field", "__InputValue", "__Schema", "__Type", "__TypeKind",
+	}
+	if !equalStrings(names, expectedNames) {
+		t.Errorf("types are %v, expected %v", names, expectedNames)
+	}
+	for _, reference := range references {
+		if _, ok := kinds[reference]; !ok {
+			t.Errorf("type %s is referred to but not listed", reference)
+		}
+	}
+	for name, expected := range map[string][]string{
+		"Query": {
+			"me: User!",
+			"summary(from: String, to: String): Summary",
+			"workouts(from: String, to: String, limit: Int): [Workout!]",
+		},
+		"Workout": {
+			"durationMinutes: Float!", "end: String", "id: Int!", "intensity: Int", "start: String!", "type: String",
+		},
+		"__Type": {
+			"description: String",
+			"enumValues(includeDeprecated: Boolean): [__EnumValue!]",
+			"fields(includeDeprecated: Boolean): [__Field!]",
+			"inputFields(includeDeprecated: Boolean): [__InputValue!]",
+			"interfaces: [__Type!]",
+			"kind: __TypeKind!",
+			"name: String",
+			"ofType: __Type",
+			"possibleTypes: [__Type!]",
+			"specifiedByURL: String",
+		},
+	} {
+		if !equalStrings(fields[name], expected) {
+			t.Errorf("fields of %s are %v, expected %v", name, fields[name], expected)
+		}
+	}
+	if kinds["Float"] != "SCALAR" || kinds["Summary"] != "OBJECT" || kinds["__TypeKind"] != "ENUM" {
+		t.Errorf("kinds of types are %v", kinds)
+	}
+}
+
+func TestGraphQLTypeIntrospection(t *testing.T) {
+	for _, test := range []struct {
+		name, query, data, err string
+	}{{
+		name:  "object",
+		query: `{ __type(name: "Summary") { kind name fields { name } enumValues { name } interfaces { name } } }`,
+		data: `{"__type": {"kind": "OBJECT", "name": "Summary", "fields": [{"name": "averageMinutes"}, {"name": "count"},
+			{"name": "first"}, {"name": "last"}, {"name": "longestMinutes"}, {"name": "perWeek"}, {"name": "totalMinutes"}],
+			"enumValues": null, "interfaces": []}}`,
+	}, {
+		name:  "scalar",
+		query: `{ __type(name: "Int") { kind name fields { name } ofType { name } } }`,
+		data:  `{"__type": {"kind": "SCALAR", "name": "Int", "fields": null, "ofType": null}}`,
+	}, {
+		name:  "enum",
+		query: `{ kind: __type(name: "__TypeKind") { enumValues { name } } }`,
+		data: `{"kind": {"enumValues": [{"name": "SCALAR"}, {"name": "OBJECT"}, {"name": "INTERFACE"}, {"name": "UNION"},
+			{"name": "ENUM"}, {"name": "INPUT_OBJECT"}, {"name": "LIST"}, {"name": "NON_NULL"}]}}`,
+	}, {
+		name:  "unknown",
+		query: `{ __type(name: "Mutation") { name } }`,
+		data:  `{"__type": null}`,
+	}, {
+		name:  "typename",
+		query: `{ __typename __schema { __typename queryType { __typename name } } }`,
+		data:  `{"__typename": "Query", "__schema": {"__typename": "__Schema", "queryType": {"__typename": "__Type", "name": "Query"}}}`,
+	}, {
+		name:  "with data",
+		query: `{ me { name } __type(name: "User") { fields { name type { kind ofType { name } } } } }`,
+		data: `{"me": {"name": "runner"}, "__type": {"fields": [{"name": "id", "type": {"kind": "NON_NULL", "ofType": {"name": "Int"}}},
+			{"name": "name", "type": {"kind": "NON_NULL", "ofType": {"name": "String"}}},
+			{"name": "summary", "type": {"kind": "OBJECT", "ofType": null}},
+			{"name": "workouts", "type": {"kind": "LIST", "ofType": {"name": null}}}]}}`,
+	}, {
+		name:  "missing argument",
+		query: `{ __type { name } }`,
+		err:   "argument 'name' of field 'Query.__type' is required",
+	}, {
+		name:  "scalar selection",
+		query: `{ __type(name: "User") { name { length } } }`,
+		err:   "field '__Type.name' is a scalar and cannot have a selection",
+	}, {
+		name:  "outside the root",
+		query: `{ me { __schema { types { name } } } }`,
+		err:   "cannot query field '__schema' on type 'User'",
+	}} {
+		t.Run(test.name, func(t *testing.T) {
+			data, errors, err := runGraphQL(t, graphQLLimits, test.query)
+			if test.err != "" {
+				if err == nil || err.Error() != test.err {
+					t.Errorf("error is %v, expected %s", err, test.err)
+				}
+				return
+			}
+			if err != nil || len(errors) > 0 {
+				t.Fatalf("query failed with %v %+v", err, errors)
+			}
+			var expected map[string]interface{}
+			if err = json.Unmarshal([]byte(test.data), &expected); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(data, expected) {
+				encoded, _ := json.Marshal(data)
+				t.Errorf("data is %s, expected %s", encoded, test.data)
+			}
+		})
+	}
+}
+
+func TestGraphQLIntrospectionLimits(t *testing.T) {
+	// Following type references deeper than any client does is rejected, and a query within
+	// the depth limit that repeats the schema under aliases runs out of objects.
+	var repeated []string
+	for i := 0; i < 40; i++ {
+		repeated = append(repeated, fmt.Sprintf("s%d: __schema { types { fields { args { name } type { name ofType { name } } } } }", i))
+	}
+	aliased := "{ " + strings.Join(repeated, " ") + " }"
+	tooDeep := "{ __schema { types { " + strings.Repeat("ofType { ", 13) + "name" + strings.Repeat(" }", 13) + " } } }"
+	fragment := "{ __schema { types { ...Ref } } } fragment Ref on __Type { " + strings.Repeat("ofType { ", 15) + "name" + strings.Repeat(" }", 15) + " }"
+
+	if _, _, err := runGraphQL(t, graphQLLimits, tooDeep); err == nil || err.Error() != gqlDepthError(graphQLLimits.MaxIntrospectionDepth).Error() {
+		t.Errorf("a query too deep was rejected with %v", err)
+	}
+	if _, _, err := runGraphQL(t, graphQLLimits, fragment); err == nil || err.Error() != gqlDepthError(graphQLLimits.MaxIntrospectionDepth).Error() {
+		t.Errorf("a fragment too deep was rejected with %v", err)
+	}
+	if _, _, err := runGraphQL(t, graphQLLimits, "{ me { workouts { id } } }"); err != nil {
+		t.Errorf("a query for data was rejected with %v", err)
+	}
+
+	data, errors, err := runGraphQL(t, graphQLLimits, aliased)
+	if err != nil {
+		t.Fatal(err)
+	}
+	message := "the introspection query exceeds the maximum number of objects and was truncated"
+	if len(errors) != 1 || errors[0].Message != message || data["s0"] == nil || data["s39"] != nil {
+		t.Errorf("a query returning too many objects failed with %+v", errors)
+	}
+
+	limits := graphQLLimits
+	limits.MaxIntrospectionObjects = 4
+	data, errors, err = runGraphQL(t, limits, "{ __schema { types { name } } }")
+	if err != nil {
+		t.Fatal(err)
+	}
+	types := data["__schema"].(map[string]interface{})["types"].([]interface{})
+	expectedPath := []interface{}{"__schema", "types", float64(3)}
+	if len(errors) != 1 || types[2] == nil || types[3] != nil || types[len(types)-1] != nil {
+		t.Errorf("types are %v with errors %+v", types, errors)
+	} else if encoded, _ := json.Marshal(errors[0].Path); string(encoded) != `["__schema","types",3]` {
+		t.Errorf("error path is %s, expected %v", encoded, expectedPath)
+	}
+}
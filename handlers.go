@@ -2,13 +2,12 @@ package main
 
 import (
 	"bytes"
-	"encoding/json"
 	"fmt"
 	"html/template"
-	"io/ioutil"
 	"net/http"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/julienschmidt/httprouter"
 	log "github.com/sirupsen/logrus"
@@ -16,30 +15,24 @@ import (
 
 // SignUp handles adding a new user to the database.
 func (env *Env) SignUp(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
-	body, err := ioutil.ReadAll(r.Body)
-	if err != nil {
-		WriteError(w, http.StatusBadRequest, err, "Invalid request")
-		return
-	}
 	var request UserRequest
-	err = json.Unmarshal(body, &request)
-	if err != nil || request.Name == "" || request.Password == "" {
-		WriteError(
-			w,
-			http.StatusBadRequest,
-			fmt.Errorf("invalid request: %s", string(body)),
-			"Invalid request",
-		)
+	if !decodeJSON(w, r, maxBodyBytes, &request) || !validRequest(w, request.validateSignUp()) {
 		return
 	}
 
 	request.Name = strings.Title(strings.ToLower(request.Name))
 	request.Token = computeHmac256(request.Password, request.Name)
-	newID, err := env.db.SignUp(request)
+	newID, err := env.db.SignUp(r.Context(), request)
 	switch {
 	case err == ErrUserAlreadyExists:
 		log.WithField("name", request.Name).Info("The given name already exists")
-		WriteError(w, http.StatusBadRequest, err, "the given name already exists")
+		WriteErrorCode(
+			w,
+			http.StatusBadRequest,
+			err,
+			ErrCodeUserAlreadyExists,
+			"the given name already exists",
+		)
 		return
 	case err != nil:
 		InternalServerError(w, err)
@@ -54,46 +47,59 @@ func (env *Env) SignUp(w http.ResponseWriter, r *http.Request, ps httprouter.Par
 }
 
 // Login validates the credentials in the request body and returns the list of workouts
-// for the user.
+// for the user along with their streaks. Streaks follow the calendar of the optional tz
+// query parameter.
 func (env *Env) Login(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
-	body, err := ioutil.ReadAll(r.Body)
-	if err != nil {
-		WriteError(w, http.StatusBadRequest, err, "Invalid request")
-	}
 	var request UserRequest
-	err = json.Unmarshal(body, &request)
-	if err != nil || ((request.Name == "" || request.Password == "") && request.Token == "") {
-		WriteError(
-			w,
-			http.StatusBadRequest,
-			fmt.Errorf("invalid request: %s", string(body)),
-			"Invalid request",
-		)
+	if !decodeJSON(w, r, maxBodyBytes, &request) {
+		return
+	}
+	location, problems := parseTimeZone(r.URL.Query())
+	if !validRequest(w, append(request.validateLogin(), problems...)) {
 		return
 	}
 
 	var user User
+	var err error
 	if request.Name != "" && request.Password != "" {
 		request.Name = strings.Title(strings.ToLower(request.Name))
 		request.Token = computeHmac256(request.Password, request.Name)
 
-		user, err = env.db.LoginWithCredentials(request.Name, request.Token)
+		user, err = env.db.LoginWithCredentials(r.Context(), request.Name, request.Token)
 		switch {
 		case err == ErrUserNotFound:
-			WriteError(w, http.StatusNotFound, err, "The specified user could not be found")
+			WriteErrorCode(
+				w,
+				http.StatusNotFound,
+				err,
+				ErrCodeUserNotFound,
+				"The specified user could not be found",
+			)
 			return
 		case err == ErrInvalidCredentials:
-			WriteError(w, http.StatusUnauthorized, err, "Invalid credentials")
+			WriteErrorCode(
+				w,
+				http.StatusUnauthorized,
+				err,
+				ErrCodeInvalidCredentials,
+				"Invalid credentials",
+			)
 			return
 		case err != nil:
 			InternalServerError(w, err)
 			return
 		}
 	} else {
-		user, err = env.db.LoginWithToken(request.Token)
+		user, err = env.db.LoginWithToken(r.Context(), request.Token)
 		switch {
 		case err == ErrUserNotFound:
-			WriteError(w, http.StatusNotFound, err, "The given token did not match any users")
+			WriteErrorCode(
+				w,
+				http.StatusNotFound,
+				err,
+				ErrCodeUserNotFound,
+				"The given token did not match any users",
+			)
 			return
 		case err != nil:
 			InternalServerError(w, err)
@@ -102,56 +108,48 @@ func (env *Env) Login(w http.ResponseWriter, r *http.Request, ps httprouter.Para
 	}
 
 	log.WithField("name", user.Name).Info("User signed in")
-	workouts, err := env.db.GetWorkouts(user.ID)
+	workouts, err := env.db.GetWorkouts(r.Context(), user.ID)
 	if err != nil {
 		InternalServerError(w, err)
 		return
 	}
 
+	options := DefaultStreakOptions
+	options.Location = location
+	streaks := ComputeStreaks(workoutStarts(workouts), time.Now(), options)
+
 	user.Token = request.Token
-	WriteJSON(w, http.StatusOK, LoginResponse{user, workouts})
+	WriteJSON(w, http.StatusOK, LoginResponse{user, workouts, &streaks})
 }
 
-// AddWorkout adds a workout to the datastore.
+// AddWorkout adds a workout to the datastore. Workouts that do not pass the configured
+// checks are only added once confirmed with the force query parameter.
 func (env *Env) AddWorkout(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
-	body, err := ioutil.ReadAll(r.Body)
-	if err != nil {
-		WriteError(w, http.StatusBadRequest, err, "Invalid request")
-		return
-	}
 	var workout Workout
-	err = json.Unmarshal(body, &workout)
-	if err != nil || workout.User == 0 || workout.Start.IsZero() || workout.End.IsZero() {
-		WriteError(
-			w,
-			http.StatusBadRequest,
-			fmt.Errorf("invalid request: %s", string(body)),
-			"Invalid request",
-		)
+	if !decodeJSON(w, r, maxBodyBytes, &workout) || !validRequest(w, workout.validateNew()) ||
+		!env.confirmWorkout(w, r, workout) {
 		return
 	}
 
-	if !workout.End.After(workout.Start) {
-		WriteError(
-			w,
-			http.StatusBadRequest,
-			fmt.Errorf("end %v is not after start %v", workout.End, workout.Start),
-			"End time must be greater than start time",
-		)
-		return
-	}
-
-	workoutID, err := env.db.AddWorkout(workout)
+	workoutID, err := env.db.AddWorkout(r.Context(), workout)
 	switch {
 	case err == ErrUserNotFound:
-		WriteError(w, http.StatusNotFound, err, "The specified user could not be found")
+		WriteErrorCode(
+			w,
+			http.StatusNotFound,
+			err,
+			ErrCodeUserNotFound,
+			"The specified user could not be found",
+		)
 		return
 	case err != nil:
 		InternalServerError(w, err)
 		return
 	}
+	workout.ID = workoutID
+	env.publish(workout.User, workoutEvent(EventWorkoutCreated, workout))
 
-	name, err := env.db.GetUsername(workout.User)
+	name, err := env.db.GetUsername(r.Context(), workout.User)
 	if err != nil {
 		InternalServerError(w, err)
 		return
@@ -160,45 +158,23 @@ func (env *Env) AddWorkout(w http.ResponseWriter, r *http.Request, ps httprouter
 	WriteJSON(w, http.StatusCreated, map[string]int{"id": workoutID})
 }
 
-// UpdateWorkout replaces the workout specified in the request body.
+// UpdateWorkout replaces the workout specified in the request body. As with AddWorkout,
+// the new workout must pass the configured checks or be confirmed.
 func (env *Env) UpdateWorkout(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
-	body, err := ioutil.ReadAll(r.Body)
-	if err != nil {
-		WriteError(w, http.StatusBadRequest, err, "Invalid request")
-		return
-	}
-
 	var workout Workout
-	err = json.Unmarshal(body, &workout)
-	if err != nil ||
-		workout.ID == 0 || workout.User == 0 ||
-		workout.Start.IsZero() || workout.End.IsZero() {
-		WriteError(
-			w,
-			http.StatusBadRequest,
-			fmt.Errorf("invalid request: %s", string(body)),
-			"Invalid request",
-		)
-		return
-	}
-
-	if !workout.End.After(workout.Start) {
-		WriteError(
-			w,
-			http.StatusBadRequest,
-			fmt.Errorf("end %v is not after start %v", workout.End, workout.Start),
-			"End time must be greater than start time",
-		)
+	if !decodeJSON(w, r, maxBodyBytes, &workout) || !validRequest(w, workout.validateUpdate()) ||
+		!env.confirmWorkout(w, r, workout) {
 		return
 	}
 
-	err = env.db.UpdateWorkout(workout)
+	err := env.db.UpdateWorkout(r.Context(), workout)
 	switch {
 	case err == ErrUserNotAuthorized:
-		WriteError(
+		WriteErrorCode(
 			w,
 			http.StatusUnauthorized,
 			err,
+			ErrCodeNotAuthorized,
 			"The requested workout does not belong to you",
 		)
 		return
@@ -206,8 +182,9 @@ func (env *Env) UpdateWorkout(w http.ResponseWriter, r *http.Request, ps httprou
 		InternalServerError(w, err)
 		return
 	}
+	env.publish(workout.User, workoutEvent(EventWorkoutUpdated, workout))
 
-	name, err := env.db.GetUsername(workout.User)
+	name, err := env.db.GetUsername(r.Context(), workout.User)
 	log.WithFields(log.Fields{
 		"name":    name,
 		"workout": workout.ID,
@@ -218,26 +195,180 @@ func (env *Env) UpdateWorkout(w http.ResponseWriter, r *http.Request, ps httprou
 	w.WriteHeader(http.StatusNoContent)
 }
 
-// DeleteWorkout deletes the workout specified in the URL parameter. There is currently no
-// validation to ensure that the caller has access to do so.
+// DeleteWorkout moves the workout specified in the URL parameter to the trash, from which
+// its owner can restore it. There is currently no validation to ensure that the caller has
+// access to do so.
 func (env *Env) DeleteWorkout(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	workoutString := ps.ByName("id")
 	workoutID, err := strconv.Atoi(workoutString)
 	if err != nil {
-		WriteError(w, http.StatusBadRequest, err, "Invalid workout")
+		WriteValidationError(
+			w,
+			err,
+			"Invalid workout",
+			[]FieldError{{"id", "must be an integer"}},
+		)
 		return
 	}
-	err = env.db.DeleteWorkout(workoutID)
-	if err != nil {
+	userID, err := env.db.DeleteWorkout(r.Context(), workoutID)
+	switch {
+	case err == ErrWorkoutNotFound:
+		// Deleting a workout that no longer exists succeeds, so that retries are harmless.
+	case err != nil:
 		InternalServerError(w, err)
 		return
+	default:
+		env.publish(userID, deletedEvent(workoutID))
 	}
 	log.WithField("id", workoutID).Info("Deleted workout")
 	w.WriteHeader(http.StatusNoContent)
 }
 
+// maxBatchOperations is the largest number of operations accepted in a single batch. The
+// datastore gives batches more time the more operations they have, so that the largest
+// fits within its deadline.
+const maxBatchOperations = 10000
+
+// BatchWorkouts applies a list of workout creates, updates and deletes in a single
+// transaction and reports the outcome of each operation individually. Operations that
+// fail validation are reported without being sent to the datastore. Workout checks are not
+// run on batches, which are meant for importing existing history.
+func (env *Env) BatchWorkouts(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	var request BatchRequest
+	if !decodeJSON(w, r, maxBatchBodyBytes, &request) ||
+		!validRequest(w, validate(rule{len(request.Operations) > 0, "operations", "must not be empty"})) {
+		return
+	}
+	if len(request.Operations) > maxBatchOperations {
+		WriteError(
+			w,
+			http.StatusRequestEntityTooLarge,
+			fmt.Errorf("batch of %d operations is too large", len(request.Operations)),
+			fmt.Sprintf("A batch may contain at most %d operations", maxBatchOperations),
+		)
+		return
+	}
+
+	results := make([]BatchResult, len(request.Operations))
+	var valid []BatchOperation
+	var indices []int
+	for i, op := range request.Operations {
+		if problems := op.validate(); len(problems) > 0 {
+			results[i] = BatchResult{
+				Index:   i,
+				Op:      op.Op,
+				ID:      op.Workout.ID,
+				Status:  http.StatusBadRequest,
+				Code:    ErrCodeValidationFailed,
+				Error:   describeProblem(problems[0]),
+				Details: problems,
+			}
+			continue
+		}
+		valid = append(valid, op)
+		indices = append(indices, i)
+	}
+
+	if len(valid) > 0 {
+		now := time.Now()
+		applied, err := env.db.BatchWorkouts(r.Context(), valid, batchWebhooks(valid, now))
+		if err != nil {
+			InternalServerError(w, err)
+			return
+		}
+		for i, result := range applied {
+			result.Index = indices[i]
+			batchResultStatus(&result)
+			results[indices[i]] = result
+		}
+		env.publishBatch(valid, applied, now)
+	}
+
+	log.WithFields(log.Fields{
+		"operations": len(results),
+		"applied":    len(valid),
+	}).Info("Applied workout batch")
+	WriteJSON(w, http.StatusOK, BatchResponse{results})
+}
+
+// batchEvents returns the events, published at the given time, for the operations of a
+// batch that were applied.
+func batchEvents(ops []BatchOperation, results []BatchResult, now time.Time) []userEvent {
+	var events []userEvent
+	for i, result := range results {
+		if result.Err != nil {
+			continue
+		}
+		workout := ops[i].Workout
+		var event Event
+		switch ops[i].Op {
+		case BatchCreate:
+			workout.ID = result.ID
+			event = workoutEvent(EventWorkoutCreated, workout)
+		case BatchUpdate:
+			event = workoutEvent(EventWorkoutUpdated, workout)
+		case BatchDelete:
+			event = deletedEvent(workout.ID)
+		}
+		event.Time = now
+		events = append(events, userEvent{workout.User, event})
+	}
+	return events
+}
+
+// batchWebhooks returns the webhook events for the events of a batch, so that their
+// deliveries are queued in the same transaction as the batch itself.
+func batchWebhooks(ops []BatchOperation, now time.Time) BatchWebhooks {
+	return func(results []BatchResult) ([]WebhookEvent, error) {
+		return newWebhookEvents(batchEvents(ops, results, now))
+	}
+}
+
+// publishBatch sends the events of a committed batch to the open event streams. Their
+// webhook deliveries were already queued along with the batch.
+func (env *Env) publishBatch(ops []BatchOperation, results []BatchResult, now time.Time) {
+	for _, e := range batchEvents(ops, results, now) {
+		env.events.Publish(e.User, e.Event)
+	}
+}
+
+// batchResultStatus fills in the status code, error code and message that the equivalent
+// single workout request would have returned for an applied batch operation.
+func batchResultStatus(result *BatchResult) {
+	switch {
+	case result.Err == nil && result.Op == BatchCreate:
+		result.Status = http.StatusCreated
+	case result.Err == nil:
+		result.Status = http.StatusNoContent
+	case result.Err == ErrUserNotFound:
+		result.Status = http.StatusNotFound
+		result.Code = ErrCodeUserNotFound
+		result.Error = "The specified user could not be found"
+	case result.Err == ErrWorkoutNotFound:
+		result.Status = http.StatusNotFound
+		result.Code = ErrCodeWorkoutNotFound
+		result.Error = "The specified workout could not be found"
+	case result.Err == ErrUserNotAuthorized:
+		result.Status = http.StatusUnauthorized
+		result.Code = ErrCodeNotAuthorized
+		result.Error = "The requested workout does not belong to you"
+	case result.Err == ErrInvalidBatchOperation:
+		result.Status = http.StatusBadRequest
+		result.Code = ErrCodeInvalidRequest
+		result.Error = fmt.Sprintf("Unknown operation '%s'", result.Op)
+	default:
+		log.WithError(result.Err).Error("An error occurred")
+		result.Status = http.StatusInternalServerError
+		result.Code = ErrCodeInternal
+		result.Error = "Unable to process request"
+	}
+}
+
 /* Landing page */
 
+// openAPIPath is the location of the OpenAPI specification describing every route.
+const openAPIPath = "./static/openapi.json"
+
 // GetIndex serves the static html landing page.
 func GetIndex(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 	type ApplicationMetadata struct {
@@ -264,30 +395,40 @@ func GetGopher(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 	http.ServeFile(w, r, "./static/coffee-gopher.gif")
 }
 
+// GetOpenAPI serves the OpenAPI specification of the service.
+func GetOpenAPI(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	http.ServeFile(w, r, openAPIPath)
+}
+
 // NotFound is a custom not found handler that logs the request data.
 func NotFound(w http.ResponseWriter, r *http.Request) {
+	requestID := assignRequestID(w, r)
 	log.WithFields(log.Fields{
-		"method": r.Method,
-		"URI":    r.RequestURI,
+		"request-id": requestID,
+		"method":     r.Method,
+		"URI":        r.RequestURI,
 	}).Info("Endpoint not found")
 
-	WriteJSON(
-		w,
-		http.StatusNotFound,
-		map[string]string{"error": "endpoint not found"},
-	)
+	WriteJSON(w, http.StatusNotFound, ErrorResponse{
+		Message:   "endpoint not found",
+		Code:      ErrCodeNotFound,
+		RequestID: requestID,
+	})
 }
 
 // MethodNotAllowed is a custom 405 handler that logs the request.
 func MethodNotAllowed(w http.ResponseWriter, r *http.Request) {
+	requestID := assignRequestID(w, r)
 	log.WithFields(log.Fields{
-		"method": r.Method,
-		"URI":    r.RequestURI,
+		"request-id": requestID,
+		"method":     r.Method,
+		"URI":        r.RequestURI,
 	}).Info("Method not allowed")
 
-	WriteJSON(
-		w,
-		http.StatusMethodNotAllowed,
-		map[string]string{"error": "Method not allowed"},
-	)
+	WriteJSON(w, http.StatusMethodNotAllowed, ErrorResponse{
+		Message:   "Method not allowed",
+		Code:      ErrCodeMethodNotAllowed,
+		RequestID: requestID,
+	})
 }
@@ -0,0 +1,987 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The handlers are tested end to end, by sending requests through the router to an
+// in-memory datastore.
+
+// handlerTest is a router backed by an empty in-memory datastore.
+type handlerTest struct {
+	t      *testing.T
+	db     Datastore
+	router http.Handler
+	dir    string
+}
+
+func newHandlerTest(t *testing.T) *handlerTest {
+	return newHandlerTestWith(t, NewMemoryDB())
+}
+
+func newHandlerTestWith(t *testing.T, db Datastore) *handlerTest {
+	dir, err := ioutil.TempDir("", "workout-handlers-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	env := &Env{db: db, events: NewEventHub(), importDir: dir}
+	return &handlerTest{t, db, env.NewRouter(), dir}
+}
+
+func (h *handlerTest) close() {
+	os.RemoveAll(h.dir)
+}
+
+// serve sends a request to the router, authenticated by token if it is not empty.
+func (h *handlerTest) serve(request *http.Request, token string) *httptest.ResponseRecorder {
+	if token != "" {
+		request.Header.Set("Authorization", "Bearer "+token)
+	}
+	recorder := httptest.NewRecorder()
+	h.router.ServeHTTP(recorder, request)
+	return recorder
+}
+
+// send sends a request with a JSON body, or no body if body is empty.
+func (h *handlerTest) send(method, path, token, body string) *httptest.ResponseRecorder {
+	contentType := "application/json"
+	if body == "" {
+		contentType = ""
+	}
+	return h.serve(newTestRequest(method, path, contentType, body), token)
+}
+
+// newTestRequest returns a request with the given body, of the given content type unless
+// it is empty.
+func newTestRequest(method, path, contentType, body string) *http.Request {
+	var reader io.Reader
+	if body != "" {
+		reader = strings.NewReader(body)
+	}
+	request := httptest.NewRequest(method, path, reader)
+	if contentType != "" {
+		request.Header.Set("Content-Type", contentType)
+	}
+	return request
+}
+
+// signUp signs up a user through the API, returning them with their access token.
+func (h *handlerTest) signUp(name, password string) User {
+	recorder := h.send("POST", "/v1/signup", "", fmt.Sprintf(`{"name": %q, "password": %q}`, name, password))
+	var user struct {
+		ID    int    `json:"id"`
+		Token string `json:"token"`
+	}
+	if !expectStatus(h.t, recorder, http.StatusCreated) || !decodeBody(h.t, recorder, &user) {
+		h.t.FailNow()
+	}
+	return User{ID: user.ID, Name: name, Token: user.Token}
+}
+
+// workoutBody returns the JSON of a workout of the user on 1 March 2019.
+func workoutBody(workoutID, userID, startHour, endHour int) string {
+	body := fmt.Sprintf(
+		`"user": %d, "start": "2019-03-01T%02d:00:00Z", "end": "2019-03-01T%02d:00:00Z", "type": "run"`,
+		userID, startHour, endHour,
+	)
+	if workoutID != 0 {
+		body = fmt.Sprintf(`"id": %d, %s`, workoutID, body)
+	}
+	return "{" + body + "}"
+}
+
+func expectStatus(t *testing.T, recorder *httptest.ResponseRecorder, status int) bool {
+	if recorder.Code != status {
+		t.Errorf("expected status %d, got %d: %s", status, recorder.Code, recorder.Body)
+		return false
+	}
+	return true
+}
+
+func decodeBody(t *testing.T, recorder *httptest.ResponseRecorder, v interface{}) bool {
+	if contentType := recorder.Header().Get("Content-Type"); !strings.HasPrefix(contentType, "application/json") {
+		t.Errorf("expected a JSON response, got %q", contentType)
+		return false
+	}
+	if err := json.Unmarshal(recorder.Body.Bytes(), v); err != nil {
+		t.Errorf("invalid JSON response %s: %v", recorder.Body, err)
+		return false
+	}
+	return true
+}
+
+// expectError checks that a response is an error envelope with the given status, code and
+// message, returning the envelope.
+func expectError(t *testing.T, recorder *httptest.ResponseRecorder, status int, code, message string) ErrorResponse {
+	var response ErrorResponse
+	if !expectStatus(t, recorder, status) || !decodeBody(t, recorder, &response) {
+		return response
+	}
+	if response.Code != code || response.Message != message {
+		t.Errorf("expected error %q (%s), got %q (%s)", message, code, response.Message, response.Code)
+	}
+	if requestID := recorder.Header().Get(requestIDHeader); response.RequestID != requestID || requestID == "" {
+		t.Errorf("expected the error to carry request ID %q, got %q", requestID, response.RequestID)
+	}
+	return response
+}
+
+// errDatastoreFailed is the error of failingDB.
+var errDatastoreFailed = errors.New("the database is unavailable")
+
+// failingDB fails to sign up, log in with credentials, and change workouts.
+type failingDB struct {
+	Datastore
+}
+
+func (db failingDB) SignUp(ctx context.Context, r UserRequest) (int, error) {
+	return 0, errDatastoreFailed
+}
+
+func (db failingDB) LoginWithCredentials(ctx context.Context, name, passHash string) (User, error) {
+	return User{}, errDatastoreFailed
+}
+
+func (db failingDB) AddWorkout(ctx context.Context, workout Workout) (int, error) {
+	return 0, errDatastoreFailed
+}
+
+func (db failingDB) UpdateWorkout(ctx context.Context, workout Workout) error {
+	return errDatastoreFailed
+}
+
+func (db failingDB) DeleteWorkout(ctx context.Context, workoutID int) (int, error) {
+	return 0, errDatastoreFailed
+}
+
+/* Users */
+
+func TestSignUp(t *testing.T) {
+	h := newHandlerTest(t)
+	defer h.close()
+
+	recorder := h.send("POST", "/v1/signup", "", `{"name": "runner", "password": "secret"}`)
+	var created map[string]interface{}
+	if expectStatus(t, recorder, http.StatusCreated) && decodeBody(t, recorder, &created) {
+		// Names are capitalized before the password is hashed with them.
+		if token := computeHmac256("secret", "Runner"); created["token"] != token || created["id"] == nil {
+			t.Errorf("expected the new user's ID and token %q, got %v", token, created)
+		}
+	}
+	if user, err := h.db.LoginWithToken(context.Background(), computeHmac256("secret", "Runner")); err != nil || user.Name != "Runner" {
+		t.Errorf("the new user is %+v, %v", user, err)
+	}
+
+	recorder = h.send("POST", "/v1/signup", "", `{"name": "RUNNER", "password": "other"}`)
+	expectError(t, recorder, http.StatusBadRequest, ErrCodeUserAlreadyExists, "the given name already exists")
+
+	recorder = h.send("POST", "/v1/signup", "", `{"name": "swimmer"}`)
+	response := expectError(t, recorder, http.StatusBadRequest, ErrCodeValidationFailed, "password is required")
+	if len(response.Details) != 1 || response.Details[0] != (FieldError{"password", "is required"}) {
+		t.Errorf("expected the missing password in the details, got %+v", response.Details)
+	}
+
+	recorder = h.send("POST", "/v1/signup", "", `{"name": "swimmer", "password": "secret", "admin": true}`)
+	expectError(t, recorder, http.StatusBadRequest, ErrCodeInvalidJSON, `Invalid request: unknown field "admin"`)
+
+	recorder = h.send("POST", "/v1/signup", "", `{"name": "swimmer",`)
+	expectError(t, recorder, http.StatusBadRequest, ErrCodeInvalidJSON, "Invalid request: unexpected EOF")
+
+	recorder = h.serve(newTestRequest("POST", "/v1/signup", "text/plain", "runner"), "")
+	expectError(t, recorder, http.StatusUnsupportedMediaType, ErrCodeUnsupportedMediaType, "The request body must be JSON")
+
+	recorder = h.serve(newTestRequest("POST", "/v1/signup", "application/json", ""), "")
+	expectError(t, recorder, http.StatusBadRequest, ErrCodeInvalidJSON, "The request body is empty")
+
+	failing := newHandlerTestWith(t, failingDB{NewMemoryDB()})
+	defer failing.close()
+	recorder = failing.send("POST", "/v1/signup", "", `{"name": "runner", "password": "secret"}`)
+	expectError(t, recorder, http.StatusInternalServerError, ErrCodeInternal, "Unable to process request")
+}
+
+func TestLogin(t *testing.T) {
+	h := newHandlerTest(t)
+	defer h.close()
+	user := h.signUp("runner", "secret")
+	h.send("POST", "/v1/workout", "", workoutBody(0, user.ID, 10, 11))
+
+	var response LoginResponse
+	recorder := h.send("POST", "/v1/login", "", `{"name": "Runner", "password": "secret"}`)
+	if expectStatus(t, recorder, http.StatusOK) && decodeBody(t, recorder, &response) {
+		if response.User.ID != user.ID || response.User.Name != "Runner" || response.User.Token != user.Token {
+			t.Errorf("expected to log in as %+v, got %+v", user, response.User)
+		}
+		if len(response.Workouts) != 1 || response.Streaks == nil {
+			t.Errorf("expected the user's workout and streaks, got %+v", response)
+		}
+	}
+
+	recorder = h.send("POST", "/v1/login", "", fmt.Sprintf(`{"token": %q}`, user.Token))
+	if expectStatus(t, recorder, http.StatusOK) && decodeBody(t, recorder, &response) && response.User.ID != user.ID {
+		t.Errorf("expected to log in as %+v with a token, got %+v", user, response.User)
+	}
+
+	recorder = h.send("POST", "/v1/login", "", `{"name": "runner", "password": "wrong"}`)
+	expectError(t, recorder, http.StatusUnauthorized, ErrCodeInvalidCredentials, "Invalid credentials")
+
+	recorder = h.send("POST", "/v1/login", "", `{"name": "swimmer", "password": "secret"}`)
+	expectError(t, recorder, http.StatusNotFound, ErrCodeUserNotFound, "The specified user could not be found")
+
+	recorder = h.send("POST", "/v1/login", "", `{"token": "unknown"}`)
+	expectError(t, recorder, http.StatusNotFound, ErrCodeUserNotFound, "The given token did not match any users")
+
+	recorder = h.send("POST", "/v1/login", "", `{"password": "secret"}`)
+	expectError(t, recorder, http.StatusBadRequest, ErrCodeValidationFailed, "name is required unless a token is given")
+
+	recorder = h.send("POST", "/v1/login?tz=Mars/Olympus", "", fmt.Sprintf(`{"token": %q}`, user.Token))
+	expectStatus(t, recorder, http.StatusBadRequest)
+
+	failing := newHandlerTestWith(t, failingDB{NewMemoryDB()})
+	defer failing.close()
+	recorder = failing.send("POST", "/v1/login", "", `{"name": "runner", "password": "secret"}`)
+	expectError(t, recorder, http.StatusInternalServerError, ErrCodeInternal, "Unable to process request")
+}
+
+/* Workouts */
+
+func TestAddWorkout(t *testing.T) {
+	h := newHandlerTest(t)
+	defer h.close()
+	user := h.signUp("runner", "secret")
+
+	recorder := h.send("POST", "/v1/workout", "", workoutBody(0, user.ID, 10, 11))
+	var created map[string]int
+	if expectStatus(t, recorder, http.StatusCreated) && decodeBody(t, recorder, &created) {
+		workouts, _ := h.db.GetWorkouts(context.Background(), user.ID)
+		if len(workouts) != 1 || workouts[0].ID != created["id"] || workouts[0].Type != "run" {
+			t.Errorf("expected workout %d to be added, the user has %+v", created["id"], workouts)
+		}
+	}
+
+	recorder = h.send("POST", "/v1/workout", "", workoutBody(0, user.ID+100, 12, 13))
+	expectError(t, recorder, http.StatusNotFound, ErrCodeUserNotFound, "The specified user could not be found")
+
+	recorder = h.send("POST", "/v1/workout", "", workoutBody(0, user.ID, 15, 14))
+	expectError(t, recorder, http.StatusBadRequest, ErrCodeValidationFailed, "end must be after start")
+
+	recorder = h.send("POST", "/v1/workout", "", fmt.Sprintf(`{"user": %d, "start": "2019-03-01T10:00:00Z"}`, user.ID))
+	expectError(t, recorder, http.StatusBadRequest, ErrCodeValidationFailed, "end is required")
+
+	recorder = h.send("POST", "/v1/workout", "", fmt.Sprintf(`{"user": %d, "start": "yesterday"}`, user.ID))
+	expectStatus(t, recorder, http.StatusBadRequest)
+
+	body := fmt.Sprintf(`{"user": %d, "start": "2019-03-01T16:00:00Z", "end": "2019-03-01T17:00:00Z", "intensity": 11}`, user.ID)
+	recorder = h.send("POST", "/v1/workout", "", body)
+	expectError(t, recorder, http.StatusBadRequest, ErrCodeValidationFailed, "intensity must be between 1 and 10")
+
+	body = fmt.Sprintf(`{"user": %d, "start": "2019-03-01T16:00:00Z", "end": "2019-03-01T17:00:00Z", "bogus": 5}`, user.ID)
+	recorder = h.send("POST", "/v1/workout", "", body)
+	expectError(t, recorder, http.StatusBadRequest, ErrCodeInvalidJSON, `Invalid request: unknown field "bogus"`)
+	recorder = h.send("POST", "/v1/workouts/batch", "", `{"operations": [{"op": "create", "workout": `+body+`}]}`)
+	expectError(t, recorder, http.StatusBadRequest, ErrCodeInvalidJSON, `Invalid request: unknown field "bogus"`)
+
+	if workouts, _ := h.db.GetWorkouts(context.Background(), user.ID); len(workouts) != 1 {
+		t.Errorf("invalid workouts were added: %+v", workouts)
+	}
+
+	db := NewMemoryDB()
+	userID := addTestUser(t, db, "runner")
+	failing := newHandlerTestWith(t, failingDB{db})
+	defer failing.close()
+	recorder = failing.send("POST", "/v1/workout", "", workoutBody(0, userID, 10, 11))
+	expectError(t, recorder, http.StatusInternalServerError, ErrCodeInternal, "Unable to process request")
+}
+
+func TestUpdateWorkout(t *testing.T) {
+	h := newHandlerTest(t)
+	defer h.close()
+	user := h.signUp("runner", "secret")
+	other := h.signUp("swimmer", "secret")
+	end := testTime(t, 11, 0)
+	workoutID, err := h.db.AddWorkout(context.Background(), Workout{User: user.ID, Start: testTime(t, 10, 0), End: &end})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	recorder := h.send("PUT", "/v1/workout", "", workoutBody(workoutID, user.ID, 12, 14))
+	if expectStatus(t, recorder, http.StatusNoContent) {
+		workouts, _ := h.db.GetWorkouts(context.Background(), user.ID)
+		if len(workouts) != 1 || workouts[0].End.Sub(workouts[0].Start) != 2*time.Hour {
+			t.Errorf("expected the workout to be updated, the user has %+v", workouts)
+		}
+	}
+
+	// Leaving out the intensity keeps it, while null clears it.
+	withIntensity := strings.Replace(workoutBody(workoutID, user.ID, 12, 14), `"type"`, `"intensity": 6, "type"`, 1)
+	withoutIntensity := workoutBody(workoutID, user.ID, 12, 14)
+	nullIntensity := strings.Replace(withoutIntensity, `"type"`, `"intensity": null, "type"`, 1)
+	six := 6
+	for _, test := range []struct {
+		body      string
+		intensity *int
+	}{
+		{withIntensity, &six},
+		{withoutIntensity, &six},
+		{nullIntensity, nil},
+	} {
+		recorder = h.send("PUT", "/v1/workout", "", test.body)
+		if !expectStatus(t, recorder, http.StatusNoContent) {
+			continue
+		}
+		stored, _ := h.db.GetWorkout(context.Background(), user.ID, workoutID)
+		if (stored.Intensity == nil) != (test.intensity == nil) || stored.Intensity != nil && *stored.Intensity != *test.intensity {
+			t.Errorf("after updating with %s, the workout is %+v", test.body, stored)
+		}
+	}
+
+	// The same goes for the type, which is cleared by an empty type.
+	withoutType := strings.Replace(withoutIntensity, `, "type": "run"`, "", 1)
+	emptyType := strings.Replace(withoutIntensity, `"type": "run"`, `"type": ""`, 1)
+	for _, test := range []struct {
+		body        string
+		workoutType string
+	}{
+		{withoutType, "run"},
+		{emptyType, ""},
+	} {
+		recorder = h.send("PUT", "/v1/workout", "", test.body)
+		if !expectStatus(t, recorder, http.StatusNoContent) {
+			continue
+		}
+		if stored, _ := h.db.GetWorkout(context.Background(), user.ID, workoutID); stored.Type != test.workoutType {
+			t.Errorf("after updating with %s, the workout is %+v", test.body, stored)
+		}
+	}
+
+	recorder = h.send("PUT", "/v1/workout", "", workoutBody(workoutID, other.ID, 16, 17))
+	expectError(t, recorder, http.StatusUnauthorized, ErrCodeNotAuthorized, "The requested workout does not belong to you")
+
+	recorder = h.send("PUT", "/v1/workout", "", workoutBody(workoutID+100, user.ID, 16, 17))
+	expectError(t, recorder, http.StatusUnauthorized, ErrCodeNotAuthorized, "The requested workout does not belong to you")
+
+	recorder = h.send("PUT", "/v1/workout", "", workoutBody(0, user.ID, 16, 17))
+	expectError(t, recorder, http.StatusBadRequest, ErrCodeValidationFailed, "id is required")
+
+	if workouts, _ := h.db.GetWorkouts(context.Background(), user.ID); len(workouts) != 1 || workouts[0].Start.Hour() != 12 {
+		t.Errorf("a rejected update changed the workout: %+v", workouts)
+	}
+
+	db := NewMemoryDB()
+	userID := addTestUser(t, db, "runner")
+	workout := addTestWorkout(t, db, userID, testTime(t, 10, 0), time.Hour)
+	failing := newHandlerTestWith(t, failingDB{db})
+	defer failing.close()
+	recorder = failing.send("PUT", "/v1/workout", "", workoutBody(workout.ID, userID, 12, 14))
+	expectError(t, recorder, http.StatusInternalServerError, ErrCodeInternal, "Unable to process request")
+}
+
+// TestWorkoutCheckWarnings checks that the owner of a workout is checked before the
+// workout checks run, and that their warnings only list other workouts to the owner.
+func TestWorkoutCheckWarnings(t *testing.T) {
+	h := newHandlerTest(t)
+	defer h.close()
+	env := &Env{db: h.db, events: NewEventHub(), checks: WorkoutChecks{Overlap: CheckWarn}}
+	h.router = env.NewRouter()
+	user := h.signUp("runner", "secret")
+	other := h.signUp("swimmer", "secret")
+	existing := addTestWorkout(t, h.db, user.ID, time.Date(2019, time.March, 1, 10, 0, 0, 0, time.UTC), time.Hour)
+	message := "The workout overlaps 1 of your other workouts. Send the request again with force=true to save it anyway"
+
+	for _, test := range []struct {
+		token    string
+		workouts []int
+	}{
+		{"", nil},
+		{other.Token, nil},
+		{user.Token, []int{existing.ID}},
+	} {
+		recorder := h.send("POST", "/v1/workout", test.token, workoutBody(0, user.ID, 10, 12))
+		response := expectError(t, recorder, http.StatusConflict, ErrCodeConfirmationRequired, message)
+		if len(response.Warnings) != 1 || !equalIDs(response.Warnings[0].Workouts, test.workouts) {
+			t.Errorf("with token %q, the warnings were %+v, expected them to list %v", test.token, response.Warnings, test.workouts)
+		}
+	}
+
+	recorder := h.send("POST", "/v1/workout", "", workoutBody(0, user.ID+100, 10, 12))
+	expectError(t, recorder, http.StatusNotFound, ErrCodeUserNotFound, "The specified user could not be found")
+	recorder = h.send("PUT", "/v1/workout", "", workoutBody(existing.ID, other.ID, 10, 12))
+	expectError(t, recorder, http.StatusUnauthorized, ErrCodeNotAuthorized, "The requested workout does not belong to you")
+}
+
+func TestFinishWorkoutChecks(t *testing.T) {
+	h := newHandlerTest(t)
+	defer h.close()
+	env := &Env{db: h.db, events: NewEventHub(), checks: WorkoutChecks{Duration: CheckWarn, MaxDuration: 12 * time.Hour}}
+	h.router = env.NewRouter()
+	user := h.signUp("runner", "secret")
+	session, err := h.db.StartWorkout(context.Background(), user.ID, time.Now().Add(-14*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := fmt.Sprintf("/v1/workout/%d/finish", session.Workout.ID)
+	recorder := h.send("POST", path, user.Token, "")
+	message := "The workout lasts 14h00m, which is longer than 12h00m. Send the request again with force=true to save it anyway"
+	expectError(t, recorder, http.StatusConflict, ErrCodeConfirmationRequired, message)
+
+	// An empty body of unknown length is no body at all.
+	request := newTestRequest("POST", path+"?force=true", "", "")
+	request.Body, request.ContentLength = ioutil.NopCloser(strings.NewReader("")), -1
+	expectStatus(t, h.serve(request, user.Token), http.StatusOK)
+	if workout, _ := h.db.GetWorkout(context.Background(), user.ID, session.Workout.ID); workout.End == nil {
+		t.Errorf("expected the confirmed workout to be finished")
+	}
+}
+
+func TestDeleteWorkout(t *testing.T) {
+	h := newHandlerTest(t)
+	defer h.close()
+	user := h.signUp("runner", "secret")
+	end := testTime(t, 11, 0)
+	workoutID, err := h.db.AddWorkout(context.Background(), Workout{User: user.ID, Start: testTime(t, 10, 0), End: &end})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := fmt.Sprintf("/v1/workout/%d", workoutID)
+	if recorder := h.send("DELETE", path, "", ""); expectStatus(t, recorder, http.StatusNoContent) {
+		if workouts, _ := h.db.GetWorkouts(context.Background(), user.ID); len(workouts) != 0 {
+			t.Errorf("expected the workout to be deleted, the user has %+v", workouts)
+		}
+	}
+	// Deleting the workout again succeeds, so that retries are harmless.
+	expectStatus(t, h.send("DELETE", path, "", ""), http.StatusNoContent)
+
+	response := expectError(t, h.send("DELETE", "/v1/workout/first", "", ""), http.StatusBadRequest, ErrCodeValidationFailed, "Invalid workout")
+	if len(response.Details) != 1 || response.Details[0].Field != "id" {
+		t.Errorf("expected the invalid ID in the details, got %+v", response.Details)
+	}
+
+	failing := newHandlerTestWith(t, failingDB{NewMemoryDB()})
+	defer failing.close()
+	recorder := failing.send("DELETE", path, "", "")
+	expectError(t, recorder, http.StatusInternalServerError, ErrCodeInternal, "Unable to process request")
+}
+
+func TestTrash(t *testing.T) {
+	h := newHandlerTest(t)
+	defer h.close()
+	user := h.signUp("runner", "secret")
+	end := testTime(t, 11, 0)
+	workoutID, err := h.db.AddWorkout(context.Background(), Workout{User: user.ID, Start: testTime(t, 10, 0), End: &end})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectStatus(t, h.send("DELETE", fmt.Sprintf("/v1/workout/%d", workoutID), "", ""), http.StatusNoContent)
+
+	var trash []Workout
+	if recorder := h.send("GET", "/v1/trash", user.Token, ""); expectStatus(t, recorder, http.StatusOK) && decodeBody(t, recorder, &trash) {
+		if len(trash) != 1 || trash[0].ID != workoutID || trash[0].Deleted == nil {
+			t.Errorf("expected the deleted workout in the trash, got %+v", trash)
+		}
+	}
+
+	path := fmt.Sprintf("/v1/workout/%d/restore", workoutID)
+	other := h.signUp("swimmer", "secret")
+	expectError(t, h.send("POST", path, other.Token, ""), http.StatusNotFound, ErrCodeWorkoutNotFound, "The specified workout is not in your trash")
+
+	var restored Workout
+	if recorder := h.send("POST", path, user.Token, ""); expectStatus(t, recorder, http.StatusOK) && decodeBody(t, recorder, &restored) {
+		if restored.ID != workoutID || restored.Deleted != nil {
+			t.Errorf("expected the restored workout, got %+v", restored)
+		}
+	}
+	if workouts, _ := h.db.GetWorkouts(context.Background(), user.ID); len(workouts) != 1 {
+		t.Errorf("expected the workout to be restored, the user has %+v", workouts)
+	}
+	expectError(t, h.send("POST", path, user.Token, ""), http.StatusNotFound, ErrCodeWorkoutNotFound, "The specified workout is not in your trash")
+	expectError(t, h.send("POST", "/v1/workout/first/restore", user.Token, ""), http.StatusBadRequest, ErrCodeValidationFailed, "Invalid workout")
+
+	// The purge deletes the workouts kept for longer than the retention, and stops once
+	// stop is closed.
+	if _, err = h.db.DeleteWorkout(context.Background(), workoutID); err != nil {
+		t.Fatal(err)
+	}
+	stop := make(chan struct{})
+	close(stop)
+	PurgeTrash(h.db, time.Hour, stop)
+	if trash, _ = h.db.GetDeletedWorkouts(context.Background(), user.ID); len(trash) != 1 {
+		t.Errorf("expected a workout deleted just now to be kept, the trash has %+v", trash)
+	}
+	PurgeTrash(h.db, -time.Minute, stop)
+	if trash, _ = h.db.GetDeletedWorkouts(context.Background(), user.ID); len(trash) != 0 {
+		t.Errorf("expected the trash to be purged, it has %+v", trash)
+	}
+}
+
+func TestBatchWorkoutsQueuesWebhooks(t *testing.T) {
+	h := newHandlerTest(t)
+	defer h.close()
+	f := newHandlerFixture(h)
+	body := f.expand(`{"operations": [
+		{"op": "create", "workout": {"user": {user}, "start": "2019-03-01T07:00:00Z", "end": "2019-03-01T08:00:00Z"}},
+		{"op": "delete", "workout": {"id": {workout}, "user": {user}}},
+		{"op": "delete", "workout": {"id": 1000, "user": {user}}}
+	]}`)
+	expectStatus(t, h.send("POST", "/v1/workouts/batch", "", body), http.StatusOK)
+
+	deliveries, err := h.db.ClaimWebhookDeliveries(context.Background(), 10, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deliveries) != 2 || deliveries[0].Event != EventWorkoutCreated || deliveries[1].Event != EventWorkoutDeleted {
+		t.Errorf("expected deliveries of the two operations that were applied, got %+v", deliveries)
+	}
+}
+
+func TestLargestBatchFitsTheQueryTimeout(t *testing.T) {
+	db, err := InitializeSQLite(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err = db.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	h := newHandlerTestWith(t, WithQueryTimeout(db, defaultQueryTimeout))
+	defer h.close()
+	user := h.signUp("runner", "secret")
+
+	ops := make([]string, maxBatchOperations)
+	start := time.Date(2019, time.March, 1, 0, 0, 0, 0, time.UTC)
+	for i := range ops {
+		day := start.AddDate(0, 0, i)
+		ops[i] = fmt.Sprintf(
+			`{"op": "create", "workout": {"user": %d, "start": %q, "end": %q}}`,
+			user.ID, day.Format(time.RFC3339), day.Add(time.Hour).Format(time.RFC3339),
+		)
+	}
+	recorder := h.send("POST", "/v1/workouts/batch", "", `{"operations": [`+strings.Join(ops, ",")+`]}`)
+	expectStatus(t, recorder, http.StatusOK)
+	if workouts, _ := h.db.GetWorkouts(context.Background(), user.ID); len(workouts) != maxBatchOperations {
+		t.Errorf("the batch added %d workouts, expected %d", len(workouts), maxBatchOperations)
+	}
+}
+
+func TestFinishedSessionQueuesCreatedWebhook(t *testing.T) {
+	h := newHandlerTest(t)
+	defer h.close()
+	f := newHandlerFixture(h)
+	workoutID := startTestSession(h, f)
+	expectStatus(t, h.send("POST", fmt.Sprintf("/v1/workout/%d/finish", workoutID), f.user.Token, ""), http.StatusOK)
+
+	deliveries, err := h.db.ClaimWebhookDeliveries(context.Background(), 10, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var payload WebhookPayload
+	if len(deliveries) != 1 || deliveries[0].Event != EventWorkoutCreated || json.Unmarshal(deliveries[0].Payload, &payload) != nil ||
+		payload.WorkoutID != workoutID || payload.Workout == nil || payload.Workout.End == nil {
+		t.Errorf("expected the finished workout to be delivered as created, got %+v", deliveries)
+	}
+}
+
+/* Timeouts */
+
+func TestQueryTimeouts(t *testing.T) {
+	h := newHandlerTestWith(t, WithQueryTimeout(slowDB{NewMemoryDB()}, 10*time.Millisecond))
+	defer h.close()
+	user := h.signUp("runner", "secret")
+
+	recorder := h.send("GET", "/v1/streaks", user.Token, "")
+	expectError(t, recorder, http.StatusServiceUnavailable, ErrCodeTimeout, "The request took too long to process")
+
+	// A client that goes away before the query finishes is logged as a 499.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	recorder = h.serve(newTestRequest("GET", "/v1/streaks", "", "").WithContext(ctx), user.Token)
+	expectError(t, recorder, StatusClientClosedRequest, ErrCodeRequestCancelled, "The request was cancelled")
+}
+
+// TestGraphQLDepth checks that deeply nested queries are rejected while they are parsed,
+// rather than after the parser has recursed through all of them.
+func TestGraphQLDepth(t *testing.T) {
+	h := newHandlerTest(t)
+	defer h.close()
+	user := h.signUp("runner", "secret")
+
+	nested := strings.Repeat("{ workouts ", 10000) + strings.Repeat("}", 10000)
+	values := "{ workouts(ids: " + strings.Repeat("[", 10000) + ") { id } }"
+	for _, query := range []string{nested, values} {
+		body, _ := json.Marshal(gqlRequest{Query: query})
+		recorder := h.send("POST", "/v1/graphql", user.Token, string(body))
+		var response gqlResponse
+		if !expectStatus(t, recorder, http.StatusBadRequest) || !decodeBody(t, recorder, &response) {
+			continue
+		}
+		message := fmt.Sprintf("the query exceeds the maximum depth of %d", graphQLLimits.MaxDepth)
+		if len(response.Errors) != 1 || response.Errors[0].Message != message {
+			t.Errorf("the query was rejected with %+v, expected '%s'", response.Errors, message)
+		}
+	}
+}
+
+/* Routes */
+
+// handlerFixture is the data that the requests of routeTests refer to.
+type handlerFixture struct {
+	user     User
+	workout  int
+	goal     int
+	webhook  int
+	job      int
+	calendar string
+}
+
+func newHandlerFixture(h *handlerTest) handlerFixture {
+	f := handlerFixture{user: h.signUp("runner", "secret"), calendar: "feed-token"}
+	end := testTime(h.t, 11, 0)
+	var err error
+	if f.workout, err = h.db.AddWorkout(context.Background(), Workout{User: f.user.ID, Start: testTime(h.t, 10, 0), End: &end}); err != nil {
+		h.t.Fatal(err)
+	}
+	if f.goal, err = h.db.AddGoal(context.Background(), Goal{User: f.user.ID, Metric: GoalWorkouts, Period: BucketWeek, Target: 3}); err != nil {
+		h.t.Fatal(err)
+	}
+	webhook := Webhook{User: f.user.ID, URL: "https://example.com/hook", Events: webhookEvents, Created: time.Now()}
+	if f.webhook, err = h.db.AddWebhook(context.Background(), webhook); err != nil {
+		h.t.Fatal(err)
+	}
+	now := time.Now()
+	job := ImportJob{User: f.user.ID, Source: ImportSourceStrava, Status: JobSucceeded, Created: now, Updated: now}
+	if f.job, err = h.db.AddImportJob(context.Background(), job); err != nil {
+		h.t.Fatal(err)
+	}
+	if err = h.db.SetCalendarToken(context.Background(), f.user.ID, f.calendar); err != nil {
+		h.t.Fatal(err)
+	}
+	return f
+}
+
+// expand replaces the names of the fixture's data in braces with their values.
+func (f handlerFixture) expand(s string) string {
+	return strings.NewReplacer(
+		"{user}", fmt.Sprint(f.user.ID),
+		"{workout}", fmt.Sprint(f.workout),
+		"{goal}", fmt.Sprint(f.goal),
+		"{webhook}", fmt.Sprint(f.webhook),
+		"{job}", fmt.Sprint(f.job),
+		"{calendar}", f.calendar,
+	).Replace(s)
+}
+
+// startTestSession starts a workout for the fixture's user, returning its ID.
+func startTestSession(h *handlerTest, f handlerFixture) int {
+	session, err := h.db.StartWorkout(context.Background(), f.user.ID, time.Now().Add(-time.Hour))
+	if err != nil {
+		h.t.Fatal(err)
+	}
+	return session.Workout.ID
+}
+
+// trashTestWorkout moves the fixture's workout to the trash, returning its ID.
+func trashTestWorkout(h *handlerTest, f handlerFixture) int {
+	if _, err := h.db.DeleteWorkout(context.Background(), f.workout); err != nil {
+		h.t.Fatal(err)
+	}
+	return f.workout
+}
+
+// routeTest is a request that a route answers with status, made as the fixture's user.
+// Paths and bodies refer to the fixture's data by name, such as {workout}, and {session}
+// names the workout that before returns, if any.
+type routeTest struct {
+	method      string
+	path        string
+	contentType string
+	body        string
+	status      int
+	before      func(h *handlerTest, f handlerFixture) int
+	// stream is set for responses that stay open, which are closed straight away.
+	stream bool
+}
+
+// routeTests has a request for every route of NewRouter, by the name of the route.
+var routeTests = map[string]routeTest{
+	"Index":   {method: "GET", path: "/", status: http.StatusOK},
+	"Icon":    {method: "GET", path: "/favicon.ico", status: http.StatusOK},
+	"Gopher":  {method: "GET", path: "/gopher.gif", status: http.StatusOK},
+	"OpenAPI": {method: "GET", path: "/openapi.json", status: http.StatusOK},
+
+	"SignUp": {method: "POST", path: "/signup", body: `{"name": "swimmer", "password": "secret"}`, status: http.StatusCreated},
+	"Login":  {method: "POST", path: "/login", body: `{"name": "runner", "password": "secret"}`, status: http.StatusOK},
+	"AddWorkout": {
+		method: "POST",
+		path:   "/workout",
+		body:   `{"user": {user}, "start": "2019-03-01T12:00:00Z", "end": "2019-03-01T13:00:00Z"}`,
+		status: http.StatusCreated,
+	},
+	"UpdateWorkout": {
+		method: "PUT",
+		path:   "/workout",
+		body:   `{"id": {workout}, "user": {user}, "start": "2019-03-01T12:00:00Z", "end": "2019-03-01T13:00:00Z"}`,
+		status: http.StatusNoContent,
+	},
+	"DeleteWorkout":  {method: "DELETE", path: "/workout/{workout}", status: http.StatusNoContent},
+	"GetTrash":       {method: "GET", path: "/trash", status: http.StatusOK, before: trashTestWorkout},
+	"RestoreWorkout": {method: "POST", path: "/workout/{workout}/restore", status: http.StatusOK, before: trashTestWorkout},
+	"BatchWorkouts": {
+		method: "POST",
+		path:   "/workouts/batch",
+		body:   `{"operations": [{"op": "delete", "workout": {"id": {workout}, "user": {user}}}]}`,
+		status: http.StatusOK,
+	},
+	"GraphQL":     {method: "POST", path: "/graphql", body: `{"query": "{ workouts { id start } }"}`, status: http.StatusOK},
+	"GetInsights": {method: "GET", path: "/insights?bucket=week&tz=America/Toronto", status: http.StatusOK},
+	"GetStreaks":  {method: "GET", path: "/streaks", status: http.StatusOK},
+
+	"GetGoals":        {method: "GET", path: "/goals", status: http.StatusOK},
+	"AddGoal":         {method: "POST", path: "/goal", body: `{"metric": "minutes", "period": "month", "target": 600}`, status: http.StatusCreated},
+	"UpdateGoal":      {method: "PUT", path: "/goal", body: `{"id": {goal}, "metric": "workouts", "period": "week", "target": 4}`, status: http.StatusNoContent},
+	"DeleteGoal":      {method: "DELETE", path: "/goal/{goal}", status: http.StatusNoContent},
+	"GetGoalProgress": {method: "GET", path: "/goals/progress?periods=4", status: http.StatusOK},
+	"GetHeatmap":      {method: "GET", path: "/heatmap?year=2019", status: http.StatusOK},
+	"GetTrainingLoad": {method: "GET", path: "/load?days=30", status: http.StatusOK},
+
+	"StartWorkout":     {method: "POST", path: "/workout/start", status: http.StatusCreated},
+	"GetActiveWorkout": {method: "GET", path: "/workout/active", status: http.StatusOK, before: startTestSession},
+	"PauseWorkout":     {method: "POST", path: "/workout/{session}/pause", status: http.StatusOK, before: startTestSession},
+	"ResumeWorkout": {
+		method: "POST",
+		path:   "/workout/{session}/resume",
+		status: http.StatusOK,
+		before: func(h *handlerTest, f handlerFixture) int {
+			sessionID := startTestSession(h, f)
+			if _, err := h.db.UpdateWorkoutSession(context.Background(), f.user.ID, sessionID, SessionPause, time.Now().Add(-time.Minute)); err != nil {
+				h.t.Fatal(err)
+			}
+			return sessionID
+		},
+	},
+	"FinishWorkout": {method: "POST", path: "/workout/{session}/finish", status: http.StatusOK, before: startTestSession},
+	"StreamEvents":  {method: "GET", path: "/events", status: http.StatusOK, stream: true},
+
+	"GetWebhooks":          {method: "GET", path: "/webhooks", status: http.StatusOK},
+	"AddWebhook":           {method: "POST", path: "/webhook", body: `{"url": "https://example.com/other"}`, status: http.StatusCreated},
+	"DeleteWebhook":        {method: "DELETE", path: "/webhook/{webhook}", status: http.StatusNoContent},
+	"GetWebhookDeliveries": {method: "GET", path: "/webhook/{webhook}/deliveries", status: http.StatusOK},
+
+	"CreateCalendarFeed": {method: "POST", path: "/calendar/token", status: http.StatusCreated},
+	"DeleteCalendarFeed": {method: "DELETE", path: "/calendar/token", status: http.StatusNoContent},
+	"GetCalendar":        {method: "GET", path: "/calendar/{calendar}.ics", status: http.StatusOK},
+	"ImportCalendar": {
+		method:      "POST",
+		path:        "/calendar/import",
+		contentType: "text/calendar",
+		body: "BEGIN:VCALENDAR\r\nBEGIN:VEVENT\r\nUID:plan-1\r\nSUMMARY:Long run\r\n" +
+			"DTSTART:20190302T140000Z\r\nDTEND:20190302T160000Z\r\nEND:VEVENT\r\nEND:VCALENDAR\r\n",
+		status: http.StatusOK,
+	},
+	"GetPlannedWorkouts": {method: "GET", path: "/workouts/planned", status: http.StatusOK},
+
+	"ExportCSV": {method: "GET", path: "/workouts.csv", status: http.StatusOK},
+	"ImportCSV": {
+		method:      "POST",
+		path:        "/import/csv?dry_run=true",
+		contentType: "text/csv",
+		body:        "start,end\n2019-03-02T10:00:00Z,2019-03-02T11:00:00Z\n",
+		status:      http.StatusOK,
+	},
+	// Uploads that would start import jobs are left empty, so that no job runs in the
+	// background of the tests.
+	"ImportAppleHealth": {method: "POST", path: "/import/apple-health", contentType: "application/zip", status: http.StatusBadRequest},
+	"ImportStrava":      {method: "POST", path: "/import/strava", contentType: "text/plain", body: "activities", status: http.StatusUnsupportedMediaType},
+	"GetImportJob":      {method: "GET", path: "/import/jobs/{job}", status: http.StatusOK},
+}
+
+func TestEveryRouteIsTested(t *testing.T) {
+	for name := range registeredRoutes() {
+		if _, ok := routeTests[name]; !ok {
+			t.Errorf("route %s has no request in routeTests", name)
+		}
+	}
+}
+
+func TestRoutes(t *testing.T) {
+	env := &Env{}
+	for _, route := range env.pageRoutes() {
+		testRoute(t, route.Name, "")
+	}
+	for _, route := range env.apiRoutes() {
+		testRoute(t, route.Name, apiVersion)
+		// The unversioned aliases serve the same routes.
+		testRoute(t, route.Name, "")
+	}
+}
+
+func testRoute(t *testing.T, name, prefix string) {
+	test, ok := routeTests[name]
+	if !ok {
+		return
+	}
+	h := newHandlerTest(t)
+	defer h.close()
+	f := newHandlerFixture(h)
+	path, body := f.expand(test.path), f.expand(test.body)
+	if test.before != nil {
+		path = strings.Replace(path, "{session}", fmt.Sprint(test.before(h, f)), -1)
+	}
+
+	contentType := test.contentType
+	if contentType == "" {
+		contentType = "application/json"
+	}
+	request := newTestRequest(test.method, prefix+path, contentType, body)
+	if test.stream {
+		ctx, cancel := context.WithCancel(request.Context())
+		cancel()
+		request = request.WithContext(ctx)
+	}
+	recorder := h.serve(request, f.user.Token)
+	if recorder.Code != test.status {
+		t.Errorf("%s %s (%s) returned %d, expected %d: %s", test.method, prefix+path, name, recorder.Code, test.status, recorder.Body)
+	}
+}
+
+func TestRoutesRequireAuthentication(t *testing.T) {
+	h := newHandlerTest(t)
+	defer h.close()
+	for _, path := range []string{"/v1/insights", "/v1/goals", "/v1/workout/active", "/v1/webhooks", "/v1/import/jobs/1"} {
+		recorder := h.send("GET", path, "", "")
+		expectError(t, recorder, http.StatusUnauthorized, ErrCodeUnauthorized, "An access token is required")
+		if recorder.Header().Get("WWW-Authenticate") != "Bearer" {
+			t.Errorf("GET %s did not ask for a bearer token", path)
+		}
+		recorder = h.send("GET", path, "unknown", "")
+		expectError(t, recorder, http.StatusUnauthorized, ErrCodeUnauthorized, "The given token did not match any users")
+	}
+}
+
+func TestUnknownRoutes(t *testing.T) {
+	h := newHandlerTest(t)
+	defer h.close()
+	expectStatus(t, h.send("GET", "/v1/workouts/unknown", "", ""), http.StatusNotFound)
+	expectError(t, h.send("PATCH", "/v1/workout", "", ""), http.StatusMethodNotAllowed, ErrCodeMethodNotAllowed, "Method not allowed")
+}
+
+/* JSON decoding */
+
+// jsonSeeds are valid request bodies that TestJSONDecodingFuzz mutates, by the path they
+// are sent to.
+var jsonSeeds = map[string][]string{
+	"/v1/signup": {`{"name": "runner", "password": "secret"}`},
+	"/v1/login":  {`{"name": "runner", "password": "secret"}`, `{"token": "Runner-token"}`},
+	"/v1/workout": {
+		`{"user": 1, "start": "2019-03-01T10:00:00Z", "end": "2019-03-01T11:00:00-05:00", "intensity": 5, "type": "run"}`,
+	},
+	"/v1/workouts/batch": {
+		`{"operations": [{"op": "create", "workout": {"user": 1, "start": "2019-03-01T10:00:00Z", "end": "2019-03-01T11:00:00Z"}},
+		{"op": "delete", "workout": {"id": 2, "user": 1}}]}`,
+	},
+}
+
+// jsonFragments are inserted into the bodies, to reach the decoder's edge cases.
+var jsonFragments = []string{
+	"{", "}", "[", "]", `"`, ",", ":", `\`, `é`, `\ud800`, "\xff", "\x00", "null", "true",
+	"-0", "1e400", "9223372036854775808", "0.5", `""`, `"2019-13-45T25:61:00Z"`, "é", " ",
+}
+
+// mutateJSON returns body with a few random bytes changed, removed, duplicated or added.
+func mutateJSON(random *rand.Rand, body string) string {
+	b := []byte(body)
+	for n := random.Intn(4) + 1; n > 0 && len(b) > 0; n-- {
+		i := random.Intn(len(b))
+		switch random.Intn(5) {
+		case 0:
+			b[i] = byte(random.Intn(256))
+		case 1:
+			b = append(b[:i], b[i+1:]...)
+		case 2:
+			j := i + random.Intn(len(b)-i)
+			b = append(b[:j], append(append([]byte(nil), b[i:j]...), b[j:]...)...)
+		case 3:
+			b = b[:i]
+		default:
+			fragment := jsonFragments[random.Intn(len(jsonFragments))]
+			b = append(b[:i], append([]byte(fragment), b[i:]...)...)
+		}
+	}
+	return string(b)
+}
+
+// TestJSONDecodingFuzz sends randomly mutated request bodies to the handlers that decode
+// JSON. Whatever the body, the handlers must answer without failing, and reject it with an
+// error envelope unless it is valid. The mutations are seeded, so failures can be
+// reproduced.
+func TestJSONDecodingFuzz(t *testing.T) {
+	iterations := 2000
+	if testing.Short() {
+		iterations = 200
+	}
+	h := newHandlerTest(t)
+	defer h.close()
+	h.db.SignUp(context.Background(), UserRequest{Name: "Runner", Token: "Runner-token"})
+
+	random := rand.New(rand.NewSource(1))
+	for path, seeds := range jsonSeeds {
+		for i := 0; i < iterations; i++ {
+			body := mutateJSON(random, seeds[random.Intn(len(seeds))])
+			recorder := h.serve(newTestRequest("POST", path, "application/json", body), "Runner-token")
+			switch {
+			case recorder.Code >= http.StatusInternalServerError:
+				t.Errorf("POST %s with %q returned %d: %s", path, body, recorder.Code, recorder.Body)
+			case recorder.Code >= http.StatusBadRequest:
+				var response ErrorResponse
+				if !decodeBody(t, recorder, &response) || response.Code == "" || response.Message == "" {
+					t.Errorf("POST %s with %q returned the error %s", path, body, recorder.Body)
+				}
+			case !json.Valid([]byte(body)):
+				t.Errorf("POST %s accepted the invalid JSON %q", path, body)
+			}
+		}
+	}
+}
+
+// TestDecodeJSONMatchesUnmarshal checks that decodeJSON accepts the same bodies as
+// json.Unmarshal into a value that only has known fields.
+func TestDecodeJSONMatchesUnmarshal(t *testing.T) {
+	random := rand.New(rand.NewSource(2))
+	seed := jsonSeeds["/v1/workout"][0]
+	for i := 0; i < 2000; i++ {
+		body := mutateJSON(random, seed)
+		request := newTestRequest("POST", "/v1/workout", "application/json", body)
+		recorder := httptest.NewRecorder()
+		var decoded Workout
+		accepted := decodeJSON(recorder, request, maxBodyBytes, &decoded)
+
+		var unmarshaled Workout
+		err := json.Unmarshal([]byte(body), &unmarshaled)
+		if accepted && err != nil {
+			t.Errorf("decodeJSON accepted %q, which json.Unmarshal rejects: %v", body, err)
+		}
+		if accepted && !sameJSON(decoded, unmarshaled) {
+			t.Errorf("decodeJSON read %q as %+v, json.Unmarshal as %+v", body, decoded, unmarshaled)
+		}
+		if !accepted && recorder.Code != http.StatusBadRequest {
+			t.Errorf("decodeJSON rejected %q with status %d", body, recorder.Code)
+		}
+	}
+}
+
+func sameJSON(a, b interface{}) bool {
+	encodedA, errA := json.Marshal(a)
+	encodedB, errB := json.Marshal(b)
+	return errA == nil && errB == nil && string(encodedA) == string(encodedB)
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	log "github.com/sirupsen/logrus"
+)
+
+// Importing the workouts of Apple Health exports.
+
+const (
+	// healthDateFormat is the format of dates in Apple Health exports.
+	healthDateFormat = "2006-01-02 15:04:05 -0700"
+	// healthExportName is the name of the export in the archive made by the Health app.
+	healthExportName = "export.xml"
+	// healthActivityTypePrefix begins the names of the activity types of workouts, such as
+	// HKWorkoutActivityTypeRunning.
+	healthActivityTypePrefix = "HKWorkoutActivityType"
+	// maxHealthExportBytes is the largest export that can be uploaded. Exports hold every
+	// sample recorded by the phone and its accessories, so years of them run to gigabytes.
+	maxHealthExportBytes = 4 << 30
+)
+
+// healthWorkout is a Workout element of an Apple Health export, which records an
+// HKWorkout.
+type healthWorkout struct {
+	ActivityType string `xml:"workoutActivityType,attr"`
+	StartDate    string `xml:"startDate,attr"`
+	EndDate      string `xml:"endDate,attr"`
+}
+
+// workout converts the element into a workout of the given user, reporting the problems
+// with it as those of the given record.
+func (element healthWorkout) workout(userID, record int) (Workout, []ImportError) {
+	var problems []ImportError
+	workout := Workout{
+		User: userID,
+		Type: normalizeWorkoutType(strings.TrimPrefix(element.ActivityType, healthActivityTypePrefix)),
+	}
+	start, err := time.Parse(healthDateFormat, element.StartDate)
+	if err != nil {
+		problems = append(problems, ImportError{record, "startDate", fmt.Sprintf("'%s' is not a valid date", element.StartDate)})
+	}
+	end, err := time.Parse(healthDateFormat, element.EndDate)
+	if err != nil {
+		problems = append(problems, ImportError{record, "endDate", fmt.Sprintf("'%s' is not a valid date", element.EndDate)})
+	}
+	if len(problems) > 0 {
+		return workout, problems
+	}
+
+	workout.Start, workout.End = start, &end
+	for _, problem := range workout.validateNew() {
+		problems = append(problems, ImportError{record, problem.Field, problem.Message})
+	}
+	return workout, problems
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	io.Reader
+	n int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.n += int64(n)
+	return n, err
+}
+
+// zipEntry closes an entry of a ZIP archive along with the archive.
+type zipEntry struct {
+	io.ReadCloser
+	archive *zip.ReadCloser
+}
+
+func (entry zipEntry) Close() error {
+	entry.ReadCloser.Close()
+	return entry.archive.Close()
+}
+
+// openHealthExport opens the Apple Health export at filename, which may either be the
+// export.xml itself or the ZIP archive that the Health app shares it in, and returns its
+// size in bytes.
+func openHealthExport(filename string) (io.ReadCloser, int64, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, 0, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, 0, err
+	}
+	magic := make([]byte, 4)
+	if _, err = io.ReadFull(file, magic); err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		file.Close()
+		return nil, 0, err
+	}
+	if !bytes.Equal(magic, []byte("PK\x03\x04")) {
+		if _, err = file.Seek(0, io.SeekStart); err != nil {
+			file.Close()
+			return nil, 0, err
+		}
+		return file, info.Size(), nil
+	}
+	file.Close()
+
+	archive, err := zip.OpenReader(filename)
+	if err != nil {
+		return nil, 0, err
+	}
+	for _, entry := range archive.File {
+		if path.Base(entry.Name) != healthExportName {
+			continue
+		}
+		contents, err := entry.Open()
+		if err != nil {
+			archive.Close()
+			return nil, 0, err
+		}
+		return zipEntry{contents, archive}, int64(entry.UncompressedSize64), nil
+	}
+	archive.Close()
+	return nil, 0, fmt.Errorf("the archive does not contain an %s", healthExportName)
+}
+
+// importHealthFile imports the Apple Health export at job.File. It satisfies importer.
+func importHealthFile(ctx context.Context, db Datastore, job *ImportJob, report func(*ImportJob) error) error {
+	export, size, err := openHealthExport(job.File)
+	if err != nil {
+		return err
+	}
+	defer export.Close()
+	job.TotalBytes = size
+	return importAppleHealth(ctx, db, export, job, report)
+}
+
+// importAppleHealth streams the workouts of an Apple Health export into the datastore as
+// workouts of job.User, without holding more than a batch of them in memory. Workouts with
+// the same start and end as an existing workout of the user are skipped as duplicates.
+func importAppleHealth(ctx context.Context, db Datastore, r io.Reader, job *ImportJob, report func(*ImportJob) error) error {
+	counter := &countingReader{Reader: r}
+	decoder := xml.NewDecoder(counter)
+	batch := newWorkoutBatch(ctx, db, job, report)
+	batch.progress = func(job *ImportJob) {
+		job.BytesRead = counter.n
+	}
+
+	resumeAfter := job.Processed
+	record := 0
+	root := true
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("invalid export: %v", err)
+		}
+		start, ok := token.(xml.StartElement)
+		switch {
+		case !ok:
+			continue
+		case root:
+			if start.Name.Local != "HealthData" {
+				return errors.New("the file is not an Apple Health export")
+			}
+			root = false
+			continue
+		case start.Name.Local == "Workout":
+			var element healthWorkout
+			if err = decoder.DecodeElement(&element, &start); err != nil {
+				return fmt.Errorf("invalid export: %v", err)
+			}
+			if record++; record <= resumeAfter {
+				break
+			}
+			job.Processed = record
+			workout, problems := element.workout(job.User, record)
+			for _, problem := range problems {
+				job.addError(problem)
+			}
+			if len(problems) == 0 {
+				err = batch.add(workout)
+			}
+		default:
+			// Samples, which make up most of an export, are skipped without decoding them.
+			if err = decoder.Skip(); err != nil {
+				return fmt.Errorf("invalid export: %v", err)
+			}
+		}
+		if err == nil {
+			err = batch.tick()
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if root {
+		return errors.New("the file is not an Apple Health export")
+	}
+	return batch.flush()
+}
+
+// ImportAppleHealth starts a job importing the workouts of the Apple Health export in the
+// request body, either the export.xml or the ZIP archive the Health app shares. Workouts
+// already recorded with the same start and end are skipped. Imported workouts are not
+// published as events, since an export can hold years of them.
+func (env *Env) ImportAppleHealth(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	user, ok := env.authenticate(w, r)
+	if !ok {
+		return
+	}
+	filename, ok := receiveUpload(
+		w,
+		r,
+		env.importDir,
+		maxHealthExportBytes,
+		"an Apple Health export",
+		"application/xml", "text/xml", "application/zip", "application/octet-stream",
+	)
+	if !ok {
+		return
+	}
+	env.startImportJob(w, r, user, ImportSourceAppleHealth, filename)
+}
+
+// importHealthCommand imports an Apple Health export from the command line, for loading
+// large exports without uploading them:
+//
+//	workout-tracker import-health -user 1 export.zip
+func importHealthCommand(db Datastore, args []string) error {
+	flags := flag.NewFlagSet("import-health", flag.ContinueOnError)
+	userID := flags.Int("user", 0, "the ID of the user to import the workouts for")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *userID == 0 || flags.NArg() != 1 {
+		flags.Usage()
+		return errors.New("usage: import-health -user ID FILE")
+	}
+	ctx := context.Background()
+	name, err := db.GetUsername(ctx, *userID)
+	if err != nil {
+		return err
+	}
+
+	job := ImportJob{
+		User:    *userID,
+		Source:  ImportSourceAppleHealth,
+		Status:  JobRunning,
+		Created: time.Now(),
+		File:    flags.Arg(0),
+	}
+	logger := log.WithFields(log.Fields{"name": name, "file": job.File})
+	logger.Info("Importing Apple Health export")
+	err = importHealthFile(ctx, db, &job, func(job *ImportJob) error {
+		progress := 0.0
+		if job.TotalBytes > 0 {
+			progress = float64(job.BytesRead) / float64(job.TotalBytes) * 100
+		}
+		logger.WithFields(log.Fields{
+			"progress": fmt.Sprintf("%.1f%%", progress),
+			"imported": job.Imported,
+		}).Info("Importing")
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, problem := range job.Errors {
+		logger.WithFields(log.Fields{
+			"record": problem.Record,
+			"field":  problem.Field,
+		}).Warn(problem.Message)
+	}
+	logger.WithFields(log.Fields{
+		"workouts":   job.Processed,
+		"imported":   job.Imported,
+		"duplicates": job.Duplicates,
+		"failed":     job.Failed,
+	}).Info("Imported Apple Health export")
+	return nil
+}
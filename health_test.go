@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// healthExport returns an Apple Health export of the given elements, with the document
+// type declaration and samples that real exports begin with.
+func healthExport(elements ...string) string {
+	return `<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE HealthData [
+<!ELEMENT HealthData (ExportDate,Me,(Record|Correlation|Workout|ActivitySummary)*)>
+<!ATTLIST HealthData locale CDATA #REQUIRED>
+]>
+<HealthData locale="en_CA">
+ <ExportDate value="2019-03-05 10:00:00 -0500"/>
+ <Me HKCharacteristicTypeIdentifierDateOfBirth="1990-01-01"/>
+ <Record type="HKQuantityTypeIdentifierStepCount" startDate="2019-03-01 08:00:00 -0500" endDate="2019-03-01 08:30:00 -0500" value="4000">
+  <MetadataEntry key="HKWasUserEntered" value="0"/>
+ </Record>
+` + strings.Join(elements, "\n") + `
+</HealthData>
+`
+}
+
+func healthWorkoutElement(activityType, start, end string) string {
+	return `<Workout workoutActivityType="` + activityType + `" duration="30" durationUnit="min" startDate="` + start + `" endDate="` + end + `">
+  <MetadataEntry key="HKIndoorWorkout" value="0"/>
+  <WorkoutEvent type="HKWorkoutEventTypePause" date="` + start + `"/>
+  <WorkoutRoute><Location date="` + start + `" latitude="43.65" longitude="-79.38"/></WorkoutRoute>
+ </Workout>`
+}
+
+func TestImportAppleHealth(t *testing.T) {
+	export := healthExport(
+		healthWorkoutElement("HKWorkoutActivityTypeRunning", "2019-03-01 08:00:00 -0500", "2019-03-01 08:30:00 -0500"),
+		healthWorkoutElement("HKWorkoutActivityTypeTraditionalStrengthTraining", "2019-03-02 18:00:00 -0500", "2019-03-02 19:00:00 -0500"),
+		healthWorkoutElement("HKWorkoutActivityTypeYoga", "yesterday", "2019-03-03 07:00:00 -0500"),
+		healthWorkoutElement("HKWorkoutActivityTypeCycling", "2019-03-04 08:00:00 +0100", "2019-03-04 07:00:00 +0100"),
+		healthWorkoutElement("HKWorkoutActivityTypeSwimming", "2019-03-05 06:00:00 -0500", "2019-03-05 06:45:00 -0500"),
+	)
+	problems := []ImportError{
+		{Record: 3, Field: "startDate", Message: "'yesterday' is not a valid date"},
+		{Record: 4, Field: "end", Message: "must be after start"},
+	}
+
+	for _, test := range []struct {
+		name string
+		// processed is the number of workouts a resumed job has already processed, and
+		// existing whether the first workout has already been recorded.
+		processed  int
+		existing   bool
+		types      []string
+		duplicates int
+		problems   []ImportError
+	}{
+		{name: "new", types: []string{"running", "traditional_strength_training", "swimming"}, problems: problems},
+		{name: "duplicate", existing: true, types: []string{"traditional_strength_training", "swimming"}, duplicates: 1, problems: problems},
+		{name: "resumed", processed: 2, types: []string{"swimming"}, problems: problems},
+		{name: "resumed after errors", processed: 4, types: []string{"swimming"}},
+		{name: "finished", processed: 5},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			db := NewMemoryDB()
+			userID := addTestUser(t, db, "Runner")
+			if test.existing {
+				start := time.Date(2019, time.March, 1, 13, 0, 0, 0, time.UTC)
+				addTestWorkout(t, db, userID, start, 30*time.Minute)
+			}
+
+			job := &ImportJob{User: userID, Processed: test.processed}
+			reports := 0
+			err := importAppleHealth(context.Background(), db, strings.NewReader(export), job, func(reported *ImportJob) error {
+				if reported != job {
+					t.Error("a different job was reported")
+				}
+				reports++
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if job.Processed != 5 || job.Imported != len(test.types) || job.Duplicates != test.duplicates || job.Failed != len(test.problems) {
+				t.Errorf("job processed %d, imported %d, skipped %d and failed %d", job.Processed, job.Imported, job.Duplicates, job.Failed)
+			}
+			if job.BytesRead != int64(len(export)) || reports == 0 {
+				t.Errorf("job read %d of %d bytes after %d reports", job.BytesRead, len(export), reports)
+			}
+			if len(job.Errors) != len(test.problems) {
+				t.Fatalf("job errors are %+v, expected %+v", job.Errors, test.problems)
+			}
+			for i := range job.Errors {
+				if job.Errors[i] != test.problems[i] {
+					t.Errorf("job error %d is %+v, expected %+v", i, job.Errors[i], test.problems[i])
+				}
+			}
+
+			workouts, err := db.GetWorkouts(context.Background(), userID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var types []string
+			for _, workout := range workouts {
+				if workout.Type != "run" {
+					types = append(types, workout.Type)
+				}
+			}
+			if !equalStrings(types, test.types) {
+				t.Errorf("imported workouts are of types %v, expected %v", types, test.types)
+			}
+		})
+	}
+}
+
+func TestImportAppleHealthTimes(t *testing.T) {
+	db := NewMemoryDB()
+	userID := addTestUser(t, db, "Runner")
+	export := healthExport(healthWorkoutElement("HKWorkoutActivityTypeRunning", "2019-03-10 01:30:00 -0500", "2019-03-10 03:15:00 -0400"))
+	job := &ImportJob{User: userID}
+	err := importAppleHealth(context.Background(), db, strings.NewReader(export), job, func(*ImportJob) error { return nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	workouts, err := db.GetWorkouts(context.Background(), userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The workout spans the hour that clocks skipped in Toronto when daylight saving time
+	// began, so it lasted 45 minutes.
+	if len(workouts) != 1 || workouts[0].Duration() != 45*time.Minute ||
+		!workouts[0].Start.Equal(time.Date(2019, time.March, 10, 6, 30, 0, 0, time.UTC)) {
+		t.Errorf("imported workouts are %+v", workouts)
+	}
+}
+
+func TestImportAppleHealthErrors(t *testing.T) {
+	reportErr := errors.New("unable to save the job")
+	for _, test := range []struct {
+		name, export, message string
+		report                error
+	}{
+		{name: "empty", message: "the file is not an Apple Health export"},
+		{name: "other document", export: `<?xml version="1.0"?><gpx><trk/></gpx>`, message: "the file is not an Apple Health export"},
+		{name: "malformed", export: `<HealthData><Record></HealthData>`, message: "invalid export: XML syntax error on line 1: element <Record> closed by </HealthData>"},
+		{name: "truncated", export: healthExport()[:300], message: "invalid export: XML syntax error on line "},
+		{
+			name:    "report",
+			export:  healthExport(healthWorkoutElement("HKWorkoutActivityTypeRunning", "2019-03-01 08:00:00 -0500", "2019-03-01 08:30:00 -0500")),
+			message: reportErr.Error(),
+			report:  reportErr,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			db := NewMemoryDB()
+			job := &ImportJob{User: addTestUser(t, db, "Runner")}
+			err := importAppleHealth(context.Background(), db, strings.NewReader(test.export), job, func(*ImportJob) error { return test.report })
+			if err == nil || !strings.HasPrefix(err.Error(), test.message) {
+				t.Errorf("error is %v, expected %s", err, test.message)
+			}
+		})
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	log "github.com/sirupsen/logrus"
+)
+
+// GetHeatmap returns the number of workouts and total minutes for each day of a calendar
+// year of the requesting user. The optional query parameters are year, defaulting to the
+// current year, and tz, which determines where days begin and end.
+func (env *Env) GetHeatmap(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	user, ok := env.authenticate(w, r)
+	if !ok {
+		return
+	}
+	params := r.URL.Query()
+	location, problems := parseTimeZone(params)
+	now := time.Now().In(location)
+	year, yearProblems := parseInt(params, "year", now.Year(), 1970, now.Year()+1)
+	if !validRequest(w, append(problems, yearProblems...)) {
+		return
+	}
+
+	from := time.Date(year, time.January, 1, 0, 0, 0, 0, location)
+	workouts, err := env.db.GetWorkoutsBetween(r.Context(), user.ID, from, from.AddDate(1, 0, 0))
+	if err != nil {
+		InternalServerError(w, err)
+		return
+	}
+
+	heatmap := ComputeHeatmap(workouts, year, location)
+	log.WithFields(log.Fields{
+		"name": user.Name,
+		"year": year,
+	}).Info("Computed heatmap")
+	WriteJSON(w, http.StatusOK, heatmap)
+}
+
+// ComputeHeatmap groups workouts by the day of the given year they started on in loc.
+// Every day of the year is included, whether or not it has workouts.
+func ComputeHeatmap(workouts []Workout, year int, loc *time.Location) Heatmap {
+	heatmap := Heatmap{Year: year, TimeZone: loc.String()}
+	for day := time.Date(year, time.January, 1, 0, 0, 0, 0, time.UTC); day.Year() == year; day = day.AddDate(0, 0, 1) {
+		heatmap.Days = append(heatmap.Days, HeatmapDay{Date: day.Format("2006-01-02")})
+	}
+
+	for _, workout := range workouts {
+		start := workout.Start.In(loc)
+		if start.Year() != year {
+			continue
+		}
+		day := &heatmap.Days[start.YearDay()-1]
+		minutes := workout.Duration().Minutes()
+		day.Count++
+		day.Minutes += minutes
+		heatmap.Count++
+		heatmap.TotalMinutes += minutes
+		if day.Count > heatmap.MaxCount {
+			heatmap.MaxCount = day.Count
+		}
+	}
+	return heatmap
+}
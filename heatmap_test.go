@@ -0,0 +1,111 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func testWorkout(start time.Time, length time.Duration) Workout {
+	end := start.Add(length)
+	return Workout{Start: start, End: &end}
+}
+
+func TestComputeHeatmap(t *testing.T) {
+	toronto := testLocation(t)
+	at := func(year int, month time.Month, day, hour, minute int) time.Time {
+		return time.Date(year, month, day, hour, minute, 0, 0, toronto)
+	}
+
+	for _, test := range []struct {
+		name     string
+		workouts []Workout
+		year     int
+		// days are the expected days with workouts, and every other day must be empty.
+		days     map[string]HeatmapDay
+		length   int
+		count    int
+		minutes  float64
+		maxCount int
+	}{{
+		name:   "empty history",
+		year:   2019,
+		length: 365,
+	}, {
+		name: "leap year",
+		workouts: []Workout{
+			testWorkout(at(2020, time.February, 29, 8, 0), 30*time.Minute),
+			testWorkout(at(2020, time.December, 31, 8, 0), 45*time.Minute),
+		},
+		year: 2020,
+		days: map[string]HeatmapDay{
+			"2020-02-29": {Count: 1, Minutes: 30},
+			"2020-12-31": {Count: 1, Minutes: 45},
+		},
+		length:   366,
+		count:    2,
+		minutes:  75,
+		maxCount: 1,
+	}, {
+		// Days begin and end in Toronto, not UTC, which is five hours ahead in winter.
+		name: "year boundaries",
+		workouts: []Workout{
+			testWorkout(at(2018, time.December, 31, 23, 30), 20*time.Minute),
+			testWorkout(at(2019, time.January, 1, 0, 15), 30*time.Minute),
+			testWorkout(at(2019, time.December, 31, 21, 0), 40*time.Minute),
+			testWorkout(at(2020, time.January, 1, 0, 0), 50*time.Minute),
+		},
+		year: 2019,
+		days: map[string]HeatmapDay{
+			"2019-01-01": {Count: 1, Minutes: 30},
+			"2019-12-31": {Count: 1, Minutes: 40},
+		},
+		length:   365,
+		count:    2,
+		minutes:  70,
+		maxCount: 1,
+	}, {
+		// Clocks went forward from 2:00 to 3:00 on 10 March, which is only 23 hours long.
+		name: "daylight saving time begins",
+		workouts: []Workout{
+			testWorkout(at(2019, time.March, 9, 23, 30), 60*time.Minute),
+			testWorkout(at(2019, time.March, 10, 0, 30), 15*time.Minute),
+			testWorkout(at(2019, time.March, 10, 3, 30), 15*time.Minute),
+			testWorkout(at(2019, time.March, 10, 23, 30), 15*time.Minute),
+			{Start: at(2019, time.March, 11, 0, 5)},
+		},
+		year: 2019,
+		days: map[string]HeatmapDay{
+			"2019-03-09": {Count: 1, Minutes: 60},
+			"2019-03-10": {Count: 3, Minutes: 45},
+			"2019-03-11": {Count: 1},
+		},
+		length:   365,
+		count:    5,
+		minutes:  105,
+		maxCount: 3,
+	}} {
+		t.Run(test.name, func(t *testing.T) {
+			heatmap := ComputeHeatmap(test.workouts, test.year, toronto)
+			if heatmap.Year != test.year || heatmap.TimeZone != "America/Toronto" {
+				t.Errorf("heatmap is for %d in %s", heatmap.Year, heatmap.TimeZone)
+			}
+			if len(heatmap.Days) != test.length {
+				t.Fatalf("heatmap has %d days, expected %d", len(heatmap.Days), test.length)
+			}
+			if first := heatmap.Days[0].Date; first != time.Date(test.year, time.January, 1, 0, 0, 0, 0, time.UTC).Format("2006-01-02") {
+				t.Errorf("heatmap begins on %s", first)
+			}
+			for _, day := range heatmap.Days {
+				expected := test.days[day.Date]
+				expected.Date = day.Date
+				if day != expected {
+					t.Errorf("day is %+v, expected %+v", day, expected)
+				}
+			}
+			if heatmap.Count != test.count || heatmap.TotalMinutes != test.minutes || heatmap.MaxCount != test.maxCount {
+				t.Errorf("heatmap has %d workouts, %v minutes and at most %d a day, expected %d, %v and %d",
+					heatmap.Count, heatmap.TotalMinutes, heatmap.MaxCount, test.count, test.minutes, test.maxCount)
+			}
+		})
+	}
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// iCalendar (RFC 5545) encoding and decoding.
+
+const (
+	// icsUTCFormat and icsLocalFormat are the formats of date-times in UTC and in a time
+	// zone given separately, and icsDateFormat the format of dates.
+	icsUTCFormat   = "20060102T150405Z"
+	icsLocalFormat = "20060102T150405"
+	icsDateFormat  = "20060102"
+	// icsLineLength is the longest a content line may be, in bytes, before it is folded.
+	icsLineLength = 75
+	// icsDomain makes the UIDs of the events we generate globally unique.
+	icsDomain = "workout-tracker"
+	// maxPlannedTextLength matches the uid and summary columns of planned_workouts.
+	maxPlannedTextLength = 255
+)
+
+// icsWriter builds an iCalendar object one content line at a time.
+type icsWriter struct {
+	buffer bytes.Buffer
+}
+
+// line writes a content line, folding it so that no line is longer than icsLineLength
+// bytes without splitting a UTF-8 character. Lines end with CRLF.
+func (w *icsWriter) line(name, value string) {
+	line := name + ":" + value
+	limit := icsLineLength
+	for len(line) > limit {
+		cut := limit
+		for cut > 0 && !utf8.RuneStart(line[cut]) {
+			cut--
+		}
+		w.buffer.WriteString(line[:cut] + "\r\n ")
+		line = line[cut:]
+		// Continuation lines begin with a space, which counts towards their length.
+		limit = icsLineLength - 1
+	}
+	w.buffer.WriteString(line + "\r\n")
+}
+
+// event writes a VEVENT with the given properties in order.
+func (w *icsWriter) event(properties ...[2]string) {
+	w.line("BEGIN", "VEVENT")
+	for _, property := range properties {
+		w.line(property[0], property[1])
+	}
+	w.line("END", "VEVENT")
+}
+
+var icsTextEscaper = strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\r\n", `\n`, "\n", `\n`)
+
+var icsTextUnescaper = strings.NewReplacer(`\\`, `\`, `\;`, ";", `\,`, ",", `\n`, "\n", `\N`, "\n")
+
+// WriteICS encodes a user's workouts and planned workouts as an iCalendar feed. Planned
+// workouts are marked as tentative. now is used as the timestamp of every event.
+func WriteICS(name string, workouts []Workout, planned []PlannedWorkout, now time.Time) []byte {
+	var w icsWriter
+	stamp := now.UTC().Format(icsUTCFormat)
+	w.line("BEGIN", "VCALENDAR")
+	w.line("VERSION", "2.0")
+	w.line("PRODID", "-//workout-tracker//Workouts//EN")
+	w.line("CALSCALE", "GREGORIAN")
+	w.line("METHOD", "PUBLISH")
+	w.line("X-WR-CALNAME", icsTextEscaper.Replace(name+"'s workouts"))
+	w.line("REFRESH-INTERVAL;VALUE=DURATION", "PT1H")
+	w.line("X-PUBLISHED-TTL", "PT1H")
+
+	for _, workout := range workouts {
+		if workout.End == nil {
+			continue
+		}
+		description := fmt.Sprintf("%.0f minutes", workout.Duration().Minutes())
+		if workout.Intensity != nil {
+			description += fmt.Sprintf(", intensity %d/10", *workout.Intensity)
+		}
+		w.event(
+			[2]string{"UID", fmt.Sprintf("workout-%d@%s", workout.ID, icsDomain)},
+			[2]string{"DTSTAMP", stamp},
+			[2]string{"DTSTART", workout.Start.UTC().Format(icsUTCFormat)},
+			[2]string{"DTEND", workout.End.UTC().Format(icsUTCFormat)},
+			[2]string{"SUMMARY", "Workout"},
+			[2]string{"DESCRIPTION", icsTextEscaper.Replace(description)},
+			[2]string{"TRANSP", "OPAQUE"},
+		)
+	}
+	for _, workout := range planned {
+		w.event(
+			[2]string{"UID", fmt.Sprintf("planned-%d@%s", workout.ID, icsDomain)},
+			[2]string{"DTSTAMP", stamp},
+			[2]string{"DTSTART", workout.Start.UTC().Format(icsUTCFormat)},
+			[2]string{"DTEND", workout.End.UTC().Format(icsUTCFormat)},
+			[2]string{"SUMMARY", icsTextEscaper.Replace(workout.Summary)},
+			[2]string{"STATUS", "TENTATIVE"},
+		)
+	}
+
+	w.line("END", "VCALENDAR")
+	return w.buffer.Bytes()
+}
+
+// icsProperty is a single unfolded content line of an iCalendar object.
+type icsProperty struct {
+	name   string
+	params map[string]string
+	value  string
+}
+
+// parseICSProperty splits a content line into its name, parameters and value. Parameter
+// values may be quoted, in which case they can contain colons and semicolons.
+func parseICSProperty(line string) (icsProperty, error) {
+	property := icsProperty{params: make(map[string]string)}
+	quoted := false
+	start := 0
+	for i, c := range line {
+		switch {
+		case c == '"':
+			quoted = !quoted
+		case quoted:
+		case c == ';' || c == ':':
+			part := line[start:i]
+			if start == 0 {
+				property.name = strings.ToUpper(part)
+			} else if eq := strings.IndexByte(part, '='); eq > 0 {
+				property.params[strings.ToUpper(part[:eq])] = strings.Trim(part[eq+1:], `"`)
+			}
+			start = i + 1
+			if c == ':' {
+				property.value = line[i+1:]
+				return property, nil
+			}
+		}
+	}
+	return property, errors.New("content line has no value")
+}
+
+// unfoldICS splits an iCalendar object into its content lines, joining folded lines.
+func unfoldICS(data []byte) []string {
+	text := strings.Replace(string(data), "\r\n", "\n", -1)
+	var lines []string
+	for _, line := range strings.Split(text, "\n") {
+		if (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")) && len(lines) > 0 {
+			lines[len(lines)-1] += line[1:]
+		} else if line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+// ParsePlannedWorkouts reads the events of an iCalendar object as planned workouts. Times
+// without a time zone, and in time zones that cannot be loaded, are read in loc. All-day
+// events last from the start of their first day to the start of the day after their last.
+// Events that cannot be read are reported by their position in the object, starting
+// from 1, rather than failing the whole import.
+func ParsePlannedWorkouts(data []byte, loc *time.Location) ([]PlannedWorkout, []ImportError, error) {
+	var planned []PlannedWorkout
+	var problems []ImportError
+	var components []string
+	var event map[string]icsProperty
+	record := 0
+
+	lines := unfoldICS(data)
+	if len(lines) == 0 || !strings.EqualFold(lines[0], "BEGIN:VCALENDAR") {
+		return nil, nil, errors.New("not an iCalendar object")
+	}
+	for _, line := range lines {
+		property, err := parseICSProperty(line)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid content line %q: %v", line, err)
+		}
+		switch property.name {
+		case "BEGIN":
+			components = append(components, strings.ToUpper(property.value))
+			if len(components) == 2 && components[1] == "VEVENT" {
+				event = make(map[string]icsProperty)
+				record++
+			}
+			continue
+		case "END":
+			if len(components) == 0 {
+				return nil, nil, errors.New("END without a matching BEGIN")
+			}
+			if len(components) == 2 && components[1] == "VEVENT" {
+				workout, err := plannedWorkout(event, loc)
+				if err != nil {
+					problems = append(problems, ImportError{Record: record, Message: err.Error()})
+				} else {
+					planned = append(planned, workout)
+				}
+			}
+			components = components[:len(components)-1]
+			continue
+		}
+		// Only properties of the event itself are read, not of its alarms.
+		if len(components) == 2 && components[1] == "VEVENT" {
+			if _, seen := event[property.name]; !seen {
+				event[property.name] = property
+			}
+		}
+	}
+	if len(components) != 0 {
+		return nil, nil, errors.New("the iCalendar object is incomplete")
+	}
+	return planned, problems, nil
+}
+
+// plannedWorkout converts the properties of a VEVENT into a planned workout.
+func plannedWorkout(event map[string]icsProperty, loc *time.Location) (PlannedWorkout, error) {
+	workout := PlannedWorkout{
+		UID:     event["UID"].value,
+		Summary: strings.TrimSpace(icsTextUnescaper.Replace(event["SUMMARY"].value)),
+	}
+	if workout.UID == "" {
+		return workout, errors.New("the event has no UID")
+	}
+	if len(workout.UID) > maxPlannedTextLength {
+		return workout, fmt.Errorf("the event's UID is longer than %d characters", maxPlannedTextLength)
+	}
+	if workout.Summary == "" {
+		workout.Summary = "Workout"
+	}
+	for len(workout.Summary) > maxPlannedTextLength {
+		_, size := utf8.DecodeLastRuneInString(workout.Summary)
+		workout.Summary = workout.Summary[:len(workout.Summary)-size]
+	}
+
+	start, ok := event["DTSTART"]
+	if !ok {
+		return workout, errors.New("the event has no DTSTART")
+	}
+	var err error
+	var allDay bool
+	if workout.Start, allDay, err = parseICSTime(start, loc); err != nil {
+		return workout, fmt.Errorf("invalid DTSTART: %v", err)
+	}
+
+	if end, ok := event["DTEND"]; ok {
+		if workout.End, _, err = parseICSTime(end, loc); err != nil {
+			return workout, fmt.Errorf("invalid DTEND: %v", err)
+		}
+	} else if duration, ok := event["DURATION"]; ok {
+		d, err := parseICSDuration(duration.value)
+		if err != nil {
+			return workout, fmt.Errorf("invalid DURATION: %v", err)
+		}
+		workout.End = workout.Start.Add(d)
+	} else if allDay {
+		workout.End = workout.Start.AddDate(0, 0, 1)
+	} else {
+		return workout, errors.New("the event has no DTEND or DURATION")
+	}
+	if !workout.End.After(workout.Start) {
+		return workout, errors.New("the event must end after it starts")
+	}
+	return workout, nil
+}
+
+// parseICSTime parses the value of a DATE or DATE-TIME property, reporting whether it
+// was a date.
+func parseICSTime(property icsProperty, loc *time.Location) (time.Time, bool, error) {
+	value := property.value
+	if property.params["VALUE"] == "DATE" || len(value) == len(icsDateFormat) {
+		t, err := time.ParseInLocation(icsDateFormat, value, loc)
+		return t, true, err
+	}
+	if strings.HasSuffix(value, "Z") {
+		t, err := time.Parse(icsUTCFormat, value)
+		return t, false, err
+	}
+	if tzid := property.params["TZID"]; tzid != "" {
+		if zone, err := time.LoadLocation(tzid); err == nil {
+			loc = zone
+		}
+	}
+	t, err := time.ParseInLocation(icsLocalFormat, value, loc)
+	return t, false, err
+}
+
+var icsDuration = regexp.MustCompile(`^\+?P(?:(\d+)W)?(?:(\d+)D)?(?:T(?:(\d+)H)?(?:(\d+)M)?(?:(\d+)S)?)?$`)
+
+// parseICSDuration parses a positive iCalendar duration such as PT1H30M.
+func parseICSDuration(value string) (time.Duration, error) {
+	match := icsDuration.FindStringSubmatch(value)
+	if match == nil || value == "P" || strings.HasSuffix(value, "T") {
+		return 0, fmt.Errorf("%q is not a duration", value)
+	}
+	units := []time.Duration{7 * 24 * time.Hour, 24 * time.Hour, time.Hour, time.Minute, time.Second}
+	var d time.Duration
+	for i, unit := range units {
+		if match[i+1] != "" {
+			n, err := strconv.Atoi(match[i+1])
+			if err != nil {
+				return 0, err
+			}
+			d += time.Duration(n) * unit
+		}
+	}
+	return d, nil
+}
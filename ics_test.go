@@ -0,0 +1,178 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+func TestICSWriterFoldsLines(t *testing.T) {
+	for _, test := range []struct {
+		name  string
+		value string
+		lines int
+	}{
+		{"short", "Workout", 1},
+		{"longest unfolded", strings.Repeat("a", icsLineLength-len("SUMMARY:")), 1},
+		{"ascii", strings.Repeat("a", 200), 3},
+		{"two-byte runes", strings.Repeat("é", 100), 3},
+		{"three-byte runes", strings.Repeat("跑", 60), 3},
+		{"mixed runes", "a" + strings.Repeat("🏃é", 30), 3},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			var w icsWriter
+			w.line("SUMMARY", test.value)
+			output := w.buffer.String()
+			if !strings.HasSuffix(output, "\r\n") {
+				t.Fatalf("%q does not end with CRLF", output)
+			}
+
+			lines := strings.Split(strings.TrimSuffix(output, "\r\n"), "\r\n")
+			if len(lines) != test.lines {
+				t.Errorf("value was folded into %d lines, expected %d", len(lines), test.lines)
+			}
+			for i, line := range lines {
+				if len(line) > icsLineLength {
+					t.Errorf("line %d is %d bytes long", i, len(line))
+				}
+				if !utf8.ValidString(line) {
+					t.Errorf("line %d splits a character: %q", i, line)
+				}
+				if i > 0 && !strings.HasPrefix(line, " ") {
+					t.Errorf("continuation line %d does not begin with a space: %q", i, line)
+				}
+			}
+
+			unfolded := unfoldICS(w.buffer.Bytes())
+			if len(unfolded) != 1 || unfolded[0] != "SUMMARY:"+test.value {
+				t.Errorf("lines unfold to %q", unfolded)
+			}
+		})
+	}
+}
+
+// icsCalendar wraps the given content lines in a VCALENDAR.
+func icsCalendar(lines ...string) []byte {
+	lines = append(append([]string{"BEGIN:VCALENDAR", "VERSION:2.0"}, lines...), "END:VCALENDAR", "")
+	return []byte(strings.Join(lines, "\r\n"))
+}
+
+func TestParsePlannedWorkouts(t *testing.T) {
+	toronto := testLocation(t)
+	paris, err := time.LoadLocation("Europe/Paris")
+	if err != nil {
+		t.Fatal(err)
+	}
+	at := func(loc *time.Location, month time.Month, day, hour, minute int) time.Time {
+		return time.Date(2019, month, day, hour, minute, 0, 0, loc)
+	}
+
+	for _, test := range []struct {
+		name     string
+		data     []byte
+		planned  []PlannedWorkout
+		problems []ImportError
+	}{{
+		name: "utc",
+		data: icsCalendar(
+			"BEGIN:VEVENT", "UID:utc", "SUMMARY:Long run", "DTSTART:20190301T130000Z", "DTEND:20190301T143000Z", "END:VEVENT",
+		),
+		planned: []PlannedWorkout{{UID: "utc", Summary: "Long run", Start: at(toronto, time.March, 1, 8, 0), End: at(toronto, time.March, 1, 9, 30)}},
+	}, {
+		name: "time zones",
+		data: icsCalendar(
+			"BEGIN:VEVENT", "UID:paris", "DTSTART;TZID=Europe/Paris:20190301T080000", "DTEND;TZID=\"Europe/Paris\":20190301T090000", "END:VEVENT",
+			"BEGIN:VEVENT", "UID:floating", "DTSTART:20190301T080000", "DURATION:PT45M", "END:VEVENT",
+			"BEGIN:VEVENT", "UID:unknown", "DTSTART;TZID=Mars/Olympus_Mons:20190301T080000", "DURATION:P1DT1H", "END:VEVENT",
+		),
+		planned: []PlannedWorkout{
+			{UID: "paris", Summary: "Workout", Start: at(paris, time.March, 1, 8, 0), End: at(paris, time.March, 1, 9, 0)},
+			{UID: "floating", Summary: "Workout", Start: at(toronto, time.March, 1, 8, 0), End: at(toronto, time.March, 1, 8, 45)},
+			{UID: "unknown", Summary: "Workout", Start: at(toronto, time.March, 1, 8, 0), End: at(toronto, time.March, 2, 9, 0)},
+		},
+	}, {
+		// Clocks went forward in Toronto on 10 March, so it lasted 23 hours.
+		name: "all-day events",
+		data: icsCalendar(
+			"BEGIN:VEVENT", "UID:one", "DTSTART;VALUE=DATE:20190310", "END:VEVENT",
+			"BEGIN:VEVENT", "UID:two", "DTSTART;VALUE=DATE:20190309", "DTEND;VALUE=DATE:20190311", "END:VEVENT",
+			"BEGIN:VEVENT", "UID:implicit", "DTSTART:20190311", "DURATION:P1W", "END:VEVENT",
+		),
+		planned: []PlannedWorkout{
+			{UID: "one", Summary: "Workout", Start: at(toronto, time.March, 10, 0, 0), End: at(toronto, time.March, 11, 0, 0)},
+			{UID: "two", Summary: "Workout", Start: at(toronto, time.March, 9, 0, 0), End: at(toronto, time.March, 11, 0, 0)},
+			{UID: "implicit", Summary: "Workout", Start: at(toronto, time.March, 11, 0, 0), End: at(toronto, time.March, 18, 0, 0)},
+		},
+	}, {
+		// The summary is folded in the middle of a multibyte character, and the alarm's
+		// summary is not the event's.
+		name: "folded and escaped text",
+		data: icsCalendar(
+			"BEGIN:VEVENT", "UID:text", "DTSTART:20190301T130000Z", "DURATION:PT1H",
+			"SUMMARY:Intervals\\, hills\\; tempo \\\\ 5\xc3", " \xa9tapes",
+			"BEGIN:VALARM", "SUMMARY:Reminder", "TRIGGER:-PT15M", "END:VALARM",
+			"END:VEVENT",
+		),
+		planned: []PlannedWorkout{{UID: "text", Summary: `Intervals, hills; tempo \ 5étapes`, Start: at(toronto, time.March, 1, 8, 0), End: at(toronto, time.March, 1, 9, 0)}},
+	}, {
+		name: "invalid events",
+		data: icsCalendar(
+			"BEGIN:VEVENT", "DTSTART:20190301T130000Z", "DURATION:PT1H", "END:VEVENT",
+			"BEGIN:VEVENT", "UID:no-end", "DTSTART:20190301T130000Z", "END:VEVENT",
+			"BEGIN:VEVENT", "UID:backwards", "DTSTART:20190301T130000Z", "DTEND:20190301T120000Z", "END:VEVENT",
+			"BEGIN:VEVENT", "UID:bad-duration", "DTSTART:20190301T130000Z", "DURATION:PT", "END:VEVENT",
+			"BEGIN:VEVENT", "UID:valid", "DTSTART:20190301T130000Z", "DURATION:PT1H", "END:VEVENT",
+		),
+		planned: []PlannedWorkout{{UID: "valid", Summary: "Workout", Start: at(toronto, time.March, 1, 8, 0), End: at(toronto, time.March, 1, 9, 0)}},
+		problems: []ImportError{
+			{Record: 1, Message: "the event has no UID"},
+			{Record: 2, Message: "the event has no DTEND or DURATION"},
+			{Record: 3, Message: "the event must end after it starts"},
+			{Record: 4, Message: `invalid DURATION: "PT" is not a duration`},
+		},
+	}} {
+		t.Run(test.name, func(t *testing.T) {
+			planned, problems, err := ParsePlannedWorkouts(test.data, toronto)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(planned) != len(test.planned) {
+				t.Fatalf("read %d planned workouts, expected %d: %+v", len(planned), len(test.planned), planned)
+			}
+			for i, workout := range planned {
+				expected := test.planned[i]
+				if workout.UID != expected.UID || workout.Summary != expected.Summary || !workout.Start.Equal(expected.Start) || !workout.End.Equal(expected.End) {
+					t.Errorf("planned workout %d is %+v, expected %+v", i, workout, expected)
+				}
+			}
+			if len(problems) != len(test.problems) {
+				t.Fatalf("reported problems %+v, expected %+v", problems, test.problems)
+			}
+			for i := range problems {
+				if problems[i] != test.problems[i] {
+					t.Errorf("problem %d is %+v, expected %+v", i, problems[i], test.problems[i])
+				}
+			}
+		})
+	}
+}
+
+func TestParsePlannedWorkoutsErrors(t *testing.T) {
+	for _, test := range []struct {
+		name, data, message string
+	}{
+		{"empty", "", "not an iCalendar object"},
+		{"not a calendar", "BEGIN:VCARD\r\nEND:VCARD\r\n", "not an iCalendar object"},
+		{"incomplete", "BEGIN:VCALENDAR\r\nBEGIN:VEVENT\r\nUID:a\r\n", "the iCalendar object is incomplete"},
+		{"unmatched end", "BEGIN:VCALENDAR\r\nEND:VCALENDAR\r\nEND:VCALENDAR\r\n", "END without a matching BEGIN"},
+		{"no value", "BEGIN:VCALENDAR\r\nVERSION\r\nEND:VCALENDAR\r\n", `invalid content line "VERSION": content line has no value`},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			_, _, err := ParsePlannedWorkouts([]byte(test.data), time.UTC)
+			if err == nil || err.Error() != test.message {
+				t.Errorf("error is %v, expected %s", err, test.message)
+			}
+		})
+	}
+}
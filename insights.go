@@ -0,0 +1,140 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	log "github.com/sirupsen/logrus"
+)
+
+// defaultInsightBuckets is the number of buckets returned when no start date is given.
+const defaultInsightBuckets = 12
+
+// GetInsights returns the time of day breakdown and workout frequency of the requesting
+// user. The optional query parameters are bucket (week or month, defaulting to month), tz,
+// and the dates from and to, which are both inclusive. The range defaults to the last
+// twelve buckets up to and including today.
+func (env *Env) GetInsights(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	user, ok := env.authenticate(w, r)
+	if !ok {
+		return
+	}
+
+	params := r.URL.Query()
+	query := InsightsQuery{Bucket: params.Get("bucket")}
+	if query.Bucket == "" {
+		query.Bucket = BucketMonth
+	}
+	problems := validate(rule{
+		query.Bucket == BucketWeek || query.Bucket == BucketMonth,
+		"bucket",
+		"must be either week or month",
+	})
+	var from, to time.Time
+	var fieldProblems []FieldError
+	query.Location, fieldProblems = parseTimeZone(params)
+	problems = append(problems, fieldProblems...)
+	if len(problems) == 0 {
+		from, fieldProblems = parseDate(params, "from", query.Location)
+		problems = append(problems, fieldProblems...)
+		to, fieldProblems = parseDate(params, "to", query.Location)
+		problems = append(problems, fieldProblems...)
+	}
+
+	if len(problems) == 0 {
+		if to.IsZero() {
+			to = startOfDay(time.Now().In(query.Location))
+		}
+		query.To = to.AddDate(0, 0, 1)
+		query.From = from
+		if from.IsZero() {
+			query.From = addBuckets(bucketStart(to, query.Bucket), query.Bucket, 1-defaultInsightBuckets)
+		}
+		problems = validateRange(query.From, query.To)
+	}
+	if !validRequest(w, problems) {
+		return
+	}
+
+	insights, err := env.db.GetInsights(r.Context(), user.ID, query)
+	if err != nil {
+		InternalServerError(w, err)
+		return
+	}
+	log.WithFields(log.Fields{
+		"name":   user.Name,
+		"bucket": query.Bucket,
+	}).Info("Computed insights")
+	WriteJSON(w, http.StatusOK, insights)
+}
+
+// ComputeInsights computes the insights of the given workouts over the range of the query,
+// for datastores that cannot compute them in the database. The workouts are expected to
+// be the finished workouts that started within the range. As in the Postgres datastore,
+// workouts are placed in the part of the day they ended in and the bucket they started in.
+func ComputeInsights(workouts []Workout, query InsightsQuery) Insights {
+	insights := Insights{
+		From:      query.From,
+		To:        query.To,
+		Bucket:    query.Bucket,
+		TimeZone:  query.Location.String(),
+		Frequency: make([]FrequencyBucket, 0),
+	}
+	for start := bucketStart(query.From.In(query.Location), query.Bucket); start.Before(query.To); start = addBuckets(start, query.Bucket, 1) {
+		insights.Frequency = append(insights.Frequency, FrequencyBucket{Start: start})
+	}
+
+	for _, workout := range workouts {
+		if workout.End == nil {
+			continue
+		}
+		switch hour := workout.End.In(query.Location).Hour(); {
+		case hour < 6:
+			insights.TimeOfDay.Night++
+		case hour < 12:
+			insights.TimeOfDay.Morning++
+		case hour < 18:
+			insights.TimeOfDay.Afternoon++
+		default:
+			insights.TimeOfDay.Evening++
+		}
+
+		start := bucketStart(workout.Start.In(query.Location), query.Bucket)
+		for i := range insights.Frequency {
+			if insights.Frequency[i].Start.Equal(start) {
+				insights.Frequency[i].Count++
+				insights.Frequency[i].TotalMinutes += workout.Duration().Minutes()
+				break
+			}
+		}
+	}
+	return insights
+}
+
+/* Calendar helpers */
+
+// startOfDay returns midnight at the start of the day of t in t's location.
+func startOfDay(t time.Time) time.Time {
+	year, month, day := t.Date()
+	return time.Date(year, month, day, 0, 0, 0, 0, t.Location())
+}
+
+// bucketStart returns the start of the week (beginning on Monday) or month containing t
+// in t's location.
+func bucketStart(t time.Time, bucket string) time.Time {
+	day := startOfDay(t)
+	if bucket == BucketWeek {
+		daysSinceMonday := (int(day.Weekday()) + 6) % 7
+		return day.AddDate(0, 0, -daysSinceMonday)
+	}
+	return day.AddDate(0, 0, 1-day.Day())
+}
+
+// addBuckets moves the start of a bucket forward by n weeks or months.
+func addBuckets(start time.Time, bucket string, n int) time.Time {
+	if bucket == BucketWeek {
+		return start.AddDate(0, 0, 7*n)
+	}
+	return start.AddDate(0, n, 0)
+}
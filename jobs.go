@@ -0,0 +1,297 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// maxJobErrors is the number of records that could not be imported that a job lists.
+	maxJobErrors = 100
+	// jobProgressInterval is how often a running job saves its progress.
+	jobProgressInterval = time.Second
+	// jobBatchSize is the most imported workouts written to the datastore at once.
+	jobBatchSize = 500
+	// jobLease is how long a job can go without saving its progress before it is
+	// considered interrupted, and jobResumeInterval how often interrupted jobs are looked
+	// for.
+	jobLease          = 5 * time.Minute
+	jobResumeInterval = time.Minute
+	// defaultImportDir is where uploads are kept until they are imported unless
+	// IMPORT_DIR says otherwise.
+	defaultImportDir = "imports"
+)
+
+// importer imports the file at job.File into the datastore, updating job as it goes and
+// calling report to save its progress. Jobs that are resumed have already processed
+// job.Processed records, which the importer skips.
+type importer func(ctx context.Context, db Datastore, job *ImportJob, report func(*ImportJob) error) error
+
+// importers maps each import source to its importer.
+var importers = map[string]importer{
+	ImportSourceAppleHealth: importHealthFile,
+	ImportSourceStrava:      importStravaFile,
+}
+
+// addError records a record that could not be imported.
+func (job *ImportJob) addError(problem ImportError) {
+	job.Failed++
+	if len(job.Errors) < maxJobErrors {
+		job.Errors = append(job.Errors, problem)
+	}
+}
+
+// workoutBatch collects the workouts read by an importer and writes them to the
+// datastore a batch at a time, saving the job's progress after each batch and at least
+// every jobProgressInterval.
+type workoutBatch struct {
+	ctx      context.Context
+	db       Datastore
+	job      *ImportJob
+	report   func(*ImportJob) error
+	workouts []Workout
+	reported time.Time
+	// progress, if set, updates the job's progress before it is saved.
+	progress func(*ImportJob)
+}
+
+func newWorkoutBatch(ctx context.Context, db Datastore, job *ImportJob, report func(*ImportJob) error) *workoutBatch {
+	return &workoutBatch{
+		ctx:      ctx,
+		db:       db,
+		job:      job,
+		report:   report,
+		workouts: make([]Workout, 0, jobBatchSize),
+		reported: time.Now(),
+	}
+}
+
+// add adds a workout to the batch, writing the batch once it is full.
+func (b *workoutBatch) add(workout Workout) error {
+	b.workouts = append(b.workouts, workout)
+	if len(b.workouts) >= jobBatchSize {
+		return b.flush()
+	}
+	return b.tick()
+}
+
+// tick writes the batch if the job has not saved its progress for jobProgressInterval.
+func (b *workoutBatch) tick() error {
+	if time.Since(b.reported) < jobProgressInterval {
+		return nil
+	}
+	return b.flush()
+}
+
+// flush writes the workouts in the batch, skipping duplicates, and saves the job's
+// progress.
+func (b *workoutBatch) flush() error {
+	if len(b.workouts) > 0 {
+		ids, err := b.db.ImportWorkouts(b.ctx, b.workouts)
+		if err != nil {
+			return err
+		}
+		for _, id := range ids {
+			if id == 0 {
+				b.job.Duplicates++
+			} else {
+				b.job.Imported++
+			}
+		}
+		b.workouts = b.workouts[:0]
+	}
+	if b.progress != nil {
+		b.progress(b.job)
+	}
+	b.reported = time.Now()
+	return b.report(b.job)
+}
+
+// receiveUpload saves the body of the request to a new file in dir, since uploads for
+// import jobs can be too large to hold in memory and are imported after the request has
+// finished. The body must be declared as one of the given media types and be no larger
+// than limit bytes. If it is not, an error response naming the expected format is
+// written to the client and false is returned.
+func receiveUpload(w http.ResponseWriter, r *http.Request, dir string, limit int64, format string, mediaTypes ...string) (string, bool) {
+	if !acceptMediaType(w, r, format, mediaTypes...) {
+		return "", false
+	}
+
+	file, err := ioutil.TempFile(dir, "workout-import-")
+	if err != nil {
+		InternalServerError(w, err)
+		return "", false
+	}
+	n, err := io.Copy(file, http.MaxBytesReader(w, r.Body, limit))
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	switch {
+	case err != nil && err.Error() == "http: request body too large":
+		WriteError(
+			w,
+			http.StatusRequestEntityTooLarge,
+			err,
+			fmt.Sprintf("The request body may be at most %d bytes", limit),
+		)
+	case err != nil:
+		WriteError(w, http.StatusBadRequest, err, "Unable to read the request body")
+	case n == 0:
+		WriteError(w, http.StatusBadRequest, errors.New("empty request body"), "The request body is empty")
+	default:
+		return file.Name(), true
+	}
+	os.Remove(file.Name())
+	return "", false
+}
+
+// startImportJob saves a new job importing the uploaded file at path from source and runs
+// it in the background, responding with the job.
+func (env *Env) startImportJob(w http.ResponseWriter, r *http.Request, user User, source, path string) {
+	now := time.Now()
+	job := ImportJob{
+		User:    user.ID,
+		Source:  source,
+		Status:  JobPending,
+		Errors:  make([]ImportError, 0),
+		Created: now,
+		Updated: now,
+		File:    path,
+		Host:    env.importHost,
+	}
+	jobID, err := env.db.AddImportJob(r.Context(), job)
+	if err != nil {
+		os.Remove(path)
+		InternalServerError(w, err)
+		return
+	}
+	job.ID = jobID
+	go runImportJob(env.db, job)
+
+	log.WithFields(log.Fields{
+		"name":   user.Name,
+		"job":    job.ID,
+		"source": source,
+	}).Info("Started import job")
+	job.User = 0
+	w.Header().Set("Location", apiVersion+"/import/jobs/"+strconv.Itoa(job.ID))
+	WriteJSON(w, http.StatusAccepted, job)
+}
+
+// runImportJob runs an import job, saving its progress as it goes and its outcome when it
+// finishes, and then removes the imported file. Jobs outlive the requests that start them,
+// so their queries are not cancelled with the request.
+func runImportJob(db Datastore, job ImportJob) {
+	ctx := context.Background()
+	report := func(job *ImportJob) error {
+		job.Updated = time.Now()
+		return db.UpdateImportJob(ctx, *job)
+	}
+
+	job.Status = JobRunning
+	err := report(&job)
+	run, ok := importers[job.Source]
+	switch {
+	case err != nil:
+	case !ok:
+		err = fmt.Errorf("unknown import source '%s'", job.Source)
+	default:
+		if _, err = os.Stat(job.File); err != nil {
+			err = errors.New("the uploaded file is no longer available")
+			break
+		}
+		err = run(ctx, db, &job, report)
+	}
+
+	now := time.Now()
+	job.Finished = &now
+	logger := log.WithFields(log.Fields{
+		"job":        job.ID,
+		"source":     job.Source,
+		"imported":   job.Imported,
+		"duplicates": job.Duplicates,
+		"failed":     job.Failed,
+	})
+	if err != nil {
+		job.Status = JobFailed
+		job.Error = err.Error()
+		logger.WithError(err).Warn("Import job failed")
+	} else {
+		job.Status = JobSucceeded
+		logger.Info("Import job succeeded")
+	}
+	if err = report(&job); err != nil {
+		// The job is left to be resumed, so its file is kept.
+		logger.WithError(err).Error("Unable to save the outcome of an import job")
+		return
+	}
+	os.Remove(job.File)
+}
+
+// ResumeImportJobs restarts the import jobs started on the host that have stopped saving
+// their progress, such as those interrupted by a restart of the server, every
+// jobResumeInterval until stop is closed. Resumed jobs carry on from the last progress
+// they saved.
+func ResumeImportJobs(db Datastore, host string, stop <-chan struct{}) {
+	ticker := time.NewTicker(jobResumeInterval)
+	defer ticker.Stop()
+	for {
+		jobs, err := db.ClaimStaleImportJobs(context.Background(), host, jobLease)
+		if err != nil {
+			log.WithError(err).Error("Unable to resume import jobs")
+		}
+		for _, job := range jobs {
+			log.WithFields(log.Fields{
+				"job":       job.ID,
+				"source":    job.Source,
+				"processed": job.Processed,
+			}).Info("Resuming import job")
+			go runImportJob(db, job)
+		}
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// GetImportJob returns the progress of the import job specified in the URL parameter.
+func (env *Env) GetImportJob(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	user, ok := env.authenticate(w, r)
+	if !ok {
+		return
+	}
+	jobID, err := strconv.Atoi(ps.ByName("id"))
+	if err != nil {
+		WriteValidationError(w, err, "Invalid import job", []FieldError{{"id", "must be an integer"}})
+		return
+	}
+
+	job, err := env.db.GetImportJob(r.Context(), user.ID, jobID)
+	switch {
+	case err == ErrImportJobNotFound:
+		WriteErrorCode(
+			w,
+			http.StatusNotFound,
+			err,
+			ErrCodeImportJobNotFound,
+			"The specified import job could not be found",
+		)
+		return
+	case err != nil:
+		InternalServerError(w, err)
+		return
+	}
+	WriteJSON(w, http.StatusOK, job)
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	log "github.com/sirupsen/logrus"
+)
+
+// Parameters of the training load model.
+const (
+	// defaultIntensity is the rating of perceived exertion assumed for workouts without
+	// one, corresponding to a moderate effort.
+	defaultIntensity = 5
+	acuteDays        = 7
+	chronicDays      = 28
+	// fitnessDays and fatigueDays are the time constants of the fitness and fatigue
+	// curves of the impulse-response model.
+	fitnessDays = 42
+	fatigueDays = 7
+	// loadWarmupDays is the history loaded before the requested range so that the
+	// chronic load and fitness curve have settled by its first day.
+	loadWarmupDays = 3 * fitnessDays
+)
+
+// Zones of the acute:chronic workload ratio.
+const (
+	ZoneUndertraining = "undertraining"
+	ZoneOptimal       = "optimal"
+	ZoneCaution       = "caution"
+	ZoneHighRisk      = "high_risk"
+)
+
+// workoutLoad returns the session load of a workout: its duration in minutes multiplied by
+// its rating of perceived exertion.
+func workoutLoad(workout Workout) float64 {
+	intensity := defaultIntensity
+	if workout.Intensity != nil {
+		intensity = *workout.Intensity
+	}
+	return workout.Duration().Minutes() * float64(intensity)
+}
+
+// loadZone classifies an acute:chronic workload ratio.
+func loadZone(ratio float64) string {
+	switch {
+	case ratio < 0.8:
+		return ZoneUndertraining
+	case ratio <= 1.3:
+		return ZoneOptimal
+	case ratio <= 1.5:
+		return ZoneCaution
+	default:
+		return ZoneHighRisk
+	}
+}
+
+// ComputeTrainingLoad computes the training load model for each of the given number of
+// days up to and including the day containing now in loc. Workouts count towards the day
+// they started on, and those started before the first day only contribute to the
+// rolling loads and curves.
+//
+// The acute and chronic loads are the average daily loads over the last 7 and 28 days.
+// Fitness and fatigue are exponentially weighted averages of the daily load with time
+// constants of 42 and 7 days, and form is their difference.
+func ComputeTrainingLoad(workouts []Workout, now time.Time, loc *time.Location, days int) TrainingLoad {
+	today := civilDay(now.In(loc))
+	first := today - days + 1
+	start := first - loadWarmupDays
+
+	loads := make([]float64, today-start+1)
+	for _, workout := range workouts {
+		if day := civilDay(workout.Start.In(loc)); day >= start && day <= today {
+			loads[day-start] += workoutLoad(workout)
+		}
+	}
+
+	result := TrainingLoad{TimeZone: loc.String(), Days: make([]LoadDay, 0, days)}
+	fitnessDecay := 1 - math.Exp(-1.0/fitnessDays)
+	fatigueDecay := 1 - math.Exp(-1.0/fatigueDays)
+	var fitness, fatigue, acuteSum, chronicSum float64
+	for i, load := range loads {
+		fitness += (load - fitness) * fitnessDecay
+		fatigue += (load - fatigue) * fatigueDecay
+		acuteSum += load
+		chronicSum += load
+		if i >= acuteDays {
+			acuteSum -= loads[i-acuteDays]
+		}
+		if i >= chronicDays {
+			chronicSum -= loads[i-chronicDays]
+		}
+
+		day := start + i
+		if day < first {
+			continue
+		}
+		loadDay := LoadDay{
+			Date:    civilDate(day, loc).Format("2006-01-02"),
+			Load:    load,
+			Acute:   acuteSum / acuteDays,
+			Chronic: chronicSum / chronicDays,
+			Fitness: fitness,
+			Fatigue: fatigue,
+			Form:    fitness - fatigue,
+		}
+		if loadDay.Chronic > 0 {
+			ratio := loadDay.Acute / loadDay.Chronic
+			loadDay.Ratio = &ratio
+			loadDay.Zone = loadZone(ratio)
+		}
+		result.Days = append(result.Days, loadDay)
+	}
+
+	result.Current = result.Days[len(result.Days)-1]
+	switch result.Current.Zone {
+	case ZoneHighRisk:
+		result.Warning = fmt.Sprintf(
+			"Your training load over the last week is %.1f times your usual load, which sharply increases the risk of injury",
+			*result.Current.Ratio,
+		)
+	case ZoneCaution:
+		result.Warning = "Your training load over the last week is well above your usual load"
+	}
+	return result
+}
+
+// GetTrainingLoad returns the training load model of the requesting user. The optional
+// query parameters are days, the number of days up to and including today to return,
+// and tz.
+func (env *Env) GetTrainingLoad(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	user, ok := env.authenticate(w, r)
+	if !ok {
+		return
+	}
+	params := r.URL.Query()
+	days, problems := parseInt(params, "days", 90, 1, 365)
+	location, tzProblems := parseTimeZone(params)
+	if !validRequest(w, append(problems, tzProblems...)) {
+		return
+	}
+
+	now := time.Now().In(location)
+	from := startOfDay(now).AddDate(0, 0, 1-days-loadWarmupDays)
+	workouts, err := env.db.GetWorkoutsBetween(r.Context(), user.ID, from, startOfDay(now).AddDate(0, 0, 1))
+	if err != nil {
+		InternalServerError(w, err)
+		return
+	}
+
+	load := ComputeTrainingLoad(workouts, now, location, days)
+	log.WithFields(log.Fields{
+		"name": user.Name,
+		"zone": load.Current.Zone,
+	}).Info("Computed training load")
+	WriteJSON(w, http.StatusOK, load)
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+// dailyWorkouts returns a workout of the given length at 8:00 on each of the given number
+// of days ending on last.
+func dailyWorkouts(last time.Time, days int, length time.Duration) []Workout {
+	workouts := make([]Workout, days)
+	for i := range workouts {
+		day := last.AddDate(0, 0, i-days+1)
+		workouts[i] = testWorkout(time.Date(day.Year(), day.Month(), day.Day(), 8, 0, 0, 0, day.Location()), length)
+	}
+	return workouts
+}
+
+func TestComputeTrainingLoad(t *testing.T) {
+	toronto := testLocation(t)
+	at := func(year int, month time.Month, day, hour, minute int) time.Time {
+		return time.Date(year, month, day, hour, minute, 0, 0, toronto)
+	}
+	intense := testWorkout(at(2019, time.March, 11, 8, 0), 30*time.Minute)
+	intense.Intensity = new(int)
+	*intense.Intensity = 9
+
+	for _, test := range []struct {
+		name     string
+		workouts []Workout
+		now      time.Time
+		days     int
+		first    string
+		// loads are the expected loads of days with workouts, and every other day must
+		// have none.
+		loads   map[string]float64
+		acute   float64
+		chronic float64
+		// ratio is the expected acute:chronic workload ratio of the last day, or zero if
+		// it should be omitted.
+		ratio   float64
+		zone    string
+		warning string
+	}{{
+		name:  "empty history",
+		now:   at(2019, time.March, 11, 12, 0),
+		days:  7,
+		first: "2019-03-05",
+	}, {
+		// Without any chronic load there is nothing to compare the acute load against.
+		name: "no chronic load",
+		workouts: []Workout{
+			testWorkout(at(2018, time.October, 1, 8, 0), 60*time.Minute),
+		},
+		now:   at(2019, time.March, 11, 12, 0),
+		days:  3,
+		first: "2019-03-09",
+	}, {
+		name:     "first workout",
+		workouts: []Workout{intense},
+		now:      at(2019, time.March, 11, 12, 0),
+		days:     3,
+		first:    "2019-03-09",
+		loads:    map[string]float64{"2019-03-11": 270},
+		acute:    270.0 / 7,
+		chronic:  270.0 / 28,
+		ratio:    4,
+		zone:     ZoneHighRisk,
+		warning:  "Your training load over the last week is 4.0 times your usual load, which sharply increases the risk of injury",
+	}, {
+		name:     "steady load",
+		workouts: dailyWorkouts(at(2019, time.March, 11, 0, 0), 60, 60*time.Minute),
+		now:      at(2019, time.March, 11, 12, 0),
+		days:     1,
+		first:    "2019-03-11",
+		loads:    map[string]float64{"2019-03-11": 300},
+		acute:    300,
+		chronic:  300,
+		ratio:    1,
+		zone:     ZoneOptimal,
+	}, {
+		name: "rising load",
+		workouts: append(
+			dailyWorkouts(at(2019, time.March, 4, 0, 0), 21, 20*time.Minute),
+			dailyWorkouts(at(2019, time.March, 11, 0, 0), 7, 34*time.Minute)...,
+		),
+		now:     at(2019, time.March, 11, 12, 0),
+		days:    1,
+		first:   "2019-03-11",
+		loads:   map[string]float64{"2019-03-11": 170},
+		acute:   170,
+		chronic: 117.5,
+		ratio:   170 / 117.5,
+		zone:    ZoneCaution,
+		warning: "Your training load over the last week is well above your usual load",
+	}, {
+		// 10 March and 3 November are 23 and 25 hours long in Toronto, and late workouts
+		// count towards the day they started on there.
+		name: "daylight saving time",
+		workouts: []Workout{
+			testWorkout(at(2019, time.March, 10, 23, 30), 10*time.Minute),
+			testWorkout(at(2019, time.November, 3, 23, 30), 20*time.Minute),
+		},
+		now:     at(2019, time.November, 4, 0, 30),
+		days:    240,
+		first:   "2019-03-10",
+		loads:   map[string]float64{"2019-03-10": 50, "2019-11-03": 100},
+		acute:   100.0 / 7,
+		chronic: 100.0 / 28,
+		ratio:   4,
+		zone:    ZoneHighRisk,
+		warning: "Your training load over the last week is 4.0 times your usual load, which sharply increases the risk of injury",
+	}} {
+		t.Run(test.name, func(t *testing.T) {
+			load := ComputeTrainingLoad(test.workouts, test.now, toronto, test.days)
+			if load.TimeZone != "America/Toronto" {
+				t.Errorf("time zone is %q", load.TimeZone)
+			}
+			if len(load.Days) != test.days {
+				t.Fatalf("training load has %d days, expected %d", len(load.Days), test.days)
+			}
+			if first := load.Days[0].Date; first != test.first {
+				t.Errorf("training load begins on %s, expected %s", first, test.first)
+			}
+			if last := load.Days[len(load.Days)-1].Date; last != test.now.Format("2006-01-02") {
+				t.Errorf("training load ends on %s", last)
+			}
+			for _, day := range load.Days {
+				if day.Load != test.loads[day.Date] {
+					t.Errorf("load on %s is %v, expected %v", day.Date, day.Load, test.loads[day.Date])
+				}
+				if (day.Ratio != nil) != (day.Chronic > 0) || (day.Ratio == nil) != (day.Zone == "") {
+					t.Errorf("day %+v has a chronic load of %v but ratio %v", day, day.Chronic, day.Ratio)
+				}
+			}
+
+			current := load.Current
+			if current != load.Days[len(load.Days)-1] {
+				t.Errorf("current day is %+v, not the last day", current)
+			}
+			if !closeTo(current.Acute, test.acute) || !closeTo(current.Chronic, test.chronic) {
+				t.Errorf("acute and chronic loads are %v and %v, expected %v and %v", current.Acute, current.Chronic, test.acute, test.chronic)
+			}
+			switch {
+			case test.ratio == 0 && current.Ratio != nil:
+				t.Errorf("ratio is %v, expected none", *current.Ratio)
+			case test.ratio != 0 && (current.Ratio == nil || !closeTo(*current.Ratio, test.ratio)):
+				t.Errorf("ratio is %v, expected %v", current.Ratio, test.ratio)
+			}
+			if current.Zone != test.zone || load.Warning != test.warning {
+				t.Errorf("zone is %q with warning %q, expected %q and %q", current.Zone, load.Warning, test.zone, test.warning)
+			}
+		})
+	}
+}
+
+func closeTo(a, b float64) bool {
+	return math.Abs(a-b) < 1e-9
+}
@@ -11,7 +11,11 @@ import (
 // Env stores the datastore and other resources shared by goroutines
 // in the application.
 type Env struct {
-	db Datastore
+	db         Datastore
+	checks     WorkoutChecks
+	events     *EventHub
+	importDir  string
+	importHost string
 }
 
 func main() {
@@ -23,12 +27,44 @@ func main() {
 
 	log.SetLevel(c.logLevel)
 
-	db, err := InitializeDB("postgres", c.dbConnectionString)
+	db, err := OpenDatabase(c.dbConnectionString)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	env := &Env{db}
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		if err = migrateCommand(db, os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if c.autoMigrate {
+		if _, err = db.Migrate(); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "import-health" {
+		if err = importHealthCommand(db, os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if err = os.MkdirAll(c.importDir, 0700); err != nil {
+		log.Fatal(err)
+	}
+	store := WithQueryTimeout(db, c.queryTimeout)
+	env := &Env{
+		db:         store,
+		checks:     c.workoutChecks,
+		events:     NewEventHub(),
+		importDir:  c.importDir,
+		importHost: c.importHost,
+	}
+	go NewWebhookDispatcher(store).Run(nil)
+	go ResumeImportJobs(store, c.importHost, nil)
+	go PurgeTrash(store, c.trashRetention, nil)
 	router := env.NewRouter()
 
 	log.WithField("port", c.port).Info("Server started")
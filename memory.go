@@ -0,0 +1,922 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+// MemoryDB implements Datastore in memory, for tests and trying out the server without a
+// database. It is safe for concurrent use, and behaves as the database datastores do,
+// including the errors they return. Nothing it holds is shared with its callers: values
+// are copied in and out. Since it never waits on anything but its own lock, it ignores
+// the contexts of calls.
+type MemoryDB struct {
+	mu     sync.RWMutex
+	nextID int
+
+	users      map[int]*memoryUser
+	workouts   map[int]*Workout
+	pauses     map[int][]Pause
+	goals      map[int]*Goal
+	webhooks   map[int]*Webhook
+	deliveries map[int]*WebhookDelivery
+	planned    map[int]*memoryPlannedWorkout
+	jobs       map[int]*ImportJob
+}
+
+// memoryUser is a user as MemoryDB stores it.
+type memoryUser struct {
+	User
+	password      string
+	token         string
+	calendarToken string
+}
+
+// memoryPlannedWorkout is a planned workout as MemoryDB stores it.
+type memoryPlannedWorkout struct {
+	PlannedWorkout
+	user int
+}
+
+// NewMemoryDB returns an empty MemoryDB.
+func NewMemoryDB() *MemoryDB {
+	return &MemoryDB{
+		users:      make(map[int]*memoryUser),
+		workouts:   make(map[int]*Workout),
+		pauses:     make(map[int][]Pause),
+		goals:      make(map[int]*Goal),
+		webhooks:   make(map[int]*Webhook),
+		deliveries: make(map[int]*WebhookDelivery),
+		planned:    make(map[int]*memoryPlannedWorkout),
+		jobs:       make(map[int]*ImportJob),
+	}
+}
+
+// newID returns an ID that has not been used for anything else. IDs are shared between
+// all kinds of rows, which datastores are free to do.
+func (db *MemoryDB) newID() int {
+	db.nextID++
+	return db.nextID
+}
+
+// copyTime returns a copy of t, so that the times stored are not shared with callers.
+func copyTime(t *time.Time) *time.Time {
+	if t == nil {
+		return nil
+	}
+	copied := *t
+	return &copied
+}
+
+func copyWorkout(workout Workout) Workout {
+	workout.End = copyTime(workout.End)
+	workout.Deleted = copyTime(workout.Deleted)
+	if workout.Intensity != nil {
+		intensity := *workout.Intensity
+		workout.Intensity = &intensity
+	}
+	return workout
+}
+
+func copyPauses(pauses []Pause) []Pause {
+	copied := make([]Pause, len(pauses))
+	for i, pause := range pauses {
+		copied[i] = Pause{Start: pause.Start, End: copyTime(pause.End)}
+	}
+	return copied
+}
+
+func copyDelivery(delivery WebhookDelivery) WebhookDelivery {
+	delivery.Payload = append([]byte(nil), delivery.Payload...)
+	delivery.NextAttempt = copyTime(delivery.NextAttempt)
+	delivery.Delivered = copyTime(delivery.Delivered)
+	return delivery
+}
+
+func copyImportJob(job ImportJob) ImportJob {
+	job.Errors = append(make([]ImportError, 0, len(job.Errors)), job.Errors...)
+	job.Finished = copyTime(job.Finished)
+	return job
+}
+
+// sortedIDs returns the keys of a map of rows in ascending order.
+func sortedIDs(n int, each func(add func(id int))) []int {
+	ids := make([]int, 0, n)
+	each(func(id int) { ids = append(ids, id) })
+	sort.Ints(ids)
+	return ids
+}
+
+/* Users */
+
+// SignUp adds a new user and returns their user ID.
+func (db *MemoryDB) SignUp(ctx context.Context, r UserRequest) (int, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	for _, user := range db.users {
+		if user.Name == r.Name {
+			return 0, ErrUserAlreadyExists
+		}
+	}
+	user := &memoryUser{User: User{ID: db.newID(), Name: r.Name}, password: r.Token, token: r.Token}
+	db.users[user.ID] = user
+	return user.ID, nil
+}
+
+// LoginWithCredentials logs a user in using a name and password hash.
+func (db *MemoryDB) LoginWithCredentials(ctx context.Context, name, passHash string) (User, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	for _, user := range db.users {
+		if user.Name != name {
+			continue
+		}
+		if user.password != passHash {
+			return User{ID: user.ID, Name: user.Name}, ErrInvalidCredentials
+		}
+		return user.User, nil
+	}
+	return User{}, ErrUserNotFound
+}
+
+// LoginWithToken logs a user in using an access token.
+func (db *MemoryDB) LoginWithToken(ctx context.Context, token string) (User, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	for _, user := range db.users {
+		if user.token == token {
+			return user.User, nil
+		}
+	}
+	return User{}, ErrUserNotFound
+}
+
+// GetUsername retrieves the name of the user with the given ID.
+func (db *MemoryDB) GetUsername(ctx context.Context, userID int) (string, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	user, ok := db.users[userID]
+	if !ok {
+		return "", ErrUserNotFound
+	}
+	return user.Name, nil
+}
+
+// GetUsers returns the names of the users in the order they signed up.
+func (db *MemoryDB) GetUsers(ctx context.Context) ([]string, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	var names []string
+	ids := sortedIDs(len(db.users), func(add func(int)) {
+		for id := range db.users {
+			add(id)
+		}
+	})
+	for _, id := range ids {
+		names = append(names, db.users[id].Name)
+	}
+	return names, nil
+}
+
+/* Workouts */
+
+// AddWorkout adds a workout.
+func (db *MemoryDB) AddWorkout(ctx context.Context, workout Workout) (int, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return db.addWorkout(workout)
+}
+
+func (db *MemoryDB) addWorkout(workout Workout) (int, error) {
+	if _, ok := db.users[workout.User]; !ok {
+		return 0, ErrUserNotFound
+	}
+	workout = copyWorkout(workout)
+	workout.ID = db.newID()
+	workout.Deleted = nil
+	db.workouts[workout.ID] = &workout
+	return workout.ID, nil
+}
+
+// UpdateWorkout replaces the workout with the given workout.
+func (db *MemoryDB) UpdateWorkout(ctx context.Context, workout Workout) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return db.updateWorkout(workout)
+}
+
+func (db *MemoryDB) updateWorkout(workout Workout) error {
+	ours, ok := db.liveWorkout(workout.ID)
+	if !ok || ours.User != workout.User {
+		return ErrUserNotAuthorized
+	}
+	workout = copyWorkout(workout)
+	ours.Start, ours.End = workout.Start, workout.End
+	if !workout.keepIntensity {
+		ours.Intensity = workout.Intensity
+	}
+	if !workout.keepType {
+		ours.Type = workout.Type
+	}
+	return nil
+}
+
+// liveWorkout returns the workout with the given ID, unless it is missing or in the trash.
+func (db *MemoryDB) liveWorkout(workoutID int) (*Workout, bool) {
+	workout, ok := db.workouts[workoutID]
+	if !ok || workout.Deleted != nil {
+		return nil, false
+	}
+	return workout, true
+}
+
+// DeleteWorkout moves the workout with the specified ID to the trash and returns the ID of
+// the user it belongs to.
+func (db *MemoryDB) DeleteWorkout(ctx context.Context, workoutID int) (int, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	workout, ok := db.liveWorkout(workoutID)
+	if !ok {
+		return 0, ErrWorkoutNotFound
+	}
+	now := time.Now()
+	workout.Deleted = &now
+	return workout.User, nil
+}
+
+// deleteOwnWorkout moves a workout to the trash after verifying that it belongs to
+// workout.User.
+func (db *MemoryDB) deleteOwnWorkout(workout Workout) error {
+	ours, ok := db.liveWorkout(workout.ID)
+	switch {
+	case !ok:
+		return ErrWorkoutNotFound
+	case ours.User != workout.User:
+		return ErrUserNotAuthorized
+	}
+	now := time.Now()
+	ours.Deleted = &now
+	return nil
+}
+
+// GetDeletedWorkouts retrieves the workouts the given user has in the trash, the most
+// recently deleted first.
+func (db *MemoryDB) GetDeletedWorkouts(ctx context.Context, userID int) ([]Workout, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	workouts := make([]Workout, 0)
+	for _, workout := range db.workouts {
+		if workout.User == userID && workout.Deleted != nil {
+			found := copyWorkout(*workout)
+			found.User = 0
+			workouts = append(workouts, found)
+		}
+	}
+	sort.Slice(workouts, func(i, j int) bool {
+		a, b := workouts[i].Deleted, workouts[j].Deleted
+		return a.After(*b) || a.Equal(*b) && workouts[i].ID < workouts[j].ID
+	})
+	return workouts, nil
+}
+
+// RestoreWorkout takes a workout of the given user out of the trash and returns it.
+func (db *MemoryDB) RestoreWorkout(ctx context.Context, userID, workoutID int) (Workout, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	workout, ok := db.workouts[workoutID]
+	switch {
+	case !ok || workout.User != userID || workout.Deleted == nil:
+		return Workout{}, ErrWorkoutNotFound
+	case workout.End == nil && db.activeWorkout(userID) != nil:
+		return Workout{}, ErrWorkoutInProgress
+	}
+	workout.Deleted = nil
+	return copyWorkout(*workout), nil
+}
+
+// PurgeDeletedWorkouts permanently deletes the workouts that were moved to the trash
+// before the given time, along with their pauses, returning how many it deleted.
+func (db *MemoryDB) PurgeDeletedWorkouts(ctx context.Context, before time.Time) (int, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	purged := 0
+	for id, workout := range db.workouts {
+		if workout.Deleted != nil && workout.Deleted.Before(before) {
+			delete(db.workouts, id)
+			delete(db.pauses, id)
+			purged++
+		}
+	}
+	return purged, nil
+}
+
+// BatchWorkouts applies a list of workout operations at once, along with queueing their
+// webhook deliveries. An operation that fails changes nothing, and is reported in its
+// result without discarding the others.
+func (db *MemoryDB) BatchWorkouts(ctx context.Context, ops []BatchOperation, webhooks BatchWebhooks) ([]BatchResult, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	// The workouts are restored if the webhook events cannot be queued, as the transaction
+	// of a database would be rolled back.
+	saved := make(map[int]Workout, len(db.workouts))
+	for id, workout := range db.workouts {
+		saved[id] = copyWorkout(*workout)
+	}
+
+	results := make([]BatchResult, len(ops))
+	for i, op := range ops {
+		result := BatchResult{Index: i, Op: op.Op, ID: op.Workout.ID}
+		switch op.Op {
+		case BatchCreate:
+			result.ID, result.Err = db.addWorkout(op.Workout)
+		case BatchUpdate:
+			result.Err = db.updateWorkout(op.Workout)
+		case BatchDelete:
+			result.Err = db.deleteOwnWorkout(op.Workout)
+		default:
+			result.Err = ErrInvalidBatchOperation
+		}
+		results[i] = result
+	}
+
+	if webhooks != nil {
+		events, err := webhooks(results)
+		if err != nil {
+			db.workouts = make(map[int]*Workout, len(saved))
+			for id, workout := range saved {
+				workout := workout
+				db.workouts[id] = &workout
+			}
+			return nil, err
+		}
+		db.queueWebhookDeliveries(events)
+	}
+	return results, nil
+}
+
+// findWorkouts returns copies of the workouts of the user that match, sorted by less,
+// leaving out those in the trash. As when they are read from a database, the copies do not
+// name the user.
+func (db *MemoryDB) findWorkouts(userID int, match func(Workout) bool, less func(a, b Workout) bool) []Workout {
+	workouts := make([]Workout, 0)
+	for _, workout := range db.workouts {
+		if workout.User == userID && workout.Deleted == nil && match(*workout) {
+			found := copyWorkout(*workout)
+			found.User = 0
+			workouts = append(workouts, found)
+		}
+	}
+	sort.Slice(workouts, func(i, j int) bool {
+		if less(workouts[i], workouts[j]) {
+			return true
+		}
+		return !less(workouts[j], workouts[i]) && workouts[i].ID < workouts[j].ID
+	})
+	return workouts
+}
+
+func byStart(a, b Workout) bool {
+	return a.Start.Before(b.Start)
+}
+
+// GetWorkouts retrieves the list of finished workouts for the given user, ordered by end
+// time.
+func (db *MemoryDB) GetWorkouts(ctx context.Context, userID int) ([]Workout, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return db.findWorkouts(
+		userID,
+		func(workout Workout) bool { return workout.End != nil },
+		func(a, b Workout) bool { return a.End.Before(*b.End) },
+	), nil
+}
+
+// GetWorkout retrieves a workout, provided that it belongs to the user and is not in the
+// trash.
+func (db *MemoryDB) GetWorkout(ctx context.Context, userID, workoutID int) (Workout, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	workout, ok := db.liveWorkout(workoutID)
+	if !ok || workout.User != userID {
+		return Workout{}, ErrWorkoutNotFound
+	}
+	return copyWorkout(*workout), nil
+}
+
+// GetWorkoutsBetween retrieves the finished workouts of the given user that started within
+// [from, to), ordered by start time.
+func (db *MemoryDB) GetWorkoutsBetween(ctx context.Context, userID int, from, to time.Time) ([]Workout, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return db.findWorkouts(
+		userID,
+		func(workout Workout) bool {
+			return workout.End != nil && !workout.Start.Before(from) && workout.Start.Before(to)
+		},
+		byStart,
+	), nil
+}
+
+// GetOverlappingWorkouts retrieves the workouts of the given user that overlap the period
+// [start, end), other than the workout with ID excludeID. Workouts in progress are
+// considered to last until now.
+func (db *MemoryDB) GetOverlappingWorkouts(ctx context.Context, userID int, start, end time.Time, excludeID int) ([]Workout, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	now := time.Now()
+	return db.findWorkouts(
+		userID,
+		func(workout Workout) bool {
+			workoutEnd := now
+			if workout.End != nil {
+				workoutEnd = *workout.End
+			}
+			return workout.ID != excludeID && workout.Start.Before(end) && workoutEnd.After(start)
+		},
+		byStart,
+	), nil
+}
+
+// GetInsights computes the time of day breakdown and workout frequency of a user over
+// the requested range.
+func (db *MemoryDB) GetInsights(ctx context.Context, userID int, query InsightsQuery) (Insights, error) {
+	workouts, err := db.GetWorkoutsBetween(ctx, userID, query.From, query.To)
+	if err != nil {
+		return Insights{}, err
+	}
+	return ComputeInsights(workouts, query), nil
+}
+
+// ImportWorkouts adds workouts at once, skipping any with the same start and end as
+// another workout of the same user, including those in the trash. It returns the IDs of
+// the workouts in order, with 0 for those that were skipped.
+func (db *MemoryDB) ImportWorkouts(ctx context.Context, workouts []Workout) ([]int, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	// Check every workout first, so that none are added if any can't be.
+	for _, workout := range workouts {
+		if _, ok := db.users[workout.User]; !ok {
+			return nil, ErrUserNotFound
+		}
+	}
+	ids := make([]int, len(workouts))
+	for i, workout := range workouts {
+		duplicate := false
+		for _, ours := range db.workouts {
+			if ours.User == workout.User && ours.Start.Equal(workout.Start) && ours.End != nil &&
+				workout.End != nil && ours.End.Equal(*workout.End) {
+				duplicate = true
+				break
+			}
+		}
+		if !duplicate {
+			workout = copyWorkout(workout)
+			workout.ID = db.newID()
+			workout.Deleted = nil
+			db.workouts[workout.ID] = &workout
+			ids[i] = workout.ID
+		}
+	}
+	return ids, nil
+}
+
+/* Goals */
+
+// GetGoals retrieves the goals of the given user in the order they were created.
+func (db *MemoryDB) GetGoals(ctx context.Context, userID int) ([]Goal, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	goals := make([]Goal, 0)
+	ids := sortedIDs(len(db.goals), func(add func(int)) {
+		for id, goal := range db.goals {
+			if goal.User == userID {
+				add(id)
+			}
+		}
+	})
+	for _, id := range ids {
+		goals = append(goals, *db.goals[id])
+	}
+	return goals, nil
+}
+
+// AddGoal adds a goal and returns its ID.
+func (db *MemoryDB) AddGoal(ctx context.Context, goal Goal) (int, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if _, ok := db.users[goal.User]; !ok {
+		return 0, ErrUserNotFound
+	}
+	goal.ID = db.newID()
+	goal.Created = time.Now()
+	db.goals[goal.ID] = &goal
+	return goal.ID, nil
+}
+
+// UpdateGoal replaces the goal with the given goal, provided that it belongs to goal.User.
+func (db *MemoryDB) UpdateGoal(ctx context.Context, goal Goal) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	ours, ok := db.goals[goal.ID]
+	if !ok || ours.User != goal.User {
+		return ErrGoalNotFound
+	}
+	ours.Metric, ours.Period, ours.Target = goal.Metric, goal.Period, goal.Target
+	return nil
+}
+
+// DeleteGoal deletes the goal with the specified ID, provided that it belongs to the user.
+func (db *MemoryDB) DeleteGoal(ctx context.Context, userID, goalID int) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	goal, ok := db.goals[goalID]
+	if !ok || goal.User != userID {
+		return ErrGoalNotFound
+	}
+	delete(db.goals, goalID)
+	return nil
+}
+
+/* Workout sessions */
+
+// activeWorkout returns the workout the user has in progress, if any.
+func (db *MemoryDB) activeWorkout(userID int) *Workout {
+	for _, workout := range db.workouts {
+		if workout.User == userID && workout.End == nil && workout.Deleted == nil {
+			return workout
+		}
+	}
+	return nil
+}
+
+// StartWorkout starts a workout for the given user that stays in progress until it is
+// finished. A user can only have one workout in progress at a time.
+func (db *MemoryDB) StartWorkout(ctx context.Context, userID int, start time.Time) (WorkoutSession, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	session := WorkoutSession{Workout: Workout{Start: start}, Pauses: make([]Pause, 0)}
+	if _, ok := db.users[userID]; !ok {
+		return session, ErrUserNotFound
+	}
+	if db.activeWorkout(userID) != nil {
+		return session, ErrWorkoutInProgress
+	}
+	session.Workout.ID = db.newID()
+	db.workouts[session.Workout.ID] = &Workout{ID: session.Workout.ID, User: userID, Start: start}
+	return session, nil
+}
+
+// GetActiveWorkout retrieves the workout the given user has in progress.
+func (db *MemoryDB) GetActiveWorkout(ctx context.Context, userID int) (WorkoutSession, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	var session WorkoutSession
+	workout := db.activeWorkout(userID)
+	if workout == nil {
+		return session, ErrWorkoutNotFound
+	}
+	session.Workout = copyWorkout(*workout)
+	session.Workout.User = 0
+	session.Pauses = copyPauses(db.pauses[workout.ID])
+	session.Paused = sessionPaused(session)
+	return session, nil
+}
+
+// UpdateWorkoutSession pauses, resumes or finishes the given workout in progress at the
+// instant at.
+func (db *MemoryDB) UpdateWorkoutSession(ctx context.Context, userID, workoutID int, action string, at time.Time) (WorkoutSession, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	var session WorkoutSession
+	workout, ok := db.liveWorkout(workoutID)
+	switch {
+	case !ok:
+		return session, ErrWorkoutNotFound
+	case workout.User != userID:
+		return session, ErrUserNotAuthorized
+	}
+	session.Workout = copyWorkout(*workout)
+	session.Workout.User = 0
+	session.Pauses = copyPauses(db.pauses[workoutID])
+	session.Paused = sessionPaused(session)
+	if err := applySessionAction(&session, action, at); err != nil {
+		return session, err
+	}
+
+	db.pauses[workoutID] = copyPauses(session.Pauses)
+	workout.End = copyTime(session.Workout.End)
+	return session, nil
+}
+
+/* Webhooks */
+
+// GetWebhooks retrieves the webhooks of the given user in the order they were added,
+// without their secrets.
+func (db *MemoryDB) GetWebhooks(ctx context.Context, userID int) ([]Webhook, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	webhooks := make([]Webhook, 0)
+	ids := sortedIDs(len(db.webhooks), func(add func(int)) {
+		for id, webhook := range db.webhooks {
+			if webhook.User == userID {
+				add(id)
+			}
+		}
+	})
+	for _, id := range ids {
+		webhook := *db.webhooks[id]
+		webhook.User, webhook.Secret = 0, ""
+		webhook.Events = append([]string(nil), webhook.Events...)
+		webhooks = append(webhooks, webhook)
+	}
+	return webhooks, nil
+}
+
+// AddWebhook adds a webhook and returns its ID.
+func (db *MemoryDB) AddWebhook(ctx context.Context, webhook Webhook) (int, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if _, ok := db.users[webhook.User]; !ok {
+		return 0, ErrUserNotFound
+	}
+	webhook.ID = db.newID()
+	webhook.Events = append([]string(nil), webhook.Events...)
+	db.webhooks[webhook.ID] = &webhook
+	return webhook.ID, nil
+}
+
+// DeleteWebhook deletes the webhook with the specified ID, provided that it belongs to the
+// user, along with its deliveries.
+func (db *MemoryDB) DeleteWebhook(ctx context.Context, userID, webhookID int) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	webhook, ok := db.webhooks[webhookID]
+	if !ok || webhook.User != userID {
+		return ErrWebhookNotFound
+	}
+	delete(db.webhooks, webhookID)
+	for id, delivery := range db.deliveries {
+		if delivery.Webhook == webhookID {
+			delete(db.deliveries, id)
+		}
+	}
+	return nil
+}
+
+// QueueWebhookDeliveries queues the delivery of each event to the webhooks of its user
+// that subscribe to it.
+func (db *MemoryDB) QueueWebhookDeliveries(ctx context.Context, events []WebhookEvent) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.queueWebhookDeliveries(events)
+	return nil
+}
+
+func (db *MemoryDB) queueWebhookDeliveries(events []WebhookEvent) {
+	now := time.Now()
+	for _, event := range events {
+		webhookIDs := sortedIDs(len(db.webhooks), func(add func(id int)) {
+			for id, webhook := range db.webhooks {
+				if webhook.User == event.User && containsString(webhook.Events, event.Type) {
+					add(id)
+				}
+			}
+		})
+		for _, webhookID := range webhookIDs {
+			delivery := copyDelivery(WebhookDelivery{
+				Webhook:     webhookID,
+				Event:       event.Type,
+				Payload:     event.Payload,
+				Status:      DeliveryPending,
+				NextAttempt: &now,
+				Created:     now,
+			})
+			delivery.ID = db.newID()
+			db.deliveries[delivery.ID] = &delivery
+		}
+	}
+}
+
+// ClaimWebhookDeliveries retrieves up to limit pending deliveries that are due, along with
+// the URL and secret of their webhooks. Claimed deliveries are not due again until the
+// lease has passed.
+func (db *MemoryDB) ClaimWebhookDeliveries(ctx context.Context, limit int, lease time.Duration) ([]WebhookDelivery, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	now := time.Now()
+	due := make([]*WebhookDelivery, 0)
+	for _, delivery := range db.deliveries {
+		if delivery.Status == DeliveryPending && delivery.NextAttempt != nil && !delivery.NextAttempt.After(now) {
+			due = append(due, delivery)
+		}
+	}
+	sort.Slice(due, func(i, j int) bool {
+		if !due[i].NextAttempt.Equal(*due[j].NextAttempt) {
+			return due[i].NextAttempt.Before(*due[j].NextAttempt)
+		}
+		return due[i].ID < due[j].ID
+	})
+	if len(due) > limit {
+		due = due[:limit]
+	}
+
+	deliveries := make([]WebhookDelivery, 0, len(due))
+	next := now.Add(lease)
+	for _, delivery := range due {
+		webhook := db.webhooks[delivery.Webhook]
+		deliveries = append(deliveries, WebhookDelivery{
+			ID:       delivery.ID,
+			Webhook:  delivery.Webhook,
+			Event:    delivery.Event,
+			Payload:  append([]byte(nil), delivery.Payload...),
+			Status:   DeliveryPending,
+			Attempts: delivery.Attempts,
+			Created:  delivery.Created,
+			URL:      webhook.URL,
+			Secret:   webhook.Secret,
+		})
+		delivery.NextAttempt = copyTime(&next)
+	}
+	return deliveries, nil
+}
+
+// RecordWebhookAttempt saves the outcome of an attempt to deliver an event.
+func (db *MemoryDB) RecordWebhookAttempt(ctx context.Context, delivery WebhookDelivery) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	ours, ok := db.deliveries[delivery.ID]
+	if !ok {
+		return nil
+	}
+	ours.Status, ours.Attempts = delivery.Status, delivery.Attempts
+	ours.NextAttempt = copyTime(delivery.NextAttempt)
+	ours.ResponseCode, ours.Error = delivery.ResponseCode, delivery.Error
+	ours.Delivered = copyTime(delivery.Delivered)
+	return nil
+}
+
+// GetWebhookDeliveries retrieves the latest deliveries of a webhook, provided that it
+// belongs to the user, starting with the most recent.
+func (db *MemoryDB) GetWebhookDeliveries(ctx context.Context, userID, webhookID, limit int) ([]WebhookDelivery, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if webhook, ok := db.webhooks[webhookID]; !ok || webhook.User != userID {
+		return nil, ErrWebhookNotFound
+	}
+	ids := sortedIDs(len(db.deliveries), func(add func(int)) {
+		for id, delivery := range db.deliveries {
+			if delivery.Webhook == webhookID {
+				add(id)
+			}
+		}
+	})
+	deliveries := make([]WebhookDelivery, 0)
+	for i := len(ids) - 1; i >= 0 && len(deliveries) < limit; i-- {
+		deliveries = append(deliveries, copyDelivery(*db.deliveries[ids[i]]))
+	}
+	return deliveries, nil
+}
+
+/* Calendars */
+
+// SetCalendarToken sets the secret token of the user's calendar feed. An empty token
+// disables the feed.
+func (db *MemoryDB) SetCalendarToken(ctx context.Context, userID int, token string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	user, ok := db.users[userID]
+	if !ok {
+		return ErrUserNotFound
+	}
+	user.calendarToken = token
+	return nil
+}
+
+// GetCalendarUser retrieves the user whose calendar feed has the given token.
+func (db *MemoryDB) GetCalendarUser(ctx context.Context, token string) (User, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if token == "" {
+		return User{}, ErrUserNotFound
+	}
+	for _, user := range db.users {
+		if user.calendarToken == token {
+			return user.User, nil
+		}
+	}
+	return User{}, ErrUserNotFound
+}
+
+// GetPlannedWorkouts retrieves the planned workouts of the given user, ordered by start
+// time.
+func (db *MemoryDB) GetPlannedWorkouts(ctx context.Context, userID int) ([]PlannedWorkout, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	planned := make([]PlannedWorkout, 0)
+	for _, workout := range db.planned {
+		if workout.user == userID {
+			planned = append(planned, workout.PlannedWorkout)
+		}
+	}
+	sort.Slice(planned, func(i, j int) bool {
+		return planned[i].Start.Before(planned[j].Start)
+	})
+	return planned, nil
+}
+
+// ImportPlannedWorkouts adds planned workouts for the given user at once, replacing any
+// previously imported with the same UID.
+func (db *MemoryDB) ImportPlannedWorkouts(ctx context.Context, userID int, planned []PlannedWorkout) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if _, ok := db.users[userID]; !ok {
+		return ErrUserNotFound
+	}
+	for _, workout := range planned {
+		replaced := false
+		for _, ours := range db.planned {
+			if ours.user == userID && ours.UID == workout.UID {
+				ours.Summary, ours.Start, ours.End = workout.Summary, workout.Start, workout.End
+				replaced = true
+				break
+			}
+		}
+		if !replaced {
+			workout.ID = db.newID()
+			db.planned[workout.ID] = &memoryPlannedWorkout{workout, userID}
+		}
+	}
+	return nil
+}
+
+/* Import jobs */
+
+// AddImportJob adds an import job and returns its ID.
+func (db *MemoryDB) AddImportJob(ctx context.Context, job ImportJob) (int, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if _, ok := db.users[job.User]; !ok {
+		return 0, ErrUserNotFound
+	}
+	job = copyImportJob(job)
+	job.ID = db.newID()
+	db.jobs[job.ID] = &job
+	return job.ID, nil
+}
+
+// UpdateImportJob saves the progress of an import job.
+func (db *MemoryDB) UpdateImportJob(ctx context.Context, job ImportJob) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	ours, ok := db.jobs[job.ID]
+	if !ok {
+		return ErrImportJobNotFound
+	}
+	job = copyImportJob(job)
+	// The owner, source, file, host and creation of a job are fixed when it is added.
+	job.User, job.Source, job.File, job.Host, job.Created = ours.User, ours.Source, ours.File, ours.Host, ours.Created
+	*ours = job
+	return nil
+}
+
+// GetImportJob retrieves an import job, provided that it belongs to the user.
+func (db *MemoryDB) GetImportJob(ctx context.Context, userID, jobID int) (ImportJob, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	job, ok := db.jobs[jobID]
+	if !ok || job.User != userID {
+		return ImportJob{ID: jobID}, ErrImportJobNotFound
+	}
+	copied := copyImportJob(*job)
+	copied.User, copied.File, copied.Host = 0, "", ""
+	return copied, nil
+}
+
+// ClaimStaleImportJobs retrieves the unfinished import jobs of the host that have not
+// saved their progress within the lease, marking them as running.
+func (db *MemoryDB) ClaimStaleImportJobs(ctx context.Context, host string, lease time.Duration) ([]ImportJob, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	now := time.Now()
+	stale := now.Add(-lease)
+	jobs := make([]ImportJob, 0)
+	ids := sortedIDs(len(db.jobs), func(add func(int)) {
+		for id, job := range db.jobs {
+			if (job.Status == JobPending || job.Status == JobRunning) && (job.Host == host || job.Host == "") && job.Updated.Before(stale) {
+				add(id)
+			}
+		}
+	})
+	for _, id := range ids {
+		job := db.jobs[id]
+		job.Status, job.Updated = JobRunning, now
+		claimed := copyImportJob(*job)
+		claimed.Error = ""
+		jobs = append(jobs, claimed)
+	}
+	return jobs, nil
+}
@@ -0,0 +1,581 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"text/tabwriter"
+	"time"
+	"unicode/utf8"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Versioned changes to the schema of the database, which are compiled into the binary so
+// that it can bring any database it is pointed at up to date.
+
+// migration is a change to the schema. Migrations are applied in order of version, each
+// in its own transaction, and down undoes up. Versions are never reused or renumbered
+// once released, and a released migration is never edited: changes go in a new one.
+type migration struct {
+	version int
+	name    string
+	up      string
+	down    string
+	// apply, if set, applies the migration in place of up, for changes to the data that
+	// SQL alone cannot make.
+	apply func(tx *sql.Tx) error
+}
+
+// migrationSet is the migrations of one kind of database, in order of version, along with
+// the statements that record which have been applied.
+type migrationSet struct {
+	migrations []migration
+	// lock and unlock take and release a lock that keeps servers starting together from
+	// applying the same migration twice, for databases that need one.
+	lock, unlock string
+	// createTable creates the schema_migrations table, while record and erase add and
+	// remove a migration's version and name.
+	createTable, record, erase string
+}
+
+// postgresMigrations migrates Postgres databases.
+var postgresMigrations = migrationSet{
+	// The lock is an advisory lock, which belongs to the session that takes it.
+	lock:   "SELECT pg_advisory_lock(4242001)",
+	unlock: "SELECT pg_advisory_unlock(4242001)",
+	createTable: `CREATE TABLE IF NOT EXISTS schema_migrations (
+		version integer CONSTRAINT migrationversion PRIMARY KEY,
+		name VARCHAR(100) NOT NULL,
+		applied_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now()
+	)`,
+	record: "INSERT INTO schema_migrations(version, name) VALUES ($1, $2)",
+	erase:  "DELETE FROM schema_migrations WHERE version = $1",
+	// Before migrations, the schema was created by running schema.sql. Migrations 1 to 9
+	// only create what does not already exist, so that databases created from any version
+	// of that file are adopted and brought up to date.
+	migrations: []migration{{
+		version: 1,
+		name:    "initial schema",
+		up: `
+CREATE TABLE IF NOT EXISTS users (
+	id SERIAL CONSTRAINT userid PRIMARY KEY,
+	name VARCHAR(50) NOT NULL,
+	password VARCHAR(50) NOT NULL,
+	token VARCHAR(50) NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS workouts (
+	id SERIAL CONSTRAINT workoutid PRIMARY KEY,
+	user_id integer NOT NULL,
+	start_time TIMESTAMP WITH TIME ZONE NOT NULL,
+	end_time TIMESTAMP WITH TIME ZONE NOT NULL,
+	CONSTRAINT fk_user_id FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE ON UPDATE CASCADE
+);
+`,
+		down: `
+DROP TABLE IF EXISTS workouts;
+DROP TABLE IF EXISTS users;
+`,
+	}, {
+		version: 2,
+		name:    "goals",
+		up: `
+CREATE TABLE IF NOT EXISTS goals (
+	id SERIAL CONSTRAINT goalid PRIMARY KEY,
+	user_id integer NOT NULL,
+	metric VARCHAR(20) NOT NULL,
+	period VARCHAR(20) NOT NULL,
+	target integer NOT NULL,
+	created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now(),
+	CONSTRAINT fk_goal_user_id FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE ON UPDATE CASCADE
+);
+`,
+		down: `DROP TABLE IF EXISTS goals;`,
+	}, {
+		version: 3,
+		name:    "workout intensity",
+		up: `
+ALTER TABLE workouts ADD COLUMN IF NOT EXISTS
+	intensity SMALLINT CONSTRAINT intensity_range CHECK (intensity BETWEEN 1 AND 10);
+`,
+		down: `ALTER TABLE workouts DROP COLUMN IF EXISTS intensity;`,
+	}, {
+		version: 4,
+		name:    "stopwatch sessions",
+		up: `
+ALTER TABLE workouts ALTER COLUMN end_time DROP NOT NULL;
+
+-- Workouts without an end are in progress, and each user can only have one at a time.
+CREATE UNIQUE INDEX IF NOT EXISTS one_active_workout ON workouts(user_id) WHERE end_time IS NULL;
+
+CREATE TABLE IF NOT EXISTS workout_pauses (
+	id SERIAL CONSTRAINT pauseid PRIMARY KEY,
+	workout_id integer NOT NULL,
+	paused_at TIMESTAMP WITH TIME ZONE NOT NULL,
+	resumed_at TIMESTAMP WITH TIME ZONE,
+	CONSTRAINT fk_workout_id FOREIGN KEY (workout_id) REFERENCES workouts(id) ON DELETE CASCADE ON UPDATE CASCADE
+);
+`,
+		// Workouts in progress have no end to keep, so they are removed.
+		down: `
+DROP TABLE IF EXISTS workout_pauses;
+DROP INDEX IF EXISTS one_active_workout;
+DELETE FROM workouts WHERE end_time IS NULL;
+ALTER TABLE workouts ALTER COLUMN end_time SET NOT NULL;
+`,
+	}, {
+		version: 5,
+		name:    "webhooks",
+		up: `
+CREATE TABLE IF NOT EXISTS webhooks (
+	id SERIAL CONSTRAINT webhookid PRIMARY KEY,
+	user_id integer NOT NULL,
+	url VARCHAR(2048) NOT NULL,
+	events VARCHAR(200) NOT NULL,
+	secret VARCHAR(64) NOT NULL,
+	created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now(),
+	CONSTRAINT fk_webhook_user_id FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE ON UPDATE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS webhook_deliveries (
+	id SERIAL CONSTRAINT deliveryid PRIMARY KEY,
+	webhook_id integer NOT NULL,
+	event VARCHAR(50) NOT NULL,
+	payload JSONB NOT NULL,
+	status VARCHAR(20) NOT NULL DEFAULT 'pending',
+	attempts integer NOT NULL DEFAULT 0,
+	next_attempt_at TIMESTAMP WITH TIME ZONE DEFAULT now(),
+	response_code integer,
+	error TEXT,
+	created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now(),
+	delivered_at TIMESTAMP WITH TIME ZONE,
+	CONSTRAINT fk_webhook_id FOREIGN KEY (webhook_id) REFERENCES webhooks(id) ON DELETE CASCADE ON UPDATE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS pending_deliveries ON webhook_deliveries(next_attempt_at) WHERE status = 'pending';
+`,
+		down: `
+DROP TABLE IF EXISTS webhook_deliveries;
+DROP TABLE IF EXISTS webhooks;
+`,
+	}, {
+		version: 6,
+		name:    "calendars",
+		up: `
+ALTER TABLE users ADD COLUMN IF NOT EXISTS
+	calendar_token VARCHAR(64) CONSTRAINT unique_calendar_token UNIQUE;
+
+CREATE TABLE IF NOT EXISTS planned_workouts (
+	id SERIAL CONSTRAINT plannedid PRIMARY KEY,
+	user_id integer NOT NULL,
+	uid VARCHAR(255) NOT NULL,
+	summary VARCHAR(255) NOT NULL,
+	start_time TIMESTAMP WITH TIME ZONE NOT NULL,
+	end_time TIMESTAMP WITH TIME ZONE NOT NULL,
+	CONSTRAINT unique_planned_uid UNIQUE (user_id, uid),
+	CONSTRAINT fk_planned_user_id FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE ON UPDATE CASCADE
+);
+`,
+		down: `
+DROP TABLE IF EXISTS planned_workouts;
+ALTER TABLE users DROP COLUMN IF EXISTS calendar_token;
+`,
+	}, {
+		version: 7,
+		name:    "import jobs",
+		up: `
+CREATE TABLE IF NOT EXISTS import_jobs (
+	id SERIAL CONSTRAINT jobid PRIMARY KEY,
+	user_id integer NOT NULL,
+	source VARCHAR(20) NOT NULL,
+	status VARCHAR(20) NOT NULL,
+	bytes_read BIGINT NOT NULL DEFAULT 0,
+	total_bytes BIGINT NOT NULL DEFAULT 0,
+	processed integer NOT NULL DEFAULT 0,
+	imported integer NOT NULL DEFAULT 0,
+	duplicates integer NOT NULL DEFAULT 0,
+	failed integer NOT NULL DEFAULT 0,
+	errors JSONB NOT NULL DEFAULT '[]',
+	error TEXT,
+	created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now(),
+	updated_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now(),
+	finished_at TIMESTAMP WITH TIME ZONE,
+	CONSTRAINT fk_job_user_id FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE ON UPDATE CASCADE
+);
+`,
+		down: `DROP TABLE IF EXISTS import_jobs;`,
+	}, {
+		version: 8,
+		name:    "workout types",
+		up:      `ALTER TABLE workouts ADD COLUMN IF NOT EXISTS type VARCHAR(50) NOT NULL DEFAULT '';`,
+		down:    `ALTER TABLE workouts DROP COLUMN IF EXISTS type;`,
+	}, {
+		version: 9,
+		name:    "resumable import jobs",
+		up: `
+ALTER TABLE import_jobs ADD COLUMN IF NOT EXISTS total integer NOT NULL DEFAULT 0;
+ALTER TABLE import_jobs ADD COLUMN IF NOT EXISTS file TEXT NOT NULL DEFAULT '';
+`,
+		down: `
+ALTER TABLE import_jobs DROP COLUMN IF EXISTS file;
+ALTER TABLE import_jobs DROP COLUMN IF EXISTS total;
+`,
+	}, {
+		version: 10,
+		name:    "unique user names",
+		// Users who signed up at the same moment could share a name before this, and all
+		// but the first of them are renamed. The names they are given are kept if the
+		// migration is reverted.
+		apply: uniqueUserNames(
+			`CREATE TABLE user_renames (
+				user_id integer CONSTRAINT renameduserid PRIMARY KEY,
+				old_name VARCHAR(50) NOT NULL,
+				new_name VARCHAR(50) NOT NULL,
+				renamed_at TIMESTAMP WITH TIME ZONE NOT NULL,
+				CONSTRAINT fk_rename_user_id FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE ON UPDATE CASCADE
+			)`,
+			`ALTER TABLE users ADD CONSTRAINT unique_user_name UNIQUE (name)`,
+		),
+		down: `
+ALTER TABLE users DROP CONSTRAINT unique_user_name;
+DROP TABLE user_renames;
+`,
+	}, {
+		version: 11,
+		name:    "workout trash",
+		up: `
+ALTER TABLE workouts ADD COLUMN deleted_at TIMESTAMP WITH TIME ZONE;
+
+-- Workouts in the trash no longer count as in progress.
+DROP INDEX one_active_workout;
+CREATE UNIQUE INDEX one_active_workout ON workouts(user_id) WHERE end_time IS NULL AND deleted_at IS NULL;
+
+CREATE INDEX deleted_workouts ON workouts(deleted_at) WHERE deleted_at IS NOT NULL;
+`,
+		// The trash is emptied, since the workouts in it would otherwise reappear.
+		down: `
+DELETE FROM workouts WHERE deleted_at IS NOT NULL;
+DROP INDEX deleted_workouts;
+DROP INDEX one_active_workout;
+CREATE UNIQUE INDEX one_active_workout ON workouts(user_id) WHERE end_time IS NULL;
+ALTER TABLE workouts DROP COLUMN deleted_at;
+`,
+	}, {
+		version: 12,
+		name:    "import job hosts",
+		// Jobs started before this have no host, and can still be resumed by any server.
+		up:   `ALTER TABLE import_jobs ADD COLUMN host TEXT NOT NULL DEFAULT '';`,
+		down: `ALTER TABLE import_jobs DROP COLUMN host;`,
+	}},
+}
+
+// uniqueUserNames returns the migration that makes user names unique, which creates the
+// user_renames table, renames the users who share a name with an earlier user and then
+// adds the constraint.
+//
+// A renamed user is given their name followed by their ID, and a counter as well should
+// that be taken. Their password is still keyed by the name they signed up with, so they
+// keep logging in with it, and the renames are recorded so that they can be told their
+// new name.
+func uniqueUserNames(createRenames, constraint string) func(tx *sql.Tx) error {
+	return func(tx *sql.Tx) error {
+		if _, err := tx.Exec(createRenames); err != nil {
+			return err
+		}
+
+		type user struct {
+			id   int
+			name string
+		}
+		var duplicates []user
+		rows, err := tx.Query(
+			"SELECT id, name FROM users WHERE id NOT IN (SELECT min(id) FROM users GROUP BY name) ORDER BY id",
+		)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var u user
+			if err = rows.Scan(&u.id, &u.name); err != nil {
+				return err
+			}
+			duplicates = append(duplicates, u)
+		}
+		if err = rows.Err(); err != nil {
+			return err
+		}
+
+		now := time.Now().UTC()
+		for _, u := range duplicates {
+			name, err := freeUserName(tx, u.name, u.id)
+			if err != nil {
+				return err
+			}
+			if _, err = tx.Exec("UPDATE users SET name = $1 WHERE id = $2", name, u.id); err != nil {
+				return err
+			}
+			_, err = tx.Exec(
+				"INSERT INTO user_renames(user_id, old_name, new_name, renamed_at) VALUES ($1, $2, $3, $4)",
+				u.id, u.name, name, now,
+			)
+			if err != nil {
+				return err
+			}
+			log.WithFields(log.Fields{"user": u.id, "old_name": u.name, "new_name": name}).Warn("Renamed user sharing a name")
+		}
+
+		_, err = tx.Exec(constraint)
+		return err
+	}
+}
+
+// freeUserName returns a name for a user that no other user has, made of their name and
+// their ID, shortened to fit within maxNameLength.
+func freeUserName(tx *sql.Tx, name string, userID int) (string, error) {
+	for n := 1; ; n++ {
+		suffix := "-" + strconv.Itoa(userID)
+		if n > 1 {
+			suffix += "-" + strconv.Itoa(n)
+		}
+		prefix := name
+		for len(prefix)+len(suffix) > maxNameLength || !utf8.ValidString(prefix) {
+			prefix = prefix[:len(prefix)-1]
+		}
+		candidate := prefix + suffix
+
+		var taken bool
+		err := tx.QueryRow("SELECT EXISTS (SELECT 1 FROM users WHERE name = $1)", candidate).Scan(&taken)
+		if err != nil || !taken {
+			return candidate, err
+		}
+	}
+}
+
+// MigrationStatus describes a migration and whether it has been applied.
+type MigrationStatus struct {
+	Version int
+	Name    string
+	Applied *time.Time
+}
+
+// withMigrationLock runs f on a connection holding the migration lock of the set, creating
+// the schema_migrations table that records the applied migrations if it does not exist.
+func withMigrationLock(db *sql.DB, set migrationSet, f func(conn *sql.Conn) error) error {
+	ctx := context.Background()
+	// Locks can belong to a session, so the lock, the migrations and the unlock all use the
+	// same connection.
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if set.lock != "" {
+		if _, err = conn.ExecContext(ctx, set.lock); err != nil {
+			return err
+		}
+		defer conn.ExecContext(ctx, set.unlock)
+	}
+	if _, err = conn.ExecContext(ctx, set.createTable); err != nil {
+		return err
+	}
+	return f(conn)
+}
+
+// appliedMigrations returns when each applied migration was applied, by version.
+func appliedMigrations(conn *sql.Conn) (map[int]time.Time, error) {
+	rows, err := conn.QueryContext(context.Background(), "SELECT version, applied_at FROM schema_migrations")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := make(map[int]time.Time)
+	for rows.Next() {
+		var version int
+		var at time.Time
+		if err = rows.Scan(&version, &at); err != nil {
+			return nil, err
+		}
+		applied[version] = at
+	}
+	return applied, rows.Err()
+}
+
+// runMigration applies m, or reverts it if up is false, and records the change in
+// schema_migrations, all in one transaction.
+func runMigration(conn *sql.Conn, set migrationSet, m migration, up bool) error {
+	ctx := context.Background()
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	// Rolling back after a successful commit is a no-op.
+	defer tx.Rollback()
+
+	if up {
+		if m.apply != nil {
+			err = m.apply(tx)
+		} else {
+			_, err = tx.Exec(m.up)
+		}
+		if err != nil {
+			return fmt.Errorf("migration %d (%s) failed: %v", m.version, m.name, err)
+		}
+		_, err = tx.Exec(set.record, m.version, m.name)
+	} else {
+		if _, err = tx.Exec(m.down); err != nil {
+			return fmt.Errorf("reverting migration %d (%s) failed: %v", m.version, m.name, err)
+		}
+		_, err = tx.Exec(set.erase, m.version)
+	}
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// migrate applies the migrations of the set that have not been applied to the database,
+// in order, and returns how many it applied.
+func migrate(db *sql.DB, set migrationSet) (int, error) {
+	count := 0
+	err := withMigrationLock(db, set, func(conn *sql.Conn) error {
+		applied, err := appliedMigrations(conn)
+		if err != nil {
+			return err
+		}
+		for _, m := range set.migrations {
+			if _, ok := applied[m.version]; ok {
+				continue
+			}
+			if err = runMigration(conn, set, m, true); err != nil {
+				return err
+			}
+			log.WithFields(log.Fields{"version": m.version, "name": m.name}).Info("Applied migration")
+			count++
+		}
+		return nil
+	})
+	return count, err
+}
+
+// migrateDown reverts the given number of the most recently applied migrations of the set
+// and returns how many it reverted, which is fewer if fewer had been applied.
+func migrateDown(db *sql.DB, set migrationSet, steps int) (int, error) {
+	count := 0
+	err := withMigrationLock(db, set, func(conn *sql.Conn) error {
+		applied, err := appliedMigrations(conn)
+		if err != nil {
+			return err
+		}
+		for i := len(set.migrations) - 1; i >= 0 && count < steps; i-- {
+			m := set.migrations[i]
+			if _, ok := applied[m.version]; !ok {
+				continue
+			}
+			if err = runMigration(conn, set, m, false); err != nil {
+				return err
+			}
+			log.WithFields(log.Fields{"version": m.version, "name": m.name}).Info("Reverted migration")
+			count++
+		}
+		return nil
+	})
+	return count, err
+}
+
+// migrationStatus lists every migration of the set and when it was applied, if it has
+// been.
+func migrationStatus(db *sql.DB, set migrationSet) ([]MigrationStatus, error) {
+	var statuses []MigrationStatus
+	err := withMigrationLock(db, set, func(conn *sql.Conn) error {
+		applied, err := appliedMigrations(conn)
+		if err != nil {
+			return err
+		}
+		for _, m := range set.migrations {
+			status := MigrationStatus{Version: m.version, Name: m.name}
+			if at, ok := applied[m.version]; ok {
+				status.Applied = &at
+			}
+			statuses = append(statuses, status)
+		}
+		return nil
+	})
+	return statuses, err
+}
+
+// Migrate applies the migrations that have not been applied to the database, in order,
+// and returns how many it applied.
+func (db *DB) Migrate() (int, error) {
+	return migrate(db.DB, postgresMigrations)
+}
+
+// MigrateDown reverts the given number of the most recently applied migrations and
+// returns how many it reverted.
+func (db *DB) MigrateDown(steps int) (int, error) {
+	return migrateDown(db.DB, postgresMigrations, steps)
+}
+
+// MigrationStatus lists every migration and when it was applied, if it has been.
+func (db *DB) MigrationStatus() ([]MigrationStatus, error) {
+	return migrationStatus(db.DB, postgresMigrations)
+}
+
+// migrateCommand applies or reverts migrations from the command line, for databases that
+// are not migrated when the server starts:
+//
+//	workout-tracker migrate [up | down [-steps N] | status]
+func migrateCommand(db Database, args []string) error {
+	action := "up"
+	if len(args) > 0 {
+		action, args = args[0], args[1:]
+	}
+	flags := flag.NewFlagSet("migrate "+action, flag.ContinueOnError)
+	steps := flags.Int("steps", 1, "the number of migrations to revert")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 0 || *steps < 1 {
+		return errors.New("usage: migrate [up | down [-steps N] | status]")
+	}
+
+	switch action {
+	case "up":
+		count, err := db.Migrate()
+		if err != nil {
+			return err
+		}
+		log.WithField("applied", count).Info("The database is up to date")
+	case "down":
+		count, err := db.MigrateDown(*steps)
+		if err != nil {
+			return err
+		}
+		log.WithField("reverted", count).Info("Reverted migrations")
+	case "status":
+		statuses, err := db.MigrationStatus()
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "VERSION\tNAME\tAPPLIED")
+		for _, status := range statuses {
+			applied := "pending"
+			if status.Applied != nil {
+				applied = status.Applied.Format(time.RFC3339)
+			}
+			fmt.Fprintf(w, "%d\t%s\t%s\n", status.Version, status.Name, applied)
+		}
+		return w.Flush()
+	default:
+		return fmt.Errorf("unknown migrate action '%s': expected up, down or status", action)
+	}
+	return nil
+}
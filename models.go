@@ -1,6 +1,9 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
+	"strings"
 	"time"
 )
 
@@ -19,16 +22,450 @@ type User struct {
 	Token string `json:"token,omitempty"`
 }
 
-// Workout represents a single workout.
+// Workout represents a single workout. End is nil while a workout recorded by the
+// stopwatch is in progress. Intensity is the optional rating of perceived exertion of the
+// workout, from 1 to 10, and Type the optional kind of activity, such as running.
 type Workout struct {
-	ID    int       `json:"id"`
-	User  int       `json:"user,omitempty"`
-	Start time.Time `json:"start"`
-	End   time.Time `json:"end"`
+	ID        int        `json:"id"`
+	User      int        `json:"user,omitempty"`
+	Start     time.Time  `json:"start"`
+	End       *time.Time `json:"end"`
+	Intensity *int       `json:"intensity,omitempty"`
+	Type      string     `json:"type,omitempty"`
+	// Deleted is when the workout was moved to the trash, for workouts in the trash.
+	Deleted *time.Time `json:"deleted,omitempty"`
+	// keepIntensity and keepType are set when a workout decoded from JSON leaves out its
+	// intensity or type, so that an update with it keeps the stored ones. An intensity of
+	// null or an empty type clears them.
+	keepIntensity, keepType bool
+}
+
+// Duration returns the length of the workout, or zero if it is still in progress.
+func (workout Workout) Duration() time.Duration {
+	if workout.End == nil {
+		return 0
+	}
+	return workout.End.Sub(workout.Start)
+}
+
+// UnmarshalJSON decodes a workout, noting which of its optional fields were left out.
+// Workouts come from request bodies, so unknown fields are rejected as decodeJSON rejects
+// them elsewhere, which a decoder does not pass on to the methods it calls.
+func (workout *Workout) UnmarshalJSON(data []byte) error {
+	// plainWorkout has the fields of a Workout but not this method, which decoding it
+	// would otherwise call again.
+	type plainWorkout Workout
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode((*plainWorkout)(workout)); err != nil {
+		return err
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+	workout.keepIntensity = !hasJSONField(fields, "intensity")
+	workout.keepType = !hasJSONField(fields, "type")
+	return nil
+}
+
+// hasJSONField reports whether an object has the named field, ignoring case in the way
+// encoding/json does when it matches fields.
+func hasJSONField(fields map[string]json.RawMessage, name string) bool {
+	for field := range fields {
+		if strings.EqualFold(field, name) {
+			return true
+		}
+	}
+	return false
 }
 
 // LoginResponse represents all of the information required upon logging in.
 type LoginResponse struct {
 	User     User      `json:"user"`
 	Workouts []Workout `json:"workouts"`
+	Streaks  *Streaks  `json:"streaks,omitempty"`
+}
+
+// Operations that can be performed on a workout as part of a batch request.
+const (
+	BatchCreate = "create"
+	BatchUpdate = "update"
+	BatchDelete = "delete"
+)
+
+// BatchOperation represents a single create, update or delete of a workout within a
+// batch request. Deletes only require the workout's ID and user.
+type BatchOperation struct {
+	Op      string  `json:"op"`
+	Workout Workout `json:"workout"`
+}
+
+// BatchRequest represents the expected request object for a batch of workout operations.
+type BatchRequest struct {
+	Operations []BatchOperation `json:"operations"`
+}
+
+// BatchResult represents the outcome of a single operation within a batch.
+type BatchResult struct {
+	Index   int          `json:"index"`
+	Op      string       `json:"op"`
+	ID      int          `json:"id,omitempty"`
+	Status  int          `json:"status"`
+	Code    string       `json:"code,omitempty"`
+	Error   string       `json:"error,omitempty"`
+	Details []FieldError `json:"details,omitempty"`
+	Err     error        `json:"-"`
+}
+
+// BatchResponse represents the per-operation results of a batch request.
+type BatchResponse struct {
+	Results []BatchResult `json:"results"`
+}
+
+// ErrorResponse is the envelope written for every failed request. Message is kept under
+// the "error" key so that clients predating the envelope continue to work.
+type ErrorResponse struct {
+	Message   string           `json:"error"`
+	Code      string           `json:"code"`
+	Details   []FieldError     `json:"details,omitempty"`
+	Warnings  []WorkoutWarning `json:"warnings,omitempty"`
+	RequestID string           `json:"request_id,omitempty"`
+}
+
+// FieldError describes a problem with a single field of a request body.
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// WorkoutSummary represents aggregate statistics over a set of workouts.
+type WorkoutSummary struct {
+	Count          int        `json:"count"`
+	TotalMinutes   float64    `json:"total_minutes"`
+	AverageMinutes float64    `json:"average_minutes"`
+	LongestMinutes float64    `json:"longest_minutes"`
+	PerWeek        float64    `json:"per_week"`
+	First          *time.Time `json:"first,omitempty"`
+	Last           *time.Time `json:"last,omitempty"`
+}
+
+// Sizes of the buckets that workouts can be grouped into over time.
+const (
+	BucketWeek  = "week"
+	BucketMonth = "month"
+)
+
+// InsightsQuery represents the range and grouping requested for a user's insights. From
+// and To are instants, while buckets follow the calendar of Location.
+type InsightsQuery struct {
+	From     time.Time
+	To       time.Time
+	Bucket   string
+	Location *time.Location
+}
+
+// Insights represents statistics about when and how often a user works out.
+type Insights struct {
+	From      time.Time          `json:"from"`
+	To        time.Time          `json:"to"`
+	Bucket    string             `json:"bucket"`
+	TimeZone  string             `json:"time_zone"`
+	TimeOfDay TimeOfDayBreakdown `json:"time_of_day"`
+	Frequency []FrequencyBucket  `json:"frequency"`
+}
+
+// TimeOfDayBreakdown counts workouts by the part of the day they ended in: night (midnight
+// to 6am), morning (6am to noon), afternoon (noon to 6pm) and evening (6pm to midnight).
+type TimeOfDayBreakdown struct {
+	Night     int `json:"night"`
+	Morning   int `json:"morning"`
+	Afternoon int `json:"afternoon"`
+	Evening   int `json:"evening"`
+}
+
+// FrequencyBucket represents the workouts started within a single week or month.
+type FrequencyBucket struct {
+	Start        time.Time `json:"start"`
+	Count        int       `json:"count"`
+	TotalMinutes float64   `json:"total_minutes"`
+}
+
+// Streak represents a run of consecutive active days or weeks.
+type Streak struct {
+	Current      int        `json:"current"`
+	Longest      int        `json:"longest"`
+	CurrentStart *time.Time `json:"current_start,omitempty"`
+	LongestStart *time.Time `json:"longest_start,omitempty"`
+}
+
+// Streaks represents a user's workout streaks and how consistently they meet their
+// weekly target.
+type Streaks struct {
+	Daily       Streak  `json:"daily"`
+	Weekly      Streak  `json:"weekly"`
+	Consistency float64 `json:"consistency"`
+	RestDays    int     `json:"rest_days"`
+	PerWeek     int     `json:"per_week"`
+	Window      int     `json:"window"`
+	TimeZone    string  `json:"time_zone"`
+}
+
+// Quantities that a goal can measure.
+const (
+	GoalWorkouts = "workouts"
+	GoalMinutes  = "minutes"
+)
+
+// Goal represents a target number of workouts or active minutes to reach every week or
+// month.
+type Goal struct {
+	ID      int       `json:"id"`
+	User    int       `json:"user,omitempty"`
+	Metric  string    `json:"metric"`
+	Period  string    `json:"period"`
+	Target  int       `json:"target"`
+	Created time.Time `json:"created"`
+}
+
+// GoalPeriod represents the progress made towards a goal within a single week or month.
+type GoalPeriod struct {
+	Start     time.Time `json:"start"`
+	End       time.Time `json:"end"`
+	Value     float64   `json:"value"`
+	Percent   float64   `json:"percent"`
+	Completed bool      `json:"completed"`
+}
+
+// GoalProgress represents the completion history of a goal, from the oldest period to the
+// one in progress.
+type GoalProgress struct {
+	Goal      Goal         `json:"goal"`
+	Periods   []GoalPeriod `json:"periods"`
+	Completed int          `json:"completed"`
+}
+
+// Heatmap represents the workouts of a user on each day of a calendar year.
+type Heatmap struct {
+	Year         int          `json:"year"`
+	TimeZone     string       `json:"time_zone"`
+	Days         []HeatmapDay `json:"days"`
+	Count        int          `json:"count"`
+	TotalMinutes float64      `json:"total_minutes"`
+	MaxCount     int          `json:"max_count"`
+}
+
+// HeatmapDay represents the workouts started on a single day.
+type HeatmapDay struct {
+	Date    string  `json:"date"`
+	Count   int     `json:"count"`
+	Minutes float64 `json:"minutes"`
+}
+
+// TrainingLoad represents a user's daily training load along with their acute and
+// chronic workloads and fitness and fatigue curves.
+type TrainingLoad struct {
+	TimeZone string    `json:"time_zone"`
+	Days     []LoadDay `json:"days"`
+	Current  LoadDay   `json:"current"`
+	Warning  string    `json:"warning,omitempty"`
+}
+
+// LoadDay represents the training load model on a single day. Ratio is the acute:chronic
+// workload ratio, which is omitted when there is no chronic load to compare against.
+type LoadDay struct {
+	Date    string   `json:"date"`
+	Load    float64  `json:"load"`
+	Acute   float64  `json:"acute"`
+	Chronic float64  `json:"chronic"`
+	Ratio   *float64 `json:"ratio,omitempty"`
+	Zone    string   `json:"zone,omitempty"`
+	Fitness float64  `json:"fitness"`
+	Fatigue float64  `json:"fatigue"`
+	Form    float64  `json:"form"`
+}
+
+// Actions that change the state of a workout in progress.
+const (
+	SessionPause  = "pause"
+	SessionResume = "resume"
+	SessionFinish = "finish"
+)
+
+// SessionRequest is the optional body of a request that starts or changes a workout in
+// progress. At is when the action happened, defaulting to when the request is received,
+// which lets devices report actions taken while they were offline.
+type SessionRequest struct {
+	At *time.Time `json:"at"`
+}
+
+// Pause represents an interval during which a workout in progress was paused. End is nil
+// while the workout is still paused.
+type Pause struct {
+	Start time.Time  `json:"start"`
+	End   *time.Time `json:"end"`
+}
+
+// WorkoutSession represents a workout recorded by the stopwatch along with the intervals
+// it was paused for. ActiveSeconds is the time spent working out excluding pauses, up to
+// the end of the workout or the time of the response if it is in progress.
+type WorkoutSession struct {
+	Workout       Workout `json:"workout"`
+	Pauses        []Pause `json:"pauses"`
+	Paused        bool    `json:"paused"`
+	ActiveSeconds float64 `json:"active_seconds"`
+}
+
+// Event represents a change to one of a user's workouts, published to their open event
+// streams. Workout is set for events about saved workouts other than deletions, and
+// Session for events about workouts in progress.
+type Event struct {
+	ID        int64           `json:"id"`
+	Type      string          `json:"type"`
+	Time      time.Time       `json:"time"`
+	WorkoutID int             `json:"workout_id"`
+	Workout   *Workout        `json:"workout,omitempty"`
+	Session   *WorkoutSession `json:"session,omitempty"`
+}
+
+// Webhook represents a URL that is sent the events of a user's workouts. The secret that
+// deliveries are signed with is only returned when the webhook is added.
+type Webhook struct {
+	ID      int       `json:"id"`
+	User    int       `json:"user,omitempty"`
+	URL     string    `json:"url"`
+	Events  []string  `json:"events"`
+	Secret  string    `json:"secret,omitempty"`
+	Created time.Time `json:"created"`
+}
+
+// WebhookEvent is an event to be delivered to those of a user's webhooks that subscribe to
+// its type, with the payload they are sent.
+type WebhookEvent struct {
+	User    int
+	Type    string
+	Payload []byte
+}
+
+// WebhookPayload is the body of the requests sent to webhooks.
+type WebhookPayload struct {
+	Type      string    `json:"type"`
+	Time      time.Time `json:"time"`
+	WorkoutID int       `json:"workout_id"`
+	Workout   *Workout  `json:"workout,omitempty"`
+}
+
+// Statuses of a webhook delivery.
+const (
+	DeliveryPending   = "pending"
+	DeliveryDelivered = "delivered"
+	DeliveryFailed    = "failed"
+)
+
+// WebhookDelivery represents the delivery of an event to a webhook along with the outcome
+// of its latest attempt. NextAttempt is only set while the delivery is pending.
+type WebhookDelivery struct {
+	ID           int             `json:"id"`
+	Webhook      int             `json:"webhook"`
+	Event        string          `json:"event"`
+	Payload      json.RawMessage `json:"payload"`
+	Status       string          `json:"status"`
+	Attempts     int             `json:"attempts"`
+	NextAttempt  *time.Time      `json:"next_attempt,omitempty"`
+	ResponseCode int             `json:"response_code,omitempty"`
+	Error        string          `json:"error,omitempty"`
+	Created      time.Time       `json:"created"`
+	Delivered    *time.Time      `json:"delivered,omitempty"`
+	URL          string          `json:"-"`
+	Secret       string          `json:"-"`
+}
+
+// PlannedWorkout represents a workout scheduled ahead of time, such as a session of a
+// training plan imported from its calendar. UID identifies the calendar event it was
+// imported from, so that importing the calendar again updates it rather than adding it
+// twice.
+type PlannedWorkout struct {
+	ID      int       `json:"id"`
+	UID     string    `json:"uid"`
+	Summary string    `json:"summary"`
+	Start   time.Time `json:"start"`
+	End     time.Time `json:"end"`
+}
+
+// ImportError describes a record of an import that could not be read. Record is the
+// position of the record in the imported file, starting from 1.
+type ImportError struct {
+	Record  int    `json:"record"`
+	Field   string `json:"field,omitempty"`
+	Message string `json:"message"`
+}
+
+// PlannedImport reports the outcome of importing a calendar of planned workouts.
+type PlannedImport struct {
+	Imported int           `json:"imported"`
+	Errors   []ImportError `json:"errors"`
+}
+
+// WorkoutImport reports the outcome of importing a file of workouts. Workouts lists the
+// workouts that were imported or, for a dry run, those that would have been.
+type WorkoutImport struct {
+	Imported int           `json:"imported"`
+	DryRun   bool          `json:"dry_run"`
+	Workouts []Workout     `json:"workouts"`
+	Errors   []ImportError `json:"errors"`
+}
+
+// Sources that workouts can be imported from by an import job.
+const (
+	ImportSourceAppleHealth = "apple_health"
+	ImportSourceStrava      = "strava"
+)
+
+// Statuses of an import job.
+const (
+	JobPending   = "pending"
+	JobRunning   = "running"
+	JobSucceeded = "succeeded"
+	JobFailed    = "failed"
+)
+
+// ImportJob tracks an import running in the background. BytesRead and TotalBytes measure
+// how far through the imported file the job is, and Total is the number of records in the
+// file when it is known up front. Processed is also where an interrupted job resumes.
+// Errors lists the first records that could not be imported, while Failed counts all of
+// them. Error describes why the job failed. File is where the upload is kept until the
+// job is done.
+type ImportJob struct {
+	ID         int           `json:"id"`
+	User       int           `json:"user,omitempty"`
+	Source     string        `json:"source"`
+	Status     string        `json:"status"`
+	BytesRead  int64         `json:"bytes_read"`
+	TotalBytes int64         `json:"total_bytes"`
+	Total      int           `json:"total,omitempty"`
+	Processed  int           `json:"processed"`
+	Imported   int           `json:"imported"`
+	Duplicates int           `json:"duplicates"`
+	Failed     int           `json:"failed"`
+	Errors     []ImportError `json:"errors"`
+	Error      string        `json:"error,omitempty"`
+	Created    time.Time     `json:"created"`
+	Updated    time.Time     `json:"updated"`
+	Finished   *time.Time    `json:"finished,omitempty"`
+	File       string        `json:"-"`
+	Host       string        `json:"-"`
+}
+
+// CalendarFeed represents the secret address of a user's calendar feed.
+type CalendarFeed struct {
+	Token string `json:"token"`
+	URL   string `json:"url"`
+}
+
+// WorkoutWarning describes a check that a workout being written did not pass. Workouts
+// lists the IDs of the other workouts involved, if any.
+type WorkoutWarning struct {
+	Check    string `json:"check"`
+	Message  string `json:"message"`
+	Workouts []int  `json:"workouts,omitempty"`
 }
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// openAPISpec is the subset of an OpenAPI document checked by the tests.
+type openAPISpec struct {
+	Paths      map[string]map[string]json.RawMessage `json:"paths"`
+	Components struct {
+		Schemas map[string]json.RawMessage `json:"schemas"`
+	} `json:"components"`
+}
+
+var routeParam = regexp.MustCompile(`:([A-Za-z_]+)`)
+
+// specPath converts an httprouter pattern such as /workout/:id to /workout/{id}.
+func specPath(pattern string) string {
+	return routeParam.ReplaceAllString(pattern, "{$1}")
+}
+
+func readSpec(t *testing.T) openAPISpec {
+	contents, err := ioutil.ReadFile(openAPIPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var spec openAPISpec
+	if err = json.Unmarshal(contents, &spec); err != nil {
+		t.Fatalf("invalid OpenAPI document: %v", err)
+	}
+	return spec
+}
+
+// registeredRoutes returns the method and spec path of every route in NewRouter.
+func registeredRoutes() map[string]string {
+	env := &Env{}
+	routes := make(map[string]string)
+	for _, route := range env.pageRoutes() {
+		routes[route.Name] = route.Method + " " + specPath(route.Pattern)
+	}
+	for _, route := range env.apiRoutes() {
+		routes[route.Name] = route.Method + " " + specPath(apiVersion+route.Pattern)
+	}
+	return routes
+}
+
+func TestOpenAPIDocumentsEveryRoute(t *testing.T) {
+	spec := readSpec(t)
+	for name, route := range registeredRoutes() {
+		parts := strings.SplitN(route, " ", 2)
+		if _, ok := spec.Paths[parts[1]][strings.ToLower(parts[0])]; !ok {
+			t.Errorf("route %s (%s) is missing from the OpenAPI document", name, route)
+		}
+	}
+}
+
+func TestOpenAPIOnlyDocumentsRegisteredRoutes(t *testing.T) {
+	registered := make(map[string]bool)
+	for _, route := range registeredRoutes() {
+		registered[route] = true
+	}
+
+	spec := readSpec(t)
+	for path, operations := range spec.Paths {
+		for method := range operations {
+			route := strings.ToUpper(method) + " " + path
+			if !registered[route] {
+				t.Errorf("the OpenAPI document describes %s, which is not registered", route)
+			}
+		}
+	}
+}
+
+func TestOpenAPIDocumentsModels(t *testing.T) {
+	spec := readSpec(t)
+	for _, name := range []string{
+		"Workout",
+		"User",
+		"UserRequest",
+		"LoginResponse",
+		"ErrorResponse",
+	} {
+		if _, ok := spec.Components.Schemas[name]; !ok {
+			t.Errorf("schema %s is missing from the OpenAPI document", name)
+		}
+	}
+}
+
+func TestServeOpenAPI(t *testing.T) {
+	env := &Env{}
+	recorder := httptest.NewRecorder()
+	env.NewRouter().ServeHTTP(recorder, httptest.NewRequest("GET", "/openapi.json", nil))
+
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, recorder.Code)
+	}
+	var spec openAPISpec
+	if err := json.Unmarshal(recorder.Body.Bytes(), &spec); err != nil {
+		t.Fatalf("served document is not valid JSON: %v", err)
+	}
+	if len(spec.Paths) == 0 {
+		t.Error("served document has no paths")
+	}
+}
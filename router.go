@@ -2,10 +2,14 @@ package main
 
 import (
 	"net/http"
+	"strings"
 
 	"github.com/julienschmidt/httprouter"
 )
 
+// apiVersion is the prefix under which the current version of the API is served.
+const apiVersion = "/v1"
+
 // Route stores all of the data required for a single route.
 type Route struct {
 	Name    string
@@ -16,7 +20,92 @@ type Route struct {
 
 // NewRouter initializes a new router with all of our routes and logging.
 func (env *Env) NewRouter() *httprouter.Router {
-	routes := []Route{
+	router := httprouter.New()
+	for _, route := range env.pageRoutes() {
+		router.Handle(
+			route.Method,
+			route.Pattern,
+			env.loggerMiddleware(route.Name, route.Handle),
+		)
+	}
+	shared := make(map[string]*sharedRoute)
+	for _, route := range env.apiRoutes() {
+		handle := env.loggerMiddleware(route.Name, route.Handle)
+		pattern, ok := sharedPatterns[route.Pattern]
+		if !ok {
+			env.handleAPI(router, route.Method, route.Pattern, handle)
+			continue
+		}
+		key := route.Method + " " + pattern
+		if shared[key] == nil {
+			shared[key] = &sharedRoute{method: route.Method, pattern: pattern}
+		}
+		shared[key].routes = append(shared[key].routes, route.Pattern)
+		shared[key].handles = append(shared[key].handles, handle)
+	}
+	for _, route := range shared {
+		env.handleAPI(router, route.method, route.pattern, route.dispatch)
+	}
+
+	router.NotFound = http.HandlerFunc(NotFound)
+	router.MethodNotAllowed = http.HandlerFunc(MethodNotAllowed)
+
+	return router
+}
+
+// handleAPI registers a handle for an API pattern.
+func (env *Env) handleAPI(router *httprouter.Router, method, pattern string, handle httprouter.Handle) {
+	router.Handle(method, apiVersion+pattern, handle)
+	// The unversioned paths are kept as aliases for clients predating /v1.
+	router.Handle(method, pattern, handle)
+}
+
+// sharedPatterns maps the routes that httprouter cannot register side by side, because a
+// static segment and a parameter would be at the same position of their paths, to the
+// parameterized pattern they are served under instead.
+var sharedPatterns = map[string]string{
+	"/workout/start":       "/workout/:id",
+	"/workout/:id/pause":   "/workout/:id/:action",
+	"/workout/:id/resume":  "/workout/:id/:action",
+	"/workout/:id/finish":  "/workout/:id/:action",
+	"/workout/:id/restore": "/workout/:id/:action",
+}
+
+// sharedRoute serves the routes registered under a shared pattern.
+type sharedRoute struct {
+	method  string
+	pattern string
+	routes  []string
+	handles []httprouter.Handle
+}
+
+// dispatch passes a request on to the route whose static segments match the parameters
+// of the shared pattern.
+func (route *sharedRoute) dispatch(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	segments := strings.Split(route.pattern, "/")
+	for i, pattern := range route.routes {
+		if matchesSegments(segments, strings.Split(pattern, "/"), ps) {
+			route.handles[i](w, r, ps)
+			return
+		}
+	}
+	NotFound(w, r)
+}
+
+// matchesSegments reports whether the parameters of a request to the shared pattern with
+// the given segments take the values of the static segments of a route.
+func matchesSegments(shared, route []string, ps httprouter.Params) bool {
+	for i, segment := range shared {
+		if strings.HasPrefix(segment, ":") && !strings.HasPrefix(route[i], ":") && ps.ByName(segment[1:]) != route[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// pageRoutes returns the routes that serve the landing page and its assets.
+func (env *Env) pageRoutes() []Route {
+	return []Route{
 		{
 			"Index",
 			"GET",
@@ -35,6 +124,19 @@ func (env *Env) NewRouter() *httprouter.Router {
 			"/gopher.gif",
 			GetGopher,
 		},
+		{
+			"OpenAPI",
+			"GET",
+			"/openapi.json",
+			GetOpenAPI,
+		},
+	}
+}
+
+// apiRoutes returns the routes of the JSON API. Their patterns are relative to
+// apiVersion.
+func (env *Env) apiRoutes() []Route {
+	return []Route{
 		{
 			"SignUp",
 			"POST",
@@ -65,19 +167,203 @@ func (env *Env) NewRouter() *httprouter.Router {
 			"/workout/:id",
 			env.DeleteWorkout,
 		},
+		{
+			"GetTrash",
+			"GET",
+			"/trash",
+			env.GetTrash,
+		},
+		{
+			"RestoreWorkout",
+			"POST",
+			"/workout/:id/restore",
+			env.RestoreWorkout,
+		},
+		{
+			"BatchWorkouts",
+			"POST",
+			"/workouts/batch",
+			env.BatchWorkouts,
+		},
+		{
+			"GraphQL",
+			"POST",
+			"/graphql",
+			env.GraphQL,
+		},
+		{
+			"GetInsights",
+			"GET",
+			"/insights",
+			env.GetInsights,
+		},
+		{
+			"GetStreaks",
+			"GET",
+			"/streaks",
+			env.GetStreaks,
+		},
+		{
+			"GetGoals",
+			"GET",
+			"/goals",
+			env.GetGoals,
+		},
+		{
+			"AddGoal",
+			"POST",
+			"/goal",
+			env.AddGoal,
+		},
+		{
+			"UpdateGoal",
+			"PUT",
+			"/goal",
+			env.UpdateGoal,
+		},
+		{
+			"DeleteGoal",
+			"DELETE",
+			"/goal/:id",
+			env.DeleteGoal,
+		},
+		{
+			"GetGoalProgress",
+			"GET",
+			"/goals/progress",
+			env.GetGoalProgress,
+		},
+		{
+			"GetHeatmap",
+			"GET",
+			"/heatmap",
+			env.GetHeatmap,
+		},
+		{
+			"GetTrainingLoad",
+			"GET",
+			"/load",
+			env.GetTrainingLoad,
+		},
+		{
+			"StartWorkout",
+			"POST",
+			"/workout/start",
+			env.StartWorkout,
+		},
+		{
+			"GetActiveWorkout",
+			"GET",
+			"/workout/active",
+			env.GetActiveWorkout,
+		},
+		{
+			"PauseWorkout",
+			"POST",
+			"/workout/:id/pause",
+			env.UpdateWorkoutSession(SessionPause),
+		},
+		{
+			"ResumeWorkout",
+			"POST",
+			"/workout/:id/resume",
+			env.UpdateWorkoutSession(SessionResume),
+		},
+		{
+			"FinishWorkout",
+			"POST",
+			"/workout/:id/finish",
+			env.UpdateWorkoutSession(SessionFinish),
+		},
+		{
+			"StreamEvents",
+			"GET",
+			"/events",
+			env.StreamEvents,
+		},
+		{
+			"GetWebhooks",
+			"GET",
+			"/webhooks",
+			env.GetWebhooks,
+		},
+		{
+			"AddWebhook",
+			"POST",
+			"/webhook",
+			env.AddWebhook,
+		},
+		{
+			"DeleteWebhook",
+			"DELETE",
+			"/webhook/:id",
+			env.DeleteWebhook,
+		},
+		{
+			"GetWebhookDeliveries",
+			"GET",
+			"/webhook/:id/deliveries",
+			env.GetWebhookDeliveries,
+		},
+		{
+			"CreateCalendarFeed",
+			"POST",
+			"/calendar/token",
+			env.CreateCalendarFeed,
+		},
+		{
+			"DeleteCalendarFeed",
+			"DELETE",
+			"/calendar/token",
+			env.DeleteCalendarFeed,
+		},
+		{
+			"GetCalendar",
+			"GET",
+			"/calendar/:file",
+			env.GetCalendar,
+		},
+		{
+			"ImportCalendar",
+			"POST",
+			"/calendar/import",
+			env.ImportCalendar,
+		},
+		{
+			"GetPlannedWorkouts",
+			"GET",
+			"/workouts/planned",
+			env.GetPlannedWorkouts,
+		},
+		{
+			"ExportCSV",
+			"GET",
+			"/workouts.csv",
+			env.ExportCSV,
+		},
+		{
+			"ImportCSV",
+			"POST",
+			"/import/csv",
+			env.ImportCSV,
+		},
+		{
+			"ImportAppleHealth",
+			"POST",
+			"/import/apple-health",
+			env.ImportAppleHealth,
+		},
+		{
+			"ImportStrava",
+			"POST",
+			"/import/strava",
+			env.ImportStrava,
+		},
+		{
+			"GetImportJob",
+			"GET",
+			"/import/jobs/:id",
+			env.GetImportJob,
+		},
 	}
-
-	router := httprouter.New()
-	for _, route := range routes {
-		router.Handle(
-			route.Method,
-			route.Pattern,
-			env.loggerMiddleware(route.Name, route.Handle),
-		)
-	}
-
-	router.NotFound = http.HandlerFunc(NotFound)
-	router.MethodNotAllowed = http.HandlerFunc(MethodNotAllowed)
-
-	return router
 }
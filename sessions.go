@@ -0,0 +1,289 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	log "github.com/sirupsen/logrus"
+)
+
+// Error codes specific to workouts in progress.
+const (
+	ErrCodeWorkoutInProgress   = "workout_in_progress"
+	ErrCodeInvalidWorkoutState = "invalid_workout_state"
+)
+
+// maxClockSkew is how far in the future a device may report an action on a workout in
+// progress, to allow for its clock being slightly ahead of ours.
+const maxClockSkew = time.Minute
+
+// sessionPaused reports whether the last pause of a session is still open.
+func sessionPaused(session WorkoutSession) bool {
+	n := len(session.Pauses)
+	return n > 0 && session.Pauses[n-1].End == nil
+}
+
+// lastSessionAction returns when the last action on a session happened.
+func lastSessionAction(session WorkoutSession) time.Time {
+	last := session.Workout.Start
+	if n := len(session.Pauses); n > 0 {
+		last = session.Pauses[n-1].Start
+		if end := session.Pauses[n-1].End; end != nil {
+			last = *end
+		}
+	}
+	return last
+}
+
+// applySessionAction pauses, resumes or finishes a workout in progress at the instant at,
+// after checking that the action is allowed in the session's current state.
+func applySessionAction(session *WorkoutSession, action string, at time.Time) error {
+	switch {
+	case session.Workout.End != nil:
+		return ErrWorkoutFinished
+	case at.Before(lastSessionAction(*session)):
+		return ErrSessionOutOfOrder
+	}
+
+	open := len(session.Pauses) - 1
+	switch action {
+	case SessionPause:
+		if session.Paused {
+			return ErrWorkoutPaused
+		}
+		session.Pauses = append(session.Pauses, Pause{Start: at})
+	case SessionResume:
+		if !session.Paused {
+			return ErrWorkoutNotPaused
+		}
+		session.Pauses[open].End = &at
+	case SessionFinish:
+		if session.Paused {
+			session.Pauses[open].End = &at
+		}
+		session.Workout.End = &at
+	default:
+		return ErrInvalidSessionAction
+	}
+	session.Paused = action == SessionPause
+	return nil
+}
+
+// measureSession sets the active time of a session, counting a workout in progress and
+// an open pause up to now.
+func measureSession(session *WorkoutSession, now time.Time) {
+	end := now
+	if session.Workout.End != nil {
+		end = *session.Workout.End
+	}
+	active := end.Sub(session.Workout.Start)
+	for _, pause := range session.Pauses {
+		resumed := end
+		if pause.End != nil {
+			resumed = *pause.End
+		}
+		active -= resumed.Sub(pause.Start)
+	}
+	if active < 0 {
+		active = 0
+	}
+	session.ActiveSeconds = active.Seconds()
+}
+
+// decodeSessionRequest reads the optional body of a request that starts or changes a
+// workout in progress, returning when the action happened. The body is read before it is
+// decoded, since requests whose length is not known in advance can also have none.
+func decodeSessionRequest(w http.ResponseWriter, r *http.Request, now time.Time) (time.Time, bool) {
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxBodyBytes+1))
+	if err != nil {
+		WriteErrorCode(w, http.StatusBadRequest, err, ErrCodeInvalidJSON, "The request body could not be read")
+		return now, false
+	}
+	var request SessionRequest
+	if len(bytes.TrimSpace(body)) > 0 {
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		if !decodeJSON(w, r, maxBodyBytes, &request) {
+			return now, false
+		}
+	}
+	if request.At == nil {
+		return now, true
+	}
+	return *request.At, validRequest(w, validate(
+		rule{!request.At.After(now.Add(maxClockSkew)), "at", "must not be in the future"},
+	))
+}
+
+// StartWorkout starts a workout for the requesting user that stays in progress until it
+// is finished, so that a stopwatch can be followed from any of their devices. The optional
+// body gives the time the workout started at.
+func (env *Env) StartWorkout(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	user, ok := env.authenticate(w, r)
+	if !ok {
+		return
+	}
+	now := time.Now()
+	start, ok := decodeSessionRequest(w, r, now)
+	if !ok {
+		return
+	}
+
+	session, err := env.db.StartWorkout(r.Context(), user.ID, start)
+	switch {
+	case err == ErrWorkoutInProgress:
+		WriteErrorCode(
+			w,
+			http.StatusConflict,
+			err,
+			ErrCodeWorkoutInProgress,
+			"You already have a workout in progress",
+		)
+		return
+	case err != nil:
+		InternalServerError(w, err)
+		return
+	}
+	measureSession(&session, now)
+	env.publish(user.ID, sessionEvent(EventWorkoutStarted, session))
+	log.WithFields(log.Fields{
+		"name":    user.Name,
+		"workout": session.Workout.ID,
+	}).Info("Started workout")
+	WriteJSON(w, http.StatusCreated, session)
+}
+
+// GetActiveWorkout returns the workout the requesting user has in progress.
+func (env *Env) GetActiveWorkout(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	user, ok := env.authenticate(w, r)
+	if !ok {
+		return
+	}
+	session, err := env.db.GetActiveWorkout(r.Context(), user.ID)
+	switch {
+	case err == ErrWorkoutNotFound:
+		WriteErrorCode(
+			w,
+			http.StatusNotFound,
+			err,
+			ErrCodeWorkoutNotFound,
+			"You do not have a workout in progress",
+		)
+		return
+	case err != nil:
+		InternalServerError(w, err)
+		return
+	}
+	measureSession(&session, time.Now())
+	WriteJSON(w, http.StatusOK, session)
+}
+
+// UpdateWorkoutSession returns a handler that pauses, resumes or finishes the workout in
+// progress specified in the URL parameter. The optional body gives the time the action
+// happened at.
+func (env *Env) UpdateWorkoutSession(action string) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		user, ok := env.authenticate(w, r)
+		if !ok {
+			return
+		}
+		workoutID, err := strconv.Atoi(ps.ByName("id"))
+		if err != nil {
+			WriteValidationError(w, err, "Invalid workout", []FieldError{{"id", "must be an integer"}})
+			return
+		}
+		now := time.Now()
+		at, ok := decodeSessionRequest(w, r, now)
+		if !ok || action == SessionFinish && !env.checkFinishedWorkout(w, r, user.ID, workoutID, at) {
+			return
+		}
+
+		session, err := env.db.UpdateWorkoutSession(r.Context(), user.ID, workoutID, action, at)
+		switch {
+		case err == ErrWorkoutNotFound:
+			WriteErrorCode(
+				w,
+				http.StatusNotFound,
+				err,
+				ErrCodeWorkoutNotFound,
+				"The specified workout could not be found",
+			)
+			return
+		case err == ErrUserNotAuthorized:
+			WriteErrorCode(
+				w,
+				http.StatusUnauthorized,
+				err,
+				ErrCodeNotAuthorized,
+				"The requested workout does not belong to you",
+			)
+			return
+		case err == ErrWorkoutFinished || err == ErrWorkoutPaused || err == ErrWorkoutNotPaused:
+			WriteErrorCode(
+				w,
+				http.StatusConflict,
+				err,
+				ErrCodeInvalidWorkoutState,
+				sessionStateMessages[err],
+			)
+			return
+		case err == ErrSessionOutOfOrder:
+			WriteValidationError(
+				w,
+				err,
+				"The action cannot happen before the workout's last action",
+				[]FieldError{{"at", "must not be before the workout's last action"}},
+			)
+			return
+		case err != nil:
+			InternalServerError(w, err)
+			return
+		}
+		measureSession(&session, now)
+		env.publish(user.ID, sessionEvent(sessionEvents[action], session))
+		if action == SessionFinish {
+			// Webhooks are not sent the events of workouts in progress, so they learn of
+			// the workout once it is finished.
+			created := workoutEvent(EventWorkoutCreated, session.Workout)
+			created.Time = time.Now()
+			env.queueWebhooks(user.ID, created)
+		}
+		log.WithFields(log.Fields{
+			"name":    user.Name,
+			"workout": workoutID,
+			"action":  action,
+		}).Info("Updated workout in progress")
+		WriteJSON(w, http.StatusOK, session)
+	}
+}
+
+// checkFinishedWorkout runs the workout checks on a workout in progress as it would be
+// once finished at the given time, such as one whose stopwatch was left running, writing an
+// error response if it should not be finished. Workouts that cannot be finished are left
+// for the finish itself to report.
+func (env *Env) checkFinishedWorkout(w http.ResponseWriter, r *http.Request, userID, workoutID int, at time.Time) bool {
+	workout, err := env.db.GetWorkout(r.Context(), userID, workoutID)
+	switch {
+	case err == ErrWorkoutNotFound:
+		return true
+	case err != nil:
+		InternalServerError(w, err)
+		return false
+	case workout.End != nil:
+		return true
+	}
+	workout.ID, workout.User, workout.End = workoutID, userID, &at
+	return env.passesChecks(w, r, workout)
+}
+
+// sessionStateMessages are the messages shown when an action is not allowed in the
+// current state of a workout.
+var sessionStateMessages = map[error]string{
+	ErrWorkoutFinished:  "The workout has already finished",
+	ErrWorkoutPaused:    "The workout is already paused",
+	ErrWorkoutNotPaused: "The workout is not paused",
+}
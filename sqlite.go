@@ -0,0 +1,1149 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// A Datastore on SQLite, for running the server without Postgres, such as for a single
+// user on a Raspberry Pi. SQLite has no time zones and compares times as text, so times
+// are stored in UTC and insights are computed in Go.
+
+// sqliteOptions are added to the data source name of SQLite databases. Foreign keys are
+// enforced so that deletes cascade, transactions take the write lock when they begin so
+// that concurrent writers wait for each other rather than fail, and readers are not
+// blocked by writers.
+const sqliteOptions = "_foreign_keys=1&_txlock=immediate&_busy_timeout=5000&_journal_mode=WAL"
+
+// sqliteMigrations migrates SQLite databases. Each process has a single connection to its
+// database, and a migration applied by another process at the same time fails to record
+// its version, rolling it back, so no lock is needed.
+var sqliteMigrations = migrationSet{
+	createTable: `CREATE TABLE IF NOT EXISTS schema_migrations (
+		version INTEGER PRIMARY KEY,
+		name TEXT NOT NULL,
+		applied_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+	)`,
+	record: "INSERT INTO schema_migrations(version, name) VALUES (?, ?)",
+	erase:  "DELETE FROM schema_migrations WHERE version = ?",
+	migrations: []migration{{
+		version: 1,
+		name:    "initial schema",
+		up: `
+CREATE TABLE users (
+	id INTEGER PRIMARY KEY,
+	name TEXT NOT NULL,
+	password TEXT NOT NULL,
+	token TEXT NOT NULL,
+	calendar_token TEXT UNIQUE
+);
+
+CREATE TABLE workouts (
+	id INTEGER PRIMARY KEY,
+	user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE ON UPDATE CASCADE,
+	start_time TIMESTAMP NOT NULL,
+	end_time TIMESTAMP,
+	intensity INTEGER CHECK (intensity BETWEEN 1 AND 10),
+	type TEXT NOT NULL DEFAULT ''
+);
+
+-- Workouts without an end are in progress, and each user can only have one at a time.
+CREATE UNIQUE INDEX one_active_workout ON workouts(user_id) WHERE end_time IS NULL;
+
+CREATE TABLE workout_pauses (
+	id INTEGER PRIMARY KEY,
+	workout_id INTEGER NOT NULL REFERENCES workouts(id) ON DELETE CASCADE ON UPDATE CASCADE,
+	paused_at TIMESTAMP NOT NULL,
+	resumed_at TIMESTAMP
+);
+
+CREATE TABLE goals (
+	id INTEGER PRIMARY KEY,
+	user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE ON UPDATE CASCADE,
+	metric TEXT NOT NULL,
+	period TEXT NOT NULL,
+	target INTEGER NOT NULL,
+	created_at TIMESTAMP NOT NULL
+);
+
+CREATE TABLE planned_workouts (
+	id INTEGER PRIMARY KEY,
+	user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE ON UPDATE CASCADE,
+	uid TEXT NOT NULL,
+	summary TEXT NOT NULL,
+	start_time TIMESTAMP NOT NULL,
+	end_time TIMESTAMP NOT NULL,
+	UNIQUE (user_id, uid)
+);
+
+CREATE TABLE import_jobs (
+	id INTEGER PRIMARY KEY,
+	user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE ON UPDATE CASCADE,
+	source TEXT NOT NULL,
+	status TEXT NOT NULL,
+	bytes_read INTEGER NOT NULL DEFAULT 0,
+	total_bytes INTEGER NOT NULL DEFAULT 0,
+	total INTEGER NOT NULL DEFAULT 0,
+	processed INTEGER NOT NULL DEFAULT 0,
+	imported INTEGER NOT NULL DEFAULT 0,
+	duplicates INTEGER NOT NULL DEFAULT 0,
+	failed INTEGER NOT NULL DEFAULT 0,
+	errors TEXT NOT NULL DEFAULT '[]',
+	error TEXT,
+	created_at TIMESTAMP NOT NULL,
+	updated_at TIMESTAMP NOT NULL,
+	finished_at TIMESTAMP,
+	file TEXT NOT NULL DEFAULT ''
+);
+
+CREATE TABLE webhooks (
+	id INTEGER PRIMARY KEY,
+	user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE ON UPDATE CASCADE,
+	url TEXT NOT NULL,
+	events TEXT NOT NULL,
+	secret TEXT NOT NULL,
+	created_at TIMESTAMP NOT NULL
+);
+
+CREATE TABLE webhook_deliveries (
+	id INTEGER PRIMARY KEY,
+	webhook_id INTEGER NOT NULL REFERENCES webhooks(id) ON DELETE CASCADE ON UPDATE CASCADE,
+	event TEXT NOT NULL,
+	payload TEXT NOT NULL,
+	status TEXT NOT NULL DEFAULT 'pending',
+	attempts INTEGER NOT NULL DEFAULT 0,
+	next_attempt_at TIMESTAMP,
+	response_code INTEGER,
+	error TEXT,
+	created_at TIMESTAMP NOT NULL,
+	delivered_at TIMESTAMP
+);
+
+CREATE INDEX pending_deliveries ON webhook_deliveries(next_attempt_at) WHERE status = 'pending';
+`,
+		down: `
+DROP TABLE webhook_deliveries;
+DROP TABLE webhooks;
+DROP TABLE import_jobs;
+DROP TABLE planned_workouts;
+DROP TABLE goals;
+DROP TABLE workout_pauses;
+DROP TABLE workouts;
+DROP TABLE users;
+`,
+	}, {
+		version: 2,
+		name:    "unique user names",
+		// Users who share a name are renamed as they are in Postgres.
+		apply: uniqueUserNames(
+			`CREATE TABLE user_renames (
+				user_id INTEGER PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE ON UPDATE CASCADE,
+				old_name TEXT NOT NULL,
+				new_name TEXT NOT NULL,
+				renamed_at TIMESTAMP NOT NULL
+			)`,
+			`CREATE UNIQUE INDEX unique_user_name ON users(name)`,
+		),
+		down: `
+DROP INDEX unique_user_name;
+DROP TABLE user_renames;
+`,
+	}, {
+		version: 3,
+		name:    "workout trash",
+		up: `
+ALTER TABLE workouts ADD COLUMN deleted_at TIMESTAMP;
+
+-- Workouts in the trash no longer count as in progress.
+DROP INDEX one_active_workout;
+CREATE UNIQUE INDEX one_active_workout ON workouts(user_id) WHERE end_time IS NULL AND deleted_at IS NULL;
+
+CREATE INDEX deleted_workouts ON workouts(deleted_at) WHERE deleted_at IS NOT NULL;
+`,
+		down: `
+DELETE FROM workouts WHERE deleted_at IS NOT NULL;
+DROP INDEX deleted_workouts;
+DROP INDEX one_active_workout;
+CREATE UNIQUE INDEX one_active_workout ON workouts(user_id) WHERE end_time IS NULL;
+ALTER TABLE workouts DROP COLUMN deleted_at;
+`,
+	}, {
+		version: 4,
+		name:    "import job hosts",
+		up:      `ALTER TABLE import_jobs ADD COLUMN host TEXT NOT NULL DEFAULT '';`,
+		down:    `ALTER TABLE import_jobs DROP COLUMN host;`,
+	}},
+}
+
+// sqliteQueryer runs queries in UTC, converting the times given to them, since SQLite
+// compares the times it stores as text.
+type sqliteQueryer struct {
+	q queryer
+}
+
+func (s sqliteQueryer) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	return s.q.ExecContext(ctx, query, utcArgs(args)...)
+}
+
+func (s sqliteQueryer) QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	return s.q.QueryContext(ctx, query, utcArgs(args)...)
+}
+
+func (s sqliteQueryer) QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row {
+	return s.q.QueryRowContext(ctx, query, utcArgs(args)...)
+}
+
+func utcArgs(args []interface{}) []interface{} {
+	converted := make([]interface{}, len(args))
+	for i, arg := range args {
+		switch arg := arg.(type) {
+		case time.Time:
+			converted[i] = arg.UTC()
+		case *time.Time:
+			if arg != nil {
+				converted[i] = arg.UTC()
+			}
+		default:
+			converted[i] = arg
+		}
+	}
+	return converted
+}
+
+// SQLiteDB implements Datastore on a SQLite database.
+type SQLiteDB struct {
+	sqliteQueryer
+	db *sql.DB
+}
+
+// InitializeSQLite opens the SQLite database at path, creating it if it does not exist.
+// The path may include the options of the driver as a query string.
+func InitializeSQLite(path string) (*SQLiteDB, error) {
+	separator := "?"
+	if strings.Contains(path, "?") {
+		separator = "&"
+	}
+	db, err := sql.Open("sqlite3", path+separator+sqliteOptions)
+	if err != nil {
+		return nil, err
+	}
+	// SQLite has a single writer anyway, and every connection to an in-memory database
+	// would otherwise be a database of its own.
+	db.SetMaxOpenConns(1)
+	if err = db.Ping(); err != nil {
+		return nil, err
+	}
+	return &SQLiteDB{sqliteQueryer{db}, db}, nil
+}
+
+// Close closes the database.
+func (db *SQLiteDB) Close() error {
+	return db.db.Close()
+}
+
+// begin starts a transaction, returning it along with a queryer that runs queries in it.
+func (db *SQLiteDB) begin(ctx context.Context) (*sql.Tx, sqliteQueryer, error) {
+	tx, err := db.db.BeginTx(ctx, nil)
+	return tx, sqliteQueryer{tx}, err
+}
+
+// Migrate applies the migrations that have not been applied to the database, in order,
+// and returns how many it applied.
+func (db *SQLiteDB) Migrate() (int, error) {
+	return migrate(db.db, sqliteMigrations)
+}
+
+// MigrateDown reverts the given number of the most recently applied migrations and
+// returns how many it reverted.
+func (db *SQLiteDB) MigrateDown(steps int) (int, error) {
+	return migrateDown(db.db, sqliteMigrations, steps)
+}
+
+// MigrationStatus lists every migration and when it was applied, if it has been.
+func (db *SQLiteDB) MigrationStatus() ([]MigrationStatus, error) {
+	return migrationStatus(db.db, sqliteMigrations)
+}
+
+// insertedID returns the ID of the row added by an INSERT statement.
+func insertedID(result sql.Result, err error) (int, error) {
+	if err != nil {
+		return 0, err
+	}
+	id, err := result.LastInsertId()
+	return int(id), err
+}
+
+// violatesSQLiteConstraint reports whether err is the violation of a constraint of the
+// given kind. SQLite does not name the constraint, so each statement can only tell apart
+// the kinds of constraint it might violate.
+func violatesSQLiteConstraint(err error, kind sqlite3.ErrNoExtended) bool {
+	sqliteErr, ok := err.(sqlite3.Error)
+	return ok && sqliteErr.ExtendedCode == kind
+}
+
+// SignUp adds a new user to the database and returns their user ID.
+func (db *SQLiteDB) SignUp(ctx context.Context, r UserRequest) (int, error) {
+	userID, err := insertedID(db.ExecContext(
+		ctx,
+		"INSERT INTO users(name, password, token) VALUES (?, ?, ?)",
+		r.Name, r.Token, r.Token,
+	))
+	if violatesSQLiteConstraint(err, sqlite3.ErrConstraintUnique) {
+		return 0, ErrUserAlreadyExists
+	}
+	return userID, err
+}
+
+// LoginWithCredentials logs a user in using a name and password hash. Users who were
+// renamed when names were made unique log in with the name they signed up with, which
+// their password is keyed by, and are told their new name when they do.
+func (db *SQLiteDB) LoginWithCredentials(ctx context.Context, name, passHash string) (User, error) {
+	user := User{}
+	var ourPassHash string
+	row := db.QueryRowContext(ctx, "SELECT id, name, password FROM users WHERE name = ?", name)
+	err := row.Scan(&user.ID, &user.Name, &ourPassHash)
+	switch {
+	case err == sql.ErrNoRows:
+		return db.loginRenamedUser(ctx, name, passHash, ErrUserNotFound)
+	case err != nil:
+		return user, err
+	case ourPassHash != passHash:
+		return db.loginRenamedUser(ctx, name, passHash, ErrInvalidCredentials)
+	default:
+		return user, nil
+	}
+}
+
+// loginRenamedUser logs in a renamed user using the name they had and their password
+// hash, returning notRenamed if there is no such user.
+func (db *SQLiteDB) loginRenamedUser(ctx context.Context, oldName, passHash string, notRenamed error) (User, error) {
+	user := User{}
+	err := db.QueryRowContext(
+		ctx,
+		`SELECT users.id, users.name
+		FROM user_renames
+		JOIN users ON users.id = user_renames.user_id
+		WHERE user_renames.old_name = ? AND users.password = ?
+		ORDER BY users.id
+		LIMIT 1`,
+		oldName, passHash,
+	).Scan(&user.ID, &user.Name)
+	if err == sql.ErrNoRows {
+		return user, notRenamed
+	}
+	return user, err
+}
+
+// LoginWithToken logs a user in using an access token.
+func (db *SQLiteDB) LoginWithToken(ctx context.Context, token string) (User, error) {
+	user := User{}
+	err := db.QueryRowContext(ctx, "SELECT id, name FROM users WHERE token = ?", token).Scan(&user.ID, &user.Name)
+	if err == sql.ErrNoRows {
+		return user, ErrUserNotFound
+	}
+	return user, err
+}
+
+// GetUsername retrieves the name of the user with the given ID.
+func (db *SQLiteDB) GetUsername(ctx context.Context, userID int) (string, error) {
+	var name string
+	err := db.QueryRowContext(ctx, "SELECT name FROM users WHERE id = ?", userID).Scan(&name)
+	if err == sql.ErrNoRows {
+		return name, ErrUserNotFound
+	}
+	return name, err
+}
+
+// GetUsers returns a list of users' names from the database.
+func (db *SQLiteDB) GetUsers(ctx context.Context) ([]string, error) {
+	var userNames []string
+	err := queryRows(
+		ctx,
+		db,
+		func(rs *sql.Rows) error {
+			var name string
+			readErr := rs.Scan(&name)
+			userNames = append(userNames, name)
+			return readErr
+		},
+		"SELECT name FROM users",
+	)
+	return userNames, err
+}
+
+// AddWorkout adds a workout to the database.
+func (db *SQLiteDB) AddWorkout(ctx context.Context, workout Workout) (int, error) {
+	return db.addWorkout(ctx, workout)
+}
+
+// UpdateWorkout replaces the workout with the given workout.
+func (db *SQLiteDB) UpdateWorkout(ctx context.Context, workout Workout) error {
+	return db.updateWorkout(ctx, workout)
+}
+
+// DeleteWorkout moves the workout with the specified ID to the trash and returns the ID of
+// the user it belongs to.
+func (db *SQLiteDB) DeleteWorkout(ctx context.Context, workoutID int) (int, error) {
+	var userID int
+	err := db.QueryRowContext(
+		ctx,
+		"UPDATE workouts SET deleted_at = ? WHERE id = ? AND deleted_at IS NULL RETURNING user_id",
+		time.Now(), workoutID,
+	).Scan(&userID)
+	if err == sql.ErrNoRows {
+		return userID, ErrWorkoutNotFound
+	}
+	return userID, err
+}
+
+// GetDeletedWorkouts retrieves the workouts the given user has in the trash, the most
+// recently deleted first.
+func (db *SQLiteDB) GetDeletedWorkouts(ctx context.Context, userID int) ([]Workout, error) {
+	workouts := make([]Workout, 0)
+	err := queryRows(
+		ctx,
+		db,
+		func(rs *sql.Rows) error {
+			var workout Workout
+			readErr := rs.Scan(&workout.ID, &workout.Start, &workout.End, &workout.Intensity, &workout.Type, &workout.Deleted)
+			workouts = append(workouts, workout)
+			return readErr
+		},
+		`SELECT id, start_time, end_time, intensity, type, deleted_at
+		FROM workouts
+		WHERE user_id = ? AND deleted_at IS NOT NULL
+		ORDER BY deleted_at DESC, id`,
+		userID,
+	)
+	return workouts, err
+}
+
+// RestoreWorkout takes a workout of the given user out of the trash and returns it.
+func (db *SQLiteDB) RestoreWorkout(ctx context.Context, userID, workoutID int) (Workout, error) {
+	workout := Workout{User: userID}
+	err := db.QueryRowContext(
+		ctx,
+		`UPDATE workouts SET deleted_at = NULL
+		WHERE id = ? AND user_id = ? AND deleted_at IS NOT NULL
+		RETURNING id, start_time, end_time, intensity, type`,
+		workoutID, userID,
+	).Scan(&workout.ID, &workout.Start, &workout.End, &workout.Intensity, &workout.Type)
+	// A workout deleted while it was in progress cannot come back while another is.
+	switch {
+	case err == sql.ErrNoRows:
+		return workout, ErrWorkoutNotFound
+	case violatesSQLiteConstraint(err, sqlite3.ErrConstraintUnique):
+		return workout, ErrWorkoutInProgress
+	}
+	return workout, err
+}
+
+// PurgeDeletedWorkouts permanently deletes the workouts that were moved to the trash
+// before the given time, returning how many it deleted.
+func (db *SQLiteDB) PurgeDeletedWorkouts(ctx context.Context, before time.Time) (int, error) {
+	result, err := db.ExecContext(ctx, "DELETE FROM workouts WHERE deleted_at < ?", before)
+	if err != nil {
+		return 0, err
+	}
+	purged, err := result.RowsAffected()
+	return int(purged), err
+}
+
+// BatchWorkouts applies a list of workout operations within a single transaction, each
+// under its own savepoint, and queues their webhook deliveries, as DB.BatchWorkouts does.
+func (db *SQLiteDB) BatchWorkouts(ctx context.Context, ops []BatchOperation, webhooks BatchWebhooks) ([]BatchResult, error) {
+	tx, q, err := db.begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	// Rolling back after a successful commit is a no-op.
+	defer tx.Rollback()
+
+	results := make([]BatchResult, len(ops))
+	for i, op := range ops {
+		if _, err = q.ExecContext(ctx, "SAVEPOINT batch_operation"); err != nil {
+			return nil, err
+		}
+
+		result := BatchResult{Index: i, Op: op.Op, ID: op.Workout.ID}
+		switch op.Op {
+		case BatchCreate:
+			result.ID, result.Err = q.addWorkout(ctx, op.Workout)
+		case BatchUpdate:
+			result.Err = q.updateWorkout(ctx, op.Workout)
+		case BatchDelete:
+			result.Err = q.deleteOwnWorkout(ctx, op.Workout)
+		default:
+			result.Err = ErrInvalidBatchOperation
+		}
+
+		if result.Err != nil {
+			_, err = q.ExecContext(ctx, "ROLLBACK TO SAVEPOINT batch_operation")
+		} else {
+			_, err = q.ExecContext(ctx, "RELEASE SAVEPOINT batch_operation")
+		}
+		if err != nil {
+			return nil, err
+		}
+		results[i] = result
+	}
+
+	if webhooks != nil {
+		events, err := webhooks(results)
+		if err != nil {
+			return nil, err
+		}
+		if err = q.queueWebhookDeliveries(ctx, events); err != nil {
+			return nil, err
+		}
+	}
+	return results, tx.Commit()
+}
+
+// addWorkout inserts a workout, relying on the foreign key of the workouts table to
+// reject users that do not exist.
+func (q sqliteQueryer) addWorkout(ctx context.Context, workout Workout) (int, error) {
+	workoutID, err := insertedID(q.ExecContext(
+		ctx,
+		"INSERT INTO workouts(user_id, start_time, end_time, intensity, type) VALUES (?, ?, ?, ?, ?)",
+		workout.User, workout.Start, workout.End, workout.Intensity, workout.Type,
+	))
+	if violatesSQLiteConstraint(err, sqlite3.ErrConstraintForeignKey) {
+		return 0, ErrUserNotFound
+	}
+	return workoutID, err
+}
+
+// updateWorkout replaces a workout if it belongs to workout.User, checking the owner in
+// the same statement that makes the change. The stored intensity and type are kept if the
+// workout left them out.
+func (q sqliteQueryer) updateWorkout(ctx context.Context, workout Workout) error {
+	result, err := q.ExecContext(
+		ctx,
+		`UPDATE workouts
+		SET start_time = ?, end_time = ?, intensity = CASE WHEN ? THEN intensity ELSE ? END,
+			type = CASE WHEN ? THEN type ELSE ? END
+		WHERE id = ? AND user_id = ? AND deleted_at IS NULL`,
+		workout.Start, workout.End, workout.keepIntensity, workout.Intensity, workout.keepType,
+		workout.Type, workout.ID, workout.User,
+	)
+	return requireAffected(result, err, ErrUserNotAuthorized)
+}
+
+// deleteOwnWorkout moves a workout to the trash after verifying that it belongs to
+// workout.User.
+func (q sqliteQueryer) deleteOwnWorkout(ctx context.Context, workout Workout) error {
+	var ourUser int
+	err := q.QueryRowContext(
+		ctx,
+		"SELECT user_id FROM workouts WHERE id = ? AND deleted_at IS NULL",
+		workout.ID,
+	).Scan(&ourUser)
+	switch {
+	case err == sql.ErrNoRows:
+		return ErrWorkoutNotFound
+	case err != nil:
+		return err
+	case ourUser != workout.User:
+		return ErrUserNotAuthorized
+	}
+
+	_, err = q.ExecContext(ctx, "UPDATE workouts SET deleted_at = ? WHERE id = ?", time.Now(), workout.ID)
+	return err
+}
+
+// getWorkouts retrieves the workouts selected by a query on the workouts table, leaving
+// out those in the trash.
+func (q sqliteQueryer) getWorkouts(ctx context.Context, where string, args ...interface{}) ([]Workout, error) {
+	workouts := make([]Workout, 0)
+	err := queryRows(
+		ctx,
+		q,
+		func(rs *sql.Rows) error {
+			var workout Workout
+			readErr := rs.Scan(&workout.ID, &workout.Start, &workout.End, &workout.Intensity, &workout.Type)
+			workouts = append(workouts, workout)
+			return readErr
+		},
+		"SELECT id, start_time, end_time, intensity, type FROM workouts WHERE deleted_at IS NULL AND "+where,
+		args...,
+	)
+	return workouts, err
+}
+
+// GetWorkouts retrieves the list of finished workouts for the given user.
+func (db *SQLiteDB) GetWorkouts(ctx context.Context, userID int) ([]Workout, error) {
+	return db.getWorkouts(ctx, "user_id = ? AND end_time IS NOT NULL ORDER BY end_time", userID)
+}
+
+// GetWorkout retrieves a workout, provided that it belongs to the user and is not in the
+// trash.
+func (db *SQLiteDB) GetWorkout(ctx context.Context, userID, workoutID int) (Workout, error) {
+	workouts, err := db.getWorkouts(ctx, "id = ? AND user_id = ?", workoutID, userID)
+	switch {
+	case err != nil:
+		return Workout{}, err
+	case len(workouts) == 0:
+		return Workout{}, ErrWorkoutNotFound
+	}
+	workouts[0].User = userID
+	return workouts[0], nil
+}
+
+// GetWorkoutsBetween retrieves the finished workouts of the given user that started within
+// [from, to), ordered by start time.
+func (db *SQLiteDB) GetWorkoutsBetween(ctx context.Context, userID int, from, to time.Time) ([]Workout, error) {
+	return db.getWorkouts(
+		ctx,
+		`user_id = ? AND start_time >= ? AND start_time < ? AND end_time IS NOT NULL
+		ORDER BY start_time`,
+		userID, from, to,
+	)
+}
+
+// GetOverlappingWorkouts retrieves the workouts of the given user that overlap the period
+// [start, end), other than the workout with ID excludeID. Workouts in progress are
+// considered to last until now.
+func (db *SQLiteDB) GetOverlappingWorkouts(ctx context.Context, userID int, start, end time.Time, excludeID int) ([]Workout, error) {
+	return db.getWorkouts(
+		ctx,
+		`user_id = ? AND start_time < ? AND COALESCE(end_time, ?) > ? AND id <> ?
+		ORDER BY start_time`,
+		userID, end, time.Now(), start, excludeID,
+	)
+}
+
+// GetInsights computes the time of day breakdown and workout frequency of a user over
+// the requested range. SQLite cannot convert times between time zones, so they are
+// computed from the workouts in the range.
+func (db *SQLiteDB) GetInsights(ctx context.Context, userID int, query InsightsQuery) (Insights, error) {
+	workouts, err := db.GetWorkoutsBetween(ctx, userID, query.From, query.To)
+	if err != nil {
+		return Insights{}, err
+	}
+	return ComputeInsights(workouts, query), nil
+}
+
+// GetGoals retrieves the goals of the given user in the order they were created.
+func (db *SQLiteDB) GetGoals(ctx context.Context, userID int) ([]Goal, error) {
+	goals := make([]Goal, 0)
+	err := queryRows(
+		ctx,
+		db,
+		func(rs *sql.Rows) error {
+			goal := Goal{User: userID}
+			readErr := rs.Scan(&goal.ID, &goal.Metric, &goal.Period, &goal.Target, &goal.Created)
+			goals = append(goals, goal)
+			return readErr
+		},
+		"SELECT id, metric, period, target, created_at FROM goals WHERE user_id = ? ORDER BY created_at, id",
+		userID,
+	)
+	return goals, err
+}
+
+// AddGoal adds a goal to the database and returns its ID.
+func (db *SQLiteDB) AddGoal(ctx context.Context, goal Goal) (int, error) {
+	return insertedID(db.ExecContext(
+		ctx,
+		"INSERT INTO goals(user_id, metric, period, target, created_at) VALUES (?, ?, ?, ?, ?)",
+		goal.User, goal.Metric, goal.Period, goal.Target, time.Now(),
+	))
+}
+
+// UpdateGoal replaces the goal with the given goal, provided that it belongs to goal.User.
+func (db *SQLiteDB) UpdateGoal(ctx context.Context, goal Goal) error {
+	result, err := db.ExecContext(
+		ctx,
+		"UPDATE goals SET metric = ?, period = ?, target = ? WHERE id = ? AND user_id = ?",
+		goal.Metric, goal.Period, goal.Target, goal.ID, goal.User,
+	)
+	return requireAffected(result, err, ErrGoalNotFound)
+}
+
+// DeleteGoal deletes the goal with the specified ID, provided that it belongs to the user.
+func (db *SQLiteDB) DeleteGoal(ctx context.Context, userID, goalID int) error {
+	result, err := db.ExecContext(ctx, "DELETE FROM goals WHERE id = ? AND user_id = ?", goalID, userID)
+	return requireAffected(result, err, ErrGoalNotFound)
+}
+
+// StartWorkout starts a workout for the given user that stays in progress until it is
+// finished. A user can only have one workout in progress at a time.
+func (db *SQLiteDB) StartWorkout(ctx context.Context, userID int, start time.Time) (WorkoutSession, error) {
+	session := WorkoutSession{Workout: Workout{Start: start}, Pauses: make([]Pause, 0)}
+	err := db.QueryRowContext(
+		ctx,
+		`INSERT INTO workouts(user_id, start_time)
+		SELECT ?, ?
+		WHERE NOT EXISTS (SELECT 1 FROM workouts WHERE user_id = ? AND end_time IS NULL AND deleted_at IS NULL)
+		RETURNING id`,
+		userID, start, userID,
+	).Scan(&session.Workout.ID)
+	switch {
+	case err == sql.ErrNoRows, violatesSQLiteConstraint(err, sqlite3.ErrConstraintUnique):
+		return session, ErrWorkoutInProgress
+	case violatesSQLiteConstraint(err, sqlite3.ErrConstraintForeignKey):
+		return session, ErrUserNotFound
+	}
+	return session, err
+}
+
+// GetActiveWorkout retrieves the workout the given user has in progress.
+func (db *SQLiteDB) GetActiveWorkout(ctx context.Context, userID int) (WorkoutSession, error) {
+	var session WorkoutSession
+	workouts, err := db.getWorkouts(ctx, "user_id = ? AND end_time IS NULL", userID)
+	switch {
+	case err != nil:
+		return session, err
+	case len(workouts) == 0:
+		return session, ErrWorkoutNotFound
+	}
+	session.Workout = workouts[0]
+	session.Pauses, err = db.getPauses(ctx, session.Workout.ID)
+	session.Paused = sessionPaused(session)
+	return session, err
+}
+
+// UpdateWorkoutSession pauses, resumes or finishes the given workout in progress at the
+// instant at.
+func (db *SQLiteDB) UpdateWorkoutSession(ctx context.Context, userID, workoutID int, action string, at time.Time) (WorkoutSession, error) {
+	var session WorkoutSession
+	tx, q, err := db.begin(ctx)
+	if err != nil {
+		return session, err
+	}
+	// Rolling back after a successful commit is a no-op.
+	defer tx.Rollback()
+
+	workout := &session.Workout
+	var ourUser int
+	err = q.QueryRowContext(
+		ctx,
+		"SELECT id, user_id, start_time, end_time, intensity, type FROM workouts WHERE id = ? AND deleted_at IS NULL",
+		workoutID,
+	).Scan(&workout.ID, &ourUser, &workout.Start, &workout.End, &workout.Intensity, &workout.Type)
+	switch {
+	case err == sql.ErrNoRows:
+		return session, ErrWorkoutNotFound
+	case err != nil:
+		return session, err
+	case ourUser != userID:
+		return session, ErrUserNotAuthorized
+	}
+	if session.Pauses, err = q.getPauses(ctx, workoutID); err != nil {
+		return session, err
+	}
+	session.Paused = sessionPaused(session)
+	if err = applySessionAction(&session, action, at); err != nil {
+		return session, err
+	}
+
+	if action == SessionPause {
+		_, err = q.ExecContext(ctx, "INSERT INTO workout_pauses(workout_id, paused_at) VALUES (?, ?)", workoutID, at)
+	} else {
+		_, err = q.ExecContext(
+			ctx,
+			"UPDATE workout_pauses SET resumed_at = ? WHERE workout_id = ? AND resumed_at IS NULL",
+			at, workoutID,
+		)
+	}
+	if err == nil && action == SessionFinish {
+		_, err = q.ExecContext(ctx, "UPDATE workouts SET end_time = ? WHERE id = ?", at, workoutID)
+	}
+	if err != nil {
+		return session, err
+	}
+	return session, tx.Commit()
+}
+
+// getPauses retrieves the pauses of a workout in the order they happened.
+func (q sqliteQueryer) getPauses(ctx context.Context, workoutID int) ([]Pause, error) {
+	pauses := make([]Pause, 0)
+	err := queryRows(
+		ctx,
+		q,
+		func(rs *sql.Rows) error {
+			var pause Pause
+			readErr := rs.Scan(&pause.Start, &pause.End)
+			pauses = append(pauses, pause)
+			return readErr
+		},
+		"SELECT paused_at, resumed_at FROM workout_pauses WHERE workout_id = ? ORDER BY paused_at",
+		workoutID,
+	)
+	return pauses, err
+}
+
+// GetWebhooks retrieves the webhooks of the given user in the order they were added,
+// without their secrets.
+func (db *SQLiteDB) GetWebhooks(ctx context.Context, userID int) ([]Webhook, error) {
+	webhooks := make([]Webhook, 0)
+	err := queryRows(
+		ctx,
+		db,
+		func(rs *sql.Rows) error {
+			var webhook Webhook
+			var events string
+			readErr := rs.Scan(&webhook.ID, &webhook.URL, &events, &webhook.Created)
+			webhook.Events = strings.Split(events, ",")
+			webhooks = append(webhooks, webhook)
+			return readErr
+		},
+		"SELECT id, url, events, created_at FROM webhooks WHERE user_id = ? ORDER BY id",
+		userID,
+	)
+	return webhooks, err
+}
+
+// AddWebhook adds a webhook to the database and returns its ID.
+func (db *SQLiteDB) AddWebhook(ctx context.Context, webhook Webhook) (int, error) {
+	return insertedID(db.ExecContext(
+		ctx,
+		"INSERT INTO webhooks(user_id, url, events, secret, created_at) VALUES (?, ?, ?, ?, ?)",
+		webhook.User, webhook.URL, strings.Join(webhook.Events, ","), webhook.Secret, webhook.Created,
+	))
+}
+
+// DeleteWebhook deletes the webhook with the specified ID, provided that it belongs to the
+// user, along with its deliveries.
+func (db *SQLiteDB) DeleteWebhook(ctx context.Context, userID, webhookID int) error {
+	result, err := db.ExecContext(ctx, "DELETE FROM webhooks WHERE id = ? AND user_id = ?", webhookID, userID)
+	return requireAffected(result, err, ErrWebhookNotFound)
+}
+
+// QueueWebhookDeliveries queues the delivery of each event to the webhooks of its user
+// that subscribe to it.
+func (db *SQLiteDB) QueueWebhookDeliveries(ctx context.Context, events []WebhookEvent) error {
+	return db.queueWebhookDeliveries(ctx, events)
+}
+
+// queueWebhookDeliveries queues the deliveries of events in a single statement, in the
+// order of the events. Each event takes three variables, so the largest batch stays
+// within the limit of SQLite.
+func (q sqliteQueryer) queueWebhookDeliveries(ctx context.Context, events []WebhookEvent) error {
+	if len(events) == 0 {
+		return nil
+	}
+	values := make([]string, len(events))
+	args := make([]interface{}, 0, 3*len(events)+2)
+	for i, event := range events {
+		values[i] = fmt.Sprintf("(%d, ?, ?, ?)", i)
+		args = append(args, event.User, event.Type, string(event.Payload))
+	}
+	now := time.Now()
+	_, err := q.ExecContext(
+		ctx,
+		`WITH e(n, user_id, type, payload) AS (VALUES `+strings.Join(values, ", ")+`)
+		INSERT INTO webhook_deliveries(webhook_id, event, payload, next_attempt_at, created_at)
+		SELECT webhooks.id, e.type, e.payload, ?, ?
+		FROM e
+		JOIN webhooks ON webhooks.user_id = e.user_id
+			AND instr(',' || webhooks.events || ',', ',' || e.type || ',') > 0
+		ORDER BY e.n, webhooks.id`,
+		append(args, now, now)...,
+	)
+	return err
+}
+
+// ClaimWebhookDeliveries retrieves up to limit pending deliveries that are due, along with
+// the URL and secret of their webhooks. Claimed deliveries are not due again until the
+// lease has passed.
+func (db *SQLiteDB) ClaimWebhookDeliveries(ctx context.Context, limit int, lease time.Duration) ([]WebhookDelivery, error) {
+	tx, q, err := db.begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	// Rolling back after a successful commit is a no-op.
+	defer tx.Rollback()
+
+	now := time.Now()
+	deliveries := make([]WebhookDelivery, 0)
+	err = queryRows(
+		ctx,
+		q,
+		func(rs *sql.Rows) error {
+			delivery := WebhookDelivery{Status: DeliveryPending}
+			var payload string
+			readErr := rs.Scan(
+				&delivery.ID, &delivery.Webhook, &delivery.Event, &payload,
+				&delivery.Attempts, &delivery.Created, &delivery.URL, &delivery.Secret,
+			)
+			delivery.Payload = []byte(payload)
+			deliveries = append(deliveries, delivery)
+			return readErr
+		},
+		`SELECT d.id, d.webhook_id, d.event, d.payload, d.attempts, d.created_at, h.url, h.secret
+		FROM webhook_deliveries d
+		JOIN webhooks h ON d.webhook_id = h.id
+		WHERE d.status = 'pending' AND d.next_attempt_at <= ?
+		ORDER BY d.next_attempt_at, d.id
+		LIMIT ?`,
+		now, limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	for _, delivery := range deliveries {
+		_, err = q.ExecContext(ctx, "UPDATE webhook_deliveries SET next_attempt_at = ? WHERE id = ?", now.Add(lease), delivery.ID)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return deliveries, tx.Commit()
+}
+
+// RecordWebhookAttempt saves the outcome of an attempt to deliver an event.
+func (db *SQLiteDB) RecordWebhookAttempt(ctx context.Context, delivery WebhookDelivery) error {
+	_, err := db.ExecContext(
+		ctx,
+		`UPDATE webhook_deliveries
+		SET status = ?, attempts = ?, next_attempt_at = ?, response_code = NULLIF(?, 0),
+			error = NULLIF(?, ''), delivered_at = ?
+		WHERE id = ?`,
+		delivery.Status, delivery.Attempts, delivery.NextAttempt, delivery.ResponseCode,
+		delivery.Error, delivery.Delivered, delivery.ID,
+	)
+	return err
+}
+
+// GetWebhookDeliveries retrieves the latest deliveries of a webhook, provided that it
+// belongs to the user, starting with the most recent.
+func (db *SQLiteDB) GetWebhookDeliveries(ctx context.Context, userID, webhookID, limit int) ([]WebhookDelivery, error) {
+	if !rowExists(ctx, db, "SELECT id FROM webhooks WHERE id = ? AND user_id = ?", webhookID, userID) {
+		return nil, ErrWebhookNotFound
+	}
+	deliveries := make([]WebhookDelivery, 0)
+	err := queryRows(
+		ctx,
+		db,
+		func(rs *sql.Rows) error {
+			delivery := WebhookDelivery{Webhook: webhookID}
+			var payload string
+			readErr := rs.Scan(
+				&delivery.ID, &delivery.Event, &payload, &delivery.Status, &delivery.Attempts,
+				&delivery.NextAttempt, &delivery.ResponseCode, &delivery.Error,
+				&delivery.Created, &delivery.Delivered,
+			)
+			delivery.Payload = []byte(payload)
+			deliveries = append(deliveries, delivery)
+			return readErr
+		},
+		`SELECT id, event, payload, status, attempts, next_attempt_at, COALESCE(response_code, 0),
+			COALESCE(error, ''), created_at, delivered_at
+		FROM webhook_deliveries
+		WHERE webhook_id = ?
+		ORDER BY id DESC
+		LIMIT ?`,
+		webhookID, limit,
+	)
+	return deliveries, err
+}
+
+// SetCalendarToken sets the secret token of the user's calendar feed. An empty token
+// disables the feed.
+func (db *SQLiteDB) SetCalendarToken(ctx context.Context, userID int, token string) error {
+	result, err := db.ExecContext(ctx, "UPDATE users SET calendar_token = NULLIF(?, '') WHERE id = ?", token, userID)
+	return requireAffected(result, err, ErrUserNotFound)
+}
+
+// GetCalendarUser retrieves the user whose calendar feed has the given token.
+func (db *SQLiteDB) GetCalendarUser(ctx context.Context, token string) (User, error) {
+	user := User{}
+	if token == "" {
+		return user, ErrUserNotFound
+	}
+	err := db.QueryRowContext(ctx, "SELECT id, name FROM users WHERE calendar_token = ?", token).Scan(&user.ID, &user.Name)
+	if err == sql.ErrNoRows {
+		return user, ErrUserNotFound
+	}
+	return user, err
+}
+
+// GetPlannedWorkouts retrieves the planned workouts of the given user, ordered by start
+// time.
+func (db *SQLiteDB) GetPlannedWorkouts(ctx context.Context, userID int) ([]PlannedWorkout, error) {
+	planned := make([]PlannedWorkout, 0)
+	err := queryRows(
+		ctx,
+		db,
+		func(rs *sql.Rows) error {
+			var workout PlannedWorkout
+			readErr := rs.Scan(&workout.ID, &workout.UID, &workout.Summary, &workout.Start, &workout.End)
+			planned = append(planned, workout)
+			return readErr
+		},
+		`SELECT id, uid, summary, start_time, end_time
+		FROM planned_workouts
+		WHERE user_id = ?
+		ORDER BY start_time`,
+		userID,
+	)
+	return planned, err
+}
+
+// ImportPlannedWorkouts adds planned workouts for the given user in a single transaction,
+// replacing any previously imported with the same UID.
+func (db *SQLiteDB) ImportPlannedWorkouts(ctx context.Context, userID int, planned []PlannedWorkout) error {
+	tx, q, err := db.begin(ctx)
+	if err != nil {
+		return err
+	}
+	// Rolling back after a successful commit is a no-op.
+	defer tx.Rollback()
+
+	for _, workout := range planned {
+		_, err = q.ExecContext(
+			ctx,
+			`INSERT INTO planned_workouts(user_id, uid, summary, start_time, end_time)
+			VALUES (?, ?, ?, ?, ?)
+			ON CONFLICT (user_id, uid) DO UPDATE
+			SET summary = excluded.summary, start_time = excluded.start_time, end_time = excluded.end_time`,
+			userID, workout.UID, workout.Summary, workout.Start, workout.End,
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// ImportWorkouts adds workouts in a single transaction, skipping any with the same start
+// and end as another workout of the same user, including those in the trash. It returns
+// the IDs of the workouts in order, with 0 for those that were skipped.
+func (db *SQLiteDB) ImportWorkouts(ctx context.Context, workouts []Workout) ([]int, error) {
+	tx, q, err := db.begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	// Rolling back after a successful commit is a no-op.
+	defer tx.Rollback()
+
+	ids := make([]int, len(workouts))
+	for i, workout := range workouts {
+		err = q.QueryRowContext(
+			ctx,
+			`INSERT INTO workouts(user_id, start_time, end_time, intensity, type)
+			SELECT ?, ?, ?, ?, ?
+			WHERE NOT EXISTS (
+				SELECT id FROM workouts WHERE user_id = ? AND start_time = ? AND end_time = ?
+			)
+			RETURNING id`,
+			workout.User, workout.Start, workout.End, workout.Intensity, workout.Type,
+			workout.User, workout.Start, workout.End,
+		).Scan(&ids[i])
+		if err != nil && err != sql.ErrNoRows {
+			return nil, err
+		}
+	}
+	return ids, tx.Commit()
+}
+
+// AddImportJob adds an import job to the database and returns its ID.
+func (db *SQLiteDB) AddImportJob(ctx context.Context, job ImportJob) (int, error) {
+	return insertedID(db.ExecContext(
+		ctx,
+		`INSERT INTO import_jobs(user_id, source, status, file, host, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		job.User, job.Source, job.Status, job.File, job.Host, job.Created, job.Updated,
+	))
+}
+
+// UpdateImportJob saves the progress of an import job.
+func (db *SQLiteDB) UpdateImportJob(ctx context.Context, job ImportJob) error {
+	importErrors, err := json.Marshal(job.Errors)
+	if err != nil {
+		return err
+	}
+	result, err := db.ExecContext(
+		ctx,
+		`UPDATE import_jobs
+		SET status = ?, bytes_read = ?, total_bytes = ?, total = ?, processed = ?, imported = ?,
+			duplicates = ?, failed = ?, errors = ?, error = NULLIF(?, ''), updated_at = ?,
+			finished_at = ?
+		WHERE id = ?`,
+		job.Status, job.BytesRead, job.TotalBytes, job.Total, job.Processed, job.Imported,
+		job.Duplicates, job.Failed, string(importErrors), job.Error, job.Updated, job.Finished,
+		job.ID,
+	)
+	return requireAffected(result, err, ErrImportJobNotFound)
+}
+
+// GetImportJob retrieves an import job, provided that it belongs to the user.
+func (db *SQLiteDB) GetImportJob(ctx context.Context, userID, jobID int) (ImportJob, error) {
+	job := ImportJob{ID: jobID}
+	var importErrors string
+	err := db.QueryRowContext(
+		ctx,
+		`SELECT source, status, bytes_read, total_bytes, total, processed, imported, duplicates,
+			failed, errors, COALESCE(error, ''), created_at, updated_at, finished_at
+		FROM import_jobs
+		WHERE id = ? AND user_id = ?`,
+		jobID, userID,
+	).Scan(
+		&job.Source, &job.Status, &job.BytesRead, &job.TotalBytes, &job.Total, &job.Processed,
+		&job.Imported, &job.Duplicates, &job.Failed, &importErrors, &job.Error, &job.Created,
+		&job.Updated, &job.Finished,
+	)
+	switch {
+	case err == sql.ErrNoRows:
+		return job, ErrImportJobNotFound
+	case err != nil:
+		return job, err
+	}
+	err = json.Unmarshal([]byte(importErrors), &job.Errors)
+	return job, err
+}
+
+// ClaimStaleImportJobs retrieves the unfinished import jobs of the host that have not
+// saved their progress within the lease, marking them as running.
+func (db *SQLiteDB) ClaimStaleImportJobs(ctx context.Context, host string, lease time.Duration) ([]ImportJob, error) {
+	tx, q, err := db.begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	// Rolling back after a successful commit is a no-op.
+	defer tx.Rollback()
+
+	now := time.Now()
+	jobs := make([]ImportJob, 0)
+	err = queryRows(
+		ctx,
+		q,
+		func(rs *sql.Rows) error {
+			job := ImportJob{Status: JobRunning, Updated: now}
+			var importErrors string
+			readErr := rs.Scan(
+				&job.ID, &job.User, &job.Source, &job.BytesRead, &job.TotalBytes, &job.Total,
+				&job.Processed, &job.Imported, &job.Duplicates, &job.Failed, &importErrors,
+				&job.Created, &job.File, &job.Host,
+			)
+			if readErr == nil {
+				readErr = json.Unmarshal([]byte(importErrors), &job.Errors)
+			}
+			jobs = append(jobs, job)
+			return readErr
+		},
+		`SELECT id, user_id, source, bytes_read, total_bytes, total, processed, imported,
+			duplicates, failed, errors, created_at, file, host
+		FROM import_jobs
+		WHERE status IN ('pending', 'running') AND host IN (?, '') AND updated_at < ?
+		ORDER BY id`,
+		host, now.Add(-lease),
+	)
+	if err != nil {
+		return nil, err
+	}
+	for _, job := range jobs {
+		_, err = q.ExecContext(ctx, "UPDATE import_jobs SET status = 'running', updated_at = ? WHERE id = ?", now, job.ID)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return jobs, tx.Commit()
+}
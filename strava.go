@@ -0,0 +1,298 @@
+package main
+
+import (
+	"archive/zip"
+	"compress/gzip"
+	"context"
+	"encoding/csv"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// Importing the activities of Strava's bulk export.
+
+const (
+	// stravaActivitiesName is the name of the list of activities in an export.
+	stravaActivitiesName = "activities.csv"
+	// maxStravaArchiveBytes is the largest export that can be uploaded. Exports include
+	// the GPS track of every activity, along with photos.
+	maxStravaArchiveBytes = 4 << 30
+)
+
+// stravaColumns lists the names that each column of activities.csv has had in exports,
+// from the current name to the oldest.
+var stravaColumns = map[string][]string{
+	"date":     {"activity date", "date"},
+	"type":     {"activity type", "type"},
+	"elapsed":  {"elapsed time", "elapsed_time"},
+	"filename": {"filename"},
+}
+
+// stravaDateLayouts are the formats that exports have given the start of activities in,
+// always in UTC.
+var stravaDateLayouts = []string{
+	"Jan 2, 2006, 3:04:05 PM",
+	"2006-01-02 15:04:05",
+}
+
+// stravaArchive is an opened Strava export.
+type stravaArchive struct {
+	header []string
+	rows   [][]string
+	// files maps the names of the activity files to their entries, and dir is the
+	// directory of activities.csv, which their names are relative to.
+	files map[string]*zip.File
+	dir   string
+}
+
+// openStravaArchive reads the list of activities from a Strava export.
+func openStravaArchive(archive *zip.Reader) (stravaArchive, error) {
+	export := stravaArchive{files: make(map[string]*zip.File)}
+	var activities *zip.File
+	for _, file := range archive.File {
+		export.files[file.Name] = file
+		if path.Base(file.Name) == stravaActivitiesName && activities == nil {
+			activities = file
+		}
+	}
+	if activities == nil {
+		return export, fmt.Errorf("the archive does not contain an %s", stravaActivitiesName)
+	}
+	export.dir = path.Dir(activities.Name)
+
+	contents, err := activities.Open()
+	if err != nil {
+		return export, err
+	}
+	defer contents.Close()
+	reader := csv.NewReader(contents)
+	reader.FieldsPerRecord = -1
+	records, err := reader.ReadAll()
+	if err != nil {
+		return export, fmt.Errorf("invalid %s: %v", stravaActivitiesName, err)
+	}
+	if len(records) == 0 {
+		return export, fmt.Errorf("%s is empty", stravaActivitiesName)
+	}
+	export.header, export.rows = records[0], records[1:]
+	return export, nil
+}
+
+// columns returns the index of each column of activities.csv that is read, by its key in
+// stravaColumns. Current exports repeat some columns, in which case the first is used.
+func (export stravaArchive) columns() map[string]int {
+	names := make(map[string]int)
+	for i, name := range export.header {
+		name = strings.ToLower(strings.TrimSpace(strings.TrimPrefix(name, "\ufeff")))
+		if _, seen := names[name]; !seen {
+			names[name] = i
+		}
+	}
+	columns := make(map[string]int)
+	for key, aliases := range stravaColumns {
+		for _, alias := range aliases {
+			if i, ok := names[alias]; ok {
+				columns[key] = i
+				break
+			}
+		}
+	}
+	return columns
+}
+
+// workout converts a row of activities.csv into a workout of the given user. Its times
+// are read from the row's start and elapsed time, or from its activity file if the row
+// does not give them, as for activities uploaded before they were listed.
+func (export stravaArchive) workout(row []string, columns map[string]int, userID, record int) (Workout, []ImportError) {
+	cell := func(key string) string {
+		if i, ok := columns[key]; ok && i < len(row) {
+			return strings.TrimSpace(row[i])
+		}
+		return ""
+	}
+	workout := Workout{User: userID, Type: normalizeWorkoutType(cell("type"))}
+
+	start, startErr := parseStravaDate(cell("date"))
+	elapsed, elapsedErr := strconv.ParseFloat(strings.Replace(cell("elapsed"), ",", "", -1), 64)
+	if elapsedErr == nil && elapsed <= 0 {
+		elapsedErr = errors.New("the elapsed time must be positive")
+	}
+	if startErr == nil && elapsedErr == nil {
+		end := start.Add(time.Duration(elapsed * float64(time.Second)))
+		workout.Start, workout.End = start, &end
+	} else if file, ok := export.files[path.Join(export.dir, cell("filename"))]; ok && cell("filename") != "" {
+		fileStart, fileEnd, err := activityFileTimes(file)
+		if err != nil {
+			return workout, []ImportError{{record, "Filename", err.Error()}}
+		}
+		workout.Start, workout.End = fileStart, &fileEnd
+	} else if startErr != nil {
+		return workout, []ImportError{{record, "Activity Date", fmt.Sprintf("'%s' is not a valid date", cell("date"))}}
+	} else {
+		return workout, []ImportError{{record, "Elapsed Time", fmt.Sprintf("'%s' is not a valid number of seconds", cell("elapsed"))}}
+	}
+
+	var problems []ImportError
+	for _, problem := range workout.validateNew() {
+		problems = append(problems, ImportError{record, problem.Field, problem.Message})
+	}
+	return workout, problems
+}
+
+// parseStravaDate parses the start of an activity in activities.csv.
+func parseStravaDate(value string) (time.Time, error) {
+	var err error
+	for _, layout := range stravaDateLayouts {
+		var t time.Time
+		if t, err = time.Parse(layout, value); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, err
+}
+
+// activityFileTimes returns the start and end of the activity recorded in a GPX, TCX or
+// FIT file, which may be gzipped.
+func activityFileTimes(file *zip.File) (time.Time, time.Time, error) {
+	contents, err := file.Open()
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	defer contents.Close()
+
+	var r io.Reader = contents
+	name := strings.ToLower(file.Name)
+	if strings.HasSuffix(name, ".gz") {
+		decompressed, err := gzip.NewReader(contents)
+		if err != nil {
+			return time.Time{}, time.Time{}, err
+		}
+		defer decompressed.Close()
+		r = decompressed
+		name = strings.TrimSuffix(name, ".gz")
+	}
+	switch path.Ext(name) {
+	case ".gpx", ".tcx":
+		return trackTimes(r)
+	case ".fit":
+		return fitTimes(r)
+	default:
+		return time.Time{}, time.Time{}, fmt.Errorf("unsupported activity file %s", path.Base(file.Name))
+	}
+}
+
+// trackTimes returns the times of the first and last points of the tracks in a GPX or TCX
+// file.
+func trackTimes(r io.Reader) (time.Time, time.Time, error) {
+	var first, last time.Time
+	decoder := xml.NewDecoder(r)
+	inPoint := false
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return first, last, fmt.Errorf("invalid track: %v", err)
+		}
+		switch token := token.(type) {
+		case xml.StartElement:
+			switch name := token.Name.Local; {
+			case name == "trkpt" || name == "Trackpoint":
+				inPoint = true
+			case inPoint && (name == "time" || name == "Time"):
+				var value string
+				if err = decoder.DecodeElement(&value, &token); err != nil {
+					return first, last, fmt.Errorf("invalid track: %v", err)
+				}
+				t, err := time.Parse(time.RFC3339, strings.TrimSpace(value))
+				if err != nil {
+					return first, last, fmt.Errorf("invalid track point time '%s'", value)
+				}
+				if first.IsZero() || t.Before(first) {
+					first = t
+				}
+				if t.After(last) {
+					last = t
+				}
+			}
+		case xml.EndElement:
+			if token.Name.Local == "trkpt" || token.Name.Local == "Trackpoint" {
+				inPoint = false
+			}
+		}
+	}
+	if first.IsZero() {
+		return first, last, errors.New("the track has no timed points")
+	}
+	return first, last, nil
+}
+
+// importStravaFile imports the Strava export at job.File. It satisfies importer.
+func importStravaFile(ctx context.Context, db Datastore, job *ImportJob, report func(*ImportJob) error) error {
+	archive, err := zip.OpenReader(job.File)
+	if err != nil {
+		return errors.New("the file is not a ZIP archive")
+	}
+	defer archive.Close()
+	export, err := openStravaArchive(&archive.Reader)
+	if err != nil {
+		return err
+	}
+	columns := export.columns()
+	if _, ok := columns["date"]; !ok {
+		return fmt.Errorf("%s has no Activity Date column", stravaActivitiesName)
+	}
+
+	job.Total = len(export.rows)
+	batch := newWorkoutBatch(ctx, db, job, report)
+	for i := job.Processed; i < len(export.rows); i++ {
+		job.Processed = i + 1
+		// Rows are numbered as in a spreadsheet, where the header is the first row.
+		workout, problems := export.workout(export.rows[i], columns, job.User, i+2)
+		for _, problem := range problems {
+			job.addError(problem)
+		}
+		if len(problems) == 0 {
+			err = batch.add(workout)
+		} else {
+			err = batch.tick()
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return batch.flush()
+}
+
+// ImportStrava starts a job importing the activities of the Strava bulk export in the
+// request body, the ZIP archive of activities.csv and the activity files. Activities
+// already recorded with the same start and end are skipped. As with Apple Health,
+// imported workouts are not published as events.
+func (env *Env) ImportStrava(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	user, ok := env.authenticate(w, r)
+	if !ok {
+		return
+	}
+	filename, ok := receiveUpload(
+		w,
+		r,
+		env.importDir,
+		maxStravaArchiveBytes,
+		"the ZIP archive of a Strava export",
+		"application/zip", "application/octet-stream",
+	)
+	if !ok {
+		return
+	}
+	env.startImportJob(w, r, user, ImportSourceStrava, filename)
+}
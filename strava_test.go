@@ -0,0 +1,115 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+// writeStravaExport writes a Strava export with the given activities.csv and activity
+// files to a temporary file, returning its name.
+func writeStravaExport(t *testing.T, activities string, files map[string][]byte) string {
+	file, err := ioutil.TempFile("", "strava-export-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	archive := zip.NewWriter(file)
+	entries := map[string][]byte{"export/activities.csv": []byte(activities)}
+	for name, contents := range files {
+		entries["export/"+name] = contents
+	}
+	for name, contents := range entries {
+		entry, err := archive.Create(name)
+		if err == nil {
+			_, err = entry.Write(contents)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = archive.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return file.Name()
+}
+
+func TestImportStrava(t *testing.T) {
+	le := binary.LittleEndian
+	var fit fitBuilder
+	fit.define(0, le, []fitField{{number: fitTimestampField, size: 4}})
+	fit.message(0, fitValue(le, uint32(time.Date(2019, time.March, 2, 13, 0, 0, 0, time.UTC).Unix()-fitEpoch)))
+	fit.message(0, fitValue(le, uint32(time.Date(2019, time.March, 2, 14, 30, 0, 0, time.UTC).Unix()-fitEpoch)))
+	var compressed bytes.Buffer
+	writer := gzip.NewWriter(&compressed)
+	writer.Write(fit.file(14))
+	writer.Close()
+
+	filename := writeStravaExport(t, "\ufeffActivity ID,Activity Date,Activity Name,Activity Type,Elapsed Time,Filename,Elapsed Time\n"+
+		`1,"Mar 1, 2019, 1:00:00 PM",Morning Run,Run,"1,800",activities/1.gpx,1800`+"\n"+
+		"2,,Afternoon Ride,Ride,,activities/2.fit.gz,\n"+
+		"3,\"Mar 3, 2019, 1:00:00 PM\",Swim,Swim,a while,,\n"+
+		"4,2019-03-04 13:00:00,Lifting,Weight Training,3600,,\n",
+		map[string][]byte{"activities/2.fit.gz": compressed.Bytes()},
+	)
+	defer os.Remove(filename)
+	problem := ImportError{Record: 4, Field: "Elapsed Time", Message: "'a while' is not a valid number of seconds"}
+
+	for _, test := range []struct {
+		name string
+		// processed is the number of rows a resumed job has already processed.
+		processed int
+		types     []string
+		problems  []ImportError
+	}{
+		{name: "new", types: []string{"run", "ride", "weight_training"}, problems: []ImportError{problem}},
+		{name: "resumed", processed: 1, types: []string{"ride", "weight_training"}, problems: []ImportError{problem}},
+		{name: "resumed after errors", processed: 3, types: []string{"weight_training"}},
+		{name: "finished", processed: 4},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			db := NewMemoryDB()
+			userID := addTestUser(t, db, "Runner")
+			job := &ImportJob{User: userID, File: filename, Processed: test.processed}
+			reports := 0
+			err := importStravaFile(context.Background(), db, job, func(*ImportJob) error {
+				reports++
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if job.Total != 4 || job.Processed != 4 || job.Imported != len(test.types) || job.Failed != len(test.problems) || reports == 0 {
+				t.Errorf("job processed %d of %d, imported %d and failed %d after %d reports",
+					job.Processed, job.Total, job.Imported, job.Failed, reports)
+			}
+			if len(job.Errors) != len(test.problems) || len(job.Errors) > 0 && job.Errors[0] != test.problems[0] {
+				t.Errorf("job errors are %+v, expected %+v", job.Errors, test.problems)
+			}
+
+			workouts, err := db.GetWorkouts(context.Background(), userID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			types := make([]string, len(workouts))
+			for i, workout := range workouts {
+				types[i] = workout.Type
+			}
+			if !equalStrings(types, test.types) {
+				t.Errorf("imported workouts are of types %v, expected %v", types, test.types)
+			}
+			for _, workout := range workouts {
+				if workout.Type == "ride" && (!workout.Start.Equal(time.Date(2019, time.March, 2, 13, 0, 0, 0, time.UTC)) || workout.Duration() != 90*time.Minute) {
+					t.Errorf("the ride was read from its FIT file as %+v", workout)
+				}
+			}
+		})
+	}
+}
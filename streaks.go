@@ -0,0 +1,213 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	log "github.com/sirupsen/logrus"
+)
+
+// StreakOptions configures how streaks and consistency are computed.
+type StreakOptions struct {
+	// RestDays is the number of days without a workout allowed between two workouts
+	// before a daily streak is broken.
+	RestDays int
+	// PerWeek is the number of workouts needed in a week for it to count towards a
+	// weekly streak, and the target used for the consistency score.
+	PerWeek int
+	// Window is the number of rolling weeks the consistency score is averaged over.
+	Window int
+	// Location determines the calendar that days and weeks follow.
+	Location *time.Location
+}
+
+// DefaultStreakOptions are used when a client does not configure its streaks.
+var DefaultStreakOptions = StreakOptions{
+	RestDays: 0,
+	PerWeek:  3,
+	Window:   4,
+	Location: time.UTC,
+}
+
+// ComputeStreaks computes the daily and weekly streaks and the consistency score of a user
+// at the instant now, given the start times of their workouts in any order.
+//
+// A daily streak counts the days with workouts in a run where no more than RestDays days
+// pass without one; it is current if today or one of the RestDays days before it could
+// still extend it. A weekly streak counts consecutive weeks, starting on Monday, with at
+// least PerWeek workouts; the week in progress only breaks the current streak once it is
+// over. The consistency score is the average, over the last Window rolling seven day
+// periods ending today, of the fraction of the weekly target that was met, from 0 to 100.
+func ComputeStreaks(starts []time.Time, now time.Time, options StreakOptions) Streaks {
+	streaks := Streaks{
+		RestDays: options.RestDays,
+		PerWeek:  options.PerWeek,
+		Window:   options.Window,
+		TimeZone: options.Location.String(),
+	}
+	today := civilDay(now.In(options.Location))
+
+	// Count workouts on each day, ignoring any scheduled in the future.
+	counts := make(map[int]int)
+	for _, start := range starts {
+		if day := civilDay(start.In(options.Location)); day <= today {
+			counts[day]++
+		}
+	}
+	days := make([]int, 0, len(counts))
+	for day := range counts {
+		days = append(days, day)
+	}
+	sort.Ints(days)
+	if len(days) == 0 {
+		return streaks
+	}
+
+	streaks.Daily = dailyStreak(days, today, options)
+	streaks.Weekly = weeklyStreak(days, counts, today, options)
+	streaks.Consistency = consistency(counts, today, options)
+	return streaks
+}
+
+func dailyStreak(days []int, today int, options StreakOptions) Streak {
+	var streak Streak
+	start, length := days[0], 0
+	for i, day := range days {
+		if i > 0 && day-days[i-1] > options.RestDays+1 {
+			start, length = day, 0
+		}
+		length++
+		if length > streak.Longest {
+			streak.Longest = length
+			streak.LongestStart = civilDate(start, options.Location)
+		}
+	}
+
+	if today-days[len(days)-1] <= options.RestDays+1 {
+		streak.Current = length
+		streak.CurrentStart = civilDate(start, options.Location)
+	}
+	return streak
+}
+
+func weeklyStreak(days []int, counts map[int]int, today int, options StreakOptions) Streak {
+	weekCounts := make(map[int]int)
+	for _, day := range days {
+		weekCounts[civilWeek(day)] += counts[day]
+	}
+
+	var streak Streak
+	thisWeek := civilWeek(today)
+	start, length := 0, 0
+	for week := civilWeek(days[0]); week <= thisWeek; week += 7 {
+		if weekCounts[week] < options.PerWeek {
+			if week != thisWeek {
+				length = 0
+			}
+			continue
+		}
+		if length == 0 {
+			start = week
+		}
+		length++
+		if length > streak.Longest {
+			streak.Longest = length
+			streak.LongestStart = civilDate(start, options.Location)
+		}
+	}
+
+	if length > 0 {
+		streak.Current = length
+		streak.CurrentStart = civilDate(start, options.Location)
+	}
+	return streak
+}
+
+func consistency(counts map[int]int, today int, options StreakOptions) float64 {
+	if options.Window <= 0 || options.PerWeek <= 0 {
+		return 0
+	}
+
+	total := 0.0
+	for period := 0; period < options.Window; period++ {
+		workouts := 0
+		for day := today - 7*period - 6; day <= today-7*period; day++ {
+			workouts += counts[day]
+		}
+		if workouts >= options.PerWeek {
+			total++
+		} else {
+			total += float64(workouts) / float64(options.PerWeek)
+		}
+	}
+	return 100 * total / float64(options.Window)
+}
+
+// civilDay returns the number of days between the Unix epoch and the calendar date of t
+// in its location. Unlike dividing durations, this is not affected by daylight saving.
+func civilDay(t time.Time) int {
+	year, month, day := t.Date()
+	return int(time.Date(year, month, day, 0, 0, 0, 0, time.UTC).Unix() / (24 * 60 * 60))
+}
+
+// civilWeek returns the civil day of the Monday starting the week containing day.
+func civilWeek(day int) int {
+	// The Unix epoch was a Thursday.
+	return day - (day+3)%7
+}
+
+// civilDate returns midnight at the start of a civil day in loc.
+func civilDate(day int, loc *time.Location) *time.Time {
+	year, month, date := time.Unix(int64(day)*24*60*60, 0).UTC().Date()
+	t := time.Date(year, month, date, 0, 0, 0, 0, loc)
+	return &t
+}
+
+// workoutStarts returns the start times of the given workouts.
+func workoutStarts(workouts []Workout) []time.Time {
+	starts := make([]time.Time, len(workouts))
+	for i, workout := range workouts {
+		starts[i] = workout.Start
+	}
+	return starts
+}
+
+// GetStreaks returns the streaks and consistency score of the requesting user. The
+// optional query parameters rest_days, per_week, window and tz override
+// DefaultStreakOptions.
+func (env *Env) GetStreaks(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	user, ok := env.authenticate(w, r)
+	if !ok {
+		return
+	}
+
+	params := r.URL.Query()
+	options := DefaultStreakOptions
+	var problems, fieldProblems []FieldError
+	options.RestDays, fieldProblems = parseInt(params, "rest_days", options.RestDays, 0, 6)
+	problems = append(problems, fieldProblems...)
+	options.PerWeek, fieldProblems = parseInt(params, "per_week", options.PerWeek, 1, 14)
+	problems = append(problems, fieldProblems...)
+	options.Window, fieldProblems = parseInt(params, "window", options.Window, 1, 52)
+	problems = append(problems, fieldProblems...)
+	options.Location, fieldProblems = parseTimeZone(params)
+	problems = append(problems, fieldProblems...)
+	if !validRequest(w, problems) {
+		return
+	}
+
+	workouts, err := env.db.GetWorkouts(r.Context(), user.ID)
+	if err != nil {
+		InternalServerError(w, err)
+		return
+	}
+	streaks := ComputeStreaks(workoutStarts(workouts), time.Now(), options)
+	log.WithFields(log.Fields{
+		"name":   user.Name,
+		"daily":  streaks.Daily.Current,
+		"weekly": streaks.Weekly.Current,
+	}).Info("Computed streaks")
+	WriteJSON(w, http.StatusOK, streaks)
+}
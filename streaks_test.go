@@ -0,0 +1,128 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// testLocation returns the time zone the calendar tests use, where daylight saving time
+// began on 10 March 2019 and ended on 3 November 2019.
+func testLocation(t *testing.T) *time.Location {
+	location, err := time.LoadLocation("America/Toronto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return location
+}
+
+// expectedStreak is a streak with its start dates written as dates in its location.
+type expectedStreak struct {
+	current, longest           int
+	currentStart, longestStart string
+}
+
+func formatStart(start *time.Time) string {
+	if start == nil {
+		return ""
+	}
+	return start.Format("2006-01-02 15:04 MST")
+}
+
+func checkStreak(t *testing.T, kind string, streak Streak, expected expectedStreak) {
+	got := expectedStreak{streak.Current, streak.Longest, formatStart(streak.CurrentStart), formatStart(streak.LongestStart)}
+	if got != expected {
+		t.Errorf("%s streak is %+v, expected %+v", kind, got, expected)
+	}
+}
+
+func TestComputeStreaks(t *testing.T) {
+	toronto := testLocation(t)
+	at := func(year int, month time.Month, day, hour, minute int) time.Time {
+		return time.Date(year, month, day, hour, minute, 0, 0, toronto)
+	}
+
+	for _, test := range []struct {
+		name        string
+		starts      []time.Time
+		now         time.Time
+		options     StreakOptions
+		daily       expectedStreak
+		weekly      expectedStreak
+		consistency float64
+	}{{
+		name:    "empty history",
+		now:     at(2019, time.March, 11, 12, 0),
+		options: StreakOptions{PerWeek: 1, Window: 4, Location: toronto},
+	}, {
+		// 10 March is 23 hours long in Toronto, so late workouts on consecutive days are
+		// less than a day apart in UTC.
+		name:        "daylight saving time begins",
+		starts:      []time.Time{at(2019, time.March, 9, 23, 30), at(2019, time.March, 10, 23, 30), at(2019, time.March, 11, 0, 30)},
+		now:         at(2019, time.March, 11, 23, 45),
+		options:     StreakOptions{PerWeek: 3, Window: 1, Location: toronto},
+		daily:       expectedStreak{3, 3, "2019-03-09 00:00 EST", "2019-03-09 00:00 EST"},
+		weekly:      expectedStreak{0, 0, "", ""},
+		consistency: 100,
+	}, {
+		name:    "daylight saving time ends",
+		starts:  []time.Time{at(2019, time.November, 2, 23, 0), at(2019, time.November, 3, 23, 30)},
+		now:     at(2019, time.November, 4, 8, 0),
+		options: StreakOptions{PerWeek: 2, Window: 1, Location: toronto},
+		daily:   expectedStreak{2, 2, "2019-11-02 00:00 EDT", "2019-11-02 00:00 EDT"},
+		// 2 November was a Saturday and 3 November a Sunday, so both are in the last week.
+		weekly:      expectedStreak{1, 1, "2019-10-28 00:00 EDT", "2019-10-28 00:00 EDT"},
+		consistency: 100,
+	}, {
+		// 30 December 2019 is the Monday starting the first ISO week of 2020.
+		name: "across a new year",
+		starts: []time.Time{
+			at(2019, time.December, 24, 8, 0),
+			at(2019, time.December, 30, 8, 0),
+			at(2019, time.December, 31, 8, 0),
+			at(2020, time.January, 1, 8, 0),
+			at(2020, time.January, 6, 8, 0),
+		},
+		now:         at(2020, time.January, 7, 8, 0),
+		options:     StreakOptions{PerWeek: 1, Window: 2, Location: toronto},
+		daily:       expectedStreak{1, 3, "2020-01-06 00:00 EST", "2019-12-30 00:00 EST"},
+		weekly:      expectedStreak{3, 3, "2019-12-23 00:00 EST", "2019-12-23 00:00 EST"},
+		consistency: 100,
+	}, {
+		name:        "rest days",
+		starts:      []time.Time{at(2019, time.March, 1, 8, 0), at(2019, time.March, 3, 8, 0), at(2019, time.March, 6, 8, 0)},
+		now:         at(2019, time.March, 7, 8, 0),
+		options:     StreakOptions{RestDays: 1, PerWeek: 3, Window: 2, Location: toronto},
+		daily:       expectedStreak{1, 2, "2019-03-06 00:00 EST", "2019-03-01 00:00 EST"},
+		weekly:      expectedStreak{0, 0, "", ""},
+		consistency: 50,
+	}, {
+		// The week in progress has no workouts yet, which does not break the streak.
+		name:        "week in progress",
+		starts:      []time.Time{at(2019, time.March, 5, 8, 0), at(2019, time.March, 12, 8, 0)},
+		now:         at(2019, time.March, 18, 8, 0),
+		options:     StreakOptions{PerWeek: 1, Window: 2, Location: toronto},
+		daily:       expectedStreak{0, 1, "", "2019-03-05 00:00 EST"},
+		weekly:      expectedStreak{2, 2, "2019-03-04 00:00 EST", "2019-03-04 00:00 EST"},
+		consistency: 100,
+	}, {
+		name:        "future workouts",
+		starts:      []time.Time{at(2019, time.March, 11, 8, 0), at(2019, time.March, 12, 8, 0)},
+		now:         at(2019, time.March, 11, 12, 0),
+		options:     StreakOptions{PerWeek: 2, Window: 1, Location: toronto},
+		daily:       expectedStreak{1, 1, "2019-03-11 00:00 EDT", "2019-03-11 00:00 EDT"},
+		weekly:      expectedStreak{0, 0, "", ""},
+		consistency: 50,
+	}} {
+		t.Run(test.name, func(t *testing.T) {
+			streaks := ComputeStreaks(test.starts, test.now, test.options)
+			checkStreak(t, "daily", streaks.Daily, test.daily)
+			checkStreak(t, "weekly", streaks.Weekly, test.weekly)
+			if streaks.Consistency != test.consistency {
+				t.Errorf("consistency is %v, expected %v", streaks.Consistency, test.consistency)
+			}
+			if streaks.TimeZone != "America/Toronto" {
+				t.Errorf("time zone is %q", streaks.TimeZone)
+			}
+		})
+	}
+}
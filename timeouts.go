@@ -0,0 +1,329 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+// defaultQueryTimeout is how long a call to the datastore may take unless QUERY_TIMEOUT
+// says otherwise.
+const defaultQueryTimeout = 10 * time.Second
+
+// batchOperationsPerTimeout is the number of operations of a batch that are given the
+// time of another call, on top of the call itself, since a batch of the largest size
+// writes far more than any other call.
+const batchOperationsPerTimeout = 1000
+
+// queryTimeoutDB limits how long each call to a Datastore may take. Drivers report the
+// queries that a context cuts short in their own ways, such as Postgres's "canceling
+// statement due to user request", so the calls cut short return the error of their context
+// instead, which handlers turn into 499 and 503 responses.
+type queryTimeoutDB struct {
+	db      Datastore
+	timeout time.Duration
+}
+
+// WithQueryTimeout returns a Datastore that cancels each call to db once it has taken
+// timeout. A timeout of zero leaves the calls unlimited, other than by their contexts.
+func WithQueryTimeout(db Datastore, timeout time.Duration) Datastore {
+	return queryTimeoutDB{db, timeout}
+}
+
+// context returns the context a call runs under.
+func (db queryTimeoutDB) context(ctx context.Context) (context.Context, context.CancelFunc) {
+	if db.timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, db.timeout)
+}
+
+// batchContext returns the context a batch of n operations runs under, whose timeout grows
+// with the size of the batch.
+func (db queryTimeoutDB) batchContext(ctx context.Context, n int) (context.Context, context.CancelFunc) {
+	if db.timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, db.timeout*time.Duration(1+n/batchOperationsPerTimeout))
+}
+
+// contextError returns the error of ctx in place of err if ctx is done, since err is then
+// the way the driver reported the query being cut short.
+func contextError(ctx context.Context, err error) error {
+	if err != nil && ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+/* Datastore methods, each running its call under the context returned by context */
+
+func (db queryTimeoutDB) SignUp(ctx context.Context, request UserRequest) (int, error) {
+	ctx, cancel := db.context(ctx)
+	defer cancel()
+	result, err := db.db.SignUp(ctx, request)
+	return result, contextError(ctx, err)
+}
+
+func (db queryTimeoutDB) LoginWithCredentials(ctx context.Context, name, passHash string) (User, error) {
+	ctx, cancel := db.context(ctx)
+	defer cancel()
+	result, err := db.db.LoginWithCredentials(ctx, name, passHash)
+	return result, contextError(ctx, err)
+}
+
+func (db queryTimeoutDB) LoginWithToken(ctx context.Context, token string) (User, error) {
+	ctx, cancel := db.context(ctx)
+	defer cancel()
+	result, err := db.db.LoginWithToken(ctx, token)
+	return result, contextError(ctx, err)
+}
+
+func (db queryTimeoutDB) GetUsername(ctx context.Context, userID int) (string, error) {
+	ctx, cancel := db.context(ctx)
+	defer cancel()
+	result, err := db.db.GetUsername(ctx, userID)
+	return result, contextError(ctx, err)
+}
+
+func (db queryTimeoutDB) AddWorkout(ctx context.Context, workout Workout) (int, error) {
+	ctx, cancel := db.context(ctx)
+	defer cancel()
+	result, err := db.db.AddWorkout(ctx, workout)
+	return result, contextError(ctx, err)
+}
+
+func (db queryTimeoutDB) UpdateWorkout(ctx context.Context, workout Workout) error {
+	ctx, cancel := db.context(ctx)
+	defer cancel()
+	return contextError(ctx, db.db.UpdateWorkout(ctx, workout))
+}
+
+func (db queryTimeoutDB) DeleteWorkout(ctx context.Context, workoutID int) (int, error) {
+	ctx, cancel := db.context(ctx)
+	defer cancel()
+	result, err := db.db.DeleteWorkout(ctx, workoutID)
+	return result, contextError(ctx, err)
+}
+
+func (db queryTimeoutDB) GetDeletedWorkouts(ctx context.Context, userID int) ([]Workout, error) {
+	ctx, cancel := db.context(ctx)
+	defer cancel()
+	result, err := db.db.GetDeletedWorkouts(ctx, userID)
+	return result, contextError(ctx, err)
+}
+
+func (db queryTimeoutDB) RestoreWorkout(ctx context.Context, userID, workoutID int) (Workout, error) {
+	ctx, cancel := db.context(ctx)
+	defer cancel()
+	result, err := db.db.RestoreWorkout(ctx, userID, workoutID)
+	return result, contextError(ctx, err)
+}
+
+func (db queryTimeoutDB) PurgeDeletedWorkouts(ctx context.Context, before time.Time) (int, error) {
+	ctx, cancel := db.context(ctx)
+	defer cancel()
+	result, err := db.db.PurgeDeletedWorkouts(ctx, before)
+	return result, contextError(ctx, err)
+}
+
+func (db queryTimeoutDB) GetWorkouts(ctx context.Context, userID int) ([]Workout, error) {
+	ctx, cancel := db.context(ctx)
+	defer cancel()
+	result, err := db.db.GetWorkouts(ctx, userID)
+	return result, contextError(ctx, err)
+}
+
+func (db queryTimeoutDB) GetWorkout(ctx context.Context, userID, workoutID int) (Workout, error) {
+	ctx, cancel := db.context(ctx)
+	defer cancel()
+	result, err := db.db.GetWorkout(ctx, userID, workoutID)
+	return result, contextError(ctx, err)
+}
+
+func (db queryTimeoutDB) GetUsers(ctx context.Context) ([]string, error) {
+	ctx, cancel := db.context(ctx)
+	defer cancel()
+	result, err := db.db.GetUsers(ctx)
+	return result, contextError(ctx, err)
+}
+
+func (db queryTimeoutDB) BatchWorkouts(ctx context.Context, ops []BatchOperation, webhooks BatchWebhooks) ([]BatchResult, error) {
+	ctx, cancel := db.batchContext(ctx, len(ops))
+	defer cancel()
+	result, err := db.db.BatchWorkouts(ctx, ops, webhooks)
+	return result, contextError(ctx, err)
+}
+
+func (db queryTimeoutDB) GetInsights(ctx context.Context, userID int, query InsightsQuery) (Insights, error) {
+	ctx, cancel := db.context(ctx)
+	defer cancel()
+	result, err := db.db.GetInsights(ctx, userID, query)
+	return result, contextError(ctx, err)
+}
+
+func (db queryTimeoutDB) GetWorkoutsBetween(ctx context.Context, userID int, from, to time.Time) ([]Workout, error) {
+	ctx, cancel := db.context(ctx)
+	defer cancel()
+	result, err := db.db.GetWorkoutsBetween(ctx, userID, from, to)
+	return result, contextError(ctx, err)
+}
+
+func (db queryTimeoutDB) GetOverlappingWorkouts(ctx context.Context, userID int, start, end time.Time, excludeID int) ([]Workout, error) {
+	ctx, cancel := db.context(ctx)
+	defer cancel()
+	result, err := db.db.GetOverlappingWorkouts(ctx, userID, start, end, excludeID)
+	return result, contextError(ctx, err)
+}
+
+func (db queryTimeoutDB) GetGoals(ctx context.Context, userID int) ([]Goal, error) {
+	ctx, cancel := db.context(ctx)
+	defer cancel()
+	result, err := db.db.GetGoals(ctx, userID)
+	return result, contextError(ctx, err)
+}
+
+func (db queryTimeoutDB) AddGoal(ctx context.Context, goal Goal) (int, error) {
+	ctx, cancel := db.context(ctx)
+	defer cancel()
+	result, err := db.db.AddGoal(ctx, goal)
+	return result, contextError(ctx, err)
+}
+
+func (db queryTimeoutDB) UpdateGoal(ctx context.Context, goal Goal) error {
+	ctx, cancel := db.context(ctx)
+	defer cancel()
+	return contextError(ctx, db.db.UpdateGoal(ctx, goal))
+}
+
+func (db queryTimeoutDB) DeleteGoal(ctx context.Context, userID, goalID int) error {
+	ctx, cancel := db.context(ctx)
+	defer cancel()
+	return contextError(ctx, db.db.DeleteGoal(ctx, userID, goalID))
+}
+
+func (db queryTimeoutDB) StartWorkout(ctx context.Context, userID int, start time.Time) (WorkoutSession, error) {
+	ctx, cancel := db.context(ctx)
+	defer cancel()
+	result, err := db.db.StartWorkout(ctx, userID, start)
+	return result, contextError(ctx, err)
+}
+
+func (db queryTimeoutDB) GetActiveWorkout(ctx context.Context, userID int) (WorkoutSession, error) {
+	ctx, cancel := db.context(ctx)
+	defer cancel()
+	result, err := db.db.GetActiveWorkout(ctx, userID)
+	return result, contextError(ctx, err)
+}
+
+func (db queryTimeoutDB) UpdateWorkoutSession(ctx context.Context, userID, workoutID int, action string, at time.Time) (WorkoutSession, error) {
+	ctx, cancel := db.context(ctx)
+	defer cancel()
+	result, err := db.db.UpdateWorkoutSession(ctx, userID, workoutID, action, at)
+	return result, contextError(ctx, err)
+}
+
+func (db queryTimeoutDB) GetWebhooks(ctx context.Context, userID int) ([]Webhook, error) {
+	ctx, cancel := db.context(ctx)
+	defer cancel()
+	result, err := db.db.GetWebhooks(ctx, userID)
+	return result, contextError(ctx, err)
+}
+
+func (db queryTimeoutDB) AddWebhook(ctx context.Context, webhook Webhook) (int, error) {
+	ctx, cancel := db.context(ctx)
+	defer cancel()
+	result, err := db.db.AddWebhook(ctx, webhook)
+	return result, contextError(ctx, err)
+}
+
+func (db queryTimeoutDB) DeleteWebhook(ctx context.Context, userID, webhookID int) error {
+	ctx, cancel := db.context(ctx)
+	defer cancel()
+	return contextError(ctx, db.db.DeleteWebhook(ctx, userID, webhookID))
+}
+
+func (db queryTimeoutDB) QueueWebhookDeliveries(ctx context.Context, events []WebhookEvent) error {
+	ctx, cancel := db.context(ctx)
+	defer cancel()
+	return contextError(ctx, db.db.QueueWebhookDeliveries(ctx, events))
+}
+
+func (db queryTimeoutDB) ClaimWebhookDeliveries(ctx context.Context, limit int, lease time.Duration) ([]WebhookDelivery, error) {
+	ctx, cancel := db.context(ctx)
+	defer cancel()
+	result, err := db.db.ClaimWebhookDeliveries(ctx, limit, lease)
+	return result, contextError(ctx, err)
+}
+
+func (db queryTimeoutDB) RecordWebhookAttempt(ctx context.Context, delivery WebhookDelivery) error {
+	ctx, cancel := db.context(ctx)
+	defer cancel()
+	return contextError(ctx, db.db.RecordWebhookAttempt(ctx, delivery))
+}
+
+func (db queryTimeoutDB) GetWebhookDeliveries(ctx context.Context, userID, webhookID, limit int) ([]WebhookDelivery, error) {
+	ctx, cancel := db.context(ctx)
+	defer cancel()
+	result, err := db.db.GetWebhookDeliveries(ctx, userID, webhookID, limit)
+	return result, contextError(ctx, err)
+}
+
+func (db queryTimeoutDB) SetCalendarToken(ctx context.Context, userID int, token string) error {
+	ctx, cancel := db.context(ctx)
+	defer cancel()
+	return contextError(ctx, db.db.SetCalendarToken(ctx, userID, token))
+}
+
+func (db queryTimeoutDB) GetCalendarUser(ctx context.Context, token string) (User, error) {
+	ctx, cancel := db.context(ctx)
+	defer cancel()
+	result, err := db.db.GetCalendarUser(ctx, token)
+	return result, contextError(ctx, err)
+}
+
+func (db queryTimeoutDB) GetPlannedWorkouts(ctx context.Context, userID int) ([]PlannedWorkout, error) {
+	ctx, cancel := db.context(ctx)
+	defer cancel()
+	result, err := db.db.GetPlannedWorkouts(ctx, userID)
+	return result, contextError(ctx, err)
+}
+
+func (db queryTimeoutDB) ImportPlannedWorkouts(ctx context.Context, userID int, planned []PlannedWorkout) error {
+	ctx, cancel := db.context(ctx)
+	defer cancel()
+	return contextError(ctx, db.db.ImportPlannedWorkouts(ctx, userID, planned))
+}
+
+func (db queryTimeoutDB) ImportWorkouts(ctx context.Context, workouts []Workout) ([]int, error) {
+	ctx, cancel := db.context(ctx)
+	defer cancel()
+	result, err := db.db.ImportWorkouts(ctx, workouts)
+	return result, contextError(ctx, err)
+}
+
+func (db queryTimeoutDB) AddImportJob(ctx context.Context, job ImportJob) (int, error) {
+	ctx, cancel := db.context(ctx)
+	defer cancel()
+	result, err := db.db.AddImportJob(ctx, job)
+	return result, contextError(ctx, err)
+}
+
+func (db queryTimeoutDB) UpdateImportJob(ctx context.Context, job ImportJob) error {
+	ctx, cancel := db.context(ctx)
+	defer cancel()
+	return contextError(ctx, db.db.UpdateImportJob(ctx, job))
+}
+
+func (db queryTimeoutDB) GetImportJob(ctx context.Context, userID, jobID int) (ImportJob, error) {
+	ctx, cancel := db.context(ctx)
+	defer cancel()
+	result, err := db.db.GetImportJob(ctx, userID, jobID)
+	return result, contextError(ctx, err)
+}
+
+func (db queryTimeoutDB) ClaimStaleImportJobs(ctx context.Context, host string, lease time.Duration) ([]ImportJob, error) {
+	ctx, cancel := db.context(ctx)
+	defer cancel()
+	result, err := db.db.ClaimStaleImportJobs(ctx, host, lease)
+	return result, contextError(ctx, err)
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	log "github.com/sirupsen/logrus"
+)
+
+// Deleted workouts are moved to a trash, from which they can be restored until they are
+// purged.
+
+const (
+	// defaultTrashRetention is how long deleted workouts are kept unless TRASH_RETENTION
+	// says otherwise.
+	defaultTrashRetention = 30 * 24 * time.Hour
+	// trashPurgeInterval is how often workouts kept for longer than the retention are
+	// deleted for good.
+	trashPurgeInterval = time.Hour
+)
+
+// GetTrash returns the deleted workouts of the requesting user that can still be restored,
+// the most recently deleted first.
+func (env *Env) GetTrash(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	user, ok := env.authenticate(w, r)
+	if !ok {
+		return
+	}
+	workouts, err := env.db.GetDeletedWorkouts(r.Context(), user.ID)
+	if err != nil {
+		InternalServerError(w, err)
+		return
+	}
+	WriteJSON(w, http.StatusOK, workouts)
+}
+
+// RestoreWorkout takes the workout specified in the URL parameter out of the requesting
+// user's trash. Clients are told of the workout as if it had just been created.
+func (env *Env) RestoreWorkout(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	user, ok := env.authenticate(w, r)
+	if !ok {
+		return
+	}
+	workoutID, err := strconv.Atoi(ps.ByName("id"))
+	if err != nil {
+		WriteValidationError(w, err, "Invalid workout", []FieldError{{"id", "must be an integer"}})
+		return
+	}
+
+	workout, err := env.db.RestoreWorkout(r.Context(), user.ID, workoutID)
+	switch {
+	case err == ErrWorkoutNotFound:
+		WriteErrorCode(
+			w,
+			http.StatusNotFound,
+			err,
+			ErrCodeWorkoutNotFound,
+			"The specified workout is not in your trash",
+		)
+		return
+	case err == ErrWorkoutInProgress:
+		WriteErrorCode(
+			w,
+			http.StatusConflict,
+			err,
+			ErrCodeWorkoutInProgress,
+			"You already have a workout in progress",
+		)
+		return
+	case err != nil:
+		InternalServerError(w, err)
+		return
+	}
+	env.publish(user.ID, workoutEvent(EventWorkoutCreated, workout))
+	log.WithFields(log.Fields{"name": user.Name, "workout": workoutID}).Info("Restored workout")
+	workout.User = 0
+	WriteJSON(w, http.StatusOK, workout)
+}
+
+// PurgeTrash deletes the workouts that have been in the trash for longer than retention,
+// every trashPurgeInterval until stop is closed.
+func PurgeTrash(db Datastore, retention time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(trashPurgeInterval)
+	defer ticker.Stop()
+	for {
+		purged, err := db.PurgeDeletedWorkouts(context.Background(), time.Now().Add(-retention))
+		switch {
+		case err != nil:
+			log.WithError(err).Error("Unable to purge the trash")
+		case purged > 0:
+			log.WithField("workouts", purged).Info("Purged the trash")
+		}
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
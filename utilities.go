@@ -1,11 +1,17 @@
 package main
 
 import (
+	"context"
 	"crypto/hmac"
+	"crypto/rand"
 	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"net/http"
+	"regexp"
+	"strings"
 	"time"
 
 	"github.com/julienschmidt/httprouter"
@@ -16,10 +22,12 @@ import (
 func (env *Env) loggerMiddleware(name string, handle httprouter.Handle) httprouter.Handle {
 	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 		start := time.Now()
+		requestID := assignRequestID(w, r)
 
 		handle(w, r, ps)
 
 		log.WithFields(log.Fields{
+			"request-id":  requestID,
 			"method":      r.Method,
 			"URI":         r.RequestURI,
 			"handler":     name,
@@ -29,20 +37,97 @@ func (env *Env) loggerMiddleware(name string, handle httprouter.Handle) httprout
 	}
 }
 
+/* Authentication */
+
+// authenticate identifies the user making a request from the access token in its
+// Authorization header, which takes the form "Bearer <token>". If the token is missing
+// or does not match any user, an error response is written and false is returned.
+func (env *Env) authenticate(w http.ResponseWriter, r *http.Request) (User, bool) {
+	header := r.Header.Get("Authorization")
+	token := strings.TrimSpace(strings.TrimPrefix(header, "Bearer "))
+	if !strings.HasPrefix(header, "Bearer ") || token == "" {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		WriteError(
+			w,
+			http.StatusUnauthorized,
+			errors.New("missing bearer token"),
+			"An access token is required",
+		)
+		return User{}, false
+	}
+
+	user, err := env.db.LoginWithToken(r.Context(), token)
+	switch {
+	case err == ErrUserNotFound:
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		WriteError(w, http.StatusUnauthorized, err, "The given token did not match any users")
+		return user, false
+	case err != nil:
+		InternalServerError(w, err)
+		return user, false
+	}
+	user.Token = token
+	return user, true
+}
+
 /* Functions to create JSON responses */
 
+// StatusClientClosedRequest is the non-standard status logged when the client goes away
+// before its request is answered.
+const StatusClientClosedRequest = 499
+
 // InternalServerError is a shorthand to write a 500 internal server error to
-// the client.
+// the client. Errors caused by the request's context ending are reported as a 499
+// if the client went away, or a 503 if a query ran out of time.
 func InternalServerError(w http.ResponseWriter, err error) {
-	WriteError(w, http.StatusInternalServerError, err,
-		"Unable to process request")
+	switch err {
+	case context.Canceled:
+		WriteErrorCode(w, StatusClientClosedRequest, err, ErrCodeRequestCancelled,
+			"The request was cancelled")
+	case context.DeadlineExceeded:
+		WriteErrorCode(w, http.StatusServiceUnavailable, err, ErrCodeTimeout,
+			"The request took too long to process")
+	default:
+		WriteError(w, http.StatusInternalServerError, err,
+			"Unable to process request")
+	}
 }
 
-// WriteError is a shorthand to write an error to the client.
+// WriteError is a shorthand to write an error to the client, using the generic error
+// code for the given HTTP status.
 func WriteError(w http.ResponseWriter, code int, err error,
 	message string) {
-	log.WithError(err).Error("An error occurred")
-	WriteJSON(w, code, map[string]string{"error": message})
+	WriteErrorCode(w, code, err, errorCodeForStatus(code), message)
+}
+
+// WriteErrorCode is a shorthand to write an error with a specific machine-readable
+// error code to the client.
+func WriteErrorCode(w http.ResponseWriter, code int, err error,
+	errorCode, message string) {
+	WriteErrorResponse(w, code, err, ErrorResponse{Message: message, Code: errorCode})
+}
+
+// WriteValidationError is a shorthand to write a 400 bad request listing the fields of
+// the request that failed validation.
+func WriteValidationError(w http.ResponseWriter, err error, message string,
+	details []FieldError) {
+	WriteErrorResponse(w, http.StatusBadRequest, err, ErrorResponse{
+		Message: message,
+		Code:    ErrCodeValidationFailed,
+		Details: details,
+	})
+}
+
+// WriteErrorResponse logs err and writes the given error envelope to the client, filling
+// in the ID of the current request.
+func WriteErrorResponse(w http.ResponseWriter, code int, err error,
+	response ErrorResponse) {
+	response.RequestID = w.Header().Get(requestIDHeader)
+	log.WithError(err).WithFields(log.Fields{
+		"request-id": response.RequestID,
+		"code":       response.Code,
+	}).Error("An error occurred")
+	WriteJSON(w, code, response)
 }
 
 // WriteJSON is a shorthand to respond to the client with a payload to be
@@ -58,6 +143,69 @@ func WriteJSON(w http.ResponseWriter, code int, payload interface{}) {
 	w.Write(response)
 }
 
+/* Error codes */
+
+// Machine-readable codes identifying the cause of an error response.
+const (
+	ErrCodeInvalidRequest     = "invalid_request"
+	ErrCodeValidationFailed   = "validation_failed"
+	ErrCodeUnauthorized       = "unauthorized"
+	ErrCodeInvalidCredentials = "invalid_credentials"
+	ErrCodeNotAuthorized      = "not_authorized"
+	ErrCodeNotFound           = "not_found"
+	ErrCodeUserNotFound       = "user_not_found"
+	ErrCodeWorkoutNotFound    = "workout_not_found"
+	ErrCodeGoalNotFound       = "goal_not_found"
+	ErrCodeWebhookNotFound    = "webhook_not_found"
+	ErrCodeImportJobNotFound  = "import_job_not_found"
+	ErrCodeUserAlreadyExists  = "user_already_exists"
+	ErrCodeMethodNotAllowed   = "method_not_allowed"
+	ErrCodeRequestTooLarge    = "request_too_large"
+	ErrCodeRequestCancelled   = "request_cancelled"
+	ErrCodeTimeout            = "timeout"
+	ErrCodeInternal           = "internal_error"
+)
+
+// errorCodeForStatus returns the generic error code used for an HTTP status when a
+// handler does not provide a more specific one.
+func errorCodeForStatus(status int) string {
+	switch status {
+	case http.StatusBadRequest:
+		return ErrCodeInvalidRequest
+	case http.StatusUnauthorized:
+		return ErrCodeUnauthorized
+	case http.StatusNotFound:
+		return ErrCodeNotFound
+	case http.StatusMethodNotAllowed:
+		return ErrCodeMethodNotAllowed
+	case http.StatusRequestEntityTooLarge:
+		return ErrCodeRequestTooLarge
+	default:
+		return ErrCodeInternal
+	}
+}
+
+/* Request IDs */
+
+const requestIDHeader = "X-Request-ID"
+
+// validRequestID matches request IDs supplied by clients or proxies that are safe to echo
+// back and log.
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// assignRequestID sets the ID of the request on the response headers and returns it. An ID
+// supplied by the client is reused, otherwise a random one is generated.
+func assignRequestID(w http.ResponseWriter, r *http.Request) string {
+	requestID := r.Header.Get(requestIDHeader)
+	if !validRequestID.MatchString(requestID) {
+		b := make([]byte, 8)
+		rand.Read(b)
+		requestID = hex.EncodeToString(b)
+	}
+	w.Header().Set(requestIDHeader, requestID)
+	return requestID
+}
+
 func computeHmac256(message, secret string) string {
 	key := []byte(secret)
 	h := hmac.New(sha256.New, key)
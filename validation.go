@@ -0,0 +1,384 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Limits on the size of request bodies.
+const (
+	maxBodyBytes      = 1 << 20
+	maxBatchBodyBytes = 8 << 20
+)
+
+// Limits on the fields of a UserRequest, matching the columns of the users table.
+const (
+	maxNameLength     = 50
+	maxPasswordLength = 256
+)
+
+// maxGoalTarget is the largest target a goal may have, which is enough for every minute
+// of a month.
+const maxGoalTarget = 31 * 24 * 60
+
+// maxWebhookURLLength matches the url column of the webhooks table.
+const maxWebhookURLLength = 2048
+
+// maxWorkoutTypeLength matches the type column of the workouts table.
+const maxWorkoutTypeLength = 50
+
+// Error codes specific to decoding request bodies.
+const (
+	ErrCodeInvalidJSON          = "invalid_json"
+	ErrCodeUnsupportedMediaType = "unsupported_media_type"
+)
+
+/* Decoding */
+
+// decodeJSON decodes the JSON body of the request into v. The body must be declared as
+// JSON, be no larger than limit bytes, contain a single value and only contain fields
+// that v has. If any of these do not hold, an error response is written to the client
+// and false is returned.
+func decodeJSON(w http.ResponseWriter, r *http.Request, limit int64, v interface{}) bool {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || !(mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")) {
+		WriteErrorCode(
+			w,
+			http.StatusUnsupportedMediaType,
+			fmt.Errorf("unsupported content type '%s'", r.Header.Get("Content-Type")),
+			ErrCodeUnsupportedMediaType,
+			"The request body must be JSON",
+		)
+		return false
+	}
+
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, limit))
+	decoder.DisallowUnknownFields()
+	err = decoder.Decode(v)
+	if err == nil && decoder.Decode(&struct{}{}) != io.EOF {
+		err = errors.New("request body contains more than one JSON value")
+	}
+
+	switch {
+	case err == nil:
+		return true
+	case err.Error() == "http: request body too large":
+		WriteError(
+			w,
+			http.StatusRequestEntityTooLarge,
+			err,
+			fmt.Sprintf("The request body may be at most %d bytes", limit),
+		)
+	case err == io.EOF:
+		WriteErrorCode(w, http.StatusBadRequest, err, ErrCodeInvalidJSON, "The request body is empty")
+	default:
+		WriteErrorCode(
+			w,
+			http.StatusBadRequest,
+			err,
+			ErrCodeInvalidJSON,
+			"Invalid request: "+strings.TrimPrefix(err.Error(), "json: "),
+		)
+	}
+	return false
+}
+
+// acceptMediaType checks that the body of the request is declared as one of the given
+// media types. If it is not, an error response naming the expected format is written to
+// the client and false is returned.
+func acceptMediaType(w http.ResponseWriter, r *http.Request, format string, mediaTypes ...string) bool {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || !containsString(mediaTypes, mediaType) {
+		WriteErrorCode(
+			w,
+			http.StatusUnsupportedMediaType,
+			fmt.Errorf("unsupported content type '%s'", r.Header.Get("Content-Type")),
+			ErrCodeUnsupportedMediaType,
+			"The request body must be "+format,
+		)
+		return false
+	}
+	return true
+}
+
+// readBody reads the body of the request, which must be declared as one of the given
+// media types and be no larger than limit bytes. If it is not, an error response naming
+// the expected format is written to the client and false is returned.
+func readBody(w http.ResponseWriter, r *http.Request, limit int64, format string, mediaTypes ...string) ([]byte, bool) {
+	if !acceptMediaType(w, r, format, mediaTypes...) {
+		return nil, false
+	}
+
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, limit))
+	switch {
+	case err != nil && err.Error() == "http: request body too large":
+		WriteError(
+			w,
+			http.StatusRequestEntityTooLarge,
+			err,
+			fmt.Sprintf("The request body may be at most %d bytes", limit),
+		)
+	case err != nil:
+		WriteError(w, http.StatusBadRequest, err, "Unable to read the request body")
+	case len(body) == 0:
+		WriteError(w, http.StatusBadRequest, errors.New("empty request body"), "The request body is empty")
+	default:
+		return body, true
+	}
+	return nil, false
+}
+
+/* Validation */
+
+// rule pairs a condition that a request must satisfy with the error reported for the
+// field when it does not.
+type rule struct {
+	valid   bool
+	field   string
+	message string
+}
+
+// validate returns the errors of every rule that does not hold.
+func validate(rules ...rule) []FieldError {
+	var problems []FieldError
+	for _, r := range rules {
+		if !r.valid {
+			problems = append(problems, FieldError{r.field, r.message})
+		}
+	}
+	return problems
+}
+
+// validRequest writes a validation error to the client and returns false if there are
+// any problems with the request.
+func validRequest(w http.ResponseWriter, problems []FieldError) bool {
+	if len(problems) == 0 {
+		return true
+	}
+	WriteValidationError(
+		w,
+		fmt.Errorf("invalid request: %v", problems),
+		describeProblem(problems[0]),
+		problems,
+	)
+	return false
+}
+
+// describeProblem formats a field error for the top-level error message.
+func describeProblem(problem FieldError) string {
+	return problem.Field + " " + problem.Message
+}
+
+// validateSignUp returns the problems with a request to create a user.
+func (r UserRequest) validateSignUp() []FieldError {
+	return validate(
+		rule{r.Name != "", "name", "is required"},
+		rule{len(r.Name) <= maxNameLength, "name", fmt.Sprintf("must be at most %d characters", maxNameLength)},
+		rule{r.Password != "", "password", "is required"},
+		rule{len(r.Password) <= maxPasswordLength, "password", fmt.Sprintf("must be at most %d characters", maxPasswordLength)},
+	)
+}
+
+// validateLogin returns the problems with a request to log in, which must contain either
+// a name and password or a token.
+func (r UserRequest) validateLogin() []FieldError {
+	if r.Token != "" && r.Name == "" && r.Password == "" {
+		return nil
+	}
+	return validate(
+		rule{r.Name != "", "name", "is required unless a token is given"},
+		rule{len(r.Name) <= maxNameLength, "name", fmt.Sprintf("must be at most %d characters", maxNameLength)},
+		rule{r.Password != "", "password", "is required unless a token is given"},
+		rule{len(r.Password) <= maxPasswordLength, "password", fmt.Sprintf("must be at most %d characters", maxPasswordLength)},
+	)
+}
+
+// validateNew returns the problems with a workout to be created.
+func (workout Workout) validateNew() []FieldError {
+	return validate(
+		rule{workout.User != 0, "user", "is required"},
+		rule{!workout.Start.IsZero(), "start", "is required"},
+		rule{workout.End != nil && !workout.End.IsZero(), "end", "is required"},
+		rule{workout.End == nil || workout.End.After(workout.Start), "end", "must be after start"},
+		rule{workout.Intensity == nil || (*workout.Intensity >= 1 && *workout.Intensity <= 10), "intensity", "must be between 1 and 10"},
+		rule{len(workout.Type) <= maxWorkoutTypeLength, "type", fmt.Sprintf("must be at most %d characters", maxWorkoutTypeLength)},
+	)
+}
+
+// validateUpdate returns the problems with a workout replacing an existing one.
+func (workout Workout) validateUpdate() []FieldError {
+	return append(
+		validate(rule{workout.ID != 0, "id", "is required"}),
+		workout.validateNew()...,
+	)
+}
+
+// validateDelete returns the problems with a workout to be deleted, which only needs to
+// identify the workout and its owner.
+func (workout Workout) validateDelete() []FieldError {
+	return validate(
+		rule{workout.ID != 0, "id", "is required"},
+		rule{workout.User != 0, "user", "is required"},
+	)
+}
+
+// normalizeWorkoutType converts the name of a kind of activity from another service, such
+// as "Weight Training" or "TraditionalStrengthTraining", into the lowercase words
+// separated by underscores that workout types are recorded as.
+func normalizeWorkoutType(name string) string {
+	var words []string
+	var word []rune
+	var previous rune
+	for _, c := range name {
+		switch {
+		case unicode.IsUpper(c) && (unicode.IsLower(previous) || unicode.IsDigit(previous)):
+			words = append(words, string(word))
+			word = []rune{unicode.ToLower(c)}
+		case unicode.IsLetter(c) || unicode.IsDigit(c):
+			word = append(word, unicode.ToLower(c))
+		case len(word) > 0:
+			words = append(words, string(word))
+			word = nil
+		}
+		previous = c
+	}
+	normalized := strings.Join(append(words, string(word)), "_")
+	normalized = strings.Trim(normalized, "_")
+	for len(normalized) > maxWorkoutTypeLength {
+		_, size := utf8.DecodeLastRuneInString(normalized)
+		normalized = normalized[:len(normalized)-size]
+	}
+	return normalized
+}
+
+// validateNew returns the problems with a goal to be created.
+func (goal Goal) validateNew() []FieldError {
+	return validate(
+		rule{goal.Metric == GoalWorkouts || goal.Metric == GoalMinutes, "metric", "must be either workouts or minutes"},
+		rule{goal.Period == BucketWeek || goal.Period == BucketMonth, "period", "must be either week or month"},
+		rule{goal.Target > 0 && goal.Target <= maxGoalTarget, "target", fmt.Sprintf("must be between 1 and %d", maxGoalTarget)},
+	)
+}
+
+// validateUpdate returns the problems with a goal replacing an existing one.
+func (goal Goal) validateUpdate() []FieldError {
+	return append(
+		validate(rule{goal.ID != 0, "id", "is required"}),
+		goal.validateNew()...,
+	)
+}
+
+// validateNew returns the problems with a new webhook.
+func (webhook Webhook) validateNew() []FieldError {
+	u, err := url.Parse(webhook.URL)
+	problems := validate(
+		rule{webhook.URL != "", "url", "is required"},
+		rule{len(webhook.URL) <= maxWebhookURLLength, "url", fmt.Sprintf("must be at most %d characters", maxWebhookURLLength)},
+		rule{
+			webhook.URL == "" || err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "",
+			"url",
+			"must be an absolute http or https URL",
+		},
+		rule{
+			err != nil || isPublicHost(u.Hostname()),
+			"url",
+			"must not be a loopback, private or link-local address",
+		},
+	)
+	for i, event := range webhook.Events {
+		if !containsString(webhookEvents, event) {
+			problems = append(problems, FieldError{"events", "must only contain " + strings.Join(webhookEvents, ", ")})
+			break
+		}
+		if containsString(webhook.Events[:i], event) {
+			problems = append(problems, FieldError{"events", "must not repeat an event"})
+			break
+		}
+	}
+	return problems
+}
+
+// validate returns the problems with a single operation of a batch request.
+func (op BatchOperation) validate() []FieldError {
+	var problems []FieldError
+	switch op.Op {
+	case BatchCreate:
+		problems = op.Workout.validateNew()
+	case BatchUpdate:
+		problems = op.Workout.validateUpdate()
+	case BatchDelete:
+		problems = op.Workout.validateDelete()
+	default:
+		return []FieldError{{"op", "must be one of create, update or delete"}}
+	}
+	for i := range problems {
+		problems[i].Field = "workout." + problems[i].Field
+	}
+	return problems
+}
+
+/* Query parameters */
+
+// maxQueryRange is the longest range of dates that can be requested at once.
+const maxQueryRange = 10 * 366 * 24 * time.Hour
+
+// parseTimeZone returns the location named by the tz query parameter, which defaults to
+// UTC.
+func parseTimeZone(params url.Values) (*time.Location, []FieldError) {
+	name := params.Get("tz")
+	if name == "" {
+		return time.UTC, nil
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil || name == "Local" {
+		return time.UTC, []FieldError{{"tz", "must be an IANA time zone such as America/Toronto"}}
+	}
+	return loc, nil
+}
+
+// parseDate returns the start of the day given by the named query parameter in loc, or the
+// zero time if the parameter is absent.
+func parseDate(params url.Values, name string, loc *time.Location) (time.Time, []FieldError) {
+	value := params.Get(name)
+	if value == "" {
+		return time.Time{}, nil
+	}
+	date, err := time.ParseInLocation("2006-01-02", value, loc)
+	if err != nil {
+		return date, []FieldError{{name, "must be a date in the form YYYY-MM-DD"}}
+	}
+	return date, nil
+}
+
+// parseInt returns the named integer query parameter, or fallback if it is absent.
+func parseInt(params url.Values, name string, fallback, min, max int) (int, []FieldError) {
+	value := params.Get(name)
+	if value == "" {
+		return fallback, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < min || n > max {
+		return fallback, []FieldError{{name, fmt.Sprintf("must be an integer between %d and %d", min, max)}}
+	}
+	return n, nil
+}
+
+// validateRange returns the problems with a range of dates read from the from and to query
+// parameters.
+func validateRange(from, to time.Time) []FieldError {
+	return validate(
+		rule{to.After(from), "to", "must not be before from"},
+		rule{to.Sub(from) <= maxQueryRange, "from", "must be at most 10 years before to"},
+	)
+}
@@ -0,0 +1,444 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	log "github.com/sirupsen/logrus"
+)
+
+// webhookEvents are the event types that can be sent to webhooks, in the order they are
+// listed when a webhook subscribes to all of them.
+var webhookEvents = []string{EventWorkoutCreated, EventWorkoutUpdated, EventWorkoutDeleted}
+
+// Headers sent with each webhook delivery. The signature is computed over the timestamp
+// and the body, joined by a period, so that receivers can reject replayed deliveries.
+const (
+	webhookEventHeader     = "X-Webhook-Event"
+	webhookDeliveryHeader  = "X-Webhook-Delivery"
+	webhookTimestampHeader = "X-Webhook-Timestamp"
+	webhookSignatureHeader = "X-Webhook-Signature"
+)
+
+const (
+	// maxWebhookAttempts is the number of times a delivery is attempted before it fails.
+	maxWebhookAttempts = 8
+	// webhookBackoff is the delay before the first retry of a delivery, which doubles
+	// with each further attempt up to maxWebhookBackoff.
+	webhookBackoff    = 30 * time.Second
+	maxWebhookBackoff = 6 * time.Hour
+	// webhookTimeout bounds each attempt, and webhookLease is how long a claimed delivery
+	// is left alone by other servers. The deliveries claimed together are attempted at
+	// once, so the lease only has to outlast a single attempt and the recording of the
+	// outcomes.
+	webhookTimeout = 10 * time.Second
+	webhookLease   = time.Minute
+	// webhookPollInterval is how often the queue is checked for due deliveries, and
+	// webhookBatch the most deliveries attempted at once.
+	webhookPollInterval = 5 * time.Second
+	webhookBatch        = 20
+	// defaultWebhookDeliveries is the number of deliveries listed when no limit is given.
+	defaultWebhookDeliveries = 50
+)
+
+// privateNetworks are the loopback, private, shared and link-local ranges, which include
+// the metadata service of cloud providers at 169.254.169.254. Webhooks are not delivered
+// to them, so that they cannot be used to reach the network the server runs in.
+var privateNetworks = parseCIDRs(
+	"0.0.0.0/8", "10.0.0.0/8", "100.64.0.0/10", "127.0.0.0/8", "169.254.0.0/16",
+	"172.16.0.0/12", "192.168.0.0/16", "::/128", "::1/128", "fc00::/7", "fe80::/10",
+)
+
+func parseCIDRs(cidrs ...string) []*net.IPNet {
+	networks := make([]*net.IPNet, len(cidrs))
+	for i, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		networks[i] = network
+	}
+	return networks
+}
+
+// isPublicAddress reports whether webhooks can be delivered to ip.
+func isPublicAddress(ip net.IP) bool {
+	if ip.IsMulticast() {
+		return false
+	}
+	for _, network := range privateNetworks {
+		if network.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// isPublicHost reports whether the host of a webhook's URL might be public. Names other
+// than localhost are only resolved when a delivery connects to them, which checks the
+// address again.
+func isPublicHost(host string) bool {
+	host = strings.ToLower(host)
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return false
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return isPublicAddress(ip)
+	}
+	return true
+}
+
+// queueWebhooks queues the delivery of an event to the webhooks of the given user.
+// Failures are only logged, since the change the event describes has already been made.
+// For the same reason, the deliveries are queued even if the client has gone away.
+func (env *Env) queueWebhooks(userID int, event Event) {
+	events, err := newWebhookEvents([]userEvent{{userID, event}})
+	if err == nil {
+		err = env.db.QueueWebhookDeliveries(context.Background(), events)
+	}
+	if err != nil {
+		log.WithError(err).WithField("event", event.Type).Error("Unable to queue webhook deliveries")
+	}
+}
+
+// newWebhookEvents returns the webhook events for the events published to users, leaving
+// out those that webhooks cannot subscribe to.
+func newWebhookEvents(events []userEvent) ([]WebhookEvent, error) {
+	var queued []WebhookEvent
+	for _, e := range events {
+		if !containsString(webhookEvents, e.Event.Type) {
+			continue
+		}
+		payload, err := json.Marshal(WebhookPayload{
+			Type:      e.Event.Type,
+			Time:      e.Event.Time,
+			WorkoutID: e.Event.WorkoutID,
+			Workout:   e.Event.Workout,
+		})
+		if err != nil {
+			return nil, err
+		}
+		queued = append(queued, WebhookEvent{User: e.User, Type: e.Event.Type, Payload: payload})
+	}
+	return queued, nil
+}
+
+// signWebhook returns the signature of a delivery, keyed with the webhook's secret.
+func signWebhook(timestamp string, payload []byte, secret string) string {
+	return "sha256=" + computeHmac256(timestamp+"."+string(payload), secret)
+}
+
+// newSecret generates a random secret, such as the key a webhook's deliveries are signed
+// with or the token naming a calendar feed.
+func newSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// webhookRetryDelay returns how long to wait before retrying a delivery that has been
+// attempted the given number of times.
+func webhookRetryDelay(attempts int) time.Duration {
+	delay := webhookBackoff
+	for i := 1; i < attempts && delay < maxWebhookBackoff; i++ {
+		delay *= 2
+	}
+	if delay > maxWebhookBackoff {
+		delay = maxWebhookBackoff
+	}
+	return delay
+}
+
+// WebhookDispatcher delivers the queued webhook events in the background. Several
+// dispatchers can share a database, since deliveries are claimed before being attempted.
+type WebhookDispatcher struct {
+	db     Datastore
+	client *http.Client
+}
+
+// NewWebhookDispatcher returns a dispatcher for the deliveries queued in db, which only
+// connects to public addresses.
+func NewWebhookDispatcher(db Datastore) *WebhookDispatcher {
+	return newWebhookDispatcher(db, isPublicAddress)
+}
+
+// newWebhookDispatcher returns a dispatcher that only connects to the addresses allowed
+// reports true for. They are checked after the URL's host is resolved, so a name cannot
+// be made to point elsewhere between the check and the connection.
+func newWebhookDispatcher(db Datastore, allowed func(net.IP) bool) *WebhookDispatcher {
+	dialer := &net.Dialer{
+		Timeout: webhookTimeout,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || !allowed(ip) {
+				return fmt.Errorf("webhooks cannot be delivered to %s", host)
+			}
+			return nil
+		},
+	}
+	return &WebhookDispatcher{
+		db: db,
+		client: &http.Client{
+			Timeout: webhookTimeout,
+			// Deliveries never go through a proxy, whose address is the one that would
+			// be checked.
+			Transport: &http.Transport{
+				DialContext:         dialer.DialContext,
+				TLSHandshakeTimeout: webhookTimeout,
+			},
+			// A redirect is treated as a failed delivery rather than followed.
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+	}
+}
+
+// Run delivers due events every webhookPollInterval until stop is closed.
+func (d *WebhookDispatcher) Run(stop <-chan struct{}) {
+	ticker := time.NewTicker(webhookPollInterval)
+	defer ticker.Stop()
+	for {
+		if _, err := d.DeliverDue(); err != nil {
+			log.WithError(err).Error("Unable to deliver webhooks")
+		}
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// DeliverDue attempts every delivery that is due and returns how many were attempted.
+// The deliveries claimed together are attempted concurrently, so that they all finish
+// within their lease however slowly their webhooks respond.
+func (d *WebhookDispatcher) DeliverDue() (int, error) {
+	attempted := 0
+	for {
+		deliveries, err := d.db.ClaimWebhookDeliveries(context.Background(), webhookBatch, webhookLease)
+		if err != nil {
+			return attempted, err
+		}
+		var wg sync.WaitGroup
+		for i := range deliveries {
+			wg.Add(1)
+			go func(delivery *WebhookDelivery) {
+				defer wg.Done()
+				*delivery = d.attempt(*delivery, time.Now())
+			}(&deliveries[i])
+		}
+		wg.Wait()
+		for _, delivery := range deliveries {
+			if err = d.db.RecordWebhookAttempt(context.Background(), delivery); err != nil {
+				return attempted, err
+			}
+			attempted++
+		}
+		if len(deliveries) < webhookBatch {
+			return attempted, nil
+		}
+	}
+}
+
+// attempt sends a delivery to its webhook and returns it updated with the outcome.
+func (d *WebhookDispatcher) attempt(delivery WebhookDelivery, now time.Time) WebhookDelivery {
+	delivery.Attempts++
+	delivery.ResponseCode = 0
+	delivery.Error = ""
+
+	err := d.send(&delivery, now)
+	logger := log.WithFields(log.Fields{
+		"delivery": delivery.ID,
+		"webhook":  delivery.Webhook,
+		"attempts": delivery.Attempts,
+	})
+	switch {
+	case err == nil:
+		delivery.Status = DeliveryDelivered
+		delivery.NextAttempt = nil
+		delivery.Delivered = &now
+		logger.Info("Delivered webhook")
+	case delivery.Attempts >= maxWebhookAttempts:
+		delivery.Status = DeliveryFailed
+		delivery.NextAttempt = nil
+		delivery.Error = err.Error()
+		logger.WithError(err).Warn("Gave up on webhook delivery")
+	default:
+		next := now.Add(webhookRetryDelay(delivery.Attempts))
+		delivery.Status = DeliveryPending
+		delivery.NextAttempt = &next
+		delivery.Error = err.Error()
+		logger.WithError(err).Info("Webhook delivery will be retried")
+	}
+	return delivery
+}
+
+// send makes a single request for a delivery, recording the response code it received.
+func (d *WebhookDispatcher) send(delivery *WebhookDelivery, now time.Time) error {
+	request, err := http.NewRequest("POST", delivery.URL, bytes.NewReader(delivery.Payload))
+	if err != nil {
+		return err
+	}
+	timestamp := strconv.FormatInt(now.Unix(), 10)
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("User-Agent", "workout-api-webhooks")
+	request.Header.Set(webhookEventHeader, delivery.Event)
+	request.Header.Set(webhookDeliveryHeader, strconv.Itoa(delivery.ID))
+	request.Header.Set(webhookTimestampHeader, timestamp)
+	request.Header.Set(webhookSignatureHeader, signWebhook(timestamp, delivery.Payload, delivery.Secret))
+
+	response, err := d.client.Do(request)
+	if err != nil {
+		return err
+	}
+	// Drain a little of the body so that the connection can be reused.
+	io.Copy(ioutil.Discard, io.LimitReader(response.Body, 4096))
+	response.Body.Close()
+
+	delivery.ResponseCode = response.StatusCode
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return fmt.Errorf("webhook responded with status %d", response.StatusCode)
+	}
+	return nil
+}
+
+// GetWebhooks returns the webhooks of the requesting user.
+func (env *Env) GetWebhooks(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	user, ok := env.authenticate(w, r)
+	if !ok {
+		return
+	}
+	webhooks, err := env.db.GetWebhooks(r.Context(), user.ID)
+	if err != nil {
+		InternalServerError(w, err)
+		return
+	}
+	WriteJSON(w, http.StatusOK, webhooks)
+}
+
+// AddWebhook registers a webhook for the requesting user. The response includes the
+// secret that deliveries are signed with, which is not shown again. A webhook that does
+// not list any events is sent all of them.
+func (env *Env) AddWebhook(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	user, ok := env.authenticate(w, r)
+	if !ok {
+		return
+	}
+	var webhook Webhook
+	if !decodeJSON(w, r, maxBodyBytes, &webhook) || !validRequest(w, webhook.validateNew()) {
+		return
+	}
+
+	if len(webhook.Events) == 0 {
+		webhook.Events = webhookEvents
+	}
+	secret, err := newSecret()
+	if err != nil {
+		InternalServerError(w, err)
+		return
+	}
+	webhook.User = user.ID
+	webhook.Secret = secret
+	webhook.Created = time.Now()
+	if webhook.ID, err = env.db.AddWebhook(r.Context(), webhook); err != nil {
+		InternalServerError(w, err)
+		return
+	}
+	log.WithFields(log.Fields{
+		"name":    user.Name,
+		"webhook": webhook.ID,
+	}).Info("Added webhook")
+	webhook.User = 0
+	WriteJSON(w, http.StatusCreated, webhook)
+}
+
+// DeleteWebhook deletes the webhook specified in the URL parameter, along with its
+// pending deliveries.
+func (env *Env) DeleteWebhook(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	user, ok := env.authenticate(w, r)
+	if !ok {
+		return
+	}
+	webhookID, err := strconv.Atoi(ps.ByName("id"))
+	if err != nil {
+		WriteValidationError(w, err, "Invalid webhook", []FieldError{{"id", "must be an integer"}})
+		return
+	}
+
+	err = env.db.DeleteWebhook(r.Context(), user.ID, webhookID)
+	switch {
+	case err == ErrWebhookNotFound:
+		WriteErrorCode(
+			w,
+			http.StatusNotFound,
+			err,
+			ErrCodeWebhookNotFound,
+			"The specified webhook could not be found",
+		)
+		return
+	case err != nil:
+		InternalServerError(w, err)
+		return
+	}
+	log.WithFields(log.Fields{
+		"name":    user.Name,
+		"webhook": webhookID,
+	}).Info("Deleted webhook")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// GetWebhookDeliveries returns the latest deliveries of the webhook specified in the URL
+// parameter, starting with the most recent. The optional limit query parameter sets how
+// many are returned.
+func (env *Env) GetWebhookDeliveries(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	user, ok := env.authenticate(w, r)
+	if !ok {
+		return
+	}
+	webhookID, err := strconv.Atoi(ps.ByName("id"))
+	if err != nil {
+		WriteValidationError(w, err, "Invalid webhook", []FieldError{{"id", "must be an integer"}})
+		return
+	}
+	limit, problems := parseInt(r.URL.Query(), "limit", defaultWebhookDeliveries, 1, 500)
+	if !validRequest(w, problems) {
+		return
+	}
+
+	deliveries, err := env.db.GetWebhookDeliveries(r.Context(), user.ID, webhookID, limit)
+	switch {
+	case err == ErrWebhookNotFound:
+		WriteErrorCode(
+			w,
+			http.StatusNotFound,
+			err,
+			ErrCodeWebhookNotFound,
+			"The specified webhook could not be found",
+		)
+		return
+	case err != nil:
+		InternalServerError(w, err)
+		return
+	}
+	WriteJSON(w, http.StatusOK, deliveries)
+}
@@ -0,0 +1,351 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// webhookReceiver is a local server standing in for a user's webhook. It checks the
+// signature of every delivery and records the payloads it accepts.
+type webhookReceiver struct {
+	*httptest.Server
+	secret string
+
+	mu       sync.Mutex
+	status   int
+	delay    time.Duration
+	payloads []WebhookPayload
+	headers  []http.Header
+}
+
+func newWebhookReceiver(t *testing.T, secret string) *webhookReceiver {
+	receiver := &webhookReceiver{secret: secret, status: http.StatusOK}
+	receiver.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Errorf("unable to read delivery: %v", err)
+			return
+		}
+		expected := signWebhook(r.Header.Get(webhookTimestampHeader), body, receiver.secret)
+		if !hmac.Equal([]byte(r.Header.Get(webhookSignatureHeader)), []byte(expected)) {
+			t.Errorf("delivery has signature %q, expected %q", r.Header.Get(webhookSignatureHeader), expected)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		var payload WebhookPayload
+		if err = json.Unmarshal(body, &payload); err != nil {
+			t.Errorf("delivery is not a webhook payload: %v", err)
+		}
+
+		receiver.mu.Lock()
+		delay := receiver.delay
+		receiver.mu.Unlock()
+		time.Sleep(delay)
+
+		receiver.mu.Lock()
+		defer receiver.mu.Unlock()
+		if receiver.status >= 200 && receiver.status <= 299 {
+			receiver.payloads = append(receiver.payloads, payload)
+			receiver.headers = append(receiver.headers, r.Header)
+		}
+		w.WriteHeader(receiver.status)
+	}))
+	return receiver
+}
+
+func (receiver *webhookReceiver) respondWith(status int) {
+	receiver.mu.Lock()
+	defer receiver.mu.Unlock()
+	receiver.status = status
+}
+
+func (receiver *webhookReceiver) respondAfter(delay time.Duration) {
+	receiver.mu.Lock()
+	defer receiver.mu.Unlock()
+	receiver.delay = delay
+}
+
+func (receiver *webhookReceiver) received() []WebhookPayload {
+	receiver.mu.Lock()
+	defer receiver.mu.Unlock()
+	return append([]WebhookPayload(nil), receiver.payloads...)
+}
+
+// webhookDB keeps the webhook delivery queue in memory for a single user and webhook.
+type webhookDB struct {
+	Datastore
+	webhook    Webhook
+	deliveries []WebhookDelivery
+}
+
+func (db *webhookDB) LoginWithToken(ctx context.Context, token string) (User, error) {
+	return User{ID: db.webhook.User, Name: "runner"}, nil
+}
+
+func (db *webhookDB) GetUsername(ctx context.Context, userID int) (string, error) {
+	return "runner", nil
+}
+
+func (db *webhookDB) GetOverlappingWorkouts(ctx context.Context, userID int, start, end time.Time, excludeID int) ([]Workout, error) {
+	return nil, nil
+}
+
+func (db *webhookDB) AddWorkout(ctx context.Context, workout Workout) (int, error) { return 42, nil }
+
+func (db *webhookDB) QueueWebhookDeliveries(ctx context.Context, events []WebhookEvent) error {
+	for _, event := range events {
+		if event.User == db.webhook.User && containsString(db.webhook.Events, event.Type) {
+			db.deliveries = append(db.deliveries, WebhookDelivery{
+				ID:      len(db.deliveries) + 1,
+				Webhook: db.webhook.ID,
+				Event:   event.Type,
+				Payload: event.Payload,
+				Status:  DeliveryPending,
+				Created: time.Now(),
+			})
+		}
+	}
+	return nil
+}
+
+func (db *webhookDB) ClaimWebhookDeliveries(ctx context.Context, limit int, lease time.Duration) ([]WebhookDelivery, error) {
+	var claimed []WebhookDelivery
+	now := time.Now()
+	for i := range db.deliveries {
+		delivery := &db.deliveries[i]
+		if delivery.Status != DeliveryPending || delivery.NextAttempt != nil && delivery.NextAttempt.After(now) ||
+			len(claimed) == limit {
+			continue
+		}
+		leased := now.Add(lease)
+		delivery.NextAttempt = &leased
+		claim := *delivery
+		claim.URL, claim.Secret = db.webhook.URL, db.webhook.Secret
+		claimed = append(claimed, claim)
+	}
+	return claimed, nil
+}
+
+func (db *webhookDB) RecordWebhookAttempt(ctx context.Context, delivery WebhookDelivery) error {
+	delivery.URL, delivery.Secret = "", ""
+	db.deliveries[delivery.ID-1] = delivery
+	return nil
+}
+
+func newWebhookDB(receiver *webhookReceiver) *webhookDB {
+	return &webhookDB{webhook: Webhook{
+		ID:     3,
+		User:   7,
+		URL:    receiver.URL,
+		Events: webhookEvents,
+		Secret: receiver.secret,
+	}}
+}
+
+// newTestDispatcher returns a dispatcher that can deliver to the receivers of the tests,
+// which listen on the loopback address.
+func newTestDispatcher(db Datastore) *WebhookDispatcher {
+	return newWebhookDispatcher(db, net.IP.IsLoopback)
+}
+
+func TestWebhookReceivesSignedWorkoutEvents(t *testing.T) {
+	receiver := newWebhookReceiver(t, "secret")
+	defer receiver.Close()
+	db := newWebhookDB(receiver)
+	env := &Env{db: db, events: NewEventHub()}
+
+	body := `{"user": 7, "start": "2018-03-01T10:00:00Z", "end": "2018-03-01T11:00:00Z"}`
+	request := httptest.NewRequest("POST", "/v1/workout", strings.NewReader(body))
+	request.Header.Set("Content-Type", "application/json")
+	recorder := httptest.NewRecorder()
+	env.NewRouter().ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusCreated {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusCreated, recorder.Code, recorder.Body)
+	}
+
+	attempted, err := newTestDispatcher(db).DeliverDue()
+	if err != nil || attempted != 1 {
+		t.Fatalf("expected 1 delivery to be attempted, got %d (%v)", attempted, err)
+	}
+	payloads := receiver.received()
+	if len(payloads) != 1 {
+		t.Fatalf("expected 1 payload to be received, got %d", len(payloads))
+	}
+	if payloads[0].Type != EventWorkoutCreated || payloads[0].WorkoutID != 42 || payloads[0].Workout == nil {
+		t.Errorf("unexpected payload %+v", payloads[0])
+	}
+	if event := receiver.headers[0].Get(webhookEventHeader); event != EventWorkoutCreated {
+		t.Errorf("expected event header %q, got %q", EventWorkoutCreated, event)
+	}
+	if delivery := db.deliveries[0]; delivery.Status != DeliveryDelivered || delivery.Delivered == nil {
+		t.Errorf("expected the delivery to be recorded as delivered, got %+v", delivery)
+	}
+}
+
+func TestWebhookDeliveryIsRetried(t *testing.T) {
+	receiver := newWebhookReceiver(t, "secret")
+	defer receiver.Close()
+	db := newWebhookDB(receiver)
+	env := &Env{db: db}
+	dispatcher := newTestDispatcher(db)
+
+	env.publish(7, deletedEvent(12))
+	receiver.respondWith(http.StatusServiceUnavailable)
+	before := time.Now()
+	if _, err := dispatcher.DeliverDue(); err != nil {
+		t.Fatal(err)
+	}
+	delivery := db.deliveries[0]
+	if delivery.Status != DeliveryPending || delivery.Attempts != 1 || delivery.ResponseCode != http.StatusServiceUnavailable {
+		t.Fatalf("expected a pending delivery after one failed attempt, got %+v", delivery)
+	}
+	if delivery.NextAttempt == nil || delivery.NextAttempt.Before(before.Add(webhookBackoff)) {
+		t.Fatalf("expected the next attempt to be at least %s away, got %v", webhookBackoff, delivery.NextAttempt)
+	}
+
+	// Deliveries are not retried before their backoff has passed.
+	if attempted, _ := dispatcher.DeliverDue(); attempted != 0 {
+		t.Fatalf("expected no delivery to be due, got %d", attempted)
+	}
+
+	receiver.respondWith(http.StatusNoContent)
+	db.deliveries[0].NextAttempt = &before
+	if _, err := dispatcher.DeliverDue(); err != nil {
+		t.Fatal(err)
+	}
+	if delivery = db.deliveries[0]; delivery.Status != DeliveryDelivered || delivery.Attempts != 2 || delivery.Error != "" {
+		t.Errorf("expected the retry to be delivered, got %+v", delivery)
+	}
+	if payloads := receiver.received(); len(payloads) != 1 || payloads[0].Type != EventWorkoutDeleted {
+		t.Errorf("expected the deleted event to be received, got %+v", payloads)
+	}
+}
+
+func TestWebhookDeliveriesAreAttemptedConcurrently(t *testing.T) {
+	receiver := newWebhookReceiver(t, "secret")
+	defer receiver.Close()
+	db := newWebhookDB(receiver)
+	env := &Env{db: db}
+
+	for i := 0; i < webhookBatch; i++ {
+		env.publish(7, deletedEvent(i+1))
+	}
+	const delay = 200 * time.Millisecond
+	receiver.respondAfter(delay)
+	began := time.Now()
+	if attempted, err := newTestDispatcher(db).DeliverDue(); err != nil || attempted != webhookBatch {
+		t.Fatalf("DeliverDue returned %d, %v, expected %d deliveries", attempted, err, webhookBatch)
+	}
+	// One after another, the deliveries would take webhookBatch times the delay.
+	if took := time.Since(began); took > 5*delay {
+		t.Errorf("delivering %d slow webhooks took %s", webhookBatch, took)
+	}
+	if payloads := receiver.received(); len(payloads) != webhookBatch {
+		t.Errorf("expected %d deliveries to be received, got %d", webhookBatch, len(payloads))
+	}
+}
+
+func TestWebhookDeliveryFailsAfterMaxAttempts(t *testing.T) {
+	receiver := newWebhookReceiver(t, "secret")
+	defer receiver.Close()
+	db := newWebhookDB(receiver)
+	env := &Env{db: db}
+
+	env.publish(7, workoutEvent(EventWorkoutUpdated, Workout{ID: 12}))
+	db.deliveries[0].Attempts = maxWebhookAttempts - 1
+	receiver.respondWith(http.StatusInternalServerError)
+	if _, err := newTestDispatcher(db).DeliverDue(); err != nil {
+		t.Fatal(err)
+	}
+	if delivery := db.deliveries[0]; delivery.Status != DeliveryFailed || delivery.NextAttempt != nil || delivery.Error == "" {
+		t.Errorf("expected the delivery to fail, got %+v", delivery)
+	}
+}
+
+func TestWebhookIsNotDeliveredToPrivateAddresses(t *testing.T) {
+	receiver := newWebhookReceiver(t, "secret")
+	defer receiver.Close()
+	db := newWebhookDB(receiver)
+	env := &Env{db: db}
+
+	env.publish(7, deletedEvent(12))
+	if _, err := NewWebhookDispatcher(db).DeliverDue(); err != nil {
+		t.Fatal(err)
+	}
+	if delivery := db.deliveries[0]; delivery.Status != DeliveryPending || !strings.Contains(delivery.Error, "cannot be delivered") {
+		t.Errorf("expected the delivery to be refused, got %+v", delivery)
+	}
+	if payloads := receiver.received(); len(payloads) != 0 {
+		t.Errorf("expected no payloads to be received, got %+v", payloads)
+	}
+}
+
+func TestWebhookIgnoresUnsubscribedEvents(t *testing.T) {
+	receiver := newWebhookReceiver(t, "secret")
+	defer receiver.Close()
+	db := newWebhookDB(receiver)
+	db.webhook.Events = []string{EventWorkoutDeleted}
+	env := &Env{db: db}
+
+	env.publish(7, workoutEvent(EventWorkoutCreated, Workout{ID: 12}))
+	env.publish(7, sessionEvent(EventWorkoutStarted, WorkoutSession{}))
+	env.publish(8, deletedEvent(12))
+	if len(db.deliveries) != 0 {
+		t.Errorf("expected no deliveries to be queued, got %+v", db.deliveries)
+	}
+}
+
+func TestWebhookRetryDelay(t *testing.T) {
+	for _, test := range []struct {
+		attempts int
+		delay    time.Duration
+	}{
+		{1, 30 * time.Second},
+		{2, time.Minute},
+		{3, 2 * time.Minute},
+		{7, 32 * time.Minute},
+		{20, maxWebhookBackoff},
+	} {
+		if delay := webhookRetryDelay(test.attempts); delay != test.delay {
+			t.Errorf("expected a delay of %s after %d attempts, got %s", test.delay, test.attempts, delay)
+		}
+	}
+}
+
+func TestWebhookValidation(t *testing.T) {
+	for _, test := range []struct {
+		webhook Webhook
+		valid   bool
+	}{
+		{Webhook{URL: "https://example.com/hooks"}, true},
+		{Webhook{URL: "http://example.com", Events: []string{EventWorkoutDeleted}}, true},
+		{Webhook{}, false},
+		{Webhook{URL: "example.com/hooks"}, false},
+		{Webhook{URL: "ftp://example.com"}, false},
+		{Webhook{URL: "http://93.184.216.34:8080/hooks"}, true},
+		{Webhook{URL: "http://localhost:8080/hooks"}, false},
+		{Webhook{URL: "http://127.0.0.1/hooks"}, false},
+		{Webhook{URL: "http://10.1.2.3/hooks"}, false},
+		{Webhook{URL: "http://172.20.0.1/hooks"}, false},
+		{Webhook{URL: "http://192.168.1.10/hooks"}, false},
+		{Webhook{URL: "http://169.254.169.254/latest/meta-data"}, false},
+		{Webhook{URL: "http://[::1]/hooks"}, false},
+		{Webhook{URL: "http://[::ffff:127.0.0.1]/hooks"}, false},
+		{Webhook{URL: "http://[fe80::1]/hooks"}, false},
+		{Webhook{URL: "https://example.com", Events: []string{EventWorkoutStarted}}, false},
+		{Webhook{URL: "https://example.com", Events: []string{EventWorkoutDeleted, EventWorkoutDeleted}}, false},
+	} {
+		if problems := test.webhook.validateNew(); (len(problems) == 0) != test.valid {
+			t.Errorf("expected %+v to be valid: %t, got problems %v", test.webhook, test.valid, problems)
+		}
+	}
+}